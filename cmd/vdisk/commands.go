@@ -0,0 +1,668 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// 读写时每次传输的字节数
+const transferSize = 1024 * 1024
+
+// commands 是所有子命令，键为子命令名。
+var commands = map[string]command{
+	"info": {
+		summary: "Print capacity, geometry, adapter and transport mode of the disk",
+		setup:   setupInfo,
+	},
+	"read": {
+		summary: "Read a byte range of the disk to a file or stdout",
+		setup:   setupRead,
+	},
+	"write": {
+		summary: "Write a file or stdin to the disk at an offset",
+		setup:   setupWrite,
+	},
+	"dump-blocks": {
+		summary: "List the allocated blocks of the disk",
+		setup:   setupDumpBlocks,
+	},
+	"create": {
+		usage:   "PATH",
+		summary: "Create a new virtual disk",
+		setup:   setupCreate,
+	},
+	"clone": {
+		usage:   "SRC DST",
+		summary: "Clone a virtual disk",
+		setup:   setupClone,
+	},
+	"grow": {
+		usage:   "PATH",
+		summary: "Grow a virtual disk to a new capacity",
+		setup:   setupGrow,
+	},
+	"shrink": {
+		summary: "Reclaim unused space of the disk",
+		setup:   setupShrink,
+	},
+	"defrag": {
+		summary: "Defragment the disk",
+		setup:   setupDefrag,
+	},
+	"check-repair": {
+		usage:   "PATH",
+		summary: "Check the metadata of a sparse disk and optionally repair it",
+		setup:   setupCheckRepair,
+	},
+	"rename": {
+		usage:   "SRC DST",
+		summary: "Rename a virtual disk",
+		setup:   setupRename,
+	},
+	"unlink": {
+		usage:   "PATH",
+		summary: "Delete a virtual disk including all of its extents",
+		setup:   setupUnlink,
+	},
+	"metadata": {
+		usage:   "list | get KEY | set KEY VALUE",
+		summary: "List, read or write the metadata of the disk",
+		setup:   setupMetadata,
+	},
+	"transport-modes": {
+		summary: "List the transport modes supported by VDDK",
+		setup:   setupTransportModes,
+	},
+	"thumbprint": {
+		summary: "Print the SHA-1 thumbprint of the server certificate",
+		noInit:  true,
+		setup:   setupThumbprint,
+	},
+}
+
+// openDisk 按照配置打开磁盘，没有指定服务器时打开本地磁盘。Close 会关闭磁盘、断开连接并结束访问。
+func (this *invocation) openDisk(readOnly bool) (virtual_disks.DiskReaderWriter, error) {
+	params := this.cfg.connectParams(readOnly)
+	this.logger.Debugf("Open disk with %s", params)
+	diskReaderWriter, vErr := virtual_disks.OpenContext(this.ctx, params, this.logger)
+	if vErr != nil {
+		return virtual_disks.DiskReaderWriter{}, vErr
+	}
+	return diskReaderWriter, nil
+}
+
+// connect 按照配置建立连接，返回的函数用于断开连接。
+func (this *invocation) connect() (disklib.VixDiskLibConnection, func(), error) {
+	params := this.cfg.connectParams(false)
+	conn, vErr := disklib.ConnectEx(params)
+	if vErr != nil {
+		return disklib.VixDiskLibConnection{}, nil, vErr
+	}
+	return conn, func() { disklib.Disconnect(conn) }, nil
+}
+
+// withDisk 打开磁盘执行 operation 后关闭磁盘，operation 成功但关闭失败时返回关闭的错误。
+func (this *invocation) withDisk(readOnly bool, operation func(disk virtual_disks.DiskReaderWriter) (interface{}, error)) (interface{}, error) {
+	disk, err := this.openDisk(readOnly)
+	if err != nil {
+		return nil, err
+	}
+	result, err := operation(disk)
+	if closeErr := disk.Close(); err == nil && closeErr != nil {
+		return nil, closeErr
+	}
+	return result, err
+}
+
+// withConnection 建立连接执行 operation 后断开连接。
+func (this *invocation) withConnection(operation func(conn disklib.VixDiskLibConnection) (interface{}, error)) (interface{}, error) {
+	conn, disconnect, err := this.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect()
+	return operation(conn)
+}
+
+// infoResult 是 info 的输出。
+type infoResult struct {
+	Capacity           int64                      `json:"capacity"`
+	CapacitySectors    uint64                     `json:"capacitySectors"`
+	AdapterType        string                     `json:"adapterType"`
+	BiosGeometry       disklib.VixDiskLibGeometry `json:"biosGeometry"`
+	PhysicalGeometry   disklib.VixDiskLibGeometry `json:"physicalGeometry"`
+	NumLinks           int                        `json:"numLinks"`
+	ParentFileNameHint string                     `json:"parentFileNameHint,omitempty"`
+	Uuid               string                     `json:"uuid,omitempty"`
+	LogicalSectorSize  uint32                     `json:"logicalSectorSize"`
+	PhysicalSectorSize uint32                     `json:"physicalSectorSize"`
+	TransportMode      string                     `json:"transportMode"`
+}
+
+func (this infoResult) writeText(w io.Writer) {
+	fmt.Fprintf(w, "Capacity:          %d bytes (%d sectors)\n", this.Capacity, this.CapacitySectors)
+	fmt.Fprintf(w, "Adapter type:      %s\n", this.AdapterType)
+	fmt.Fprintf(w, "BIOS geometry:     %d/%d/%d\n", this.BiosGeometry.Cylinders, this.BiosGeometry.Heads, this.BiosGeometry.Sectors)
+	fmt.Fprintf(w, "Physical geometry: %d/%d/%d\n", this.PhysicalGeometry.Cylinders, this.PhysicalGeometry.Heads, this.PhysicalGeometry.Sectors)
+	fmt.Fprintf(w, "Links:             %d\n", this.NumLinks)
+	if this.ParentFileNameHint != "" {
+		fmt.Fprintf(w, "Parent:            %s\n", this.ParentFileNameHint)
+	}
+	if this.Uuid != "" {
+		fmt.Fprintf(w, "UUID:              %s\n", this.Uuid)
+	}
+	fmt.Fprintf(w, "Sector size:       %d logical, %d physical\n", this.LogicalSectorSize, this.PhysicalSectorSize)
+	fmt.Fprintf(w, "Transport mode:    %s\n", this.TransportMode)
+}
+
+func setupInfo(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	return func(inv *invocation) (interface{}, error) {
+		if err := inv.expectArgs(0); err != nil {
+			return nil, err
+		}
+		return inv.withDisk(true, func(disk virtual_disks.DiskReaderWriter) (interface{}, error) {
+			info := disk.Info()
+			var transportMode string
+			disk.WithHandle(func(dli disklib.VixDiskLibHandle) disklib.VddkError {
+				transportMode = disklib.GetTransportMode(dli)
+				return nil
+			})
+			return infoResult{
+				Capacity:           disk.Capacity(),
+				CapacitySectors:    uint64(info.Capacity),
+				AdapterType:        adapterName(info.AdapterType),
+				BiosGeometry:       info.BiosGeo,
+				PhysicalGeometry:   info.PhysGeo,
+				NumLinks:           info.NumLinks,
+				ParentFileNameHint: info.ParentFileNameHint,
+				Uuid:               info.Uuid,
+				LogicalSectorSize:  info.LogicalSectorSize,
+				PhysicalSectorSize: info.PhysicalSectorSize,
+				TransportMode:      transportMode,
+			}, nil
+		})
+	}
+}
+
+// transferResult 是 read 和 write 的输出。
+type transferResult struct {
+	Offset int64 `json:"offset"`
+	Bytes  int64 `json:"bytes"`
+}
+
+func (this transferResult) writeText(w io.Writer) {
+	fmt.Fprintf(w, "%d bytes at offset %d\n", this.Bytes, this.Offset)
+}
+
+func setupRead(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	offset := flags.String("offset", "0", "offset in bytes, K/M/G/T suffixes are accepted")
+	length := flags.String("length", "", "number of bytes to read (default: to the end of the disk)")
+	output := flags.String("output", "-", "output file, - for stdout")
+	return func(inv *invocation) (interface{}, error) {
+		if err := inv.expectArgs(0); err != nil {
+			return nil, err
+		}
+		start, err := parseSize(*offset)
+		if err != nil {
+			return nil, usageError(err.Error())
+		}
+		return inv.withDisk(true, func(disk virtual_disks.DiskReaderWriter) (interface{}, error) {
+			end := disk.Capacity()
+			if start > end {
+				return nil, errors.Errorf("Offset %d is beyond the capacity %d of the disk", start, end)
+			}
+			if *length != "" {
+				size, err := parseSize(*length)
+				if err != nil {
+					return nil, usageError(err.Error())
+				}
+				if size < end-start {
+					end = start + size
+				}
+			}
+			out := inv.stdout
+			if *output != "-" {
+				file, err := os.Create(*output)
+				if err != nil {
+					return nil, err
+				}
+				defer file.Close()
+				out = file
+			}
+			buf := make([]byte, transferSize)
+			pos := start
+			for pos < end {
+				if err := inv.ctx.Err(); err != nil {
+					return nil, err
+				}
+				chunk := buf
+				if end-pos < int64(len(chunk)) {
+					chunk = chunk[:end-pos]
+				}
+				n, err := disk.ReadAtContext(inv.ctx, chunk, pos)
+				if err != nil {
+					return nil, errors.Wrapf(err, "Read at offset %d failed", pos)
+				}
+				if _, err = out.Write(chunk[:n]); err != nil {
+					return nil, err
+				}
+				pos = pos + int64(n)
+			}
+			// 数据写到标准输出时不再输出统计
+			if *output == "-" {
+				return nil, nil
+			}
+			return transferResult{Offset: start, Bytes: pos - start}, nil
+		})
+	}
+}
+
+func setupWrite(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	offset := flags.String("offset", "0", "offset in bytes, K/M/G/T suffixes are accepted")
+	input := flags.String("input", "-", "input file, - for stdin")
+	return func(inv *invocation) (interface{}, error) {
+		if err := inv.expectArgs(0); err != nil {
+			return nil, err
+		}
+		start, err := parseSize(*offset)
+		if err != nil {
+			return nil, usageError(err.Error())
+		}
+		in := inv.stdin
+		if *input != "-" {
+			file, err := os.Open(*input)
+			if err != nil {
+				return nil, err
+			}
+			defer file.Close()
+			in = file
+		}
+		return inv.withDisk(false, func(disk virtual_disks.DiskReaderWriter) (interface{}, error) {
+			buf := make([]byte, transferSize)
+			pos := start
+			for {
+				n, readErr := io.ReadFull(in, buf)
+				if n > 0 {
+					if _, err := disk.WriteAtContext(inv.ctx, buf[:n], pos); err != nil {
+						return nil, errors.Wrapf(err, "Write at offset %d failed", pos)
+					}
+					pos = pos + int64(n)
+				}
+				if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+					break
+				}
+				if readErr != nil {
+					return nil, readErr
+				}
+			}
+			return transferResult{Offset: start, Bytes: pos - start}, nil
+		})
+	}
+}
+
+// blockResult 是一个已分配块，单位为扇区。
+type blockResult struct {
+	Offset uint64 `json:"offset"`
+	Length uint64 `json:"length"`
+}
+
+// blocksResult 是 dump-blocks 的输出。
+type blocksResult struct {
+	ChunkSize      uint64        `json:"chunkSize"`
+	Blocks         []blockResult `json:"blocks"`
+	AllocatedBytes int64         `json:"allocatedBytes"`
+}
+
+func (this blocksResult) writeText(w io.Writer) {
+	for _, block := range this.Blocks {
+		fmt.Fprintf(w, "%d %d\n", block.Offset, block.Length)
+	}
+}
+
+func setupDumpBlocks(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	start := flags.Uint64("start", 0, "first sector, must be a multiple of the chunk size")
+	count := flags.Uint64("count", 0, "number of sectors (default: to the end of the disk)")
+	chunkSize := flags.Uint64("chunk-size", 2048, "chunk size in sectors")
+	return func(inv *invocation) (interface{}, error) {
+		if err := inv.expectArgs(0); err != nil {
+			return nil, err
+		}
+		if *chunkSize < disklib.VIXDISKLIB_MIN_CHUNK_SIZE || *start%*chunkSize != 0 {
+			return nil, usageError(fmt.Sprintf("start must be a multiple of the chunk size and the chunk size must be at least %d", disklib.VIXDISKLIB_MIN_CHUNK_SIZE))
+		}
+		return inv.withDisk(true, func(disk virtual_disks.DiskReaderWriter) (interface{}, error) {
+			count := *count
+			if count == 0 {
+				count = uint64(disk.Info().Capacity)
+			}
+			it, vErr := disk.AllocatedBlocksRange(disklib.VixDiskLibSectorType(*start), disklib.VixDiskLibSectorType(count),
+				disklib.VixDiskLibSectorType(*chunkSize))
+			if vErr != nil {
+				return nil, vErr
+			}
+			result := blocksResult{ChunkSize: *chunkSize, Blocks: []blockResult{}}
+			for it.Next() {
+				block := it.Block()
+				result.Blocks = append(result.Blocks, blockResult{Offset: uint64(block.Offset()), Length: uint64(block.Length())})
+				result.AllocatedBytes = result.AllocatedBytes + int64(block.Length())*disklib.VIXDISKLIB_SECTOR_SIZE
+			}
+			if vErr := it.Err(); vErr != nil {
+				return nil, vErr
+			}
+			return result, nil
+		})
+	}
+}
+
+// createFlags 是 create 和 clone 共用的参数。
+type createFlags struct {
+	diskType           *string
+	adapterType        *string
+	hwVersion          *uint
+	logicalSectorSize  *uint
+	physicalSectorSize *uint
+}
+
+func registerCreateFlags(flags *flag.FlagSet) createFlags {
+	names := make([]string, 0, len(diskTypes))
+	for name := range diskTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return createFlags{
+		diskType:           flags.String("disk-type", "monolithic-sparse", "disk type: "+strings.Join(names, ", ")),
+		adapterType:        flags.String("adapter", "lsilogic", "adapter type: ide, buslogic, lsilogic, lsisas, pvscsi or nvme"),
+		hwVersion:          flags.Uint("hw-version", 7, "virtual hardware version"),
+		logicalSectorSize:  flags.Uint("logical-sector-size", 512, "logical sector size in bytes, 4096 for 4Kn disks"),
+		physicalSectorSize: flags.Uint("physical-sector-size", 512, "physical sector size in bytes"),
+	}
+}
+
+// createParams 根据参数生成 VixDiskLibCreateParams。
+func (this createFlags) createParams(capacity disklib.VixDiskLibSectorType) (disklib.VixDiskLibCreateParams, error) {
+	diskType, err := parseDiskType(*this.diskType)
+	if err != nil {
+		return disklib.VixDiskLibCreateParams{}, usageError(err.Error())
+	}
+	adapterType, err := parseAdapterType(*this.adapterType)
+	if err != nil {
+		return disklib.VixDiskLibCreateParams{}, usageError(err.Error())
+	}
+	return disklib.NewCreateParams(diskType, adapterType, uint16(*this.hwVersion), capacity).
+		WithSectorSize(uint32(*this.logicalSectorSize), uint32(*this.physicalSectorSize)), nil
+}
+
+// pathResult 是只操作磁盘路径的子命令的输出。
+type pathResult struct {
+	Operation string `json:"operation"`
+	Path      string `json:"path"`
+	Target    string `json:"target,omitempty"`
+}
+
+func (this pathResult) writeText(w io.Writer) {
+	if this.Target != "" {
+		fmt.Fprintf(w, "%s %s -> %s\n", this.Operation, this.Path, this.Target)
+		return
+	}
+	fmt.Fprintf(w, "%s %s\n", this.Operation, this.Path)
+}
+
+func setupCreate(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	capacity := flags.String("capacity", "", "capacity in bytes, K/M/G/T suffixes are accepted")
+	create := registerCreateFlags(flags)
+	return func(inv *invocation) (interface{}, error) {
+		if err := inv.expectArgs(1); err != nil {
+			return nil, err
+		}
+		sectors, err := parseCapacity(*capacity)
+		if err != nil {
+			return nil, usageError(err.Error())
+		}
+		params, err := create.createParams(sectors)
+		if err != nil {
+			return nil, err
+		}
+		path := inv.args[0]
+		return inv.withConnection(func(conn disklib.VixDiskLibConnection) (interface{}, error) {
+			if vErr := disklib.CreateContext(inv.ctx, conn, path, params, inv.progressFunc("create")); vErr != nil {
+				return nil, vErr
+			}
+			return pathResult{Operation: "create", Path: path}, nil
+		})
+	}
+}
+
+func setupClone(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	create := registerCreateFlags(flags)
+	overwrite := flags.Bool("overwrite", false, "overwrite the destination if it exists")
+	return func(inv *invocation) (interface{}, error) {
+		if err := inv.expectArgs(2); err != nil {
+			return nil, err
+		}
+		params, err := create.createParams(0)
+		if err != nil {
+			return nil, err
+		}
+		src, dst := inv.args[0], inv.args[1]
+		return inv.withConnection(func(conn disklib.VixDiskLibConnection) (interface{}, error) {
+			if vErr := disklib.CloneContext(inv.ctx, conn, dst, conn, src, params, inv.progressFunc("clone"), *overwrite); vErr != nil {
+				return nil, vErr
+			}
+			return pathResult{Operation: "clone", Path: src, Target: dst}, nil
+		})
+	}
+}
+
+func setupGrow(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	capacity := flags.String("capacity", "", "new capacity in bytes, K/M/G/T suffixes are accepted")
+	updateGeometry := flags.Bool("update-geometry", false, "update the BIOS geometry of the disk")
+	return func(inv *invocation) (interface{}, error) {
+		if err := inv.expectArgs(1); err != nil {
+			return nil, err
+		}
+		sectors, err := parseCapacity(*capacity)
+		if err != nil {
+			return nil, usageError(err.Error())
+		}
+		path := inv.args[0]
+		return inv.withConnection(func(conn disklib.VixDiskLibConnection) (interface{}, error) {
+			if vErr := disklib.GrowContext(inv.ctx, conn, path, sectors, *updateGeometry, inv.progressFunc("grow")); vErr != nil {
+				return nil, vErr
+			}
+			return pathResult{Operation: "grow", Path: path}, nil
+		})
+	}
+}
+
+func setupShrink(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	return func(inv *invocation) (interface{}, error) {
+		if err := inv.expectArgs(0); err != nil {
+			return nil, err
+		}
+		return inv.withDisk(false, func(disk virtual_disks.DiskReaderWriter) (interface{}, error) {
+			vErr := disk.WithHandle(func(dli disklib.VixDiskLibHandle) disklib.VddkError {
+				return disklib.ShrinkContext(inv.ctx, dli, inv.progressFunc("shrink"))
+			})
+			if vErr != nil {
+				return nil, vErr
+			}
+			return pathResult{Operation: "shrink", Path: inv.cfg.diskName()}, nil
+		})
+	}
+}
+
+func setupDefrag(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	return func(inv *invocation) (interface{}, error) {
+		if err := inv.expectArgs(0); err != nil {
+			return nil, err
+		}
+		return inv.withDisk(false, func(disk virtual_disks.DiskReaderWriter) (interface{}, error) {
+			vErr := disk.WithHandle(func(dli disklib.VixDiskLibHandle) disklib.VddkError {
+				return disklib.DefragmentContext(inv.ctx, dli, inv.progressFunc("defrag"))
+			})
+			if vErr != nil {
+				return nil, vErr
+			}
+			return pathResult{Operation: "defrag", Path: inv.cfg.diskName()}, nil
+		})
+	}
+}
+
+func setupCheckRepair(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	repair := flags.Bool("repair", false, "repair the disk if problems are found")
+	return func(inv *invocation) (interface{}, error) {
+		if err := inv.expectArgs(1); err != nil {
+			return nil, err
+		}
+		path := inv.args[0]
+		return inv.withConnection(func(conn disklib.VixDiskLibConnection) (interface{}, error) {
+			if vErr := disklib.CheckRepairContext(inv.ctx, conn, path, *repair); vErr != nil {
+				return nil, vErr
+			}
+			return pathResult{Operation: "check-repair", Path: path}, nil
+		})
+	}
+}
+
+func setupRename(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	return func(inv *invocation) (interface{}, error) {
+		if err := inv.expectArgs(2); err != nil {
+			return nil, err
+		}
+		if vErr := disklib.Rename(inv.args[0], inv.args[1]); vErr != nil {
+			return nil, vErr
+		}
+		return pathResult{Operation: "rename", Path: inv.args[0], Target: inv.args[1]}, nil
+	}
+}
+
+func setupUnlink(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	return func(inv *invocation) (interface{}, error) {
+		if err := inv.expectArgs(1); err != nil {
+			return nil, err
+		}
+		path := inv.args[0]
+		return inv.withConnection(func(conn disklib.VixDiskLibConnection) (interface{}, error) {
+			if vErr := disklib.Unlink(conn, path); vErr != nil {
+				return nil, vErr
+			}
+			return pathResult{Operation: "unlink", Path: path}, nil
+		})
+	}
+}
+
+// metadataResult 是 metadata list 和 get 的输出。
+type metadataResult map[string]string
+
+func (this metadataResult) writeText(w io.Writer) {
+	for _, key := range sortedKeys(this) {
+		fmt.Fprintf(w, "%s = %s\n", key, this[key])
+	}
+}
+
+func setupMetadata(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	return func(inv *invocation) (interface{}, error) {
+		if len(inv.args) == 0 {
+			return nil, usageError("missing metadata action")
+		}
+		switch inv.args[0] {
+		case "list":
+			if len(inv.args) != 1 {
+				return nil, usageError("metadata list does not take arguments")
+			}
+			return inv.withDisk(true, func(disk virtual_disks.DiskReaderWriter) (interface{}, error) {
+				metadata, vErr := disk.GetMetadata()
+				if vErr != nil {
+					return nil, vErr
+				}
+				return metadataResult(metadata), nil
+			})
+		case "get":
+			if len(inv.args) != 2 {
+				return nil, usageError("metadata get takes a key")
+			}
+			return inv.withDisk(true, func(disk virtual_disks.DiskReaderWriter) (interface{}, error) {
+				value, vErr := disk.ReadMetadata(inv.args[1])
+				if vErr != nil {
+					return nil, vErr
+				}
+				return metadataResult{inv.args[1]: value}, nil
+			})
+		case "set":
+			if len(inv.args) != 3 {
+				return nil, usageError("metadata set takes a key and a value")
+			}
+			return inv.withDisk(false, func(disk virtual_disks.DiskReaderWriter) (interface{}, error) {
+				if vErr := disk.WriteMetadata(map[string]string{inv.args[1]: inv.args[2]}); vErr != nil {
+					return nil, vErr
+				}
+				return metadataResult{inv.args[1]: inv.args[2]}, nil
+			})
+		default:
+			return nil, usageError(fmt.Sprintf("unknown metadata action %q", inv.args[0]))
+		}
+	}
+}
+
+// sortedKeys 返回按字母顺序排列的键。
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// stringsResult 是字符串列表的输出，文本输出时每行一个。
+type stringsResult []string
+
+func (this stringsResult) writeText(w io.Writer) {
+	for _, value := range this {
+		fmt.Fprintln(w, value)
+	}
+}
+
+func setupTransportModes(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	return func(inv *invocation) (interface{}, error) {
+		if err := inv.expectArgs(0); err != nil {
+			return nil, err
+		}
+		return stringsResult(strings.Split(disklib.ListTransportModes(), ":")), nil
+	}
+}
+
+// thumbprintResult 是 thumbprint 的输出。
+type thumbprintResult struct {
+	Server     string `json:"server"`
+	Thumbprint string `json:"thumbprint"`
+}
+
+func (this thumbprintResult) writeText(w io.Writer) {
+	fmt.Fprintln(w, this.Thumbprint)
+}
+
+func setupThumbprint(flags *flag.FlagSet) func(inv *invocation) (interface{}, error) {
+	port := flags.String("port", "443", "TLS port of the server")
+	return func(inv *invocation) (interface{}, error) {
+		if err := inv.expectArgs(0); err != nil {
+			return nil, err
+		}
+		if inv.cfg.Server == "" {
+			return nil, usageError("--server is required")
+		}
+		thumbprint, err := disklib.GetThumbPrintForServer(inv.cfg.Server, *port)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Get thumbprint of %s failed", inv.cfg.Server)
+		}
+		return thumbprintResult{Server: inv.cfg.Server, Thumbprint: thumbprint}, nil
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// config 是连接 vSphere 和初始化 VDDK 所需的参数，取代 disklib.NewConnectParams 的 14 个参数。
+// 优先级从低到高依次为：配置文件、环境变量、命令行参数。
+type config struct {
+	LibDir     string `json:"libDir"`     // VDDK 库所在目录
+	VddkConfig string `json:"vddkConfig"` // 传给 InitEx 的 VDDK 配置文件
+	VmxSpec    string `json:"vmxSpec"`
+	Server     string `json:"server"`
+	Thumbprint string `json:"thumbprint"`
+	User       string `json:"user"`
+	Password   string `json:"password"`
+	FcdId      string `json:"fcdId"`
+	Datastore  string `json:"datastore"`
+	FcdssId    string `json:"fcdssId"`
+	Cookie     string `json:"cookie"`
+	Identity   string `json:"identity"`
+	Path       string `json:"path"`      // 磁盘路径，FcdId 为空时使用
+	Mode       string `json:"mode"`      // 传输模式，例如 nbd、nbdssl、hotadd
+	OpenFlags  uint32 `json:"openFlags"` // 打开磁盘的 VIXDISKLIB_FLAG_OPEN_* 标志
+}
+
+// configEnv 是每个字段对应的环境变量。
+var configEnv = []struct {
+	name  string
+	field func(cfg *config) *string
+}{
+	{"VDISK_LIBDIR", func(cfg *config) *string { return &cfg.LibDir }},
+	{"VDISK_VDDK_CONFIG", func(cfg *config) *string { return &cfg.VddkConfig }},
+	{"VDISK_VMX_SPEC", func(cfg *config) *string { return &cfg.VmxSpec }},
+	{"VDISK_SERVER", func(cfg *config) *string { return &cfg.Server }},
+	{"VDISK_THUMBPRINT", func(cfg *config) *string { return &cfg.Thumbprint }},
+	{"VDISK_USER", func(cfg *config) *string { return &cfg.User }},
+	{"VDISK_PASSWORD", func(cfg *config) *string { return &cfg.Password }},
+	{"VDISK_FCD_ID", func(cfg *config) *string { return &cfg.FcdId }},
+	{"VDISK_DATASTORE", func(cfg *config) *string { return &cfg.Datastore }},
+	{"VDISK_FCDSS_ID", func(cfg *config) *string { return &cfg.FcdssId }},
+	{"VDISK_COOKIE", func(cfg *config) *string { return &cfg.Cookie }},
+	{"VDISK_IDENTITY", func(cfg *config) *string { return &cfg.Identity }},
+	{"VDISK_PATH", func(cfg *config) *string { return &cfg.Path }},
+	{"VDISK_MODE", func(cfg *config) *string { return &cfg.Mode }},
+}
+
+// connectionFlags 保存命令行中的连接参数，只有显式设置的参数才会覆盖配置文件和环境变量。
+type connectionFlags struct {
+	configFile string
+	values     map[string]*string
+	openFlags  string
+}
+
+// flagNames 是连接参数在命令行中的名称，顺序与 configEnv 相同。
+var flagNames = []string{"libdir", "vddk-config", "vmx-spec", "server", "thumbprint", "user", "password",
+	"fcd-id", "datastore", "fcdss-id", "cookie", "identity", "path", "mode"}
+
+// registerConnectionFlags 在 flags 中登记连接参数。
+func registerConnectionFlags(flags *flag.FlagSet) *connectionFlags {
+	conn := &connectionFlags{values: make(map[string]*string)}
+	flags.StringVar(&conn.configFile, "config", "", "JSON configuration file (default $VDISK_CONFIG)")
+	for i, name := range flagNames {
+		conn.values[name] = flags.String(name, "", "connection parameter, overrides $"+configEnv[i].name)
+	}
+	flags.StringVar(&conn.openFlags, "open-flags", "", "VIXDISKLIB_FLAG_OPEN_* flags used to open the disk")
+	return conn
+}
+
+// load 按照配置文件、环境变量、命令行参数的顺序合并出最终的配置。
+func (this *connectionFlags) load(flags *flag.FlagSet) (*config, error) {
+	cfg := &config{}
+	configFile := this.configFile
+	if configFile == "" {
+		configFile = os.Getenv("VDISK_CONFIG")
+	}
+	if configFile != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Read config file failed")
+		}
+		if err = json.Unmarshal(data, cfg); err != nil {
+			return nil, errors.Wrapf(err, "Parse config file %s failed", configFile)
+		}
+	}
+	for _, env := range configEnv {
+		if value, ok := os.LookupEnv(env.name); ok {
+			*env.field(cfg) = value
+		}
+	}
+	if value, ok := os.LookupEnv("VDISK_OPEN_FLAGS"); ok {
+		if err := setOpenFlags(cfg, value); err != nil {
+			return nil, err
+		}
+	}
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for i, name := range flagNames {
+		if set[name] {
+			*configEnv[i].field(cfg) = *this.values[name]
+		}
+	}
+	if set["open-flags"] {
+		if err := setOpenFlags(cfg, this.openFlags); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// setOpenFlags 解析十进制或 0x 开头的十六进制标志。
+func setOpenFlags(cfg *config, value string) error {
+	flags, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid open flags %s", value)
+	}
+	cfg.OpenFlags = uint32(flags)
+	return nil
+}
+
+// connectParams 根据配置生成 disklib.ConnectParams，readOnly 为 true 时以只读方式打开磁盘。
+func (this *config) connectParams(readOnly bool) disklib.ConnectParams {
+	params := disklib.BuildConnectParams(
+		disklib.WithServer(this.Server),
+		disklib.WithThumbprint(this.Thumbprint),
+		disklib.WithCredentials(this.User, this.Password),
+		disklib.ForFCD(this.FcdId, this.Datastore),
+		disklib.WithFCDSnapshot(this.FcdssId),
+		disklib.ForVMX(this.VmxSpec, this.Path),
+		disklib.WithIdentity(this.Identity),
+		disklib.WithTransport(this.Mode),
+		disklib.WithOpenFlags(this.OpenFlags))
+	if this.Cookie != "" {
+		params = params.With(disklib.WithSessionCookie(this.Cookie, this.User))
+	}
+	if readOnly {
+		params = params.With(disklib.ReadOnly())
+	}
+	return params
+}
+
+// diskName 返回用于输出的磁盘名称。
+func (this *config) diskName() string {
+	if this.FcdId != "" {
+		return this.FcdId
+	}
+	return this.Path
+}
+
+// diskTypes 是命令行中磁盘类型的名称。
+var diskTypes = map[string]disklib.VixDiskLibDiskType{
+	"monolithic-sparse": disklib.VIXDISKLIB_DISK_MONOLITHIC_SPARSE,
+	"monolithic-flat":   disklib.VIXDISKLIB_DISK_MONOLITHIC_FLAT,
+	"split-sparse":      disklib.VIXDISKLIB_DISK_SPLIT_SPARSE,
+	"split-flat":        disklib.VIXDISKLIB_DISK_SPLIT_FLAT,
+	"vmfs-flat":         disklib.VIXDISKLIB_DISK_VMFS_FLAT,
+	"stream-optimized":  disklib.VIXDISKLIB_DISK_STREAM_OPTIMIZED,
+	"vmfs-thin":         disklib.VIXDISKLIB_DISK_VMFS_THIN,
+	"vmfs-sparse":       disklib.VIXDISKLIB_DISK_VMFS_SPARSE,
+}
+
+// adapterTypes 是命令行中适配器类型的名称。
+var adapterTypes = map[string]disklib.VixDiskLibAdapterType{
+	"ide":      disklib.VIXDISKLIB_ADAPTER_IDE,
+	"buslogic": disklib.VIXDISKLIB_ADAPTER_SCSI_BUSLOGIC,
+	"lsilogic": disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC,
+	"lsisas":   disklib.VIXDISKLIB_ADAPTER_SCSI_LSISAS,
+	"pvscsi":   disklib.VIXDISKLIB_ADAPTER_SCSI_PVSCSI,
+	"nvme":     disklib.VIXDISKLIB_ADAPTER_NVME,
+}
+
+// parseDiskType 解析磁盘类型的名称。
+func parseDiskType(name string) (disklib.VixDiskLibDiskType, error) {
+	diskType, ok := diskTypes[name]
+	if !ok {
+		return 0, errors.Errorf("Unknown disk type %s", name)
+	}
+	return diskType, nil
+}
+
+// parseAdapterType 解析适配器类型的名称。
+func parseAdapterType(name string) (disklib.VixDiskLibAdapterType, error) {
+	adapterType, ok := adapterTypes[name]
+	if !ok {
+		return 0, errors.Errorf("Unknown adapter type %s", name)
+	}
+	return adapterType, nil
+}
+
+// adapterName 返回适配器类型的名称。
+func adapterName(adapterType disklib.VixDiskLibAdapterType) string {
+	for name, value := range adapterTypes {
+		if value == adapterType {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// parseSize 解析以字节为单位的大小，可以带 K、M、G、T 后缀（1024 进制）。
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.ToUpper(strings.TrimSpace(value))
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(number, suffix) {
+			multiplier = int64(1) << (10 * uint(i+1))
+			number = strings.TrimSuffix(number, suffix)
+			break
+		}
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.Errorf("Invalid size %s", value)
+	}
+	if size > math.MaxInt64/multiplier {
+		return 0, errors.Errorf("Size %s is too large", value)
+	}
+	return size * multiplier, nil
+}
+
+// parseCapacity 解析磁盘容量，返回扇区数，容量必须是扇区大小的整数倍。
+func parseCapacity(value string) (disklib.VixDiskLibSectorType, error) {
+	if value == "" {
+		return 0, errors.New("--capacity is required")
+	}
+	size, err := parseSize(value)
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 || size%disklib.VIXDISKLIB_SECTOR_SIZE != 0 {
+		return 0, errors.Errorf("Capacity %s is not a positive multiple of %d bytes", value, disklib.VIXDISKLIB_SECTOR_SIZE)
+	}
+	return disklib.VixDiskLibSectorType(size / disklib.VIXDISKLIB_SECTOR_SIZE), nil
+}
@@ -0,0 +1,216 @@
+// vdisk 是封装 disklib 和 virtual_disks 的命令行工具，运维人员不需要编写 Go 代码即可查看、读写和管理虚拟磁盘。
+//
+// 用法：vdisk <command> [flags] [args]，连接参数可以来自 --config 指定的 JSON 文件、VDISK_* 环境变量或命令行参数，
+// 加上 --json 后输出 JSON，便于在脚本中使用。
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// 退出码
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// VDDK 的版本号
+const (
+	vddkMajorVersion = 7
+	vddkMinorVersion = 0
+)
+
+// command 是一个子命令。setup 在 flags 中登记子命令自己的参数，返回执行子命令的函数。
+type command struct {
+	usage   string
+	summary string
+	// noInit 为 true 时不需要初始化 VDDK
+	noInit bool
+	setup  func(flags *flag.FlagSet) func(inv *invocation) (interface{}, error)
+}
+
+// textResult 是可以输出为文本的结果，没有实现该接口的结果总是输出为 JSON。
+type textResult interface {
+	writeText(w io.Writer)
+}
+
+// invocation 是一次子命令调用的上下文。
+type invocation struct {
+	ctx      context.Context
+	args     []string
+	cfg      *config
+	logger   logrus.FieldLogger
+	stdin    io.Reader
+	stdout   io.Writer
+	stderr   io.Writer
+	progress bool
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// run 执行 args 指定的子命令并返回退出码。
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage(stderr)
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return exitOK
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "vdisk: unknown command %q\n\n", args[0])
+		printUsage(stderr)
+		return exitUsage
+	}
+	flags := flag.NewFlagSet("vdisk "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: vdisk %s [flags] %s\n\n%s\n\nFlags:\n", args[0], cmd.usage, cmd.summary)
+		flags.PrintDefaults()
+	}
+	connFlags := registerConnectionFlags(flags)
+	jsonOutput := flags.Bool("json", false, "print the result as JSON")
+	progress := flags.Bool("progress", false, "print progress of long running operations to stderr")
+	verbose := flags.Bool("verbose", false, "enable debug logging")
+	execute := cmd.setup(flags)
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	cfg, err := connFlags.load(flags)
+	if err != nil {
+		return fail(stdout, stderr, *jsonOutput, err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(stderr)
+	logger.SetLevel(logrus.WarnLevel)
+	if *verbose {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+	inv := &invocation{
+		ctx:      ctx,
+		args:     flags.Args(),
+		cfg:      cfg,
+		logger:   logger,
+		stdin:    stdin,
+		stdout:   stdout,
+		stderr:   stderr,
+		progress: *progress,
+	}
+	if !cmd.noInit {
+		var vErr disklib.VddkError
+		if cfg.VddkConfig != "" {
+			vErr = disklib.InitExWithLogger(vddkMajorVersion, vddkMinorVersion, cfg.LibDir, cfg.VddkConfig, logger)
+		} else {
+			vErr = disklib.InitWithLogger(vddkMajorVersion, vddkMinorVersion, cfg.LibDir, logger)
+		}
+		if vErr != nil {
+			return fail(stdout, stderr, *jsonOutput, vErr)
+		}
+		defer disklib.Exit()
+	}
+	result, err := execute(inv)
+	if err != nil {
+		if _, ok := errors.Cause(err).(usageError); ok {
+			fmt.Fprintf(stderr, "vdisk %s: %v\n", args[0], err)
+			flags.Usage()
+			return exitUsage
+		}
+		return fail(stdout, stderr, *jsonOutput, err)
+	}
+	if result == nil {
+		return exitOK
+	}
+	if text, ok := result.(textResult); ok && !*jsonOutput {
+		text.writeText(stdout)
+		return exitOK
+	}
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+	return exitOK
+}
+
+// usageError 表示命令行参数错误，退出码为 exitUsage。
+type usageError string
+
+func (this usageError) Error() string {
+	return string(this)
+}
+
+// errorResult 是 --json 时输出的错误。
+type errorResult struct {
+	Error        string `json:"error"`
+	VixErrorCode uint64 `json:"vixErrorCode,omitempty"`
+}
+
+// fail 输出错误并返回 exitError。
+func fail(stdout io.Writer, stderr io.Writer, jsonOutput bool, err error) int {
+	result := errorResult{Error: err.Error()}
+	if vErr, ok := errors.Cause(err).(disklib.VddkError); ok {
+		result.VixErrorCode = vErr.VixErrorCode()
+	}
+	if jsonOutput {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result)
+	} else if result.VixErrorCode != 0 {
+		fmt.Fprintf(stderr, "vdisk: %s (error code %d)\n", result.Error, result.VixErrorCode)
+	} else {
+		fmt.Fprintf(stderr, "vdisk: %s\n", result.Error)
+	}
+	return exitError
+}
+
+// printUsage 输出所有子命令的简介。
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: vdisk <command> [flags] [args]\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-16s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(w, "\nRun 'vdisk <command> -h' for the flags of a command.\n")
+}
+
+// progressFunc 返回打印进度的回调，没有指定 --progress 时返回 nil。
+func (this *invocation) progressFunc(operation string) disklib.ProgressFunc {
+	if !this.progress {
+		return nil
+	}
+	return func(percentCompleted int) bool {
+		fmt.Fprintf(this.stderr, "%s: %d%%\n", operation, percentCompleted)
+		return true
+	}
+}
+
+// expectArgs 检查位置参数的个数。
+func (this *invocation) expectArgs(count int) error {
+	if len(this.args) != count {
+		return usageError(fmt.Sprintf("expected %d arguments, got %d", count, len(this.args)))
+	}
+	return nil
+}
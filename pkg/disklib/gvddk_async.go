@@ -0,0 +1,69 @@
+package disklib
+
+import "sync"
+
+// AsyncRequest 表示一个已经提交的异步读写请求。
+// 请求完成前调用方不能访问或复用提交时传入的缓冲区。
+type AsyncRequest struct {
+	done chan struct{}
+	err  VddkError
+}
+
+// newAsyncRequest 创建一个尚未完成的异步请求。
+func newAsyncRequest() *AsyncRequest {
+	return &AsyncRequest{done: make(chan struct{})}
+}
+
+// complete 记录请求的结果并通知等待者，每个请求只能被调用一次。
+func (this *AsyncRequest) complete(err VddkError) {
+	this.err = err
+	close(this.done)
+}
+
+// Done 返回一个在请求完成后被关闭的 channel，便于与 select 配合使用。
+func (this *AsyncRequest) Done() <-chan struct{} {
+	return this.done
+}
+
+// Err 返回请求的结果，请求尚未完成时返回 nil。
+func (this *AsyncRequest) Err() VddkError {
+	select {
+	case <-this.done:
+		return this.err
+	default:
+		return nil
+	}
+}
+
+// Wait 阻塞直到请求完成，并返回请求的结果。
+func (this *AsyncRequest) Wait() VddkError {
+	<-this.done
+	return this.err
+}
+
+// 正在进行的异步请求所登记的完成函数。与进度回调相同，C 侧只保存请求编号，不持有 Go 指针。
+var (
+	asyncMutex       sync.Mutex
+	asyncNextId      uintptr
+	asyncCompletions = make(map[uintptr]func(result uint64))
+)
+
+// registerAsync 登记一个异步请求的完成函数并返回其编号。
+func registerAsync(completion func(result uint64)) uintptr {
+	asyncMutex.Lock()
+	defer asyncMutex.Unlock()
+	asyncNextId++
+	asyncCompletions[asyncNextId] = completion
+	return asyncNextId
+}
+
+// completeAsync 取出编号对应的完成函数并以 result 调用它。每个编号只会被处理一次，重复调用将被忽略。
+func completeAsync(asyncId uintptr, result uint64) {
+	asyncMutex.Lock()
+	completion := asyncCompletions[asyncId]
+	delete(asyncCompletions, asyncId)
+	asyncMutex.Unlock()
+	if completion != nil {
+		completion(result)
+	}
+}
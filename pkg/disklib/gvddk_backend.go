@@ -0,0 +1,79 @@
+package disklib
+
+import "sync"
+
+// Backend 抽象了 disklib 对 VDDK C 函数的全部调用。
+// 默认后端在正常构建时直接调用 VixDiskLib（见 gvddk_cgo.go），在使用 novddk 构建标签时为纯 Go 的 FakeBackend，
+// 也可以通过 InitWithBackend 在初始化时选择任意实现，以便在没有 VDDK 的机器上测试 disklib 与 virtual_disks。
+type Backend interface {
+	Init(majorVersion uint32, minorVersion uint32, dir string) VddkError
+	InitEx(majorVersion uint32, minorVersion uint32, dir string, configFile string) VddkError
+	Exit()
+
+	PrepareForAccess(appGlobal ConnectParams) VddkError
+	EndAccess(appGlobal ConnectParams) VddkError
+	Connect(appGlobal ConnectParams) (VixDiskLibConnection, VddkError)
+	ConnectEx(appGlobal ConnectParams) (VixDiskLibConnection, VddkError)
+	Disconnect(connection VixDiskLibConnection) VddkError
+	Cleanup(appGlobal ConnectParams, numCleanUp uint32, numRemaining uint32) VddkError
+	ListTransportModes() string
+	GetErrorText(errCode uint64, locale string) string
+
+	Open(conn VixDiskLibConnection, params ConnectParams) (VixDiskLibHandle, VddkError)
+	Close(diskHandle VixDiskLibHandle) VddkError
+	GetInfo(diskHandle VixDiskLibHandle) (VixDiskLibInfo, VddkError)
+	GetTransportMode(diskHandle VixDiskLibHandle) string
+	Read(diskHandle VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte) VddkError
+	Write(diskHandle VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte) VddkError
+	// ReadAsync 和 WriteAsync 提交异步读写请求。返回 nil 时 completion 在请求完成后恰好被调用一次，
+	// 返回错误时请求没有被提交，completion 不会被调用。
+	ReadAsync(diskHandle VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte, completion func(VddkError)) VddkError
+	WriteAsync(diskHandle VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte, completion func(VddkError)) VddkError
+	Wait(diskHandle VixDiskLibHandle) VddkError
+	Flush(diskHandle VixDiskLibHandle) VddkError
+	QueryAllocatedBlocks(diskHandle VixDiskLibHandle, startSector VixDiskLibSectorType, numSectors VixDiskLibSectorType, chunkSize VixDiskLibSectorType) ([]VixDiskLibBlock, VddkError)
+
+	// GetMetadataKeys 和 ReadMetadata 将结果写入 buf，并返回完整结果所需的字节数。
+	GetMetadataKeys(diskHandle VixDiskLibHandle, buf []byte) (uint, VddkError)
+	ReadMetadata(diskHandle VixDiskLibHandle, key string, buf []byte) (uint, VddkError)
+	WriteMetadata(diskHandle VixDiskLibHandle, key string, val string) VddkError
+
+	Create(connection VixDiskLibConnection, path string, createParams VixDiskLibCreateParams, progress ProgressFunc) VddkError
+	CreateChild(diskHandle VixDiskLibHandle, childPath string, diskType VixDiskLibDiskType, progress ProgressFunc) VddkError
+	Clone(dstConnection VixDiskLibConnection, dstPath string, srcConnection VixDiskLibConnection, srcPath string,
+		params VixDiskLibCreateParams, progress ProgressFunc, overWrite bool) VddkError
+	Grow(connection VixDiskLibConnection, path string, capacity VixDiskLibSectorType, updateGeometry bool, progress ProgressFunc) VddkError
+	Shrink(diskHandle VixDiskLibHandle, progress ProgressFunc) VddkError
+	Defragment(diskHandle VixDiskLibHandle, progress ProgressFunc) VddkError
+	Attach(childHandle VixDiskLibHandle, parentHandle VixDiskLibHandle) VddkError
+	CheckRepair(connection VixDiskLibConnection, filename string, repair bool) VddkError
+	Rename(srcFileName string, dstFileName string) VddkError
+	Unlink(connection VixDiskLibConnection, path string) VddkError
+	SpaceNeededForClone(srcHandle VixDiskLibHandle, diskType VixDiskLibDiskType) (uint64, VddkError)
+}
+
+// 当前使用的后端及保护它的读写锁
+var (
+	backendMutex   sync.RWMutex
+	currentBackend Backend = newDefaultBackend()
+)
+
+// DefaultBackend 返回 Init 默认使用的后端：正常构建时调用 VixDiskLib，使用 novddk 构建标签时为新的 FakeBackend。
+// 可以将它包装后传给 InitWithBackend，例如 metrics.NewCollector(disklib.DefaultBackend())。
+func DefaultBackend() Backend {
+	return newDefaultBackend()
+}
+
+// getBackend 返回当前使用的后端。
+func getBackend() Backend {
+	backendMutex.RLock()
+	defer backendMutex.RUnlock()
+	return currentBackend
+}
+
+// setBackend 替换当前使用的后端。
+func setBackend(b Backend) {
+	backendMutex.Lock()
+	defer backendMutex.Unlock()
+	currentBackend = b
+}
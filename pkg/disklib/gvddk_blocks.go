@@ -0,0 +1,219 @@
+package disklib
+
+import (
+	"fmt"
+)
+
+// BlockQuerier 是可以按块查询已分配区域的磁盘，virtual_disks.DiskReaderWriter 和 vmdk.Disk 都满足该接口。
+type BlockQuerier interface {
+	QueryAllocatedBlocks(startSector VixDiskLibSectorType, numSectors VixDiskLibSectorType, chunkSize VixDiskLibSectorType) ([]VixDiskLibBlock, VddkError)
+}
+
+// QueryChunks 实现不依赖 VDDK 的 QueryAllocatedBlocks：按照 VDDK 的规则校验参数，对范围内的每个块调用 allocated，
+// 并返回合并了相邻块的已分配区域。startSector 必须按 chunkSize 对齐，numSectors 只有在到达磁盘末尾时才允许不对齐，
+// 块数不能超过 VIXDISKLIB_MAX_CHUNK_NUMBER。capacity 是磁盘容量（扇区），allocated 的参数是块的起止扇区，
+// 返回错误时 QueryChunks 返回 VIX_E_FAIL。
+func QueryChunks(startSector VixDiskLibSectorType, numSectors VixDiskLibSectorType, chunkSize VixDiskLibSectorType, capacity VixDiskLibSectorType,
+	allocated func(chunkStart VixDiskLibSectorType, chunkEnd VixDiskLibSectorType) (bool, error)) ([]VixDiskLibBlock, VddkError) {
+	newError := func(code uint64) VddkError {
+		return NewVddkError(code, fmt.Sprintf("QueryAllocatedBlocks(%d, %d, %d) failed. The error code is %d.", startSector, numSectors, chunkSize, code))
+	}
+	if chunkSize < VIXDISKLIB_MIN_CHUNK_SIZE || chunkSize > VIXDISKLIB_MAX_CHUNK_SIZE || startSector%chunkSize != 0 {
+		return nil, newError(VIX_E_INVALID_ARG)
+	}
+	if (numSectors+chunkSize-1)/chunkSize > VIXDISKLIB_MAX_CHUNK_NUMBER {
+		return nil, newError(VIX_E_INVALID_ARG)
+	}
+	endSector := startSector + numSectors
+	if endSector > capacity || endSector < startSector {
+		return nil, newError(VIX_E_DISK_OUTOFRANGE)
+	}
+	if numSectors%chunkSize != 0 && endSector != capacity {
+		return nil, newError(VIX_E_INVALID_ARG)
+	}
+	var blocks []VixDiskLibBlock
+	for chunk := startSector; chunk < endSector; chunk += chunkSize {
+		chunkEnd := chunk + chunkSize
+		if chunkEnd > endSector {
+			chunkEnd = endSector
+		}
+		ok, err := allocated(chunk, chunkEnd)
+		if err != nil {
+			return nil, newError(VIX_E_FAIL)
+		}
+		if ok {
+			blocks = AppendBlock(blocks, chunk, chunkEnd-chunk)
+		}
+	}
+	return blocks, nil
+}
+
+// AppendBlock 将从 offset 开始的 length 个扇区追加到按偏移量排序的 blocks 中，与最后一个区域相邻或重叠时合并。
+func AppendBlock(blocks []VixDiskLibBlock, offset VixDiskLibSectorType, length VixDiskLibSectorType) []VixDiskLibBlock {
+	if length == 0 {
+		return blocks
+	}
+	if last := len(blocks) - 1; last >= 0 && blocks[last].Offset()+blocks[last].Length() >= offset {
+		if end := offset + length; end > blocks[last].Offset()+blocks[last].Length() {
+			blocks[last].SetLength(end - blocks[last].Offset())
+		}
+		return blocks
+	}
+	var block VixDiskLibBlock
+	block.SetOffset(offset)
+	block.SetLength(length)
+	return append(blocks, block)
+}
+
+// AssumeAllocatedIfUnsupported 包装 querier：querier 返回 VIX_E_NOT_SUPPORTED 时，将查询的整个范围作为已分配的区域返回。
+// 适用于读取整个磁盘作为后备方案的调用者，例如复制和导出。
+func AssumeAllocatedIfUnsupported(querier BlockQuerier) BlockQuerier {
+	return unsupportedAsAllocated{querier}
+}
+
+// unsupportedAsAllocated 是 AssumeAllocatedIfUnsupported 返回的包装。
+type unsupportedAsAllocated struct {
+	querier BlockQuerier
+}
+
+// QueryAllocatedBlocks 调用被包装的 QueryAllocatedBlocks，不支持时返回整个范围。
+func (this unsupportedAsAllocated) QueryAllocatedBlocks(startSector VixDiskLibSectorType, numSectors VixDiskLibSectorType, chunkSize VixDiskLibSectorType) ([]VixDiskLibBlock, VddkError) {
+	blocks, vErr := this.querier.QueryAllocatedBlocks(startSector, numSectors, chunkSize)
+	if vErr != nil && vErr.VixErrorCode() == VIX_E_NOT_SUPPORTED {
+		return AppendBlock(nil, startSector, numSectors), nil
+	}
+	return blocks, vErr
+}
+
+// AllocatedBlockIterator 按窗口分页调用 QueryAllocatedBlocks，遍历一段扇区范围内已分配的区域。
+// 每个窗口最多包含 VIXDISKLIB_MAX_CHUNK_NUMBER 个块，相邻的区域（包括跨越窗口边界的）会被合并为一个，
+// 磁盘末尾不足一个块的部分也会被查询，返回的区域不会超出遍历范围。用法：
+//
+//	it, vErr := diskReaderWriter.AllocatedBlocks(2048)
+//	for it.Next() {
+//		block := it.Block()
+//	}
+//	if vErr := it.Err(); vErr != nil {
+//	}
+type AllocatedBlockIterator struct {
+	querier    BlockQuerier
+	chunkSize  VixDiskLibSectorType
+	capacity   VixDiskLibSectorType // 磁盘容量（扇区）
+	end        VixDiskLibSectorType // 遍历的结束扇区
+	next       VixDiskLibSectorType // 下一个窗口的起始扇区
+	pending    []VixDiskLibBlock    // 当前窗口中尚未处理的区域
+	merged     VixDiskLibBlock      // 正在合并的区域，长度为 0 表示没有
+	block      VixDiskLibBlock      // Next 返回 true 后的当前区域
+	err        VddkError
+	windowSize VixDiskLibSectorType
+}
+
+// NewAllocatedBlockIterator 返回遍历 querier 中从 startSector 开始 numSectors 个扇区内已分配区域的迭代器。
+// capacity 是磁盘容量（扇区），超出容量的部分会被忽略。chunkSize 必须在 VIXDISKLIB_MIN_CHUNK_SIZE 和
+// VIXDISKLIB_MAX_CHUNK_SIZE 之间，startSector 必须是 chunkSize 的整数倍。
+func NewAllocatedBlockIterator(querier BlockQuerier, startSector VixDiskLibSectorType, numSectors VixDiskLibSectorType,
+	chunkSize VixDiskLibSectorType, capacity VixDiskLibSectorType) (*AllocatedBlockIterator, VddkError) {
+	if chunkSize < VIXDISKLIB_MIN_CHUNK_SIZE || chunkSize > VIXDISKLIB_MAX_CHUNK_SIZE {
+		return nil, NewVddkError(VIX_E_INVALID_ARG, fmt.Sprintf("Chunk size %d is not between %d and %d. The error code is %d.",
+			chunkSize, VIXDISKLIB_MIN_CHUNK_SIZE, VIXDISKLIB_MAX_CHUNK_SIZE, VIX_E_INVALID_ARG))
+	}
+	if startSector%chunkSize != 0 {
+		return nil, NewVddkError(VIX_E_INVALID_ARG, fmt.Sprintf(
+			"Start sector %d is not a multiple of the chunk size %d. The error code is %d.", startSector, chunkSize, VIX_E_INVALID_ARG))
+	}
+	end := capacity
+	if startSector < capacity && numSectors < capacity-startSector {
+		end = startSector + numSectors
+	}
+	return &AllocatedBlockIterator{
+		querier:    querier,
+		chunkSize:  chunkSize,
+		capacity:   capacity,
+		end:        end,
+		next:       startSector,
+		windowSize: chunkSize * VIXDISKLIB_MAX_CHUNK_NUMBER,
+	}, nil
+}
+
+// Next 前进到下一个已分配区域，没有更多区域或者出错时返回 false。
+func (this *AllocatedBlockIterator) Next() bool {
+	if this.err != nil {
+		return false
+	}
+	for {
+		if len(this.pending) == 0 && this.next < this.end {
+			if this.err = this.queryWindow(); this.err != nil {
+				return false
+			}
+			continue
+		}
+		if len(this.pending) == 0 {
+			// 所有窗口都已查询，返回最后一个合并中的区域
+			if this.merged.Length() == 0 {
+				return false
+			}
+			this.block, this.merged = this.merged, VixDiskLibBlock{}
+			return true
+		}
+		block := this.pending[0]
+		this.pending = this.pending[1:]
+		if this.merged.Length() == 0 {
+			this.merged = block
+			continue
+		}
+		if this.merged.Offset()+this.merged.Length() >= block.Offset() {
+			this.merged.SetLength(block.Offset() + block.Length() - this.merged.Offset())
+			continue
+		}
+		this.block, this.merged = this.merged, block
+		return true
+	}
+}
+
+// Block 返回当前的已分配区域，只在 Next 返回 true 之后有效。
+func (this *AllocatedBlockIterator) Block() VixDiskLibBlock {
+	return this.block
+}
+
+// Err 返回遍历中遇到的错误。
+func (this *AllocatedBlockIterator) Err() VddkError {
+	return this.err
+}
+
+// queryWindow 查询下一个窗口，并将结果裁剪到遍历范围内。
+func (this *AllocatedBlockIterator) queryWindow() VddkError {
+	start := this.next
+	numSectors := this.windowSize
+	if numSectors > this.end-start {
+		numSectors = this.end - start
+		// 只有到达磁盘末尾时扇区数才可以不按块对齐
+		if rem := numSectors % this.chunkSize; rem != 0 {
+			numSectors = numSectors + this.chunkSize - rem
+		}
+		if numSectors > this.capacity-start {
+			numSectors = this.capacity - start
+		}
+	}
+	blocks, vErr := this.querier.QueryAllocatedBlocks(start, numSectors, this.chunkSize)
+	if vErr != nil {
+		return vErr
+	}
+	this.next = start + numSectors
+	this.pending = this.pending[:0]
+	for _, block := range blocks {
+		offset, blockEnd := block.Offset(), block.Offset()+block.Length()
+		if offset < start {
+			offset = start
+		}
+		if blockEnd > this.end {
+			blockEnd = this.end
+		}
+		if blockEnd <= offset {
+			continue
+		}
+		block.SetOffset(offset)
+		block.SetLength(blockEnd - offset)
+		this.pending = append(this.pending, block)
+	}
+	return nil
+}
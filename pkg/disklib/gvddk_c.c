@@ -1,31 +1,67 @@
+//go:build !novddk
+// +build !novddk
+
 #include "gvddk_c.h"
 #include <string.h>
+#include <stdlib.h>
+#include <stdarg.h>
+
+// logMessage 格式化 VDDK 的日志信息并交给 Go 侧的 GoLog 按级别记录。
+static void logMessage(int level, const char *fmt, va_list args)
+{
+    va_list copy;
+    va_copy(copy, args);
+    int len = vsnprintf(NULL, 0, fmt, copy);
+    va_end(copy);
+    if (len < 0) {
+        return;
+    }
+    char *buf = malloc(len + 1);
+    if (buf == NULL) {
+        return;
+    }
+    vsnprintf(buf, len + 1, fmt, args);
+    GoLog(level, buf);
+    free(buf);
+}
 
 // 日志记录函数
 void LogFunc(const char *fmt, va_list args)
 {
-    char *buf = malloc(1024);           // 这里创建了一个缓冲区并使用 sprintf 格式化日志消息。
-    sprintf(buf, fmt, args);
-    GoLogWarn(buf);                     // GoLogWarn 应该是 Go 中的记录日志的函数。
+    logMessage(VDDK_LOG_LOG, fmt, args);
+}
+
+// 警告记录函数
+void WarnFunc(const char *fmt, va_list args)
+{
+    logMessage(VDDK_LOG_WARN, fmt, args);
 }
 
-// ProgressFunc 函数用于处理进度回调。在此只是简单地返回true。
+// PanicFunc 记录 VDDK 的致命错误。VDDK 要求 panic 函数不能返回，因此记录之后终止进程。
+void PanicFunc(const char *fmt, va_list args)
+{
+    logMessage(VDDK_LOG_PANIC, fmt, args);
+    abort();
+}
+
+// ProgressFunc 函数用于处理进度回调。progressData 中保存的是 Go 侧登记的回调编号，
+// 由 GoProgressFunc 找到对应的 Go 回调，返回 false 时 VDDK 会取消当前操作。
 bool ProgressFunc(void *progressData, int percentCompleted)
 {
-    return true;
+    return GoProgressFunc((uintptr_t)progressData, percentCompleted);
 }
 
 // Init函数用于初始化VixDiskLib库。
 VixError Init(uint32 major, uint32 minor, char* libDir)
 {
-    VixError result = VixDiskLib_Init(major, minor, NULL, NULL, NULL, libDir);
+    VixError result = VixDiskLib_Init(major, minor, LogFunc, WarnFunc, PanicFunc, libDir);
     return result;
 }
 
 // 带额外信息的初始化
 VixError InitEx(uint32 major, uint32 minor, char* libDir, char* configFile)
 {
-    VixError result = VixDiskLib_InitEx(major, minor, NULL, NULL, NULL, libDir, configFile);
+    VixError result = VixDiskLib_InitEx(major, minor, LogFunc, WarnFunc, PanicFunc, libDir, configFile);
     return result;
 }
 
@@ -37,9 +73,9 @@ VixError Connect(VixDiskLibConnectParams *cnxParams, VixDiskLibConnection *conne
 }
 
 // 带额外信息的连接虚拟磁盘
-VixError ConnectEx(VixDiskLibConnectParams *cnxParams, bool readOnly, char* transportModes, VixDiskLibConnection *connection) {
+VixError ConnectEx(VixDiskLibConnectParams *cnxParams, bool readOnly, char* snapshotRef, char* transportModes, VixDiskLibConnection *connection) {
     VixError vixError;
-    vixError = VixDiskLib_ConnectEx(cnxParams, readOnly, "", transportModes, connection);
+    vixError = VixDiskLib_ConnectEx(cnxParams, readOnly, snapshotRef, transportModes, connection);
     return vixError;
 }
 
@@ -84,24 +120,24 @@ void Params_helper(VixDiskLibConnectParams *cnxParams, char* arg1, char* arg2, c
     return;
 }
 
-VixError Create(VixDiskLibConnection connection, char *path, VixDiskLibCreateParams *createParams, void *progressCallbackData)
+VixError Create(VixDiskLibConnection connection, char *path, VixDiskLibCreateParams *createParams, uintptr_t progressId)
 {
     VixError vixError;
-    vixError = VixDiskLib_Create(connection, path, createParams, (VixDiskLibProgressFunc)&ProgressFunc, progressCallbackData);
+    vixError = VixDiskLib_Create(connection, path, createParams, (VixDiskLibProgressFunc)&ProgressFunc, (void *)progressId);
     return vixError;
 }
 
-VixError CreateChild(VixDiskLibHandle diskHandle, char *childPath, VixDiskLibDiskType diskType, void *progressCallbackData)
+VixError CreateChild(VixDiskLibHandle diskHandle, char *childPath, VixDiskLibDiskType diskType, uintptr_t progressId)
 {
     VixError vixError;
-    vixError = VixDiskLib_CreateChild(diskHandle, childPath, diskType, (VixDiskLibProgressFunc)&ProgressFunc, progressCallbackData);
+    vixError = VixDiskLib_CreateChild(diskHandle, childPath, diskType, (VixDiskLibProgressFunc)&ProgressFunc, (void *)progressId);
     return vixError;
 }
 
-VixError Defragment(VixDiskLibHandle diskHandle, void *progressCallbackData)
+VixError Defragment(VixDiskLibHandle diskHandle, uintptr_t progressId)
 {
     VixError vixError;
-    vixError = VixDiskLib_Defragment(diskHandle, (VixDiskLibProgressFunc)&ProgressFunc, progressCallbackData);
+    vixError = VixDiskLib_Defragment(diskHandle, (VixDiskLibProgressFunc)&ProgressFunc, (void *)progressId);
     return vixError;
 }
 
@@ -112,17 +148,17 @@ VixError GetInfo(VixDiskLibHandle diskHandle, VixDiskLibInfo *info)
     return error;
 }
 
-VixError Grow(VixDiskLibConnection connection, char* path, VixDiskLibSectorType capacity, bool updateGeometry, void *progressCallbackData)
+VixError Grow(VixDiskLibConnection connection, char* path, VixDiskLibSectorType capacity, bool updateGeometry, uintptr_t progressId)
 {
     VixError error;
-    error = VixDiskLib_Grow(connection, path, capacity, updateGeometry, (VixDiskLibProgressFunc)&ProgressFunc, progressCallbackData);
+    error = VixDiskLib_Grow(connection, path, capacity, updateGeometry, (VixDiskLibProgressFunc)&ProgressFunc, (void *)progressId);
     return error;
 }
 
-VixError Shrink(VixDiskLibHandle diskHandle, void *progressCallbackData)
+VixError Shrink(VixDiskLibHandle diskHandle, uintptr_t progressId)
 {
     VixError error;
-    error = VixDiskLib_Shrink(diskHandle, (VixDiskLibProgressFunc)&ProgressFunc, progressCallbackData);
+    error = VixDiskLib_Shrink(diskHandle, (VixDiskLibProgressFunc)&ProgressFunc, (void *)progressId);
     return error;
 }
 
@@ -140,18 +176,18 @@ VixError Cleanup(VixDiskLibConnectParams *connectParams, uint32 numCleanedUp, ui
     return error;
 }
 
-VixError GetMetadataKeys(VixDiskLibHandle diskHandle, char *buf, size_t bufLen, size_t required)
+VixError GetMetadataKeys(VixDiskLibHandle diskHandle, char *buf, size_t bufLen, size_t *required)
 {
     VixError error;
-    error = VixDiskLib_GetMetadataKeys(diskHandle, buf, bufLen, &required);
+    error = VixDiskLib_GetMetadataKeys(diskHandle, buf, bufLen, required);
     return error;
 }
 
 VixError Clone(VixDiskLibConnection dstConn, char *dstPath, VixDiskLibConnection srcConn, char *srcPath, VixDiskLibCreateParams *createParams,
-               void *progressCallbackData, bool overWrite)
+               uintptr_t progressId, bool overWrite)
 {
     VixError error;
-    error = VixDiskLib_Clone(dstConn, dstPath, srcConn, srcPath, createParams, (VixDiskLibProgressFunc)&ProgressFunc, progressCallbackData, overWrite);
+    error = VixDiskLib_Clone(dstConn, dstPath, srcConn, srcPath, createParams, (VixDiskLibProgressFunc)&ProgressFunc, (void *)progressId, overWrite);
     return error;
 }
 
@@ -194,3 +230,30 @@ VixError BlockListCopyAndFree(BlockListDescriptor *bld,  VixDiskLibBlock *ba)
 
     return VixDiskLib_FreeBlockList(bl);
 }
+
+/*
+ * CompletionCB 函数用于处理异步读写的完成回调。cbData 中保存的是 Go 侧登记的请求编号，
+ * 由 GoAsyncCompletion 找到对应的请求并通知 Go。
+ */
+void CompletionCB(void *cbData, VixError result)
+{
+    GoAsyncCompletion((uintptr_t)cbData, result);
+}
+
+/*
+ * ReadAsync 提交一个异步读请求，请求完成前 readBuffer 必须保持有效。
+ */
+VixError ReadAsync(VixDiskLibHandle diskHandle, VixDiskLibSectorType startSector, VixDiskLibSectorType numSectors,
+                   uint8 *readBuffer, uintptr_t asyncId)
+{
+    return VixDiskLib_ReadAsync(diskHandle, startSector, numSectors, readBuffer, &CompletionCB, (void *)asyncId);
+}
+
+/*
+ * WriteAsync 提交一个异步写请求，请求完成前 writeBuffer 必须保持有效。
+ */
+VixError WriteAsync(VixDiskLibHandle diskHandle, VixDiskLibSectorType startSector, VixDiskLibSectorType numSectors,
+                    uint8 *writeBuffer, uintptr_t asyncId)
+{
+    return VixDiskLib_WriteAsync(diskHandle, startSector, numSectors, writeBuffer, &CompletionCB, (void *)asyncId);
+}
@@ -1,5 +1,6 @@
 #include <stdio.h>
 #include <stdbool.h>
+#include <stdint.h>
 #include "vixDiskLib.h"
 
 typedef struct {
@@ -12,27 +13,40 @@ typedef struct {
     void*  blockList; /* opaque to Go */
 } BlockListDescriptor;
 
+#define VDDK_LOG_LOG   0
+#define VDDK_LOG_WARN  1
+#define VDDK_LOG_PANIC 2
+
 void LogFunc(const char *fmt, va_list args);
-void GoLogWarn(char * msg);
+void WarnFunc(const char *fmt, va_list args);
+void PanicFunc(const char *fmt, va_list args);
+void GoLog(int level, char *msg);
+bool GoProgressFunc(uintptr_t progressId, int percentCompleted);
+void GoAsyncCompletion(uintptr_t asyncId, VixError result);
 VixError Init(uint32 major, uint32 minor, char* libDir);
 VixError InitEx(uint32 major, uint32 minor, char* libDir, char* configFile);
 VixError Connect(VixDiskLibConnectParams *cnxParams, VixDiskLibConnection *connection);
-VixError ConnectEx(VixDiskLibConnectParams *cnxParams, bool readOnly, char* transportModes, VixDiskLibConnection *connection);
+VixError ConnectEx(VixDiskLibConnectParams *cnxParams, bool readOnly, char* snapshotRef, char* transportModes, VixDiskLibConnection *connection);
 DiskHandle Open(VixDiskLibConnection conn, char* path, uint32 flags);
 VixError PrepareForAccess(VixDiskLibConnectParams *cnxParams, char* identity);
 void Params_helper(VixDiskLibConnectParams *cnxParams, char* arg1, char* arg2, char* arg3, bool isFcd, bool isSession);
-VixError Create(VixDiskLibConnection connection, char *path, VixDiskLibCreateParams *createParams, void *progressCallbackData);
+VixError Create(VixDiskLibConnection connection, char *path, VixDiskLibCreateParams *createParams, uintptr_t progressId);
 bool ProgressFunc(void *progressData, int percentCompleted);
-VixError CreateChild(VixDiskLibHandle diskHandle, char *childPath, VixDiskLibDiskType diskType, void *progressCallbackData);
-VixError Defragment(VixDiskLibHandle diskHandle, void *progressCallbackData);
+VixError CreateChild(VixDiskLibHandle diskHandle, char *childPath, VixDiskLibDiskType diskType, uintptr_t progressId);
+VixError Defragment(VixDiskLibHandle diskHandle, uintptr_t progressId);
 VixError GetInfo(VixDiskLibHandle diskHandle, VixDiskLibInfo *info);
-VixError Grow(VixDiskLibConnection connection, char* path, VixDiskLibSectorType capacity, bool updateGeometry, void *progressCallbackData);
-VixError Shrink(VixDiskLibHandle diskHandle, void *progressCallbackData);
+VixError Grow(VixDiskLibConnection connection, char* path, VixDiskLibSectorType capacity, bool updateGeometry, uintptr_t progressId);
+VixError Shrink(VixDiskLibHandle diskHandle, uintptr_t progressId);
 VixError CheckRepair(VixDiskLibConnection connection, char *file, bool repair);
 VixError Cleanup(VixDiskLibConnectParams *connectParams, uint32 numCleanedUp, uint32 numRemaining);
-VixError GetMetadataKeys(VixDiskLibHandle diskHandle, char *buf, size_t bufLen, size_t required);
+VixError GetMetadataKeys(VixDiskLibHandle diskHandle, char *buf, size_t bufLen, size_t *required);
 VixError Clone(VixDiskLibConnection dstConn, char *dstPath, VixDiskLibConnection srcConn, char *srcPath, VixDiskLibCreateParams *createParams,
-               void *progressCallbackData, bool overWrite);
+               uintptr_t progressId, bool overWrite);
 VixError QueryAllocatedBlocks(VixDiskLibHandle diskHandle, VixDiskLibSectorType startSector,
                               VixDiskLibSectorType numSectors, VixDiskLibSectorType chunkSize, BlockListDescriptor *bld);
+void CompletionCB(void *cbData, VixError result);
+VixError ReadAsync(VixDiskLibHandle diskHandle, VixDiskLibSectorType startSector, VixDiskLibSectorType numSectors,
+                   uint8 *readBuffer, uintptr_t asyncId);
+VixError WriteAsync(VixDiskLibHandle diskHandle, VixDiskLibSectorType startSector, VixDiskLibSectorType numSectors,
+                    uint8 *writeBuffer, uintptr_t asyncId);
 VixError BlockListCopyAndFree(BlockListDescriptor *bld, VixDiskLibBlock *ba);
@@ -0,0 +1,687 @@
+//go:build !novddk
+// +build !novddk
+
+package disklib
+// #cgo 指令用于配置与C语言的互操作性
+// LDFLAGS 用于指定链接器标志，CFLAGS 用于指定编译器标志
+
+// #cgo LDFLAGS: -L/usr/local/vmware-vix-disklib-distrib/lib64 -lvixDiskLib
+// #cgo CFLAGS: -I/usr/local/vmware-vix-disklib-distrib/include
+// #include "gvddk_c.h"
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// 声明用于打开磁盘的标志常量
+const (
+	VIXDISKLIB_FLAG_OPEN_UNBUFFERED         = C.VIXDISKLIB_FLAG_OPEN_UNBUFFERED
+	VIXDISKLIB_FLAG_OPEN_SINGLE_LINK        = C.VIXDISKLIB_FLAG_OPEN_SINGLE_LINK
+	VIXDISKLIB_FLAG_OPEN_READ_ONLY          = C.VIXDISKLIB_FLAG_OPEN_READ_ONLY
+	VIXDISKLIB_FLAG_OPEN_COMPRESSION_ZLIB   = C.VIXDISKLIB_FLAG_OPEN_COMPRESSION_ZLIB
+	VIXDISKLIB_FLAG_OPEN_COMPRESSION_FASTLZ = C.VIXDISKLIB_FLAG_OPEN_COMPRESSION_FASTLZ
+	VIXDISKLIB_FLAG_OPEN_COMPRESSION_SKIPZ  = C.VIXDISKLIB_FLAG_OPEN_COMPRESSION_SKIPZ
+	VIXDISKLIB_FLAG_OPEN_COMPRESSION_MASK   = C.VIXDISKLIB_FLAG_OPEN_COMPRESSION_MASK
+)
+
+// 声明扇区大小的常量
+const VIXDISKLIB_SECTOR_SIZE = C.VIXDISKLIB_SECTOR_SIZE
+
+// 定义块的常量
+const VIXDISKLIB_MIN_CHUNK_SIZE = C.VIXDISKLIB_MIN_CHUNK_SIZE
+const VIXDISKLIB_MAX_CHUNK_SIZE = C.VIXDISKLIB_MAX_CHUNK_SIZE
+const VIXDISKLIB_MAX_CHUNK_NUMBER = C.VIXDISKLIB_MAX_CHUNK_NUMBER
+
+// 声明错误代码的常量
+const (
+	VIX_E_FAIL                = C.VIX_E_FAIL
+	VIX_E_INVALID_ARG         = C.VIX_E_INVALID_ARG
+	VIX_E_FILE_NOT_FOUND      = C.VIX_E_FILE_NOT_FOUND
+	VIX_E_NOT_SUPPORTED       = C.VIX_E_NOT_SUPPORTED
+	VIX_E_CANCELLED           = C.VIX_E_CANCELLED
+	VIX_ASYNC                 = C.VIX_ASYNC
+	VIX_E_FILE_READ_ONLY      = C.VIX_E_FILE_READ_ONLY
+	VIX_E_FILE_ALREADY_EXISTS = C.VIX_E_FILE_ALREADY_EXISTS
+	VIX_E_BUFFER_TOOSMALL     = C.VIX_E_BUFFER_TOOSMALL
+	VIX_E_DISK_OUTOFRANGE     = C.VIX_E_DISK_OUTOFRANGE
+	VIX_E_DISK_FULL           = C.VIX_E_DISK_FULL
+	VIX_E_FILE_ACCESS_ERROR   = C.VIX_E_FILE_ACCESS_ERROR
+)
+
+// 网络和主机连接错误的常量，ConnectionPool 遇到这些错误时重新连接
+const (
+	VIX_E_HOST_NETWORK_CONN_REFUSED = C.VIX_E_HOST_NETWORK_CONN_REFUSED
+	VIX_E_HOST_TCP_SOCKET_ERROR     = C.VIX_E_HOST_TCP_SOCKET_ERROR
+	VIX_E_HOST_TCP_CONN_LOST        = C.VIX_E_HOST_TCP_CONN_LOST
+	VIX_E_HOST_SERVER_SHUTDOWN      = C.VIX_E_HOST_SERVER_SHUTDOWN
+	VIX_E_HOST_SERVER_NOT_AVAILABLE = C.VIX_E_HOST_SERVER_NOT_AVAILABLE
+	VIX_E_CANNOT_CONNECT_TO_HOST    = C.VIX_E_CANNOT_CONNECT_TO_HOST
+)
+
+// 磁盘类型
+const (
+	VIXDISKLIB_DISK_MONOLITHIC_SPARSE VixDiskLibDiskType = C.VIXDISKLIB_DISK_MONOLITHIC_SPARSE // monolithic file, sparse,
+	VIXDISKLIB_DISK_MONOLITHIC_FLAT   VixDiskLibDiskType = C.VIXDISKLIB_DISK_MONOLITHIC_FLAT   // monolithic file, all space pre-allocated
+	VIXDISKLIB_DISK_SPLIT_SPARSE      VixDiskLibDiskType = C.VIXDISKLIB_DISK_SPLIT_SPARSE      // disk split into 2GB extents, sparse
+	VIXDISKLIB_DISK_SPLIT_FLAT        VixDiskLibDiskType = C.VIXDISKLIB_DISK_SPLIT_FLAT        // disk split into 2GB extents, pre-allocated
+	VIXDISKLIB_DISK_VMFS_FLAT         VixDiskLibDiskType = C.VIXDISKLIB_DISK_VMFS_FLAT         // ESX 3.0 and above flat disks
+	VIXDISKLIB_DISK_STREAM_OPTIMIZED  VixDiskLibDiskType = C.VIXDISKLIB_DISK_STREAM_OPTIMIZED  // compressed monolithic sparse
+	VIXDISKLIB_DISK_VMFS_THIN         VixDiskLibDiskType = C.VIXDISKLIB_DISK_VMFS_THIN         // ESX 3.0 and above thin provisioned
+	VIXDISKLIB_DISK_VMFS_SPARSE       VixDiskLibDiskType = C.VIXDISKLIB_DISK_VMFS_SPARSE       // ESX 3.0 and above sparse disks
+	VIXDISKLIB_DISK_UNKNOWN           VixDiskLibDiskType = C.VIXDISKLIB_DISK_UNKNOWN           // unknown type
+)
+
+// 适配器类型
+const (
+	VIXDISKLIB_ADAPTER_IDE           VixDiskLibAdapterType = C.VIXDISKLIB_ADAPTER_IDE
+	VIXDISKLIB_ADAPTER_SCSI_BUSLOGIC VixDiskLibAdapterType = C.VIXDISKLIB_ADAPTER_SCSI_BUSLOGIC
+	VIXDISKLIB_ADAPTER_SCSI_LSILOGIC VixDiskLibAdapterType = C.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC
+	VIXDISKLIB_ADAPTER_SCSI_LSISAS   VixDiskLibAdapterType = C.VIXDISKLIB_ADAPTER_SCSI_LSISAS
+	VIXDISKLIB_ADAPTER_SCSI_PVSCSI   VixDiskLibAdapterType = C.VIXDISKLIB_ADAPTER_SCSI_PVSCSI
+	VIXDISKLIB_ADAPTER_NVME          VixDiskLibAdapterType = C.VIXDISKLIB_ADAPTER_NVME
+	VIXDISKLIB_ADAPTER_UNKNOWN       VixDiskLibAdapterType = C.VIXDISKLIB_ADAPTER_UNKNOWN
+)
+
+// vddkBackend 是直接调用 VixDiskLib 的默认后端。
+type vddkBackend struct{}
+
+// newDefaultBackend 返回使用 VDDK 构建时的默认后端。
+func newDefaultBackend() Backend {
+	return vddkBackend{}
+}
+
+// cHandle 取出句柄中的 C 磁盘句柄。
+func cHandle(diskHandle VixDiskLibHandle) C.VixDiskLibHandle {
+	dli, _ := diskHandle.dli.(C.VixDiskLibHandle)
+	return dli
+}
+
+// cConnection 取出连接中的 C 连接对象。
+func cConnection(connection VixDiskLibConnection) C.VixDiskLibConnection {
+	conn, _ := connection.conn.(C.VixDiskLibConnection)
+	return conn
+}
+
+// GoLog 是供 C 侧 LogFunc、WarnFunc 和 PanicFunc 调用的跳板函数，将 VDDK 的信息按级别转发给 logrus。
+//export GoLog
+func GoLog(level C.int, buf *C.char) {
+	logVddkMessage(int(level), C.GoString(buf))
+}
+
+// GoProgressFunc 是供 C 侧 ProgressFunc 调用的跳板函数，根据回调编号找到登记的 Go 回调并转发进度。
+//export GoProgressFunc
+func GoProgressFunc(progressId C.uintptr_t, percentCompleted C.int) C._Bool {
+	return C._Bool(invokeProgress(uintptr(progressId), int(percentCompleted)))
+}
+
+// Init 函数用于初始化虚拟磁盘库（虚拟磁盘库主版本号，次版本号，库路径）
+func (vddkBackend) Init(majorVersion uint32, minorVersion uint32, dir string) VddkError {
+	// 将 Go 字符串转换为 C 字符串
+	libDir := C.CString(dir)
+	// 延迟，用于释放字符串内存
+	defer C.free(unsafe.Pointer(libDir))
+	// 调用 C 库中的初始化函数，返回错误码
+	result := C.Init(C.uint32(majorVersion), C.uint32(minorVersion), libDir)
+	if result != 0 {
+		return NewVddkError(uint64(result), fmt.Sprintf("Initialize failed. The error code is %d.", result))
+	}
+	return nil
+}
+
+// InitEx 函数类似于 Init，但还接受配置文件作为参数（虚拟磁盘库主版本号，次版本号，库路径，配置文件路径）
+func (vddkBackend) InitEx(majorVersion uint32, minorVersion uint32, dir string, configFile string) VddkError {
+	var result C.VixError
+	libDir := C.CString(dir)
+	defer C.free(unsafe.Pointer(libDir))
+	if configFile == "" {
+		// 如果 configFile 为空，则执行与 Init 函数相同的初始化操作。
+		result = C.Init(C.uint32(majorVersion), C.uint32(minorVersion), libDir)
+	} else {
+		// 如果提供了配置文件，调用 C.InitEx 函数执行初始化。
+		config := C.CString(configFile)
+		defer C.free(unsafe.Pointer(config))
+		result = C.InitEx(C.uint32(majorVersion), C.uint32(minorVersion), libDir, config)
+	}
+	// 判断是否初始化成功
+	if result != 0 {
+		return NewVddkError(uint64(result), fmt.Sprintf("Initialize failed. The error code is %d.", result))
+	}
+	return nil
+}
+
+// prepareConnectParams 函数用于准备连接虚拟磁盘所需的参数（全局参数）（指向连接参数的指针，全局参数的切片）
+func prepareConnectParams(appGlobal ConnectParams) (*C.VixDiskLibConnectParams, []*C.char) {
+	// 将 Go 字符串转换为 C 字符串
+	vmxSpec := C.CString(appGlobal.vmxSpec)
+	serverName := C.CString(appGlobal.serverName)
+	thumbPrint := C.CString(appGlobal.thumbPrint)
+	userName := C.CString(appGlobal.userName)
+	password := C.CString(appGlobal.password)
+	fcdId := C.CString(appGlobal.fcdId)
+	ds := C.CString(appGlobal.ds)
+	fcdssId := C.CString(appGlobal.fcdssId)
+	cookie := C.CString(appGlobal.cookie)
+	// 将上述 C 字符串添加到切片中
+	var cParams = []*C.char{vmxSpec, serverName, thumbPrint, userName, password, fcdId, ds, fcdssId, cookie}
+	// 创建一个连接参数结构体的指针 cnxParams，并分配内存
+	var cnxParams *C.VixDiskLibConnectParams = C.VixDiskLib_AllocateConnectParams()
+	// 根据 appGlobal 中的参数，设置 cnxParams 结构体的各个字段，以构造连接参数。
+	if appGlobal.fcdId != "" {
+		cnxParams.specType = C.VIXDISKLIB_SPEC_VSTORAGE_OBJECT
+		C.Params_helper(cnxParams, fcdId, ds, fcdssId, true, false)
+	} else if appGlobal.vmxSpec != "" {
+		cnxParams.specType = C.VIXDISKLIB_SPEC_VMX
+		cnxParams.vmxSpec = vmxSpec
+	}
+	cnxParams.thumbPrint = thumbPrint
+	cnxParams.serverName = serverName
+	if appGlobal.cookie == "" {
+		cnxParams.credType = C.VIXDISKLIB_CRED_UID
+		C.Params_helper(cnxParams, cookie, userName, password, false, false)
+	} else {
+		cnxParams.credType = C.VIXDISKLIB_CRED_SESSIONID
+		C.Params_helper(cnxParams, cookie, userName, password, false, true)
+	}
+	// 将 cnxParams 和 cParams 返回，以便在调用方使用它们进行虚拟磁盘连接。
+	return cnxParams, cParams
+}
+
+// freeParams 函数用于释放 C 字符串数组。（参数切片）
+func freeParams(params []*C.char) {
+	for i, _ := range params {
+		C.free(unsafe.Pointer(params[i]))
+	}
+	return
+}
+
+// Connect 函数用于连接虚拟磁盘。（连接参数）（虚拟磁盘连接信息对象，错误码）
+func (vddkBackend) Connect(appGlobal ConnectParams) (VixDiskLibConnection, VddkError) {
+	var connection C.VixDiskLibConnection
+	// 准备连接虚拟磁盘所需的参数。这个函数会返回指向连接参数的指针 cnxParams 和全局参数的切片 toFree。
+	cnxParams, toFree := prepareConnectParams(appGlobal)
+	defer freeParams(toFree)
+	// 利用连接参数 cnxParams ，连接对象的指针 &connection 尝试连接
+	err := C.Connect(cnxParams, &connection)
+	if err != 0 {
+		return VixDiskLibConnection{}, NewVddkError(uint64(err), fmt.Sprintf("Connect failed. The error code is %d.", err))
+	}
+	// 如果连接成功，则返回一个 VixDiskLibConnection 对象，其中包含了连接的相关信息。
+	return VixDiskLibConnection{conn: connection}, nil
+}
+
+// ConnectEx 函数类似于 Connect，但还接受连接模式作为参数。（连接参数）（虚拟磁盘连接信息对象，错误码）
+func (vddkBackend) ConnectEx(appGlobal ConnectParams) (VixDiskLibConnection, VddkError) {
+	var connection C.VixDiskLibConnection
+	cnxParams, toFree := prepareConnectParams(appGlobal)
+	defer freeParams(toFree)
+	modes := C.CString(appGlobal.mode)
+	defer C.free(unsafe.Pointer(modes))
+	// snapshotRef 为空时访问虚拟机的当前磁盘，否则访问该快照中的磁盘
+	snapshotRef := C.CString(appGlobal.snapshotRef)
+	defer C.free(unsafe.Pointer(snapshotRef))
+	// 传递连接参数 cnxParams、只读标志 readOnly、快照 snapshotRef、连接模式 modes，以及连接对象的指针 &connection。
+	err := C.ConnectEx(cnxParams, C._Bool(appGlobal.readOnly), snapshotRef, modes, &connection)
+	if err != 0 {
+		return VixDiskLibConnection{}, NewVddkError(uint64(err), fmt.Sprintf("ConnectEx failed. The error code is %d.", err))
+	}
+	// 如果连接成功，则返回一个 VixDiskLibConnection 对象，其中包含了连接的相关信息。
+	return VixDiskLibConnection{conn: connection}, nil
+}
+
+// PrepareForAccess 准备虚拟磁盘以进行访问。（全局参数）
+func (vddkBackend) PrepareForAccess(appGlobal ConnectParams) VddkError {
+	// 将 Go 字符串转换为 C 字符串
+	name := C.CString(appGlobal.identity)
+	defer C.free(unsafe.Pointer(name))
+	// 获取连接参数
+	cnxParams, toFree := prepareConnectParams(appGlobal)
+	defer freeParams(toFree)
+	// 调用 C 库中的 PrepareForAccess 函数
+	result := C.PrepareForAccess(cnxParams, name)
+	if result != 0 {
+		return NewVddkError(uint64(result), fmt.Sprintf("Prepare for access failed. The error code is %d.", result))
+	}
+	// 准备访问操作成功
+	return nil
+}
+
+// open 打开虚拟磁盘。（虚拟磁盘连接信息，连接参数）（虚拟磁盘句柄）
+func (vddkBackend) Open(conn VixDiskLibConnection, params ConnectParams) (VixDiskLibHandle, VddkError) {
+	// 虚拟磁盘句柄，用于表示对虚拟磁盘文件的操作，如打开、读取、写入、关闭等。
+	var dli VixDiskLibHandle
+	filePath := C.CString(params.path)
+	defer C.free(unsafe.Pointer(filePath))
+	// 调用 C 库中的 Open 函数
+	res := C.Open(cConnection(conn), filePath, C.uint32(params.flag))
+	dli.dli = res.dli
+	if res.err != 0 {
+		return dli, NewVddkError(uint64(res.err), fmt.Sprintf("Open virtual disk file failed. The error code is %d.", res.err))
+	}
+	return dli, nil
+}
+
+// 结束虚拟磁盘的访问。
+func (vddkBackend) EndAccess(appGlobal ConnectParams) VddkError {
+	name := C.CString(appGlobal.identity)
+	defer C.free(unsafe.Pointer(name))
+	cnxParams, toFree := prepareConnectParams(appGlobal)
+	// 调用 C 库中的 VixDiskLib_EndAccess 函数
+	result := C.VixDiskLib_EndAccess(cnxParams, name)
+	freeParams(toFree)
+	if result != 0 {
+		return NewVddkError(uint64(result), fmt.Sprintf("End access failed. The error code is %d.", result))
+	}
+	return nil
+}
+
+// 断开虚拟磁盘连接。
+func (vddkBackend) Disconnect(connection VixDiskLibConnection) VddkError {
+	res := C.VixDiskLib_Disconnect(cConnection(connection))
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Disconnect failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 退出虚拟磁盘库。
+func (vddkBackend) Exit() {
+	C.VixDiskLib_Exit()
+}
+
+// 将子磁盘链附加到父磁盘链。
+func (vddkBackend) Attach(childHandle VixDiskLibHandle, parentHandle VixDiskLibHandle) VddkError {
+	res := C.VixDiskLib_Attach(cHandle(childHandle), cHandle(parentHandle))
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Attach child disk chain to the parent disk chain failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 检查或修复虚拟磁盘文件。
+func (vddkBackend) CheckRepair(connection VixDiskLibConnection, filename string, repair bool) VddkError {
+	file := C.CString(filename)
+	defer C.free(unsafe.Pointer(file))
+	res := C.CheckRepair(cConnection(connection), file, C._Bool(repair))
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Check repair failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 清理虚拟磁盘连接。
+func (vddkBackend) Cleanup(appGlobal ConnectParams, numCleanUp uint32, numRemaining uint32) VddkError {
+	cnxParams, toFree := prepareConnectParams(appGlobal)
+	defer freeParams(toFree)
+	res := C.Cleanup(cnxParams, C.uint32(numCleanUp), C.uint32(numRemaining))
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Clean up failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 克隆虚拟磁盘。（目标虚拟磁盘的连接，目标虚拟磁盘的路径，源虚拟磁盘的连接，源虚拟磁盘的路径，虚拟磁盘的创建参数，进度回调数据，是否覆盖目标虚拟磁盘）
+func (vddkBackend) Clone(dstConnection VixDiskLibConnection, dstPath string, srcConnection VixDiskLibConnection, srcPath string,
+	params VixDiskLibCreateParams, progress ProgressFunc, overWrite bool) VddkError {
+	dst := C.CString(dstPath)
+	defer C.free(unsafe.Pointer(dst))
+	src := C.CString(srcPath)
+	defer C.free(unsafe.Pointer(src))
+	createParams := prepareCreateParams(params)
+	progressId := registerProgress(progress)
+	defer unregisterProgress(progressId)
+	res := C.Clone(cConnection(dstConnection), dst, cConnection(srcConnection), src, createParams, C.uintptr_t(progressId), C._Bool(overWrite))
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Clone a virtual disk failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 准备虚拟磁盘的创建参数。（包含虚拟磁盘信息的参数结构体）
+// 结构体中没有 Go 指针，可以直接将其地址传给 C 函数。
+func prepareCreateParams(createSpec VixDiskLibCreateParams) *C.VixDiskLibCreateParams {
+	createParams := &C.VixDiskLibCreateParams{}
+	createParams.diskType = C.VixDiskLibDiskType(createSpec.diskType)
+	createParams.adapterType = C.VixDiskLibAdapterType(createSpec.adapterType)
+	createParams.hwVersion = C.uint16(createSpec.hwVersion)
+	createParams.capacity = C.VixDiskLibSectorType(createSpec.capacity)
+	createParams.logicalSectorSize = C.uint32(createSpec.LogicalSectorSize())
+	createParams.physicalSectorSize = C.uint32(createSpec.PhysicalSectorSize())
+	return createParams
+}
+
+// 创建虚拟磁盘。
+func (vddkBackend) Create(connection VixDiskLibConnection, path string, createParams VixDiskLibCreateParams, progress ProgressFunc) VddkError {
+	pathName := C.CString(path)
+	defer C.free(unsafe.Pointer(pathName))
+	// 准备虚拟磁盘的创建参数
+	createSpec := prepareCreateParams(createParams)
+	progressId := registerProgress(progress)
+	defer unregisterProgress(progressId)
+	// 创建虚拟磁盘
+	res := C.Create(cConnection(connection), pathName, createSpec, C.uintptr_t(progressId))
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Create a virtual disk failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 创建虚拟磁盘的子磁盘。（虚拟磁盘的句柄，子磁盘的路径，子磁盘的类型，进度回调数据）
+func (vddkBackend) CreateChild(diskHandle VixDiskLibHandle, childPath string, diskType VixDiskLibDiskType, progress ProgressFunc) VddkError {
+	child := C.CString(childPath)
+	defer C.free(unsafe.Pointer(child))
+	progressId := registerProgress(progress)
+	defer unregisterProgress(progressId)
+	res := C.CreateChild(cHandle(diskHandle), child, C.VixDiskLibDiskType(diskType), C.uintptr_t(progressId))
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Create child virtual disk failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 扩展虚拟磁盘的容量。
+func (vddkBackend) Grow(connection VixDiskLibConnection, path string, capacity VixDiskLibSectorType, updateGeometry bool, progress ProgressFunc) VddkError {
+	filePath := C.CString(path)
+	defer C.free(unsafe.Pointer(filePath))
+	progressId := registerProgress(progress)
+	defer unregisterProgress(progressId)
+	res := C.Grow(cConnection(connection), filePath, C.VixDiskLibSectorType(capacity), C._Bool(updateGeometry), C.uintptr_t(progressId))
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Grow failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 列出支持的传输模式。
+func (vddkBackend) ListTransportModes() string {
+	res := C.VixDiskLib_ListTransportModes()
+	modes := C.GoString(res)
+	return modes
+}
+
+// GetErrorText 调用 VixDiskLib_GetErrorText 获取错误码的说明。
+func (vddkBackend) GetErrorText(errCode uint64, locale string) string {
+	var cLocale *C.char
+	if locale != "" {
+		cLocale = C.CString(locale)
+		defer C.free(unsafe.Pointer(cLocale))
+	}
+	text := C.VixDiskLib_GetErrorText(C.VixError(errCode), cLocale)
+	if text == nil {
+		return ""
+	}
+	defer C.VixDiskLib_FreeErrorText(text)
+	return C.GoString(text)
+}
+
+// 重命名虚拟磁盘文件。
+func (vddkBackend) Rename(srcFileName string, dstFileName string) VddkError {
+	src := C.CString(srcFileName)
+	defer C.free(unsafe.Pointer(src))
+	dst := C.CString(dstFileName)
+	defer C.free(unsafe.Pointer(dst))
+	res := C.VixDiskLib_Rename(src, dst)
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Rename failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 获取克隆操作所需的空间大小。
+func (vddkBackend) SpaceNeededForClone(srcHandle VixDiskLibHandle, diskType VixDiskLibDiskType) (uint64, VddkError) {
+	var space C.uint64
+	res := C.VixDiskLib_SpaceNeededForClone(cHandle(srcHandle), C.VixDiskLibDiskType(diskType), &space)
+	if res != 0 {
+		return 0, NewVddkError(uint64(res), fmt.Sprintf("Get space needed for clone failed. The error code is %d.", res))
+	}
+	return uint64(space), nil
+}
+
+// 删除虚拟磁盘文件，包括所有的扩展。
+func (vddkBackend) Unlink(connection VixDiskLibConnection, path string) VddkError {
+	delete := C.CString(path)
+	defer C.free(unsafe.Pointer(delete))
+	res := C.VixDiskLib_Unlink(cConnection(connection), delete)
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Delete the virtual disk including all the extents failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 收缩虚拟磁盘的容量。
+func (vddkBackend) Shrink(diskHandle VixDiskLibHandle, progress ProgressFunc) VddkError {
+	progressId := registerProgress(progress)
+	defer unregisterProgress(progressId)
+	res := C.Shrink(cHandle(diskHandle), C.uintptr_t(progressId))
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Shrink failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 对虚拟磁盘执行碎片整理。#################
+func (vddkBackend) Defragment(diskHandle VixDiskLibHandle, progress ProgressFunc) VddkError {
+	progressId := registerProgress(progress)
+	defer unregisterProgress(progressId)
+	res := C.Defragment(cHandle(diskHandle), C.uintptr_t(progressId))
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Defragment failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 获取虚拟磁盘的传输模式。
+func (vddkBackend) GetTransportMode(diskHandle VixDiskLibHandle) string {
+	res := C.VixDiskLib_GetTransportMode(cHandle(diskHandle))
+	mode := C.GoString(res)
+	return mode
+}
+
+// metadataBuffer 返回指向 buf 的 C 指针，buf 为空时返回 NULL，VDDK 据此只返回所需的长度。
+func metadataBuffer(buf []byte) *C.char {
+	if len(buf) == 0 {
+		return nil
+	}
+	return (*C.char)(unsafe.Pointer(&buf[0]))
+}
+
+// 获取虚拟磁盘的元数据键。
+func (vddkBackend) GetMetadataKeys(diskHandle VixDiskLibHandle, buf []byte) (uint, VddkError) {
+	cbuf := metadataBuffer(buf)
+	var required C.size_t
+	res := C.GetMetadataKeys(cHandle(diskHandle), cbuf, C.size_t(len(buf)), &required)
+	if res != 0 {
+		return uint(required), NewVddkError(uint64(res), fmt.Sprintf("GetMetadataKeys failed. The error code is %d.", res))
+	}
+	return uint(required), nil
+}
+
+// 关闭虚拟磁盘句柄，释放相关资源。
+func (vddkBackend) Close(diskHandle VixDiskLibHandle) VddkError {
+	res := C.VixDiskLib_Close(cHandle(diskHandle))
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Close virtual disk failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 写入虚拟磁盘的元数据。
+func (vddkBackend) WriteMetadata(diskHandle VixDiskLibHandle, key string, val string) VddkError {
+	w_key := C.CString(key)
+	defer C.free(unsafe.Pointer(w_key))
+	w_val := C.CString(val)
+	defer C.free(unsafe.Pointer(w_val))
+	res := C.VixDiskLib_WriteMetadata(cHandle(diskHandle), w_key, w_val)
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Write meta data failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 从虚拟磁盘中读取元数据。
+func (vddkBackend) ReadMetadata(diskHandle VixDiskLibHandle, key string, buf []byte) (uint, VddkError) {
+	readKey := C.CString(key)
+	defer C.free(unsafe.Pointer(readKey))
+	cbuf := metadataBuffer(buf)
+	var required C.size_t
+	res := C.VixDiskLib_ReadMetadata(cHandle(diskHandle), readKey, cbuf, C.size_t(len(buf)), &required)
+	if res != 0 {
+		return uint(required), NewVddkError(uint64(res), fmt.Sprintf("Read meta data from virtual disk file failed. The error code is %d.", res))
+	}
+	return uint(required), nil
+}
+
+// 从虚拟磁盘中读取数据。
+func (vddkBackend) Read(diskHandle VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte) VddkError {
+	cbuf := ((*C.uint8)(unsafe.Pointer(&buf[0])))
+	res := C.VixDiskLib_Read(cHandle(diskHandle), C.VixDiskLibSectorType(startSector), C.VixDiskLibSectorType(numSectors), cbuf)
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Read from virtual disk file failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 向虚拟磁盘中写入数据。
+func (vddkBackend) Write(diskHandle VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte) VddkError {
+	cbuf := ((*C.uint8)(unsafe.Pointer(&buf[0])))
+	res := C.VixDiskLib_Write(cHandle(diskHandle), C.VixDiskLibSectorType(startSector), C.VixDiskLibSectorType(numSectors), cbuf)
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Write to virtual disk file failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// GoAsyncCompletion 由 C 侧的 CompletionCB 调用，将异步请求的结果转发给编号对应的 Go 完成函数。
+//
+//export GoAsyncCompletion
+func GoAsyncCompletion(asyncId C.uintptr_t, result C.VixError) {
+	completeAsync(uintptr(asyncId), uint64(result))
+}
+
+// submitAsync 处理异步请求提交后的返回值。VDDK 接受请求时返回 VIX_ASYNC，结果随后通过 CompletionCB 送达；
+// 其他返回值表示请求已经同步结束，此时回调不会被调用，由这里完成请求。
+func submitAsync(asyncId uintptr, res C.VixError) {
+	if res != VIX_ASYNC {
+		completeAsync(asyncId, uint64(res))
+	}
+}
+
+// 异步地从虚拟磁盘中读取数据。请求完成前 VDDK 会一直使用缓冲区，因此数据先读入 C 内存，完成后再复制到 buf。
+func (vddkBackend) ReadAsync(diskHandle VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte, completion func(VddkError)) VddkError {
+	size := numSectors * VIXDISKLIB_SECTOR_SIZE
+	if uint64(len(buf)) < size {
+		return NewVddkError(VIX_E_INVALID_ARG, fmt.Sprintf("Read from virtual disk file asynchronously failed. The error code is %d.", VIX_E_INVALID_ARG))
+	}
+	cbuf := C.malloc(C.size_t(size))
+	asyncId := registerAsync(func(res uint64) {
+		if res == 0 {
+			copy(buf[:size], unsafe.Slice((*byte)(cbuf), size))
+		}
+		C.free(cbuf)
+		if res != 0 {
+			completion(NewVddkError(res, fmt.Sprintf("Read from virtual disk file asynchronously failed. The error code is %d.", res)))
+			return
+		}
+		completion(nil)
+	})
+	res := C.ReadAsync(cHandle(diskHandle), C.VixDiskLibSectorType(startSector), C.VixDiskLibSectorType(numSectors), (*C.uint8)(cbuf), C.uintptr_t(asyncId))
+	submitAsync(asyncId, res)
+	return nil
+}
+
+// 异步地向虚拟磁盘中写入数据。数据在提交前被复制到 C 内存中，请求完成后释放。
+func (vddkBackend) WriteAsync(diskHandle VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte, completion func(VddkError)) VddkError {
+	size := numSectors * VIXDISKLIB_SECTOR_SIZE
+	if uint64(len(buf)) < size {
+		return NewVddkError(VIX_E_INVALID_ARG, fmt.Sprintf("Write to virtual disk file asynchronously failed. The error code is %d.", VIX_E_INVALID_ARG))
+	}
+	cbuf := C.CBytes(buf[:size])
+	asyncId := registerAsync(func(res uint64) {
+		C.free(cbuf)
+		if res != 0 {
+			completion(NewVddkError(res, fmt.Sprintf("Write to virtual disk file asynchronously failed. The error code is %d.", res)))
+			return
+		}
+		completion(nil)
+	})
+	res := C.WriteAsync(cHandle(diskHandle), C.VixDiskLibSectorType(startSector), C.VixDiskLibSectorType(numSectors), (*C.uint8)(cbuf), C.uintptr_t(asyncId))
+	submitAsync(asyncId, res)
+	return nil
+}
+
+// 等待虚拟磁盘句柄上所有未完成的异步请求结束。
+func (vddkBackend) Wait(diskHandle VixDiskLibHandle) VddkError {
+	res := C.VixDiskLib_Wait(cHandle(diskHandle))
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Wait for asynchronous operations failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 将虚拟磁盘句柄上缓存的写入刷新到磁盘。
+func (vddkBackend) Flush(diskHandle VixDiskLibHandle) VddkError {
+	res := C.VixDiskLib_Flush(cHandle(diskHandle))
+	if res != 0 {
+		return NewVddkError(uint64(res), fmt.Sprintf("Flush virtual disk file failed. The error code is %d.", res))
+	}
+	return nil
+}
+
+// 获取虚拟磁盘的信息，如容量、几何信息等。
+func (vddkBackend) GetInfo(diskHandle VixDiskLibHandle) (VixDiskLibInfo, VddkError) {
+	var dliInfoPtr *C.VixDiskLibInfo
+	res := C.VixDiskLib_GetInfo(cHandle(diskHandle), &dliInfoPtr)
+	if res != 0 {
+		return VixDiskLibInfo{}, NewVddkError(uint64(res), fmt.Sprintf("GetInfo failed. The error code is %d.", res))
+	}
+	dliInfo := *dliInfoPtr
+	retInfo := VixDiskLibInfo{
+		BiosGeo: VixDiskLibGeometry{
+			Cylinders: uint32(dliInfo.biosGeo.cylinders),
+			Heads:     uint32(dliInfo.biosGeo.heads),
+			Sectors:   uint32(dliInfo.biosGeo.sectors),
+		},
+		PhysGeo: VixDiskLibGeometry{
+			Cylinders: uint32(dliInfo.physGeo.cylinders),
+			Heads:     uint32(dliInfo.physGeo.heads),
+			Sectors:   uint32(dliInfo.physGeo.sectors),
+		},
+		Capacity:           VixDiskLibSectorType(dliInfo.capacity),
+		AdapterType:        VixDiskLibAdapterType(dliInfo.adapterType),
+		NumLinks:           int(dliInfo.numLinks),
+		ParentFileNameHint: C.GoString(dliInfo.parentFileNameHint),
+		Uuid:               C.GoString(dliInfo.uuid),
+		LogicalSectorSize:  uint32(dliInfo.logicalSectorSize),
+		PhysicalSectorSize: uint32(dliInfo.physicalSectorSize),
+	}
+	C.VixDiskLib_FreeInfo(dliInfoPtr)
+	return retInfo, nil
+}
+
+// 查询虚拟磁盘中已分配的块。
+func (vddkBackend) QueryAllocatedBlocks(diskHandle VixDiskLibHandle, startSector VixDiskLibSectorType, numSectors VixDiskLibSectorType, chunkSize VixDiskLibSectorType) ([]VixDiskLibBlock, VddkError) {
+	ss := C.VixDiskLibSectorType(startSector)
+	ns := C.VixDiskLibSectorType(numSectors)
+	cs := C.VixDiskLibSectorType(chunkSize)
+	var bld C.BlockListDescriptor
+
+	res := C.QueryAllocatedBlocks(cHandle(diskHandle), ss, ns, cs, &bld)
+	if res != 0 {
+		return nil, NewVddkError(uint64(res), fmt.Sprintf("QueryAllocatedBlocks(%d, %d, %d) error: %d.", startSector, numSectors, chunkSize, res))
+	}
+
+	cList := make([]C.VixDiskLibBlock, bld.numBlocks)
+	// 没有已分配块时也要释放块列表，此时不能取 cList[0] 的地址
+	var cBlocks *C.VixDiskLibBlock
+	if len(cList) > 0 {
+		cBlocks = &cList[0]
+	}
+	C.BlockListCopyAndFree(&bld, cBlocks)
+
+	retList := make([]VixDiskLibBlock, len(cList))
+	for i, cBlock := range cList {
+		retList[i].SetOffset(VixDiskLibSectorType(cBlock.offset))
+		retList[i].SetLength(VixDiskLibSectorType(cBlock.length))
+	}
+	return retList, nil
+}
@@ -0,0 +1,132 @@
+package disklib
+
+import (
+	"context"
+	"fmt"
+)
+
+// vddkContextError 表示因 context 被取消或超时而中止的操作。
+// 它仍然是一个 VddkError，同时通过 Unwrap 暴露 ctx.Err()，因此 errors.Is(err, context.Canceled) 可以成立。
+type vddkContextError struct {
+	vddkErrorImpl
+	cause error
+}
+
+// Unwrap 返回导致操作中止的 context 错误。
+func (this vddkContextError) Unwrap() error {
+	return this.cause
+}
+
+// Cause 与 Unwrap 相同，供 github.com/pkg/errors 使用。
+func (this vddkContextError) Cause() error {
+	return this.cause
+}
+
+// WrapContextError 将 ctx 被取消或超时的原因附加到 VDDK 错误上。
+// vErr 为 nil 时使用 VIX_E_CANCELLED 作为错误码；ctx 没有结束时原样返回 vErr。
+func WrapContextError(ctx context.Context, vErr VddkError) VddkError {
+	cause := ctx.Err()
+	if cause == nil {
+		return vErr
+	}
+	if vErr == nil {
+		vErr = NewVddkError(VIX_E_CANCELLED, fmt.Sprintf("The operation was cancelled. The error code is %d.", VIX_E_CANCELLED))
+	}
+	return vddkContextError{
+		vddkErrorImpl: vddkErrorImpl{
+			err_code: vErr.VixErrorCode(),
+			err_msg:  vErr.Error() + ": " + cause.Error(),
+		},
+		cause: cause,
+	}
+}
+
+// progressWithContext 返回一个在 ctx 结束后要求取消操作的进度回调，其余情况下转发给 progress。
+func progressWithContext(ctx context.Context, progress ProgressFunc) ProgressFunc {
+	if ctx.Done() == nil {
+		return progress
+	}
+	return func(percentCompleted int) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		if progress == nil {
+			return true
+		}
+		return progress(percentCompleted)
+	}
+}
+
+// runWithProgressContext 在 ctx 的控制下执行一个支持进度回调的操作。
+// ctx 在操作开始前已经结束时不执行操作；操作因 ctx 结束而失败时，返回的错误同时包含 Vix 错误码和 ctx.Err()。
+func runWithProgressContext(ctx context.Context, progress ProgressFunc, operation func(ProgressFunc) VddkError) VddkError {
+	if ctx.Err() != nil {
+		return WrapContextError(ctx, nil)
+	}
+	vErr := operation(progressWithContext(ctx, progress))
+	if vErr != nil && ctx.Err() != nil {
+		return WrapContextError(ctx, vErr)
+	}
+	return vErr
+}
+
+// CloneContext 与 Clone 相同，但在 ctx 被取消或超时后通过进度回调中止克隆。
+func CloneContext(ctx context.Context, dstConnection VixDiskLibConnection, dstPath string, srcConnection VixDiskLibConnection, srcPath string,
+	params VixDiskLibCreateParams, progress ProgressFunc, overWrite bool) VddkError {
+	return runWithProgressContext(ctx, progress, func(progress ProgressFunc) VddkError {
+		return Clone(dstConnection, dstPath, srcConnection, srcPath, params, progress, overWrite)
+	})
+}
+
+// CreateContext 与 Create 相同，但在 ctx 被取消或超时后通过进度回调中止创建。
+func CreateContext(ctx context.Context, connection VixDiskLibConnection, path string, createParams VixDiskLibCreateParams, progress ProgressFunc) VddkError {
+	return runWithProgressContext(ctx, progress, func(progress ProgressFunc) VddkError {
+		return Create(connection, path, createParams, progress)
+	})
+}
+
+// CreateChildContext 与 CreateChild 相同，但在 ctx 被取消或超时后通过进度回调中止创建。
+func CreateChildContext(ctx context.Context, diskHandle VixDiskLibHandle, childPath string, diskType VixDiskLibDiskType, progress ProgressFunc) VddkError {
+	return runWithProgressContext(ctx, progress, func(progress ProgressFunc) VddkError {
+		return CreateChild(diskHandle, childPath, diskType, progress)
+	})
+}
+
+// GrowContext 与 Grow 相同，但在 ctx 被取消或超时后通过进度回调中止扩展。
+func GrowContext(ctx context.Context, connection VixDiskLibConnection, path string, capacity VixDiskLibSectorType, updateGeometry bool, progress ProgressFunc) VddkError {
+	return runWithProgressContext(ctx, progress, func(progress ProgressFunc) VddkError {
+		return Grow(connection, path, capacity, updateGeometry, progress)
+	})
+}
+
+// ShrinkContext 与 Shrink 相同，但在 ctx 被取消或超时后通过进度回调中止收缩。
+func ShrinkContext(ctx context.Context, diskHandle VixDiskLibHandle, progress ProgressFunc) VddkError {
+	return runWithProgressContext(ctx, progress, func(progress ProgressFunc) VddkError {
+		return Shrink(diskHandle, progress)
+	})
+}
+
+// DefragmentContext 与 Defragment 相同，但在 ctx 被取消或超时后通过进度回调中止碎片整理。
+func DefragmentContext(ctx context.Context, diskHandle VixDiskLibHandle, progress ProgressFunc) VddkError {
+	return runWithProgressContext(ctx, progress, func(progress ProgressFunc) VddkError {
+		return Defragment(diskHandle, progress)
+	})
+}
+
+// CheckRepairContext 与 CheckRepair 相同，但 ctx 被取消或超时后立即返回。
+// VDDK 的 CheckRepair 不支持进度回调，无法被中途中止，因此底层调用会在后台继续执行直到 VDDK 返回。
+func CheckRepairContext(ctx context.Context, connection VixDiskLibConnection, filename string, repair bool) VddkError {
+	if ctx.Err() != nil {
+		return WrapContextError(ctx, nil)
+	}
+	result := make(chan VddkError, 1)
+	go func() {
+		result <- CheckRepair(connection, filename, repair)
+	}()
+	select {
+	case vErr := <-result:
+		return vErr
+	case <-ctx.Done():
+		return WrapContextError(ctx, nil)
+	}
+}
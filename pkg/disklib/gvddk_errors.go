@@ -0,0 +1,195 @@
+package disklib
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// vixErrorClass 是一类 Vix 错误码，作为 errors.Is 的目标使用。
+type vixErrorClass struct {
+	text  string
+	codes []uint64
+}
+
+// Error 返回错误类别的说明。
+func (this *vixErrorClass) Error() string {
+	return this.text
+}
+
+// contains 判断错误码是否属于该类别。
+func (this *vixErrorClass) contains(code uint64) bool {
+	for _, c := range this.codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// 常见 Vix 错误码对应的哨兵错误，用法：errors.Is(vErr, disklib.ErrFileNotFound)。
+// disklib 返回的 VddkError 以及经过 github.com/pkg/errors 包装后的错误都可以这样判断。
+var (
+	ErrFail              error = &vixErrorClass{"unknown error", []uint64{VIX_E_FAIL}}
+	ErrInvalidArg        error = &vixErrorClass{"invalid argument", []uint64{VIX_E_INVALID_ARG}}
+	ErrFileNotFound      error = &vixErrorClass{"file not found", []uint64{VIX_E_FILE_NOT_FOUND}}
+	ErrNotSupported      error = &vixErrorClass{"operation not supported", []uint64{VIX_E_NOT_SUPPORTED}}
+	ErrDiskFull          error = &vixErrorClass{"disk full", []uint64{VIX_E_DISK_FULL}}
+	ErrCancelled         error = &vixErrorClass{"operation cancelled", []uint64{VIX_E_CANCELLED}}
+	ErrFileReadOnly      error = &vixErrorClass{"file is read only", []uint64{VIX_E_FILE_READ_ONLY}}
+	ErrFileAlreadyExists error = &vixErrorClass{"file already exists", []uint64{VIX_E_FILE_ALREADY_EXISTS}}
+	ErrAccessDenied      error = &vixErrorClass{"access denied", []uint64{VIX_E_FILE_ACCESS_ERROR}}
+	ErrBufferTooSmall    error = &vixErrorClass{"buffer too small", []uint64{VIX_E_BUFFER_TOOSMALL}}
+	ErrDiskOutOfRange    error = &vixErrorClass{"disk access out of range", []uint64{VIX_E_DISK_OUTOFRANGE}}
+	// ErrHostConnectionLost 包括连接被拒绝、连接中断、服务器关闭或不可用以及无法连接到主机
+	ErrHostConnectionLost error = &vixErrorClass{"host connection lost", []uint64{VIX_E_HOST_NETWORK_CONN_REFUSED,
+		VIX_E_HOST_TCP_SOCKET_ERROR, VIX_E_HOST_TCP_CONN_LOST, VIX_E_HOST_SERVER_SHUTDOWN,
+		VIX_E_HOST_SERVER_NOT_AVAILABLE, VIX_E_CANNOT_CONNECT_TO_HOST}}
+)
+
+// errorClasses 是所有错误类别，用于根据错误码查找类别。
+var errorClasses = []error{ErrFail, ErrInvalidArg, ErrFileNotFound, ErrNotSupported, ErrDiskFull, ErrCancelled,
+	ErrFileReadOnly, ErrFileAlreadyExists, ErrAccessDenied, ErrBufferTooSmall, ErrDiskOutOfRange, ErrHostConnectionLost}
+
+// errorClass 返回错误码所属的类别，没有时返回 nil。
+func errorClass(code uint64) *vixErrorClass {
+	for _, class := range errorClasses {
+		if class.(*vixErrorClass).contains(code) {
+			return class.(*vixErrorClass)
+		}
+	}
+	return nil
+}
+
+// Is 判断错误是否属于 target 表示的类别，或者与 target 是错误码相同的 VddkError。
+func (this vddkErrorImpl) Is(target error) bool {
+	switch t := target.(type) {
+	case *vixErrorClass:
+		return t.contains(this.err_code)
+	case VddkError:
+		return t.VixErrorCode() == this.err_code
+	}
+	return false
+}
+
+// Unwrap 返回错误码所属的哨兵错误，没有对应的类别时返回 nil。
+func (this vddkErrorImpl) Unwrap() error {
+	if class := errorClass(this.err_code); class != nil {
+		return class
+	}
+	return nil
+}
+
+// Retryable 判断操作是否可以在重新连接后重试，即错误是否属于 ErrHostConnectionLost。
+func (this vddkErrorImpl) Retryable() bool {
+	return errorClass(this.err_code) == ErrHostConnectionLost
+}
+
+// Retryable 对因 context 结束而中止的操作总是返回 false。
+func (this vddkContextError) Retryable() bool {
+	return false
+}
+
+// Retryable 判断 err 或它包装的错误是否是可以在重新连接后重试的 VDDK 错误，
+// 例如 ConnectionPool 据此决定是否重新连接并重试读写。
+func Retryable(err error) bool {
+	var retryable interface{ Retryable() bool }
+	if errors.As(err, &retryable) {
+		return retryable.Retryable()
+	}
+	return false
+}
+
+// GetErrorText 返回 VDDK 对错误码的说明，locale 为空时使用默认语言。
+func GetErrorText(errCode uint64, locale string) string {
+	return getBackend().GetErrorText(errCode, locale)
+}
+
+// initialized 在 Init、InitEx 或 InitWithBackend 成功后为 1，Exit 后为 0。
+var initialized int32
+
+// backendTexts 缓存后端返回的、errorTexts 中没有的错误说明，在初始化和 Exit 时清空。
+var (
+	backendTextsLock sync.Mutex
+	backendTexts     = map[uint64]string{}
+)
+
+// setInitialized 根据初始化的结果设置 initialized，并原样返回 vErr。
+func setInitialized(vErr VddkError) VddkError {
+	if vErr == nil {
+		clearBackendTexts()
+		atomic.StoreInt32(&initialized, 1)
+	}
+	return vErr
+}
+
+// clearInitialized 在 Exit 时清除 initialized 和缓存的错误说明。
+func clearInitialized() {
+	atomic.StoreInt32(&initialized, 0)
+	clearBackendTexts()
+}
+
+// clearBackendTexts 清空缓存的后端错误说明。
+func clearBackendTexts() {
+	backendTextsLock.Lock()
+	defer backendTextsLock.Unlock()
+	backendTexts = map[uint64]string{}
+}
+
+// errorText 返回错误码的说明。errorTexts 中有的错误码直接使用其中的英文说明，
+// 其它错误码在初始化之后调用 VixDiskLib_GetErrorText，并按错误码缓存结果，
+// 因此异步回调中构造错误时不会反复调用 VDDK，也不会让 vddk_calls_total 随错误数增加。
+// VixDiskLib_GetErrorText 只能在初始化之后调用，在 Init 之前或 Exit 之后没有说明时返回空字符串。
+func errorText(code uint64) string {
+	if code == 0 {
+		return ""
+	}
+	if text, ok := errorTexts[code]; ok {
+		return text
+	}
+	if atomic.LoadInt32(&initialized) == 0 {
+		return ""
+	}
+	backendTextsLock.Lock()
+	defer backendTextsLock.Unlock()
+	text, ok := backendTexts[code]
+	if !ok {
+		text = GetErrorText(code, "")
+		backendTexts[code] = text
+	}
+	return text
+}
+
+// withErrorText 在 msg 后追加错误码的说明，msg 中已经包含说明时原样返回。
+func withErrorText(code uint64, msg string) string {
+	text := strings.TrimRight(errorText(code), ". \r\n")
+	switch {
+	case text == "" || strings.Contains(msg, text):
+		return msg
+	case msg == "":
+		return text + "."
+	}
+	return msg + " " + text + "."
+}
+
+// errorTexts 是 FakeBackend 以及 NewVddkError 使用的错误说明，与 VDDK 英文说明一致。
+var errorTexts = map[uint64]string{
+	VIX_E_FAIL:                      "Unknown error",
+	VIX_E_INVALID_ARG:               "One of the parameters was invalid",
+	VIX_E_FILE_NOT_FOUND:            "A file was not found",
+	VIX_E_NOT_SUPPORTED:             "The operation is not supported",
+	VIX_E_DISK_FULL:                 "Disk full",
+	VIX_E_CANCELLED:                 "The operation was canceled",
+	VIX_E_FILE_READ_ONLY:            "The file is write-protected",
+	VIX_E_FILE_ALREADY_EXISTS:       "The file already exists",
+	VIX_E_FILE_ACCESS_ERROR:         "You do not have access rights to this file",
+	VIX_E_BUFFER_TOOSMALL:           "The buffer is too small",
+	VIX_E_DISK_OUTOFRANGE:           "The disk access is out of range",
+	VIX_E_HOST_NETWORK_CONN_REFUSED: "The host refused the network connection",
+	VIX_E_HOST_TCP_SOCKET_ERROR:     "A TCP socket error occurred",
+	VIX_E_HOST_TCP_CONN_LOST:        "The TCP connection was lost",
+	VIX_E_HOST_SERVER_SHUTDOWN:      "The server was shut down",
+	VIX_E_HOST_SERVER_NOT_AVAILABLE: "The server is not available",
+	VIX_E_CANNOT_CONNECT_TO_HOST:    "Cannot connect to host",
+}
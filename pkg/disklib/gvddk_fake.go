@@ -0,0 +1,1018 @@
+package disklib
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FakeBackend 是一个纯 Go 实现的后端，磁盘内容保存在内存中或由本地文件承载，
+// 用于在没有 VDDK 的机器上测试 disklib 和 virtual_disks 的完整流程。
+// 磁盘按路径登记：Open 时优先使用 ConnectParams 中的 path，为空时使用 FCD ID。
+type FakeBackend struct {
+	mutex       sync.Mutex
+	initialized bool
+	disks       map[string]*fakeDisk
+	snapshots   map[string]map[string]*fakeDisk // 快照 MoRef 到快照中磁盘的映射
+	epoch       int                             // DropConnections 的调用次数
+	connects    int                             // 成功建立的连接数
+}
+
+// fakeConnection 是 FakeBackend 中的连接对象。
+type fakeConnection struct {
+	params ConnectParams
+	closed bool
+	epoch  int // 建立连接时 FakeBackend 的 epoch，不相等表示连接已经断开
+}
+
+// fakeHandle 是 FakeBackend 中的磁盘句柄。
+type fakeHandle struct {
+	disk     *fakeDisk
+	conn     *fakeConnection
+	readOnly bool
+	closed   bool
+	pending  sync.WaitGroup // 未完成的异步请求
+}
+
+// 内存磁盘按颗粒（grain）分配存储，未分配的颗粒读出为零。
+const (
+	fakeGrainSectors = 128
+	fakeGrainSize    = fakeGrainSectors * VIXDISKLIB_SECTOR_SIZE
+)
+
+// fakeDisk 表示 FakeBackend 中的一块虚拟磁盘。
+type fakeDisk struct {
+	mutex     sync.RWMutex
+	path      string
+	info      VixDiskLibInfo
+	diskType  VixDiskLibDiskType
+	grains    map[uint64][]byte // 内存模式下按颗粒保存的数据
+	file      *os.File          // 文件模式下的后备文件
+	allocated map[uint64]bool   // 已分配（写入过）的颗粒
+	metadata  map[string]string
+	parent    *fakeDisk
+}
+
+// NewFakeBackend 创建一个不包含任何磁盘的 FakeBackend。
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		disks:     make(map[string]*fakeDisk),
+		snapshots: make(map[string]map[string]*fakeDisk),
+	}
+}
+
+// AddDisk 在 FakeBackend 中登记一块容量为 capacity 个扇区的空白内存磁盘，已存在的同名磁盘会被替换。
+func (fb *FakeBackend) AddDisk(path string, capacity VixDiskLibSectorType) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.disks[path] = newFakeDisk(path, capacity, VIXDISKLIB_DISK_MONOLITHIC_SPARSE, VIXDISKLIB_ADAPTER_SCSI_LSILOGIC)
+}
+
+// AddFileDisk 在 FakeBackend 中登记一块以本地文件 fileName 为内容的磁盘，容量为文件大小向下取整到扇区。
+// 文件中非零的颗粒视为已分配。
+func (fb *FakeBackend) AddFileDisk(path string, fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	disk := newFakeDisk(path, VixDiskLibSectorType(stat.Size()/VIXDISKLIB_SECTOR_SIZE), VIXDISKLIB_DISK_MONOLITHIC_FLAT, VIXDISKLIB_ADAPTER_SCSI_LSILOGIC)
+	disk.file = file
+	buf := make([]byte, fakeGrainSize)
+	for grain := uint64(0); int64(grain)*fakeGrainSize < stat.Size(); grain++ {
+		n, err := file.ReadAt(buf, int64(grain)*fakeGrainSize)
+		if err != nil && err != io.EOF {
+			file.Close()
+			return err
+		}
+		if !isZero(buf[:n]) {
+			disk.allocated[grain] = true
+		}
+	}
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.disks[path] = disk
+	return nil
+}
+
+// AddSnapshot 模拟创建虚拟机快照：将 paths 指定的磁盘的当前内容冻结到快照 snapshotRef 中。
+// 使用 WithSnapshotRef(snapshotRef) 连接后打开的磁盘读出创建快照时的内容，并且只能以只读方式访问。
+func (fb *FakeBackend) AddSnapshot(snapshotRef string, paths ...string) error {
+	frozen := make(map[string]*fakeDisk)
+	for _, path := range paths {
+		disk, ok := fb.lookupDisk(path)
+		if !ok {
+			return fmt.Errorf("disk %s does not exist", path)
+		}
+		disk.mutex.RLock()
+		copied := newFakeDisk(path, disk.info.Capacity, disk.diskType, disk.info.AdapterType)
+		copied.info.Uuid = disk.info.Uuid
+		copied.setSectorSize(disk.info.LogicalSectorSize, disk.info.PhysicalSectorSize)
+		for key, value := range disk.metadata {
+			copied.metadata[key] = value
+		}
+		err := disk.cloneData(copied, nil)
+		disk.mutex.RUnlock()
+		if err != nil {
+			return err
+		}
+		frozen[path] = copied
+	}
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.snapshots[snapshotRef] = frozen
+	return nil
+}
+
+// newFakeDisk 创建一块空白的内存磁盘。
+func newFakeDisk(path string, capacity VixDiskLibSectorType, diskType VixDiskLibDiskType, adapterType VixDiskLibAdapterType) *fakeDisk {
+	disk := &fakeDisk{
+		path:      path,
+		diskType:  diskType,
+		grains:    make(map[uint64][]byte),
+		allocated: make(map[uint64]bool),
+		metadata:  make(map[string]string),
+		info: VixDiskLibInfo{
+			Capacity:           capacity,
+			AdapterType:        adapterType,
+			NumLinks:           1,
+			Uuid:               newFakeUuid(),
+			LogicalSectorSize:  VIXDISKLIB_SECTOR_SIZE,
+			PhysicalSectorSize: VIXDISKLIB_SECTOR_SIZE,
+		},
+	}
+	disk.info.BiosGeo, disk.info.PhysGeo = fakeGeometry(capacity)
+	return disk
+}
+
+// setSectorSize 设置磁盘的逻辑和物理扇区大小。
+func (disk *fakeDisk) setSectorSize(logicalSectorSize uint32, physicalSectorSize uint32) {
+	disk.info.LogicalSectorSize = logicalSectorSize
+	disk.info.PhysicalSectorSize = physicalSectorSize
+}
+
+// checkSectorSize 与 VDDK 一样只接受 512 或 4096 字节的扇区，并且物理扇区不能小于逻辑扇区。
+func checkSectorSize(createParams VixDiskLibCreateParams, operation string) VddkError {
+	logical, physical := createParams.LogicalSectorSize(), createParams.PhysicalSectorSize()
+	if (logical != 512 && logical != 4096) || (physical != 512 && physical != 4096) || physical < logical {
+		return newFakeError(VIX_E_INVALID_ARG, operation)
+	}
+	return nil
+}
+
+// newFakeUuid 生成 VMDK 描述符中 ddb.uuid 格式的随机 UUID。
+func newFakeUuid() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	parts := make([]string, len(b))
+	for i, v := range b {
+		parts[i] = fmt.Sprintf("%02x", v)
+	}
+	return strings.Join(parts[:8], " ") + "-" + strings.Join(parts[8:], " ")
+}
+
+// fakeGeometry 按照 VDDK 的惯例根据容量计算 BIOS 几何信息和物理几何信息。
+func fakeGeometry(capacity VixDiskLibSectorType) (VixDiskLibGeometry, VixDiskLibGeometry) {
+	bios := VixDiskLibGeometry{Heads: 255, Sectors: 63}
+	bios.Cylinders = uint32(uint64(capacity) / (255 * 63))
+	phys := VixDiskLibGeometry{Heads: 16, Sectors: 63}
+	phys.Cylinders = uint32(uint64(capacity) / (16 * 63))
+	if phys.Cylinders > 16383 {
+		phys.Cylinders = 16383
+	}
+	return bios, phys
+}
+
+// isZero 判断缓冲区是否全部为零。
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// newFakeError 生成与 VDDK 后端相同格式的错误信息。
+func newFakeError(code uint64, operation string) VddkError {
+	return NewVddkError(code, fmt.Sprintf("%s failed. The error code is %d.", operation, code))
+}
+
+// fakeProgress 向进度回调报告进度，回调要求取消时返回 VIX_E_CANCELLED 错误。
+func fakeProgress(progress ProgressFunc, percentCompleted int, operation string) VddkError {
+	if progress != nil && !progress(percentCompleted) {
+		return newFakeError(VIX_E_CANCELLED, operation)
+	}
+	return nil
+}
+
+// capacityBytes 返回磁盘容量（以字节为单位），调用方需持有 d.mutex。
+func (d *fakeDisk) capacityBytes() int64 {
+	return int64(d.info.Capacity) * VIXDISKLIB_SECTOR_SIZE
+}
+
+// isAllocated 判断颗粒在磁盘链中是否已分配，调用方需持有 d.mutex。
+func (d *fakeDisk) isAllocated(grain uint64) bool {
+	if d.allocated[grain] {
+		return true
+	}
+	if d.parent == nil {
+		return false
+	}
+	d.parent.mutex.RLock()
+	defer d.parent.mutex.RUnlock()
+	return d.parent.isAllocated(grain)
+}
+
+// allocatedGrains 返回整个磁盘链中已分配的颗粒，调用方需持有 d.mutex。
+func (d *fakeDisk) allocatedGrains() map[uint64]bool {
+	grains := make(map[uint64]bool)
+	if d.parent != nil {
+		d.parent.mutex.RLock()
+		grains = d.parent.allocatedGrains()
+		d.parent.mutex.RUnlock()
+	}
+	for grain := range d.allocated {
+		grains[grain] = true
+	}
+	return grains
+}
+
+// readAt 从磁盘读取数据，未分配的颗粒从父磁盘读取或读出为零，调用方需持有 d.mutex。
+func (d *fakeDisk) readAt(p []byte, off int64) error {
+	for len(p) > 0 {
+		grain := uint64(off / fakeGrainSize)
+		grainOff := off % fakeGrainSize
+		count := int64(len(p))
+		if count > fakeGrainSize-grainOff {
+			count = fakeGrainSize - grainOff
+		}
+		chunk := p[:count]
+		switch {
+		case d.allocated[grain] && d.file != nil:
+			if _, err := d.file.ReadAt(chunk, off); err != nil && err != io.EOF {
+				return err
+			}
+		case d.allocated[grain]:
+			copy(chunk, d.grains[grain][grainOff:])
+		case d.parent != nil:
+			d.parent.mutex.RLock()
+			err := d.parent.readParentAt(chunk, off)
+			d.parent.mutex.RUnlock()
+			if err != nil {
+				return err
+			}
+		default:
+			for i := range chunk {
+				chunk[i] = 0
+			}
+		}
+		p = p[count:]
+		off += count
+	}
+	return nil
+}
+
+// readParentAt 以父磁盘的身份读取数据，超出父磁盘容量的部分读出为零，调用方需持有 d.mutex。
+func (d *fakeDisk) readParentAt(p []byte, off int64) error {
+	capacity := d.capacityBytes()
+	if off >= capacity {
+		for i := range p {
+			p[i] = 0
+		}
+		return nil
+	}
+	if off+int64(len(p)) > capacity {
+		tail := p[capacity-off:]
+		for i := range tail {
+			tail[i] = 0
+		}
+		p = p[:capacity-off]
+	}
+	return d.readAt(p, off)
+}
+
+// writeAt 向磁盘写入数据，首次写入的颗粒会先从父磁盘复制原有内容，调用方需持有 d.mutex 的写锁。
+func (d *fakeDisk) writeAt(p []byte, off int64) error {
+	for len(p) > 0 {
+		grain := uint64(off / fakeGrainSize)
+		grainOff := off % fakeGrainSize
+		count := int64(len(p))
+		if count > fakeGrainSize-grainOff {
+			count = fakeGrainSize - grainOff
+		}
+		if !d.allocated[grain] {
+			grainBuf := make([]byte, fakeGrainSize)
+			if d.parent != nil {
+				d.parent.mutex.RLock()
+				err := d.parent.readParentAt(grainBuf, int64(grain)*fakeGrainSize)
+				d.parent.mutex.RUnlock()
+				if err != nil {
+					return err
+				}
+			}
+			if d.file != nil {
+				if d.parent != nil {
+					if _, err := d.file.WriteAt(grainBuf, int64(grain)*fakeGrainSize); err != nil {
+						return err
+					}
+				}
+			} else {
+				d.grains[grain] = grainBuf
+			}
+			d.allocated[grain] = true
+		}
+		if d.file != nil {
+			if _, err := d.file.WriteAt(p[:count], off); err != nil {
+				return err
+			}
+		} else {
+			copy(d.grains[grain][grainOff:], p[:count])
+		}
+		p = p[count:]
+		off += count
+	}
+	return nil
+}
+
+// cloneData 将整个磁盘链的数据展开复制到新的内存磁盘中，每复制一个颗粒报告一次进度，调用方需持有 d.mutex。
+func (d *fakeDisk) cloneData(dst *fakeDisk, progress ProgressFunc) VddkError {
+	grains := make([]uint64, 0)
+	for grain := range d.allocatedGrains() {
+		grains = append(grains, grain)
+	}
+	sort.Slice(grains, func(i, j int) bool { return grains[i] < grains[j] })
+	for i, grain := range grains {
+		if err := fakeProgress(progress, i*100/len(grains), "Clone a virtual disk"); err != nil {
+			return err
+		}
+		buf := make([]byte, fakeGrainSize)
+		if err := d.readParentAt(buf, int64(grain)*fakeGrainSize); err != nil {
+			return newFakeError(VIX_E_FAIL, "Clone a virtual disk")
+		}
+		dst.grains[grain] = buf
+		dst.allocated[grain] = true
+	}
+	return nil
+}
+
+// lookupDisk 按路径查找磁盘。
+func (fb *FakeBackend) lookupDisk(path string) (*fakeDisk, bool) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	disk, ok := fb.disks[path]
+	return disk, ok
+}
+
+// lookupHandle 校验并取出句柄。
+func (fb *FakeBackend) lookupHandle(diskHandle VixDiskLibHandle) (*fakeHandle, bool) {
+	handle, ok := diskHandle.dli.(*fakeHandle)
+	if !ok || handle == nil {
+		return nil, false
+	}
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	if handle.closed || handle.conn.closed {
+		return nil, false
+	}
+	return handle, true
+}
+
+// lookupConnection 校验并取出连接。
+func (fb *FakeBackend) lookupConnection(connection VixDiskLibConnection) (*fakeConnection, bool) {
+	conn, ok := connection.conn.(*fakeConnection)
+	if !ok || conn == nil {
+		return nil, false
+	}
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	return conn, !conn.closed
+}
+
+// Init 初始化 FakeBackend。
+func (fb *FakeBackend) Init(majorVersion uint32, minorVersion uint32, dir string) VddkError {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.initialized = true
+	return nil
+}
+
+// InitEx 初始化 FakeBackend，配置文件会被忽略。
+func (fb *FakeBackend) InitEx(majorVersion uint32, minorVersion uint32, dir string, configFile string) VddkError {
+	return fb.Init(majorVersion, minorVersion, dir)
+}
+
+// Exit 结束 FakeBackend 的使用，已登记的磁盘会被保留。
+func (fb *FakeBackend) Exit() {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.initialized = false
+}
+
+// checkInitialized 检查 FakeBackend 是否已经初始化。
+func (fb *FakeBackend) checkInitialized(operation string) VddkError {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	if !fb.initialized {
+		return newFakeError(VIX_E_FAIL, operation)
+	}
+	return nil
+}
+
+// PrepareForAccess 在 FakeBackend 中总是成功。
+func (fb *FakeBackend) PrepareForAccess(appGlobal ConnectParams) VddkError {
+	return fb.checkInitialized("Prepare for access")
+}
+
+// EndAccess 在 FakeBackend 中总是成功。
+func (fb *FakeBackend) EndAccess(appGlobal ConnectParams) VddkError {
+	return fb.checkInitialized("End access")
+}
+
+// Connect 创建一个新的连接。
+func (fb *FakeBackend) Connect(appGlobal ConnectParams) (VixDiskLibConnection, VddkError) {
+	if err := fb.checkInitialized("Connect"); err != nil {
+		return VixDiskLibConnection{}, err
+	}
+	return fb.newConnection(appGlobal), nil
+}
+
+// ConnectEx 创建一个新的连接，设置了快照时快照必须已经通过 AddSnapshot 登记。
+func (fb *FakeBackend) ConnectEx(appGlobal ConnectParams) (VixDiskLibConnection, VddkError) {
+	if err := fb.checkInitialized("ConnectEx"); err != nil {
+		return VixDiskLibConnection{}, err
+	}
+	if appGlobal.snapshotRef != "" {
+		fb.mutex.Lock()
+		_, ok := fb.snapshots[appGlobal.snapshotRef]
+		fb.mutex.Unlock()
+		if !ok {
+			return VixDiskLibConnection{}, newFakeError(VIX_E_INVALID_ARG, "ConnectEx")
+		}
+	}
+	return fb.newConnection(appGlobal), nil
+}
+
+// newConnection 创建一个新的连接并计数。
+func (fb *FakeBackend) newConnection(appGlobal ConnectParams) VixDiskLibConnection {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.connects++
+	return VixDiskLibConnection{conn: &fakeConnection{params: appGlobal, epoch: fb.epoch}}
+}
+
+// DropConnections 模拟网络中断：此前建立的远程连接上的读写都返回 VIX_E_HOST_TCP_CONN_LOST，
+// 重新连接并打开磁盘后恢复正常。本地连接不受影响。
+func (fb *FakeBackend) DropConnections() {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.epoch++
+}
+
+// ConnectCount 返回 Connect 和 ConnectEx 成功建立的连接数。
+func (fb *FakeBackend) ConnectCount() int {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	return fb.connects
+}
+
+// checkConnected 检查句柄所在的远程连接是否被 DropConnections 断开。
+func (fb *FakeBackend) checkConnected(handle *fakeHandle, operation string) VddkError {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	if handle.conn.params.serverName != "" && handle.conn.epoch != fb.epoch {
+		return newFakeError(VIX_E_HOST_TCP_CONN_LOST, operation)
+	}
+	return nil
+}
+
+// Disconnect 关闭连接，连接上打开的句柄随之失效。
+func (fb *FakeBackend) Disconnect(connection VixDiskLibConnection) VddkError {
+	conn, ok := fb.lookupConnection(connection)
+	if !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Disconnect")
+	}
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	conn.closed = true
+	return nil
+}
+
+// Cleanup 在 FakeBackend 中没有需要清理的内容。
+func (fb *FakeBackend) Cleanup(appGlobal ConnectParams, numCleanUp uint32, numRemaining uint32) VddkError {
+	return nil
+}
+
+// ListTransportModes 返回 FakeBackend 支持的传输模式。
+func (fb *FakeBackend) ListTransportModes() string {
+	return "file:" + NBDSSL + ":" + NBD
+}
+
+// GetErrorText 返回与 VDDK 相同的英文错误说明，忽略 locale。
+func (fb *FakeBackend) GetErrorText(errCode uint64, locale string) string {
+	if text, ok := errorTexts[errCode]; ok {
+		return text
+	}
+	return fmt.Sprintf("Unknown error %d", errCode)
+}
+
+// Open 打开已登记的磁盘。
+func (fb *FakeBackend) Open(conn VixDiskLibConnection, params ConnectParams) (VixDiskLibHandle, VddkError) {
+	fakeConn, ok := fb.lookupConnection(conn)
+	if !ok {
+		return VixDiskLibHandle{}, newFakeError(VIX_E_INVALID_ARG, "Open virtual disk file")
+	}
+	path := params.path
+	if path == "" {
+		path = params.fcdId
+	}
+	snapshotRef := fakeConn.params.snapshotRef
+	var disk *fakeDisk
+	if snapshotRef != "" {
+		fb.mutex.Lock()
+		disk, ok = fb.snapshots[snapshotRef][path]
+		fb.mutex.Unlock()
+	} else {
+		disk, ok = fb.lookupDisk(path)
+	}
+	if !ok {
+		return VixDiskLibHandle{}, newFakeError(VIX_E_FILE_NOT_FOUND, "Open virtual disk file")
+	}
+	handle := &fakeHandle{
+		disk:     disk,
+		conn:     fakeConn,
+		readOnly: params.flag&VIXDISKLIB_FLAG_OPEN_READ_ONLY != 0 || fakeConn.params.readOnly || snapshotRef != "",
+	}
+	// 与 VDDK 一样通过日志回调报告打开的磁盘
+	logVddkMessage(vddkLogLevelLog, fmt.Sprintf("VixDiskLib: Opening disk %s.\n", path))
+	if snapshotRef != "" && params.flag&VIXDISKLIB_FLAG_OPEN_READ_ONLY == 0 {
+		logVddkMessage(vddkLogLevelWarn, fmt.Sprintf("VixDiskLib: Disk %s of snapshot %s is opened read-only.\n", path, snapshotRef))
+	}
+	return VixDiskLibHandle{dli: handle}, nil
+}
+
+// Close 关闭磁盘句柄。
+func (fb *FakeBackend) Close(diskHandle VixDiskLibHandle) VddkError {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Close virtual disk")
+	}
+	logVddkMessage(vddkLogLevelLog, fmt.Sprintf("VixDiskLib: Closing disk %s.\n", handle.disk.path))
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	handle.closed = true
+	return nil
+}
+
+// GetInfo 返回磁盘信息。
+func (fb *FakeBackend) GetInfo(diskHandle VixDiskLibHandle) (VixDiskLibInfo, VddkError) {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return VixDiskLibInfo{}, newFakeError(VIX_E_INVALID_ARG, "GetInfo")
+	}
+	handle.disk.mutex.RLock()
+	defer handle.disk.mutex.RUnlock()
+	info := handle.disk.info
+	for parent := handle.disk.parent; parent != nil; parent = parent.parent {
+		if info.ParentFileNameHint == "" {
+			info.ParentFileNameHint = parent.path
+		}
+		info.NumLinks++
+	}
+	return info, nil
+}
+
+// GetTransportMode 返回句柄所在连接使用的传输模式，本地连接为 file。
+func (fb *FakeBackend) GetTransportMode(diskHandle VixDiskLibHandle) string {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return ""
+	}
+	params := handle.conn.params
+	if params.serverName == "" {
+		return "file"
+	}
+	if params.mode == "" {
+		return NBD
+	}
+	return strings.Split(params.mode, ":")[0]
+}
+
+// checkRange 校验一次扇区读写的参数。
+func (fb *FakeBackend) checkRange(handle *fakeHandle, startSector uint64, numSectors uint64, buf []byte, operation string) VddkError {
+	if uint64(len(buf)) < numSectors*VIXDISKLIB_SECTOR_SIZE {
+		return newFakeError(VIX_E_INVALID_ARG, operation)
+	}
+	if startSector+numSectors > uint64(handle.disk.info.Capacity) {
+		return newFakeError(VIX_E_DISK_OUTOFRANGE, operation)
+	}
+	return nil
+}
+
+// Read 从磁盘读取 numSectors 个扇区。
+func (fb *FakeBackend) Read(diskHandle VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte) VddkError {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Read from virtual disk file")
+	}
+	if err := fb.checkConnected(handle, "Read from virtual disk file"); err != nil {
+		return err
+	}
+	handle.disk.mutex.RLock()
+	defer handle.disk.mutex.RUnlock()
+	if err := fb.checkRange(handle, startSector, numSectors, buf, "Read from virtual disk file"); err != nil {
+		return err
+	}
+	if err := handle.disk.readAt(buf[:numSectors*VIXDISKLIB_SECTOR_SIZE], int64(startSector)*VIXDISKLIB_SECTOR_SIZE); err != nil {
+		return newFakeError(VIX_E_FAIL, "Read from virtual disk file")
+	}
+	return nil
+}
+
+// Write 向磁盘写入 numSectors 个扇区。
+func (fb *FakeBackend) Write(diskHandle VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte) VddkError {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Write to virtual disk file")
+	}
+	if err := fb.checkConnected(handle, "Write to virtual disk file"); err != nil {
+		return err
+	}
+	if handle.readOnly {
+		return newFakeError(VIX_E_FILE_READ_ONLY, "Write to virtual disk file")
+	}
+	handle.disk.mutex.Lock()
+	defer handle.disk.mutex.Unlock()
+	if err := fb.checkRange(handle, startSector, numSectors, buf, "Write to virtual disk file"); err != nil {
+		return err
+	}
+	if err := handle.disk.writeAt(buf[:numSectors*VIXDISKLIB_SECTOR_SIZE], int64(startSector)*VIXDISKLIB_SECTOR_SIZE); err != nil {
+		return newFakeError(VIX_E_FAIL, "Write to virtual disk file")
+	}
+	return nil
+}
+
+// ReadAsync 在单独的 goroutine 中执行读取，完成后调用 completion。
+func (fb *FakeBackend) ReadAsync(diskHandle VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte, completion func(VddkError)) VddkError {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Read from virtual disk file asynchronously")
+	}
+	handle.pending.Add(1)
+	go func() {
+		defer handle.pending.Done()
+		completion(fb.Read(diskHandle, startSector, numSectors, buf))
+	}()
+	return nil
+}
+
+// WriteAsync 在单独的 goroutine 中执行写入，完成后调用 completion。
+func (fb *FakeBackend) WriteAsync(diskHandle VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte, completion func(VddkError)) VddkError {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Write to virtual disk file asynchronously")
+	}
+	handle.pending.Add(1)
+	go func() {
+		defer handle.pending.Done()
+		completion(fb.Write(diskHandle, startSector, numSectors, buf))
+	}()
+	return nil
+}
+
+// Wait 等待句柄上所有未完成的异步请求结束。
+func (fb *FakeBackend) Wait(diskHandle VixDiskLibHandle) VddkError {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Wait for asynchronous operations")
+	}
+	handle.pending.Wait()
+	return nil
+}
+
+// Flush 对内存磁盘没有作用，文件磁盘会被同步到存储上。
+func (fb *FakeBackend) Flush(diskHandle VixDiskLibHandle) VddkError {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Flush virtual disk file")
+	}
+	handle.disk.mutex.RLock()
+	defer handle.disk.mutex.RUnlock()
+	if handle.disk.file != nil {
+		if err := handle.disk.file.Sync(); err != nil {
+			return newFakeError(VIX_E_FAIL, "Flush virtual disk file")
+		}
+	}
+	return nil
+}
+
+// QueryAllocatedBlocks 按照 chunkSize 返回已分配的块，参数的校验和相邻块的合并与 VDDK 一致，参见 QueryChunks。
+func (fb *FakeBackend) QueryAllocatedBlocks(diskHandle VixDiskLibHandle, startSector VixDiskLibSectorType, numSectors VixDiskLibSectorType, chunkSize VixDiskLibSectorType) ([]VixDiskLibBlock, VddkError) {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return nil, newFakeError(VIX_E_INVALID_ARG, fmt.Sprintf("QueryAllocatedBlocks(%d, %d, %d)", startSector, numSectors, chunkSize))
+	}
+	disk := handle.disk
+	disk.mutex.RLock()
+	defer disk.mutex.RUnlock()
+	return QueryChunks(startSector, numSectors, chunkSize, disk.info.Capacity, func(chunk VixDiskLibSectorType, chunkEnd VixDiskLibSectorType) (bool, error) {
+		for grain := uint64(chunk) / fakeGrainSectors; grain <= uint64(chunkEnd-1)/fakeGrainSectors; grain++ {
+			if disk.isAllocated(grain) {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+// GetMetadataKeys 将以 NUL 分隔的元数据键列表写入 buf，并以额外的 NUL 结尾。
+func (fb *FakeBackend) GetMetadataKeys(diskHandle VixDiskLibHandle, buf []byte) (uint, VddkError) {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return 0, newFakeError(VIX_E_INVALID_ARG, "GetMetadataKeys")
+	}
+	handle.disk.mutex.RLock()
+	keys := make([]string, 0, len(handle.disk.metadata))
+	for key := range handle.disk.metadata {
+		keys = append(keys, key)
+	}
+	handle.disk.mutex.RUnlock()
+	sort.Strings(keys)
+	var list []byte
+	for _, key := range keys {
+		list = append(list, key...)
+		list = append(list, 0)
+	}
+	list = append(list, 0)
+	if len(buf) < len(list) {
+		return uint(len(list)), newFakeError(VIX_E_BUFFER_TOOSMALL, "GetMetadataKeys")
+	}
+	copy(buf, list)
+	return uint(len(list)), nil
+}
+
+// ReadMetadata 将元数据键 key 对应的值以 NUL 结尾写入 buf。
+func (fb *FakeBackend) ReadMetadata(diskHandle VixDiskLibHandle, key string, buf []byte) (uint, VddkError) {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return 0, newFakeError(VIX_E_INVALID_ARG, "Read meta data from virtual disk file")
+	}
+	handle.disk.mutex.RLock()
+	val, ok := handle.disk.metadata[key]
+	handle.disk.mutex.RUnlock()
+	if !ok {
+		return 0, newFakeError(VIX_E_FAIL, "Read meta data from virtual disk file")
+	}
+	required := uint(len(val) + 1)
+	if uint(len(buf)) < required {
+		return required, newFakeError(VIX_E_BUFFER_TOOSMALL, "Read meta data from virtual disk file")
+	}
+	copy(buf, val)
+	buf[len(val)] = 0
+	return required, nil
+}
+
+// WriteMetadata 写入一个元数据键值对。
+func (fb *FakeBackend) WriteMetadata(diskHandle VixDiskLibHandle, key string, val string) VddkError {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Write meta data")
+	}
+	if handle.readOnly {
+		return newFakeError(VIX_E_FILE_READ_ONLY, "Write meta data")
+	}
+	handle.disk.mutex.Lock()
+	defer handle.disk.mutex.Unlock()
+	handle.disk.metadata[key] = val
+	return nil
+}
+
+// Create 创建一块新的内存磁盘。
+func (fb *FakeBackend) Create(connection VixDiskLibConnection, path string, createParams VixDiskLibCreateParams, progress ProgressFunc) VddkError {
+	if _, ok := fb.lookupConnection(connection); !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Create a virtual disk")
+	}
+	if err := checkSectorSize(createParams, "Create a virtual disk"); err != nil {
+		return err
+	}
+	if err := fakeProgress(progress, 0, "Create a virtual disk"); err != nil {
+		return err
+	}
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	if _, ok := fb.disks[path]; ok {
+		return newFakeError(VIX_E_FILE_ALREADY_EXISTS, "Create a virtual disk")
+	}
+	disk := newFakeDisk(path, createParams.capacity, createParams.diskType, createParams.adapterType)
+	disk.setSectorSize(createParams.LogicalSectorSize(), createParams.PhysicalSectorSize())
+	fb.disks[path] = disk
+	fakeProgress(progress, 100, "Create a virtual disk")
+	return nil
+}
+
+// CreateChild 为句柄对应的磁盘创建一块子磁盘，子磁盘中未写入的数据从父磁盘读取。
+func (fb *FakeBackend) CreateChild(diskHandle VixDiskLibHandle, childPath string, diskType VixDiskLibDiskType, progress ProgressFunc) VddkError {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Create child virtual disk")
+	}
+	handle.disk.mutex.RLock()
+	child := newFakeDisk(childPath, handle.disk.info.Capacity, diskType, handle.disk.info.AdapterType)
+	child.setSectorSize(handle.disk.info.LogicalSectorSize, handle.disk.info.PhysicalSectorSize)
+	handle.disk.mutex.RUnlock()
+	child.parent = handle.disk
+	if err := fakeProgress(progress, 0, "Create child virtual disk"); err != nil {
+		return err
+	}
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	if _, ok := fb.disks[childPath]; ok {
+		return newFakeError(VIX_E_FILE_ALREADY_EXISTS, "Create child virtual disk")
+	}
+	fb.disks[childPath] = child
+	fakeProgress(progress, 100, "Create child virtual disk")
+	return nil
+}
+
+// Clone 将源磁盘链展开复制为一块新的内存磁盘。
+func (fb *FakeBackend) Clone(dstConnection VixDiskLibConnection, dstPath string, srcConnection VixDiskLibConnection, srcPath string,
+	params VixDiskLibCreateParams, progress ProgressFunc, overWrite bool) VddkError {
+	_, dstOk := fb.lookupConnection(dstConnection)
+	_, srcOk := fb.lookupConnection(srcConnection)
+	if !dstOk || !srcOk {
+		return newFakeError(VIX_E_INVALID_ARG, "Clone a virtual disk")
+	}
+	src, ok := fb.lookupDisk(srcPath)
+	if !ok {
+		return newFakeError(VIX_E_FILE_NOT_FOUND, "Clone a virtual disk")
+	}
+	if _, ok := fb.lookupDisk(dstPath); ok && !overWrite {
+		return newFakeError(VIX_E_FILE_ALREADY_EXISTS, "Clone a virtual disk")
+	}
+	if err := checkSectorSize(params, "Clone a virtual disk"); err != nil {
+		return err
+	}
+	src.mutex.RLock()
+	dst := newFakeDisk(dstPath, src.info.Capacity, params.diskType, params.adapterType)
+	dst.setSectorSize(params.LogicalSectorSize(), params.PhysicalSectorSize())
+	err := src.cloneData(dst, progress)
+	src.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.disks[dstPath] = dst
+	fakeProgress(progress, 100, "Clone a virtual disk")
+	return nil
+}
+
+// Grow 将磁盘扩展到 capacity 个扇区。
+func (fb *FakeBackend) Grow(connection VixDiskLibConnection, path string, capacity VixDiskLibSectorType, updateGeometry bool, progress ProgressFunc) VddkError {
+	if _, ok := fb.lookupConnection(connection); !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Grow")
+	}
+	disk, ok := fb.lookupDisk(path)
+	if !ok {
+		return newFakeError(VIX_E_FILE_NOT_FOUND, "Grow")
+	}
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+	if capacity < disk.info.Capacity {
+		return newFakeError(VIX_E_INVALID_ARG, "Grow")
+	}
+	if err := fakeProgress(progress, 0, "Grow"); err != nil {
+		return err
+	}
+	if disk.file != nil {
+		if err := disk.file.Truncate(int64(capacity) * VIXDISKLIB_SECTOR_SIZE); err != nil {
+			return newFakeError(VIX_E_FAIL, "Grow")
+		}
+	}
+	disk.info.Capacity = capacity
+	if updateGeometry {
+		disk.info.BiosGeo, disk.info.PhysGeo = fakeGeometry(capacity)
+	}
+	fakeProgress(progress, 100, "Grow")
+	return nil
+}
+
+// Shrink 回收内容全部为零的颗粒。
+func (fb *FakeBackend) Shrink(diskHandle VixDiskLibHandle, progress ProgressFunc) VddkError {
+	handle, ok := fb.lookupHandle(diskHandle)
+	if !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Shrink")
+	}
+	disk := handle.disk
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+	if disk.file != nil || disk.parent != nil {
+		return nil
+	}
+	done := 0
+	total := len(disk.grains)
+	for grain, buf := range disk.grains {
+		if err := fakeProgress(progress, done*100/total, "Shrink"); err != nil {
+			return err
+		}
+		if isZero(buf) {
+			delete(disk.grains, grain)
+			delete(disk.allocated, grain)
+		}
+		done++
+	}
+	fakeProgress(progress, 100, "Shrink")
+	return nil
+}
+
+// Defragment 在 FakeBackend 中不需要做任何事情。
+func (fb *FakeBackend) Defragment(diskHandle VixDiskLibHandle, progress ProgressFunc) VddkError {
+	if _, ok := fb.lookupHandle(diskHandle); !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Defragment")
+	}
+	if err := fakeProgress(progress, 0, "Defragment"); err != nil {
+		return err
+	}
+	fakeProgress(progress, 100, "Defragment")
+	return nil
+}
+
+// Attach 将子磁盘链附加到父磁盘链上。
+func (fb *FakeBackend) Attach(childHandle VixDiskLibHandle, parentHandle VixDiskLibHandle) VddkError {
+	child, childOk := fb.lookupHandle(childHandle)
+	parent, parentOk := fb.lookupHandle(parentHandle)
+	if !childOk || !parentOk || child.disk == parent.disk {
+		return newFakeError(VIX_E_INVALID_ARG, "Attach child disk chain to the parent disk chain")
+	}
+	child.disk.mutex.Lock()
+	defer child.disk.mutex.Unlock()
+	child.disk.parent = parent.disk
+	return nil
+}
+
+// CheckRepair 检查磁盘是否存在。
+func (fb *FakeBackend) CheckRepair(connection VixDiskLibConnection, filename string, repair bool) VddkError {
+	if _, ok := fb.lookupConnection(connection); !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Check repair")
+	}
+	if _, ok := fb.lookupDisk(filename); !ok {
+		return newFakeError(VIX_E_FILE_NOT_FOUND, "Check repair")
+	}
+	return nil
+}
+
+// Rename 重命名已登记的磁盘。
+func (fb *FakeBackend) Rename(srcFileName string, dstFileName string) VddkError {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	disk, ok := fb.disks[srcFileName]
+	if !ok {
+		return newFakeError(VIX_E_FILE_NOT_FOUND, "Rename")
+	}
+	if _, ok := fb.disks[dstFileName]; ok {
+		return newFakeError(VIX_E_FILE_ALREADY_EXISTS, "Rename")
+	}
+	delete(fb.disks, srcFileName)
+	disk.path = dstFileName
+	fb.disks[dstFileName] = disk
+	return nil
+}
+
+// Unlink 删除已登记的磁盘。
+func (fb *FakeBackend) Unlink(connection VixDiskLibConnection, path string) VddkError {
+	if _, ok := fb.lookupConnection(connection); !ok {
+		return newFakeError(VIX_E_INVALID_ARG, "Delete the virtual disk including all the extents")
+	}
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	if _, ok := fb.disks[path]; !ok {
+		return newFakeError(VIX_E_FILE_NOT_FOUND, "Delete the virtual disk including all the extents")
+	}
+	delete(fb.disks, path)
+	return nil
+}
+
+// SpaceNeededForClone 返回克隆为 diskType 类型所需的字节数：预分配类型需要完整容量，稀疏类型只需要已分配的数据。
+func (fb *FakeBackend) SpaceNeededForClone(srcHandle VixDiskLibHandle, diskType VixDiskLibDiskType) (uint64, VddkError) {
+	handle, ok := fb.lookupHandle(srcHandle)
+	if !ok {
+		return 0, newFakeError(VIX_E_INVALID_ARG, "Get space needed for clone")
+	}
+	disk := handle.disk
+	disk.mutex.RLock()
+	defer disk.mutex.RUnlock()
+	switch diskType {
+	case VIXDISKLIB_DISK_MONOLITHIC_FLAT, VIXDISKLIB_DISK_SPLIT_FLAT, VIXDISKLIB_DISK_VMFS_FLAT:
+		return uint64(disk.capacityBytes()), nil
+	default:
+		return uint64(len(disk.allocatedGrains())) * fakeGrainSize, nil
+	}
+}
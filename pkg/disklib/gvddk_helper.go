@@ -1,7 +1,5 @@
 package disklib
 
-// #include "gvddk_c.h"
-import "C"
 import (
 	"crypto/tls"		// 导入 TLS 库用于加密通信
 	"fmt"
@@ -9,16 +7,9 @@ import (
 )
 import "crypto/sha1"	// 导入 SHA-1 哈希库用于计算指纹
 
-// 声明用于打开磁盘的标志常量
-const (
-	VIXDISKLIB_FLAG_OPEN_UNBUFFERED         = C.VIXDISKLIB_FLAG_OPEN_UNBUFFERED
-	VIXDISKLIB_FLAG_OPEN_SINGLE_LINK        = C.VIXDISKLIB_FLAG_OPEN_SINGLE_LINK
-	VIXDISKLIB_FLAG_OPEN_READ_ONLY          = C.VIXDISKLIB_FLAG_OPEN_READ_ONLY
-	VIXDISKLIB_FLAG_OPEN_COMPRESSION_ZLIB   = C.VIXDISKLIB_FLAG_OPEN_COMPRESSION_ZLIB
-	VIXDISKLIB_FLAG_OPEN_COMPRESSION_FASTLZ = C.VIXDISKLIB_FLAG_OPEN_COMPRESSION_FASTLZ
-	VIXDISKLIB_FLAG_OPEN_COMPRESSION_SKIPZ  = C.VIXDISKLIB_FLAG_OPEN_COMPRESSION_SKIPZ
-	VIXDISKLIB_FLAG_OPEN_COMPRESSION_MASK   = C.VIXDISKLIB_FLAG_OPEN_COMPRESSION_MASK
-)
+// 打开磁盘的标志、扇区与块大小、错误码以及磁盘和适配器类型的常量取值由后端决定：
+// 使用 VDDK 构建时直接取自 vixDiskLib.h（见 gvddk_cgo.go），
+// 使用 novddk 构建标签时取自 gvddk_novddk.go 中的等值定义。
 
 // 声明传输模式的常量
 const (
@@ -27,41 +18,12 @@ const (
 	HOTADD = "hotadd"
 )
 
-// 声明扇区大小的常量
-const VIXDISKLIB_SECTOR_SIZE = C.VIXDISKLIB_SECTOR_SIZE
-
-// 定义块的常量
-const VIXDISKLIB_MIN_CHUNK_SIZE = C.VIXDISKLIB_MIN_CHUNK_SIZE
-const VIXDISKLIB_MAX_CHUNK_SIZE = C.VIXDISKLIB_MAX_CHUNK_SIZE
-const VIXDISKLIB_MAX_CHUNK_NUMBER = C.VIXDISKLIB_MAX_CHUNK_NUMBER
-
-// 声明错误代码的常量
-const VIX_E_DISK_OUTOFRANGE = C.VIX_E_DISK_OUTOFRANGE
-
 // 定义磁盘类型的枚举类型
 type VixDiskLibDiskType int
-const (
-	VIXDISKLIB_DISK_MONOLITHIC_SPARSE VixDiskLibDiskType = C.VIXDISKLIB_DISK_MONOLITHIC_SPARSE // monolithic file, sparse,
-	VIXDISKLIB_DISK_MONOLITHIC_FLAT   VixDiskLibDiskType = C.VIXDISKLIB_DISK_MONOLITHIC_FLAT   // monolithic file, all space pre-allocated
-	VIXDISKLIB_DISK_SPLIT_SPARSE      VixDiskLibDiskType = C.VIXDISKLIB_DISK_SPLIT_SPARSE      // disk split into 2GB extents, sparse
-	VIXDISKLIB_DISK_SPLIT_FLAT        VixDiskLibDiskType = C.VIXDISKLIB_DISK_SPLIT_FLAT        // disk split into 2GB extents, pre-allocated
-	VIXDISKLIB_DISK_VMFS_FLAT         VixDiskLibDiskType = C.VIXDISKLIB_DISK_VMFS_FLAT         // ESX 3.0 and above flat disks
-	VIXDISKLIB_DISK_STREAM_OPTIMIZED  VixDiskLibDiskType = C.VIXDISKLIB_DISK_STREAM_OPTIMIZED  // compressed monolithic sparse
-	VIXDISKLIB_DISK_VMFS_THIN         VixDiskLibDiskType = C.VIXDISKLIB_DISK_VMFS_THIN         // ESX 3.0 and above thin provisioned
-	VIXDISKLIB_DISK_VMFS_SPARSE       VixDiskLibDiskType = C.VIXDISKLIB_DISK_VMFS_SPARSE       // ESX 3.0 and above sparse disks
-	VIXDISKLIB_DISK_UNKNOWN           VixDiskLibDiskType = C.VIXDISKLIB_DISK_UNKNOWN           // unknown type
-)
 
 // 定义适配器类型的枚举类型
 type VixDiskLibAdapterType int
 
-const (
-	VIXDISKLIB_ADAPTER_IDE           VixDiskLibAdapterType = C.VIXDISKLIB_ADAPTER_IDE
-	VIXDISKLIB_ADAPTER_SCSI_BUSLOGIC VixDiskLibAdapterType = C.VIXDISKLIB_ADAPTER_SCSI_BUSLOGIC
-	VIXDISKLIB_ADAPTER_SCSI_LSILOGIC VixDiskLibAdapterType = C.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC
-	VIXDISKLIB_ADAPTER_UNKNOWN       VixDiskLibAdapterType = C.VIXDISKLIB_ADAPTER_UNKNOWN
-)
-
 // 定义扇区类型的无符号整数类型
 type VixDiskLibSectorType uint64
 
@@ -81,16 +43,17 @@ type ConnectParams struct {
 	flag       uint32	// 标志
 	readOnly   bool		// 是否只读
 	mode       string	// 模式
+	snapshotRef string	// 虚拟机快照的 MoRef，与 vmxSpec 一起使用
 }
 
-// 定义 VixDiskLibHandle 结构，表示磁盘句柄
+// 定义 VixDiskLibHandle 结构，表示磁盘句柄，dli 的具体类型由创建它的后端决定
 type VixDiskLibHandle struct {
-	dli C.VixDiskLibHandle
+	dli interface{}
 }
 
-// 定义 VixDiskLibConnection 结构，表示磁盘连接
+// 定义 VixDiskLibConnection 结构，表示磁盘连接，conn 的具体类型由创建它的后端决定
 type VixDiskLibConnection struct {
-	conn C.VixDiskLibConnection
+	conn interface{}
 }
 
 // 定义 vddkErrorImpl 结构，实现 VddkError 接口
@@ -107,34 +70,39 @@ type vddkErrorImpl struct {
 
 // 该结构用于定义创建磁盘时的参数。
 type VixDiskLibCreateParams struct {
-	diskType    VixDiskLibDiskType
-	adapterType VixDiskLibAdapterType
-	hwVersion   uint16
-	capacity    VixDiskLibSectorType
+	diskType           VixDiskLibDiskType
+	adapterType        VixDiskLibAdapterType
+	hwVersion          uint16
+	capacity           VixDiskLibSectorType
+	logicalSectorSize  uint32
+	physicalSectorSize uint32
 }
 
-// VixDiskLib Block 是底层 C 类型的 Go 类型。
+// VixDiskLibBlock 对应底层 C 类型 VixDiskLibBlock。
 // 该结构用于表示虚拟磁盘上的数据块。
-type VixDiskLibBlock C.VixDiskLibBlock
+type VixDiskLibBlock struct {
+	offset VixDiskLibSectorType
+	length VixDiskLibSectorType
+}
 
 // 返回块的偏移量（以扇区为单位）。
 func (b VixDiskLibBlock) Offset() VixDiskLibSectorType {
-	return VixDiskLibSectorType(b.offset)
+	return b.offset
 }
 
 // 用于设置块的偏移量。
 func (b *VixDiskLibBlock) SetOffset(offset VixDiskLibSectorType) {
-	b.offset = C.VixDiskLibSectorType(offset)
+	b.offset = offset
 }
 
 // 返回块的长度（以扇区为单位）。
 func (b VixDiskLibBlock) Length() VixDiskLibSectorType {
-	return VixDiskLibSectorType(b.length)
+	return b.length
 }
 
 // 方法用于设置块的长度。
 func (b *VixDiskLibBlock) SetLength(length VixDiskLibSectorType) {
-	b.length = C.VixDiskLibSectorType(length)
+	b.length = length
 }
 
 // 该结构用于表示虚拟磁盘的几何信息，包括圆柱数、磁头数和扇区数。
@@ -153,6 +121,8 @@ type VixDiskLibInfo struct {
 	NumLinks           int
 	ParentFileNameHint string
 	Uuid               string
+	LogicalSectorSize  uint32 // 逻辑扇区大小，4Kn 磁盘为 4096
+	PhysicalSectorSize uint32 // 物理扇区大小
 }
 
 // 错误信息
@@ -166,6 +136,8 @@ func (this vddkErrorImpl) VixErrorCode() uint64 {
 }
 
 // 该函数用于创建 ConnectParams 结构，包括连接虚拟机所需的参数。
+//
+// Deprecated: 使用 BuildConnectParams 和 ConnectOption，例如 ForFCD、WithCredentials。
 func NewConnectParams(vmxSpec string, serverName string, thumbPrint string, userName string, password string,
 	fcdId string, ds string, fcdssId string, cookie string, identity string, path string, flag uint32, readOnly bool, mode string) ConnectParams {
 	params := ConnectParams{
@@ -187,11 +159,11 @@ func NewConnectParams(vmxSpec string, serverName string, thumbPrint string, user
 	return params
 }
 
-// 该函数用于创建 VddkError 接口的实现，表示VDDK错误。
+// 该函数用于创建 VddkError 接口的实现，表示VDDK错误。错误信息后会追加 VDDK 对错误码的说明。
 func NewVddkError(err_code uint64, err_msg string) VddkError {
 	vddkError := vddkErrorImpl{
 		err_code: err_code,
-		err_msg:  err_msg,
+		err_msg:  withErrorText(err_code, err_msg),
 	}
 	return vddkError
 }
@@ -199,14 +171,60 @@ func NewVddkError(err_code uint64, err_msg string) VddkError {
 // 该函数用于创建 VixDiskLibCreateParams 结构，包括创建磁盘所需的参数。
 func NewCreateParams(diskType VixDiskLibDiskType, adapterType VixDiskLibAdapterType, hwVersion uint16, capacity VixDiskLibSectorType) VixDiskLibCreateParams {
 	params := VixDiskLibCreateParams{
-		diskType:    diskType,
-		adapterType: adapterType,
-		hwVersion:   hwVersion,
-		capacity:    capacity,
+		diskType:           diskType,
+		adapterType:        adapterType,
+		hwVersion:          hwVersion,
+		capacity:           capacity,
+		logicalSectorSize:  VIXDISKLIB_SECTOR_SIZE,
+		physicalSectorSize: VIXDISKLIB_SECTOR_SIZE,
 	}
 	return params
 }
 
+// WithSectorSize 返回设置了逻辑和物理扇区大小的副本，例如 4Kn 磁盘为 (4096, 4096)，512e 磁盘为 (512, 4096)。
+// 容量仍以 512 字节的扇区为单位。
+func (this VixDiskLibCreateParams) WithSectorSize(logicalSectorSize uint32, physicalSectorSize uint32) VixDiskLibCreateParams {
+	this.logicalSectorSize = logicalSectorSize
+	this.physicalSectorSize = physicalSectorSize
+	return this
+}
+
+// 返回磁盘类型。
+func (this VixDiskLibCreateParams) DiskType() VixDiskLibDiskType {
+	return this.diskType
+}
+
+// 返回适配器类型。
+func (this VixDiskLibCreateParams) AdapterType() VixDiskLibAdapterType {
+	return this.adapterType
+}
+
+// 返回虚拟硬件版本。
+func (this VixDiskLibCreateParams) HwVersion() uint16 {
+	return this.hwVersion
+}
+
+// 返回磁盘容量（以扇区为单位）。
+func (this VixDiskLibCreateParams) Capacity() VixDiskLibSectorType {
+	return this.capacity
+}
+
+// 返回逻辑扇区大小，未设置时为 512。
+func (this VixDiskLibCreateParams) LogicalSectorSize() uint32 {
+	if this.logicalSectorSize == 0 {
+		return VIXDISKLIB_SECTOR_SIZE
+	}
+	return this.logicalSectorSize
+}
+
+// 返回物理扇区大小，未设置时为 512。
+func (this VixDiskLibCreateParams) PhysicalSectorSize() uint32 {
+	if this.physicalSectorSize == 0 {
+		return VIXDISKLIB_SECTOR_SIZE
+	}
+	return this.physicalSectorSize
+}
+
 // 该函数用于从URL中获取服务器的证书指纹。
 func GetThumbPrintForURL(url url.URL) (string, error) {
 	return GetThumbPrintForServer(url.Hostname(), url.Port())
@@ -0,0 +1,147 @@
+package disklib
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// VDDK 日志回调的级别，与 gvddk_c.h 中的 VDDK_LOG_* 一致
+const (
+	vddkLogLevelLog   = 0
+	vddkLogLevelWarn  = 1
+	vddkLogLevelPanic = 2
+)
+
+var (
+	logMutex sync.RWMutex
+	// vddkLogger 接收 VDDK 的日志、警告和 panic 信息，为 nil 时使用 logrus.StandardLogger()
+	vddkLogger logrus.FieldLogger
+	// openDiskPaths 记录正在打开或已经打开的磁盘路径，用于为日志添加 connection 和 disk 字段
+	openDiskPaths = map[string]*diskLogContext{}
+	// openDiskHandles 记录已经打开的磁盘句柄对应的路径，Close 时据此移除 openDiskPaths 中的记录
+	openDiskHandles = map[interface{}]string{}
+)
+
+// diskLogContext 是一个磁盘路径所属的连接以及打开的次数。
+type diskLogContext struct {
+	connection string
+	refs       int
+}
+
+// SetLogger 设置接收 VDDK 日志的 logger，传入 nil 恢复为 logrus.StandardLogger()。
+// VDDK 的日志、警告和 panic 信息分别以 Info、Warn 和 Error 级别记录，并带有 component=vddk 字段，
+// 提到已打开磁盘路径的信息还带有 connection 和 disk 字段。
+func SetLogger(logger logrus.FieldLogger) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	vddkLogger = logger
+}
+
+// InitWithLogger 与 Init 相同，但先设置接收 VDDK 日志的 logger。
+func InitWithLogger(majorVersion uint32, minorVersion uint32, dir string, logger logrus.FieldLogger) VddkError {
+	SetLogger(logger)
+	return Init(majorVersion, minorVersion, dir)
+}
+
+// InitExWithLogger 与 InitEx 相同，但先设置接收 VDDK 日志的 logger。
+func InitExWithLogger(majorVersion uint32, minorVersion uint32, dir string, configFile string, logger logrus.FieldLogger) VddkError {
+	SetLogger(logger)
+	return InitEx(majorVersion, minorVersion, dir, configFile)
+}
+
+// logVddkMessage 记录一条 VDDK 信息。它会在 VDDK 内部线程的 cgo 回调中被调用，因此不能阻塞或 panic，
+// panic 级别的信息也只以 Error 级别记录。
+func logVddkMessage(level int, msg string) {
+	msg = strings.TrimRight(msg, "\r\n")
+	logMutex.RLock()
+	logger := vddkLogger
+	fields := logrus.Fields{"component": "vddk"}
+	for path, context := range openDiskPaths {
+		if strings.Contains(msg, path) {
+			fields["connection"] = context.connection
+			fields["disk"] = path
+			break
+		}
+	}
+	logMutex.RUnlock()
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	entry := logger.WithFields(fields)
+	switch level {
+	case vddkLogLevelWarn:
+		entry.Warn(msg)
+	case vddkLogLevelPanic:
+		entry.WithField("panic", true).Error(msg)
+	default:
+		entry.Info(msg)
+	}
+}
+
+// diskLogPath 返回打开磁盘时日志中用于识别磁盘的路径，FCD 使用 FCD ID。
+func diskLogPath(params ConnectParams) string {
+	if params.path != "" {
+		return params.path
+	}
+	return params.fcdId
+}
+
+// trackDiskPath 在打开磁盘之前登记路径，使打开过程中的 VDDK 日志也带有 connection 和 disk 字段。
+func trackDiskPath(params ConnectParams) {
+	path := diskLogPath(params)
+	if path == "" {
+		return
+	}
+	connection := params.serverName
+	if connection == "" {
+		connection = "local"
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	context, ok := openDiskPaths[path]
+	if !ok {
+		context = &diskLogContext{connection: connection}
+		openDiskPaths[path] = context
+	}
+	context.refs++
+}
+
+// releaseDiskPathLocked 减少路径的打开次数，不再打开时移除记录。调用者需要持有 logMutex。
+func releaseDiskPathLocked(path string) {
+	if context, ok := openDiskPaths[path]; ok {
+		context.refs--
+		if context.refs <= 0 {
+			delete(openDiskPaths, path)
+		}
+	}
+}
+
+// trackDiskHandle 记录打开成功的句柄，打开失败时移除 trackDiskPath 登记的路径。
+func trackDiskHandle(params ConnectParams, diskHandle VixDiskLibHandle, vErr VddkError) {
+	path := diskLogPath(params)
+	if path == "" {
+		return
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	if vErr != nil || diskHandle.dli == nil {
+		releaseDiskPathLocked(path)
+		return
+	}
+	openDiskHandles[diskHandle.dli] = path
+}
+
+// untrackDiskHandle 在磁盘关闭后移除句柄和路径的记录。
+func untrackDiskHandle(diskHandle VixDiskLibHandle) {
+	if diskHandle.dli == nil {
+		return
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	if path, ok := openDiskHandles[diskHandle.dli]; ok {
+		delete(openDiskHandles, diskHandle.dli)
+		releaseDiskPathLocked(path)
+	}
+}
@@ -0,0 +1,88 @@
+package disklib
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// metadataQueryAttempts 是两阶段读取元数据时最多查询的次数，元数据在两次查询之间变长时需要重新分配缓冲区
+const metadataQueryAttempts = 3
+
+// queryMetadata 先以空缓冲区查询所需的长度，再分配缓冲区读取，返回去掉末尾 NUL 的结果。
+func queryMetadata(operation string, query func(buf []byte) (uint, VddkError)) ([]byte, VddkError) {
+	var buf []byte
+	for attempt := 0; attempt < metadataQueryAttempts; attempt++ {
+		required, vErr := query(buf)
+		if vErr == nil {
+			if required > uint(len(buf)) {
+				required = uint(len(buf))
+			}
+			return bytes.TrimRight(buf[:required], "\x00"), nil
+		}
+		if vErr.VixErrorCode() != VIX_E_BUFFER_TOOSMALL || required <= uint(len(buf)) {
+			return nil, vErr
+		}
+		buf = make([]byte, required)
+	}
+	return nil, NewVddkError(VIX_E_BUFFER_TOOSMALL, fmt.Sprintf("%s failed. The error code is %d.", operation, VIX_E_BUFFER_TOOSMALL))
+}
+
+// ListMetadataKeys 返回磁盘上所有元数据的键，内部先查询所需的缓冲区大小，再读取并解析以 NUL 分隔的键列表。
+func ListMetadataKeys(diskHandle VixDiskLibHandle) ([]string, VddkError) {
+	list, vErr := queryMetadata("GetMetadataKeys", func(buf []byte) (uint, VddkError) {
+		return getBackend().GetMetadataKeys(diskHandle, buf)
+	})
+	if vErr != nil {
+		return nil, vErr
+	}
+	keys := []string{}
+	for _, key := range bytes.Split(list, []byte{0}) {
+		if len(key) > 0 {
+			keys = append(keys, string(key))
+		}
+	}
+	return keys, nil
+}
+
+// ReadMetadataKey 返回元数据键 key 的值，内部先查询所需的缓冲区大小再读取。
+func ReadMetadataKey(diskHandle VixDiskLibHandle, key string) (string, VddkError) {
+	val, vErr := queryMetadata("Read meta data from virtual disk file", func(buf []byte) (uint, VddkError) {
+		return getBackend().ReadMetadata(diskHandle, key, buf)
+	})
+	if vErr != nil {
+		return "", vErr
+	}
+	return string(val), nil
+}
+
+// GetMetadata 以键值对的形式返回磁盘上的全部元数据。
+func GetMetadata(diskHandle VixDiskLibHandle) (map[string]string, VddkError) {
+	keys, vErr := ListMetadataKeys(diskHandle)
+	if vErr != nil {
+		return nil, vErr
+	}
+	metadata := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if metadata[key], vErr = ReadMetadataKey(diskHandle, key); vErr != nil {
+			return nil, vErr
+		}
+	}
+	return metadata, nil
+}
+
+// WriteMetadataBatch 按键的字母顺序写入多个元数据键值对，遇到错误时停止，之前写入的键值对不会回滚。
+func WriteMetadataBatch(diskHandle VixDiskLibHandle, values map[string]string) VddkError {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if vErr := getBackend().WriteMetadata(diskHandle, key, values[key]); vErr != nil {
+			return NewVddkError(vErr.VixErrorCode(), fmt.Sprintf("Write meta data for key %s failed. The error code is %d.",
+				key, vErr.VixErrorCode()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+//go:build novddk
+// +build novddk
+
+package disklib
+
+// 使用 novddk 构建标签时不链接 VDDK，以下常量与 vixDiskLib.h 中的取值保持一致。
+
+// 声明用于打开磁盘的标志常量
+const (
+	VIXDISKLIB_FLAG_OPEN_UNBUFFERED         = 1 << 0
+	VIXDISKLIB_FLAG_OPEN_SINGLE_LINK        = 1 << 1
+	VIXDISKLIB_FLAG_OPEN_READ_ONLY          = 1 << 2
+	VIXDISKLIB_FLAG_OPEN_COMPRESSION_ZLIB   = 1 << 4
+	VIXDISKLIB_FLAG_OPEN_COMPRESSION_FASTLZ = 1 << 5
+	VIXDISKLIB_FLAG_OPEN_COMPRESSION_SKIPZ  = 1 << 6
+	VIXDISKLIB_FLAG_OPEN_COMPRESSION_MASK   = VIXDISKLIB_FLAG_OPEN_COMPRESSION_ZLIB | VIXDISKLIB_FLAG_OPEN_COMPRESSION_FASTLZ | VIXDISKLIB_FLAG_OPEN_COMPRESSION_SKIPZ
+)
+
+// 声明扇区大小的常量
+const VIXDISKLIB_SECTOR_SIZE = 512
+
+// 定义块的常量
+const VIXDISKLIB_MIN_CHUNK_SIZE = 128
+const VIXDISKLIB_MAX_CHUNK_SIZE = 64 * 1024 * 1024
+const VIXDISKLIB_MAX_CHUNK_NUMBER = 512 * 1024
+
+// 声明错误代码的常量
+const (
+	VIX_E_FAIL                = 1
+	VIX_E_INVALID_ARG         = 3
+	VIX_E_FILE_NOT_FOUND      = 4
+	VIX_E_NOT_SUPPORTED       = 6
+	VIX_E_CANCELLED           = 10
+	VIX_ASYNC                 = 25
+	VIX_E_FILE_READ_ONLY      = 11
+	VIX_E_FILE_ALREADY_EXISTS = 12
+	VIX_E_BUFFER_TOOSMALL     = 24
+	VIX_E_DISK_OUTOFRANGE     = 16007
+	VIX_E_DISK_FULL           = 8
+	VIX_E_FILE_ACCESS_ERROR   = 13
+)
+
+// 网络和主机连接错误的常量，ConnectionPool 遇到这些错误时重新连接
+const (
+	VIX_E_HOST_NETWORK_CONN_REFUSED = 14009
+	VIX_E_HOST_TCP_SOCKET_ERROR     = 14010
+	VIX_E_HOST_TCP_CONN_LOST        = 14011
+	VIX_E_HOST_SERVER_SHUTDOWN      = 14014
+	VIX_E_HOST_SERVER_NOT_AVAILABLE = 14015
+	VIX_E_CANNOT_CONNECT_TO_HOST    = 18000
+)
+
+// 磁盘类型
+const (
+	VIXDISKLIB_DISK_MONOLITHIC_SPARSE VixDiskLibDiskType = 1   // monolithic file, sparse,
+	VIXDISKLIB_DISK_MONOLITHIC_FLAT   VixDiskLibDiskType = 2   // monolithic file, all space pre-allocated
+	VIXDISKLIB_DISK_SPLIT_SPARSE      VixDiskLibDiskType = 3   // disk split into 2GB extents, sparse
+	VIXDISKLIB_DISK_SPLIT_FLAT        VixDiskLibDiskType = 4   // disk split into 2GB extents, pre-allocated
+	VIXDISKLIB_DISK_VMFS_FLAT         VixDiskLibDiskType = 5   // ESX 3.0 and above flat disks
+	VIXDISKLIB_DISK_STREAM_OPTIMIZED  VixDiskLibDiskType = 6   // compressed monolithic sparse
+	VIXDISKLIB_DISK_VMFS_THIN         VixDiskLibDiskType = 7   // ESX 3.0 and above thin provisioned
+	VIXDISKLIB_DISK_VMFS_SPARSE       VixDiskLibDiskType = 8   // ESX 3.0 and above sparse disks
+	VIXDISKLIB_DISK_UNKNOWN           VixDiskLibDiskType = 256 // unknown type
+)
+
+// 适配器类型
+const (
+	VIXDISKLIB_ADAPTER_IDE           VixDiskLibAdapterType = 1
+	VIXDISKLIB_ADAPTER_SCSI_BUSLOGIC VixDiskLibAdapterType = 2
+	VIXDISKLIB_ADAPTER_SCSI_LSILOGIC VixDiskLibAdapterType = 3
+	VIXDISKLIB_ADAPTER_SCSI_LSISAS   VixDiskLibAdapterType = 4
+	VIXDISKLIB_ADAPTER_SCSI_PVSCSI   VixDiskLibAdapterType = 5
+	VIXDISKLIB_ADAPTER_NVME          VixDiskLibAdapterType = 6
+	VIXDISKLIB_ADAPTER_UNKNOWN       VixDiskLibAdapterType = 256
+)
+
+// newDefaultBackend 返回不链接 VDDK 时的默认后端：一个空的内存 FakeBackend。
+func newDefaultBackend() Backend {
+	return NewFakeBackend()
+}
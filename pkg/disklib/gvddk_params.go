@@ -0,0 +1,298 @@
+package disklib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// 其余传输模式的常量，与 NBD、NBDSSL、HOTADD 一起用于 WithTransport
+const (
+	FILE = "file"
+	SAN  = "san"
+)
+
+// knownTransportModes 是 VDDK 支持的传输模式
+var knownTransportModes = map[string]bool{
+	FILE:   true,
+	SAN:    true,
+	HOTADD: true,
+	NBDSSL: true,
+	NBD:    true,
+}
+
+// ConnectOption 用于设置 ConnectParams 中的一项或几项参数。
+type ConnectOption func(params *ConnectParams)
+
+// BuildConnectParams 按顺序应用 opts 生成 ConnectParams，取代需要 14 个位置参数的 NewConnectParams。
+// 例如：BuildConnectParams(WithServer(server), WithCredentials(user, password), ForFCD(fcdId, ds), WithTransport(NBDSSL))。
+// 生成的参数没有校验，PrepareForAccess、Connect 和 ConnectEx 在调用 VDDK 之前会调用 Validate。
+func BuildConnectParams(opts ...ConnectOption) ConnectParams {
+	params := ConnectParams{}
+	for _, opt := range opts {
+		opt(&params)
+	}
+	return params
+}
+
+// With 返回应用 opts 之后的副本，原参数不变。
+func (this ConnectParams) With(opts ...ConnectOption) ConnectParams {
+	for _, opt := range opts {
+		opt(&this)
+	}
+	return this
+}
+
+// WithServer 设置 vCenter 或 ESXi 服务器的名称或 IP 地址。
+func WithServer(serverName string) ConnectOption {
+	return func(params *ConnectParams) {
+		params.serverName = serverName
+	}
+}
+
+// WithThumbprint 设置服务器证书的 SHA-1 指纹，可以由 GetThumbPrintForURL 或 GetThumbPrintForServer 获取。
+func WithThumbprint(thumbPrint string) ConnectOption {
+	return func(params *ConnectParams) {
+		params.thumbPrint = thumbPrint
+	}
+}
+
+// WithCredentials 使用用户名和密码登录。
+func WithCredentials(userName string, password string) ConnectOption {
+	return func(params *ConnectParams) {
+		params.userName = userName
+		params.password = password
+	}
+}
+
+// WithSessionCookie 使用已有会话的 cookie 登录，userName 可以为空。不能与密码同时使用。
+func WithSessionCookie(cookie string, userName string) ConnectOption {
+	return func(params *ConnectParams) {
+		params.cookie = cookie
+		params.userName = userName
+	}
+}
+
+// ForFCD 指定要访问的 FCD 以及它所在的数据存储。
+func ForFCD(fcdId string, datastore string) ConnectOption {
+	return func(params *ConnectParams) {
+		params.fcdId = fcdId
+		params.ds = datastore
+	}
+}
+
+// WithFCDSnapshot 指定 FCD 的快照 ID，只能与 ForFCD 同时使用。
+func WithFCDSnapshot(fcdssId string) ConnectOption {
+	return func(params *ConnectParams) {
+		params.fcdssId = fcdssId
+	}
+}
+
+// ForVMX 指定虚拟机（例如 "moref=vm-42"）以及虚拟机上磁盘的路径（例如 "[datastore1] vm/vm.vmdk"）。
+func ForVMX(vmxSpec string, diskPath string) ConnectOption {
+	return func(params *ConnectParams) {
+		params.vmxSpec = vmxSpec
+		params.path = diskPath
+	}
+}
+
+// ForPath 指定磁盘路径，用于本地磁盘或通过数据存储路径访问的磁盘。
+func ForPath(path string) ConnectOption {
+	return func(params *ConnectParams) {
+		params.path = path
+	}
+}
+
+// WithSnapshotRef 指定虚拟机快照的 MoRef（例如 "snapshot-7"），只能与 ForVMX 同时使用。
+func WithSnapshotRef(snapshotRef string) ConnectOption {
+	return func(params *ConnectParams) {
+		params.snapshotRef = snapshotRef
+	}
+}
+
+// WithIdentity 设置 PrepareForAccess 和 EndAccess 使用的访问标识。
+func WithIdentity(identity string) ConnectOption {
+	return func(params *ConnectParams) {
+		params.identity = identity
+	}
+}
+
+// WithTransport 设置传输模式，多个模式用冒号分隔，例如 "hotadd:nbdssl"。
+func WithTransport(mode string) ConnectOption {
+	return func(params *ConnectParams) {
+		params.mode = mode
+	}
+}
+
+// WithOpenFlags 设置打开磁盘的 VIXDISKLIB_FLAG_OPEN_* 标志。
+func WithOpenFlags(flag uint32) ConnectOption {
+	return func(params *ConnectParams) {
+		params.flag = flag
+	}
+}
+
+// ReadOnly 以只读方式连接并打开磁盘。
+func ReadOnly() ConnectOption {
+	return func(params *ConnectParams) {
+		params.readOnly = true
+		params.flag = params.flag | VIXDISKLIB_FLAG_OPEN_READ_ONLY
+	}
+}
+
+// Validate 检查参数之间是否矛盾，不访问网络也不调用 VDDK。
+func (this ConnectParams) Validate() VddkError {
+	switch {
+	case this.fcdId != "" && this.ds == "":
+		return invalidConnectParams("FCD %s requires a datastore", this.fcdId)
+	case this.fcdssId != "" && this.fcdId == "":
+		return invalidConnectParams("FCD snapshot %s requires an FCD ID", this.fcdssId)
+	case this.fcdId != "" && this.vmxSpec != "":
+		return invalidConnectParams("FCD ID and VMX spec cannot be used together")
+	case this.snapshotRef != "" && this.vmxSpec == "":
+		return invalidConnectParams("Snapshot reference %s requires a VMX spec", this.snapshotRef)
+	case this.cookie != "" && this.password != "":
+		return invalidConnectParams("Session cookie and password cannot be used together")
+	case this.serverName == "" && (this.fcdId != "" || this.vmxSpec != ""):
+		return invalidConnectParams("FCD or VMX access requires a server")
+	case this.serverName != "" && this.userName == "" && this.cookie == "":
+		return invalidConnectParams("Server %s requires credentials or a session cookie", this.serverName)
+	}
+	if this.mode != "" {
+		for _, mode := range strings.Split(this.mode, ":") {
+			if !knownTransportModes[mode] {
+				return invalidConnectParams("Unknown transport mode %q", mode)
+			}
+		}
+	}
+	return nil
+}
+
+// invalidConnectParams 返回 VIX_E_INVALID_ARG 错误。
+func invalidConnectParams(format string, args ...interface{}) VddkError {
+	return NewVddkError(VIX_E_INVALID_ARG, fmt.Sprintf("Validate connect params failed: %s. The error code is %d.",
+		fmt.Sprintf(format, args...), VIX_E_INVALID_ARG))
+}
+
+// 以下为只读访问方法，密码和 cookie 不提供访问方法，只能通过 HasPassword 和 HasCookie 判断是否设置。
+
+// VmxSpec 返回虚拟机的 VMX 描述。
+func (this ConnectParams) VmxSpec() string {
+	return this.vmxSpec
+}
+
+// ServerName 返回服务器名称或 IP 地址。
+func (this ConnectParams) ServerName() string {
+	return this.serverName
+}
+
+// ThumbPrint 返回服务器证书的指纹。
+func (this ConnectParams) ThumbPrint() string {
+	return this.thumbPrint
+}
+
+// UserName 返回用户名。
+func (this ConnectParams) UserName() string {
+	return this.userName
+}
+
+// HasPassword 返回是否设置了密码。
+func (this ConnectParams) HasPassword() bool {
+	return this.password != ""
+}
+
+// HasCookie 返回是否设置了会话 cookie。
+func (this ConnectParams) HasCookie() bool {
+	return this.cookie != ""
+}
+
+// FcdId 返回 FCD ID。
+func (this ConnectParams) FcdId() string {
+	return this.fcdId
+}
+
+// Datastore 返回 FCD 所在的数据存储。
+func (this ConnectParams) Datastore() string {
+	return this.ds
+}
+
+// FcdssId 返回 FCD 快照 ID。
+func (this ConnectParams) FcdssId() string {
+	return this.fcdssId
+}
+
+// Identity 返回访问标识。
+func (this ConnectParams) Identity() string {
+	return this.identity
+}
+
+// Path 返回磁盘路径。
+func (this ConnectParams) Path() string {
+	return this.path
+}
+
+// SnapshotRef 返回虚拟机快照的 MoRef。
+func (this ConnectParams) SnapshotRef() string {
+	return this.snapshotRef
+}
+
+// Flag 返回打开磁盘的标志。
+func (this ConnectParams) Flag() uint32 {
+	return this.flag
+}
+
+// IsReadOnly 返回是否以只读方式连接。
+func (this ConnectParams) IsReadOnly() bool {
+	return this.readOnly
+}
+
+// Mode 返回传输模式。
+func (this ConnectParams) Mode() string {
+	return this.mode
+}
+
+// CredentialDigest 返回密码和 cookie 的 SHA-256 摘要，用于在不暴露密钥的情况下判断两组参数的凭据是否相同，
+// 例如作为连接池的键。
+func (this ConnectParams) CredentialDigest() string {
+	digest := sha256.Sum256([]byte(this.password + "\x00" + this.cookie))
+	return hex.EncodeToString(digest[:])
+}
+
+// String 返回便于记录日志的描述，密码和 cookie 被替换为 "***"。
+func (this ConnectParams) String() string {
+	fields := []string{}
+	add := func(name string, value string) {
+		if value != "" {
+			fields = append(fields, name+"="+value)
+		}
+	}
+	add("server", this.serverName)
+	add("thumbprint", this.thumbPrint)
+	add("user", this.userName)
+	if this.password != "" {
+		add("password", "***")
+	}
+	if this.cookie != "" {
+		add("cookie", "***")
+	}
+	add("vmx", this.vmxSpec)
+	add("snapshot", this.snapshotRef)
+	add("fcd", this.fcdId)
+	add("datastore", this.ds)
+	add("fcdss", this.fcdssId)
+	add("path", this.path)
+	add("identity", this.identity)
+	add("mode", this.mode)
+	if this.flag != 0 {
+		add("flags", fmt.Sprintf("%#x", this.flag))
+	}
+	if this.readOnly {
+		add("readOnly", "true")
+	}
+	return "ConnectParams{" + strings.Join(fields, " ") + "}"
+}
+
+// GoString 与 String 相同，避免 %#v 输出密码和 cookie。
+func (this ConnectParams) GoString() string {
+	return this.String()
+}
@@ -0,0 +1,61 @@
+package disklib
+
+import "sync"
+
+// ProgressFunc 用于接收 Create、Clone、Grow、Shrink、Defragment 和 CreateChild 等长时间操作的进度。
+// percentCompleted 为已完成的百分比，返回 false 将取消操作，此时操作返回 VIX_E_CANCELLED。
+// 回调可能在 VDDK 的线程中被调用，不应长时间阻塞。
+type ProgressFunc func(percentCompleted int) bool
+
+// ProgressToChannel 返回一个将进度发送到 ch 的 ProgressFunc。
+// 发送是非阻塞的，接收方来不及处理时该次进度会被丢弃，操作不会因此被取消。
+func ProgressToChannel(ch chan<- int) ProgressFunc {
+	return func(percentCompleted int) bool {
+		select {
+		case ch <- percentCompleted:
+		default:
+		}
+		return true
+	}
+}
+
+// 正在进行的操作所登记的进度回调。C 侧只保存回调编号，不持有 Go 指针，
+// 编号在操作开始时分配、结束时回收，因此并发的操作之间不会相互串扰。
+var (
+	progressMutex  sync.Mutex
+	progressNextId uintptr
+	progressFuncs  = make(map[uintptr]ProgressFunc)
+)
+
+// registerProgress 登记一个进度回调并返回其编号，回调为 nil 时返回 0。
+func registerProgress(progress ProgressFunc) uintptr {
+	if progress == nil {
+		return 0
+	}
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	progressNextId++
+	progressFuncs[progressNextId] = progress
+	return progressNextId
+}
+
+// unregisterProgress 注销编号对应的进度回调。
+func unregisterProgress(progressId uintptr) {
+	if progressId == 0 {
+		return
+	}
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	delete(progressFuncs, progressId)
+}
+
+// invokeProgress 将进度转发给编号对应的回调，返回 false 表示需要取消操作。
+func invokeProgress(progressId uintptr, percentCompleted int) bool {
+	progressMutex.Lock()
+	progress := progressFuncs[progressId]
+	progressMutex.Unlock()
+	if progress == nil {
+		return true
+	}
+	return progress(percentCompleted)
+}
@@ -0,0 +1,478 @@
+// Package metrics 为 disklib 的后端提供 Prometheus 指标。
+//
+// Collector 包装另一个 disklib.Backend，记录每次 VDDK 调用的次数、耗时和错误码，按传输模式统计读写的字节数，
+// 以及当前打开的连接和磁盘句柄数，同时实现 prometheus.Collector。用法：
+//
+//	collector := metrics.NewCollector(disklib.DefaultBackend())
+//	prometheus.MustRegister(collector)
+//	disklib.InitWithBackend(collector, 7, 0, libDir)
+package metrics
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// Namespace 是所有指标名称的前缀。
+const Namespace = "vddk"
+
+// Collector 是记录 Prometheus 指标的 disklib.Backend，实际的调用由被包装的后端完成。
+type Collector struct {
+	backend disklib.Backend
+
+	calls           *prometheus.CounterVec   // 按操作统计的调用次数
+	errors          *prometheus.CounterVec   // 按操作和 Vix 错误码统计的失败次数
+	duration        *prometheus.HistogramVec // 按操作统计的调用耗时
+	bytesRead       *prometheus.CounterVec   // 按传输模式统计读取的字节数
+	bytesWritten    *prometheus.CounterVec   // 按传输模式统计写入的字节数
+	openHandles     *prometheus.GaugeVec     // 按传输模式统计打开的磁盘句柄数
+	openConnections prometheus.Gauge
+
+	mutex      sync.Mutex
+	transports map[disklib.VixDiskLibHandle]string // 打开的磁盘句柄及其传输模式
+}
+
+// NewCollector 返回包装 backend 的 Collector。
+func NewCollector(backend disklib.Backend) *Collector {
+	return &Collector{
+		backend: backend,
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "calls_total",
+			Help:      "Number of VixDiskLib calls by operation.",
+		}, []string{"operation"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "errors_total",
+			Help:      "Number of failed VixDiskLib calls by operation and Vix error code.",
+		}, []string{"operation", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "call_duration_seconds",
+			Help:      "Latency of VixDiskLib calls by operation.",
+			// 0.5 ms 到约 16 s
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, []string{"operation"}),
+		bytesRead: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "read_bytes_total",
+			Help:      "Bytes read from virtual disks by transport mode.",
+		}, []string{"transport"}),
+		bytesWritten: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "written_bytes_total",
+			Help:      "Bytes written to virtual disks by transport mode.",
+		}, []string{"transport"}),
+		openHandles: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "open_handles",
+			Help:      "Number of open virtual disk handles by transport mode.",
+		}, []string{"transport"}),
+		openConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "open_connections",
+			Help:      "Number of open VixDiskLib connections.",
+		}),
+		transports: make(map[disklib.VixDiskLibHandle]string),
+	}
+}
+
+// Describe 实现 prometheus.Collector。
+func (this *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range this.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+// Collect 实现 prometheus.Collector。
+func (this *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range this.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+// collectors 返回 Collector 包含的所有指标。
+func (this *Collector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{this.calls, this.errors, this.duration, this.bytesRead, this.bytesWritten,
+		this.openHandles, this.openConnections}
+}
+
+// observe 记录一次从 start 开始的 operation 调用。
+func (this *Collector) observe(operation string, start time.Time, vErr disklib.VddkError) {
+	this.calls.WithLabelValues(operation).Inc()
+	this.duration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if vErr != nil {
+		this.errors.WithLabelValues(operation, strconv.FormatUint(vErr.VixErrorCode(), 10)).Inc()
+	}
+}
+
+// transport 返回磁盘句柄的传输模式，不是通过 Collector 打开的句柄返回 "unknown"。
+func (this *Collector) transport(diskHandle disklib.VixDiskLibHandle) string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if transport, ok := this.transports[diskHandle]; ok {
+		return transport
+	}
+	return "unknown"
+}
+
+// sectorBytes 返回 numSectors 个扇区的字节数。
+func sectorBytes(numSectors uint64) float64 {
+	return float64(numSectors * disklib.VIXDISKLIB_SECTOR_SIZE)
+}
+
+// Init 调用被包装后端的 Init。
+func (this *Collector) Init(majorVersion uint32, minorVersion uint32, dir string) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Init(majorVersion, minorVersion, dir)
+	this.observe("Init", start, vErr)
+	return vErr
+}
+
+// InitEx 调用被包装后端的 InitEx。
+func (this *Collector) InitEx(majorVersion uint32, minorVersion uint32, dir string, configFile string) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.InitEx(majorVersion, minorVersion, dir, configFile)
+	this.observe("InitEx", start, vErr)
+	return vErr
+}
+
+// Exit 调用被包装后端的 Exit，所有连接和句柄随之失效，相应的指标清零。
+func (this *Collector) Exit() {
+	start := time.Now()
+	this.backend.Exit()
+	this.observe("Exit", start, nil)
+	this.mutex.Lock()
+	this.transports = make(map[disklib.VixDiskLibHandle]string)
+	this.mutex.Unlock()
+	this.openHandles.Reset()
+	this.openConnections.Set(0)
+}
+
+// PrepareForAccess 调用被包装后端的 PrepareForAccess。
+func (this *Collector) PrepareForAccess(appGlobal disklib.ConnectParams) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.PrepareForAccess(appGlobal)
+	this.observe("PrepareForAccess", start, vErr)
+	return vErr
+}
+
+// EndAccess 调用被包装后端的 EndAccess。
+func (this *Collector) EndAccess(appGlobal disklib.ConnectParams) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.EndAccess(appGlobal)
+	this.observe("EndAccess", start, vErr)
+	return vErr
+}
+
+// Connect 调用被包装后端的 Connect。
+func (this *Collector) Connect(appGlobal disklib.ConnectParams) (disklib.VixDiskLibConnection, disklib.VddkError) {
+	start := time.Now()
+	conn, vErr := this.backend.Connect(appGlobal)
+	this.observe("Connect", start, vErr)
+	if vErr == nil {
+		this.openConnections.Inc()
+	}
+	return conn, vErr
+}
+
+// ConnectEx 调用被包装后端的 ConnectEx。
+func (this *Collector) ConnectEx(appGlobal disklib.ConnectParams) (disklib.VixDiskLibConnection, disklib.VddkError) {
+	start := time.Now()
+	conn, vErr := this.backend.ConnectEx(appGlobal)
+	this.observe("ConnectEx", start, vErr)
+	if vErr == nil {
+		this.openConnections.Inc()
+	}
+	return conn, vErr
+}
+
+// Disconnect 调用被包装后端的 Disconnect。
+func (this *Collector) Disconnect(connection disklib.VixDiskLibConnection) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Disconnect(connection)
+	this.observe("Disconnect", start, vErr)
+	if vErr == nil {
+		this.openConnections.Dec()
+	}
+	return vErr
+}
+
+// Cleanup 调用被包装后端的 Cleanup。
+func (this *Collector) Cleanup(appGlobal disklib.ConnectParams, numCleanUp uint32, numRemaining uint32) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Cleanup(appGlobal, numCleanUp, numRemaining)
+	this.observe("Cleanup", start, vErr)
+	return vErr
+}
+
+// ListTransportModes 调用被包装后端的 ListTransportModes。
+func (this *Collector) ListTransportModes() string {
+	start := time.Now()
+	modes := this.backend.ListTransportModes()
+	this.observe("ListTransportModes", start, nil)
+	return modes
+}
+
+// GetErrorText 调用被包装后端的 GetErrorText。
+func (this *Collector) GetErrorText(errCode uint64, locale string) string {
+	start := time.Now()
+	text := this.backend.GetErrorText(errCode, locale)
+	this.observe("GetErrorText", start, nil)
+	return text
+}
+
+// Open 调用被包装后端的 Open，成功后记录句柄的传输模式。
+func (this *Collector) Open(conn disklib.VixDiskLibConnection, params disklib.ConnectParams) (disklib.VixDiskLibHandle, disklib.VddkError) {
+	start := time.Now()
+	diskHandle, vErr := this.backend.Open(conn, params)
+	this.observe("Open", start, vErr)
+	if vErr == nil {
+		transport := this.backend.GetTransportMode(diskHandle)
+		this.mutex.Lock()
+		this.transports[diskHandle] = transport
+		this.mutex.Unlock()
+		this.openHandles.WithLabelValues(transport).Inc()
+	}
+	return diskHandle, vErr
+}
+
+// Close 调用被包装后端的 Close。
+func (this *Collector) Close(diskHandle disklib.VixDiskLibHandle) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Close(diskHandle)
+	this.observe("Close", start, vErr)
+	if vErr == nil {
+		this.mutex.Lock()
+		transport, ok := this.transports[diskHandle]
+		delete(this.transports, diskHandle)
+		this.mutex.Unlock()
+		if ok {
+			this.openHandles.WithLabelValues(transport).Dec()
+		}
+	}
+	return vErr
+}
+
+// GetInfo 调用被包装后端的 GetInfo。
+func (this *Collector) GetInfo(diskHandle disklib.VixDiskLibHandle) (disklib.VixDiskLibInfo, disklib.VddkError) {
+	start := time.Now()
+	info, vErr := this.backend.GetInfo(diskHandle)
+	this.observe("GetInfo", start, vErr)
+	return info, vErr
+}
+
+// GetTransportMode 调用被包装后端的 GetTransportMode。
+func (this *Collector) GetTransportMode(diskHandle disklib.VixDiskLibHandle) string {
+	start := time.Now()
+	mode := this.backend.GetTransportMode(diskHandle)
+	this.observe("GetTransportMode", start, nil)
+	return mode
+}
+
+// Read 调用被包装后端的 Read，成功后按传输模式记录读取的字节数。
+func (this *Collector) Read(diskHandle disklib.VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Read(diskHandle, startSector, numSectors, buf)
+	this.observe("Read", start, vErr)
+	if vErr == nil {
+		this.bytesRead.WithLabelValues(this.transport(diskHandle)).Add(sectorBytes(numSectors))
+	}
+	return vErr
+}
+
+// Write 调用被包装后端的 Write，成功后按传输模式记录写入的字节数。
+func (this *Collector) Write(diskHandle disklib.VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Write(diskHandle, startSector, numSectors, buf)
+	this.observe("Write", start, vErr)
+	if vErr == nil {
+		this.bytesWritten.WithLabelValues(this.transport(diskHandle)).Add(sectorBytes(numSectors))
+	}
+	return vErr
+}
+
+// ReadAsync 调用被包装后端的 ReadAsync。耗时从提交到 completion 被调用为止，提交失败时立即记录。
+func (this *Collector) ReadAsync(diskHandle disklib.VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte,
+	completion func(disklib.VddkError)) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.ReadAsync(diskHandle, startSector, numSectors, buf, func(result disklib.VddkError) {
+		this.observe("ReadAsync", start, result)
+		if result == nil {
+			this.bytesRead.WithLabelValues(this.transport(diskHandle)).Add(sectorBytes(numSectors))
+		}
+		completion(result)
+	})
+	if vErr != nil {
+		this.observe("ReadAsync", start, vErr)
+	}
+	return vErr
+}
+
+// WriteAsync 调用被包装后端的 WriteAsync。耗时从提交到 completion 被调用为止，提交失败时立即记录。
+func (this *Collector) WriteAsync(diskHandle disklib.VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte,
+	completion func(disklib.VddkError)) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.WriteAsync(diskHandle, startSector, numSectors, buf, func(result disklib.VddkError) {
+		this.observe("WriteAsync", start, result)
+		if result == nil {
+			this.bytesWritten.WithLabelValues(this.transport(diskHandle)).Add(sectorBytes(numSectors))
+		}
+		completion(result)
+	})
+	if vErr != nil {
+		this.observe("WriteAsync", start, vErr)
+	}
+	return vErr
+}
+
+// Wait 调用被包装后端的 Wait。
+func (this *Collector) Wait(diskHandle disklib.VixDiskLibHandle) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Wait(diskHandle)
+	this.observe("Wait", start, vErr)
+	return vErr
+}
+
+// Flush 调用被包装后端的 Flush。
+func (this *Collector) Flush(diskHandle disklib.VixDiskLibHandle) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Flush(diskHandle)
+	this.observe("Flush", start, vErr)
+	return vErr
+}
+
+// QueryAllocatedBlocks 调用被包装后端的 QueryAllocatedBlocks。
+func (this *Collector) QueryAllocatedBlocks(diskHandle disklib.VixDiskLibHandle, startSector disklib.VixDiskLibSectorType,
+	numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
+	start := time.Now()
+	blocks, vErr := this.backend.QueryAllocatedBlocks(diskHandle, startSector, numSectors, chunkSize)
+	this.observe("QueryAllocatedBlocks", start, vErr)
+	return blocks, vErr
+}
+
+// GetMetadataKeys 调用被包装后端的 GetMetadataKeys。两阶段查询中的 VIX_E_BUFFER_TOOSMALL 也会被记录为错误。
+func (this *Collector) GetMetadataKeys(diskHandle disklib.VixDiskLibHandle, buf []byte) (uint, disklib.VddkError) {
+	start := time.Now()
+	required, vErr := this.backend.GetMetadataKeys(diskHandle, buf)
+	this.observe("GetMetadataKeys", start, vErr)
+	return required, vErr
+}
+
+// ReadMetadata 调用被包装后端的 ReadMetadata。两阶段查询中的 VIX_E_BUFFER_TOOSMALL 也会被记录为错误。
+func (this *Collector) ReadMetadata(diskHandle disklib.VixDiskLibHandle, key string, buf []byte) (uint, disklib.VddkError) {
+	start := time.Now()
+	required, vErr := this.backend.ReadMetadata(diskHandle, key, buf)
+	this.observe("ReadMetadata", start, vErr)
+	return required, vErr
+}
+
+// WriteMetadata 调用被包装后端的 WriteMetadata。
+func (this *Collector) WriteMetadata(diskHandle disklib.VixDiskLibHandle, key string, val string) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.WriteMetadata(diskHandle, key, val)
+	this.observe("WriteMetadata", start, vErr)
+	return vErr
+}
+
+// Create 调用被包装后端的 Create。
+func (this *Collector) Create(connection disklib.VixDiskLibConnection, path string, createParams disklib.VixDiskLibCreateParams,
+	progress disklib.ProgressFunc) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Create(connection, path, createParams, progress)
+	this.observe("Create", start, vErr)
+	return vErr
+}
+
+// CreateChild 调用被包装后端的 CreateChild。
+func (this *Collector) CreateChild(diskHandle disklib.VixDiskLibHandle, childPath string, diskType disklib.VixDiskLibDiskType,
+	progress disklib.ProgressFunc) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.CreateChild(diskHandle, childPath, diskType, progress)
+	this.observe("CreateChild", start, vErr)
+	return vErr
+}
+
+// Clone 调用被包装后端的 Clone。
+func (this *Collector) Clone(dstConnection disklib.VixDiskLibConnection, dstPath string, srcConnection disklib.VixDiskLibConnection,
+	srcPath string, params disklib.VixDiskLibCreateParams, progress disklib.ProgressFunc, overWrite bool) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Clone(dstConnection, dstPath, srcConnection, srcPath, params, progress, overWrite)
+	this.observe("Clone", start, vErr)
+	return vErr
+}
+
+// Grow 调用被包装后端的 Grow。
+func (this *Collector) Grow(connection disklib.VixDiskLibConnection, path string, capacity disklib.VixDiskLibSectorType,
+	updateGeometry bool, progress disklib.ProgressFunc) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Grow(connection, path, capacity, updateGeometry, progress)
+	this.observe("Grow", start, vErr)
+	return vErr
+}
+
+// Shrink 调用被包装后端的 Shrink。
+func (this *Collector) Shrink(diskHandle disklib.VixDiskLibHandle, progress disklib.ProgressFunc) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Shrink(diskHandle, progress)
+	this.observe("Shrink", start, vErr)
+	return vErr
+}
+
+// Defragment 调用被包装后端的 Defragment。
+func (this *Collector) Defragment(diskHandle disklib.VixDiskLibHandle, progress disklib.ProgressFunc) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Defragment(diskHandle, progress)
+	this.observe("Defragment", start, vErr)
+	return vErr
+}
+
+// Attach 调用被包装后端的 Attach。
+func (this *Collector) Attach(childHandle disklib.VixDiskLibHandle, parentHandle disklib.VixDiskLibHandle) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Attach(childHandle, parentHandle)
+	this.observe("Attach", start, vErr)
+	return vErr
+}
+
+// CheckRepair 调用被包装后端的 CheckRepair。
+func (this *Collector) CheckRepair(connection disklib.VixDiskLibConnection, filename string, repair bool) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.CheckRepair(connection, filename, repair)
+	this.observe("CheckRepair", start, vErr)
+	return vErr
+}
+
+// Rename 调用被包装后端的 Rename。
+func (this *Collector) Rename(srcFileName string, dstFileName string) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Rename(srcFileName, dstFileName)
+	this.observe("Rename", start, vErr)
+	return vErr
+}
+
+// Unlink 调用被包装后端的 Unlink。
+func (this *Collector) Unlink(connection disklib.VixDiskLibConnection, path string) disklib.VddkError {
+	start := time.Now()
+	vErr := this.backend.Unlink(connection, path)
+	this.observe("Unlink", start, vErr)
+	return vErr
+}
+
+// SpaceNeededForClone 调用被包装后端的 SpaceNeededForClone。
+func (this *Collector) SpaceNeededForClone(srcHandle disklib.VixDiskLibHandle, diskType disklib.VixDiskLibDiskType) (uint64, disklib.VddkError) {
+	start := time.Now()
+	spaceNeeded, vErr := this.backend.SpaceNeededForClone(srcHandle, diskType)
+	this.observe("SpaceNeededForClone", start, vErr)
+	return spaceNeeded, vErr
+}
+
+// 编译期检查 Collector 同时实现了两个接口
+var (
+	_ disklib.Backend      = (*Collector)(nil)
+	_ prometheus.Collector = (*Collector)(nil)
+)
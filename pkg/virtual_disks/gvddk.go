@@ -1,9 +1,10 @@
 package virtual_disks
 
-import "C"
 import (
+	"context"
 	"fmt"
 	"io"
+	"strings"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -16,39 +17,93 @@ import (
 func OpenFCD(serverName string, thumbPrint string, userName string, password string, fcdId string, fcdssid string, datastore string,
 	flags uint32, readOnly bool, transportMode string, identity string, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
 	// 创建全局参数对象，包含了连接虚拟磁盘所需的信息
-	globalParams := disklib.NewConnectParams("", serverName, thumbPrint, userName, password, fcdId, datastore, 
-	fcdssid, "", identity, "", flags, readOnly, transportMode)
+	globalParams := disklib.BuildConnectParams(
+		disklib.WithServer(serverName),
+		disklib.WithThumbprint(thumbPrint),
+		disklib.WithCredentials(userName, password),
+		disklib.ForFCD(fcdId, datastore),
+		disklib.WithFCDSnapshot(fcdssid),
+		disklib.WithIdentity(identity),
+		disklib.WithOpenFlags(flags),
+		disklib.WithTransport(transportMode))
+	if readOnly {
+		globalParams = globalParams.With(disklib.ReadOnly())
+	}
 	// 调用 Open 函数以实际打开虚拟磁盘，传递全局参数和日志记录器
 	return Open(globalParams, logger)
 }
 
+// OpenVMDisk 用于打开虚拟机上的磁盘，snapshotMoRef 不为空时打开该快照中的磁盘，从而在虚拟机运行时得到一致的备份。
+// vmMoRef 是虚拟机的 MoRef（例如 "vm-42"），snapshotMoRef 是快照的 MoRef（例如 "snapshot-7"），
+// diskPath 是磁盘在数据存储中的路径（例如 "[datastore1] vm/vm.vmdk"），其余参数与 OpenFCD 相同。
+// 快照中的磁盘只能读取，应以只读方式打开。
+func OpenVMDisk(serverName string, thumbPrint string, userName string, password string, vmMoRef string, snapshotMoRef string,
+	diskPath string, flags uint32, readOnly bool, transportMode string, identity string, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
+	vmxSpec := vmMoRef
+	if !strings.HasPrefix(vmxSpec, "moref=") {
+		vmxSpec = "moref=" + vmxSpec
+	}
+	globalParams := disklib.BuildConnectParams(
+		disklib.WithServer(serverName),
+		disklib.WithThumbprint(thumbPrint),
+		disklib.WithCredentials(userName, password),
+		disklib.ForVMX(vmxSpec, diskPath),
+		disklib.WithSnapshotRef(snapshotMoRef),
+		disklib.WithIdentity(identity),
+		disklib.WithOpenFlags(flags),
+		disklib.WithTransport(transportMode))
+	if readOnly {
+		globalParams = globalParams.With(disklib.ReadOnly())
+	}
+	return Open(globalParams, logger)
+}
+
 // Open 用于打开虚拟磁盘，并建立与虚拟磁盘的连接
 func Open(globalParams disklib.ConnectParams, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
-	// 调用 PrepareForAccess 函数以准备虚拟磁盘以进行访问
-	err := disklib.PrepareForAccess(globalParams)
+	// 调用 PrepareForAccess 和 ConnectEx 函数以建立虚拟磁盘的连接，本地磁盘只调用 Connect
+	conn, err := connect(globalParams)
+	if err != nil {
+		return DiskReaderWriter{}, err
+	}
+	return openConnected(conn, globalParams, logger)
+}
+
+// CreateDisk 在 globalParams.Path() 指定的路径（远程磁盘为 "[datastore] dir/disk.vmdk"）上按 createParams 创建虚拟磁盘，
+// 然后打开并返回它的 DiskReaderWriter。创建成功但打开失败时磁盘会被保留。
+func CreateDisk(globalParams disklib.ConnectParams, createParams disklib.VixDiskLibCreateParams, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
+	if globalParams.Path() == "" {
+		return DiskReaderWriter{}, disklib.NewVddkError(disklib.VIX_E_INVALID_ARG,
+			fmt.Sprintf("Create a virtual disk failed: no path is given. The error code is %d.", disklib.VIX_E_INVALID_ARG))
+	}
+	conn, err := connect(globalParams)
 	if err != nil {
 		return DiskReaderWriter{}, err
 	}
-	// 调用 ConnectEx 函数以建立虚拟磁盘的连接
-	conn, err := disklib.ConnectEx(globalParams)
-	// 如果打开虚拟磁盘失败，断开连接并结束访问，然后返回错误
+	err = disklib.Create(conn, globalParams.Path(), createParams, nil)
 	if err != nil {
-		disklib.EndAccess(globalParams)
+		disklib.Disconnect(conn)
+		endAccess(globalParams)
 		return DiskReaderWriter{}, err
 	}
+	return openConnected(conn, globalParams, logger)
+}
+
+// openConnected 在已经建立的连接上打开虚拟磁盘，失败时断开连接并结束访问。
+func openConnected(conn disklib.VixDiskLibConnection, globalParams disklib.ConnectParams, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
 	// 调用 Open 函数以打开虚拟磁盘
 	dli, err := disklib.Open(conn, globalParams)
 	if err != nil {
 		disklib.Disconnect(conn)
-		disklib.EndAccess(globalParams)
+		endAccess(globalParams)
 		return DiskReaderWriter{}, err
 	}
 	// 获取虚拟磁盘信息
 	info, err := disklib.GetInfo(dli)
 	// 如果获取信息失败，断开连接并结束访问，然后返回错误
 	if err != nil {
+		disklib.Close(dli)
 		disklib.Disconnect(conn)
-		disklib.EndAccess(globalParams)
+		endAccess(globalParams)
 		return DiskReaderWriter{}, err
 	}
 	// 创建虚拟磁盘句柄，包括连接、全局参数、信息
@@ -57,6 +112,35 @@ func Open(globalParams disklib.ConnectParams, logger logrus.FieldLogger) (DiskRe
 	return NewDiskReaderWriter(diskHandle, logger), nil
 }
 
+// OpenContext 与 Open 相同，但 ctx 被取消或超时后立即返回。
+// 此时仍在进行中的连接会在后台完成，成功打开的磁盘会被自动关闭，不会泄漏连接。
+func OpenContext(ctx context.Context, globalParams disklib.ConnectParams, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
+	if ctx.Err() != nil {
+		return DiskReaderWriter{}, disklib.WrapContextError(ctx, nil)
+	}
+	type openResult struct {
+		diskReaderWriter DiskReaderWriter
+		err              disklib.VddkError
+	}
+	result := make(chan openResult, 1)
+	go func() {
+		diskReaderWriter, err := Open(globalParams, logger)
+		result <- openResult{diskReaderWriter, err}
+	}()
+	select {
+	case r := <-result:
+		return r.diskReaderWriter, r.err
+	case <-ctx.Done():
+		go func() {
+			r := <-result
+			if r.err == nil {
+				r.diskReaderWriter.Close()
+			}
+		}()
+		return DiskReaderWriter{}, disklib.WrapContextError(ctx, nil)
+	}
+}
+
 // DiskReaderWriter 类型表示虚拟磁盘的读写操作对象。
 type DiskReaderWriter struct {
 	diskHandle DiskConnectHandle	// 虚拟磁盘连接句柄，用于执行读写操作
@@ -68,9 +152,14 @@ type DiskReaderWriter struct {
 // Read 方法用于从虚拟磁盘读取数据，将数据读入切片 p 中，并返回读取的字节数。
 // 该方法在多线程环境中使用互斥锁来保护读取操作，以确保多个线程不会同时读取相同的数据。
 func (this DiskReaderWriter) Read(p []byte) (n int, err error) {
+	return this.ReadContext(context.Background(), p)
+}
+
+// ReadContext 与 Read 相同，但在每批扇区之间检查 ctx，ctx 结束后返回已读取的字节数和包含 ctx.Err() 的错误。
+func (this DiskReaderWriter) ReadContext(ctx context.Context, p []byte) (n int, err error) {
 	this.mutex.Lock()												// 添加互斥锁，只有一个携程可以访问资源
 	defer this.mutex.Unlock()										// 延迟释放锁
-	bytesRead, err := this.diskHandle.ReadAt(p, *this.offset)		// 读取偏移量数据到p中
+	bytesRead, err := this.diskHandle.ReadAtContext(ctx, p, *this.offset)	// 读取偏移量数据到p中
 	*this.offset += int64(bytesRead)								// 更新偏移量的值
 	this.logger.Infof("Read returning %d, len(p) = %d, offset=%d\n", bytesRead, len(p), *this.offset)
 	return bytesRead, err											// 记录日志并返回
@@ -79,9 +168,14 @@ func (this DiskReaderWriter) Read(p []byte) (n int, err error) {
 // Write 方法用于向虚拟磁盘写入数据，将数据从切片 p 写入虚拟磁盘，并返回写入的字节数。
 // 该方法在多线程环境中使用互斥锁来保护写入操作，以确保多个线程不会同时写入相同的数据。
 func (this DiskReaderWriter) Write(p []byte) (n int, err error) {
+	return this.WriteContext(context.Background(), p)
+}
+
+// WriteContext 与 Write 相同，但在每批扇区之间检查 ctx，ctx 结束后返回已写入的字节数和包含 ctx.Err() 的错误。
+func (this DiskReaderWriter) WriteContext(ctx context.Context, p []byte) (n int, err error) {
 	this.mutex.Lock()												// 添加互斥锁，只有一个携程可以访问资源
 	defer this.mutex.Unlock()										// 延迟释放锁
-	bytesWritten, err := this.diskHandle.WriteAt(p, *this.offset)	// 读取偏移量数据到p中
+	bytesWritten, err := this.diskHandle.WriteAtContext(ctx, p, *this.offset)	// 读取偏移量数据到p中
 	*this.offset += int64(bytesWritten)								// 更新偏移量的值
 	this.logger.Infof("Write returning %d, len(p) = %d, offset=%d\n", bytesWritten, len(p), *this.offset)
 	return bytesWritten, err										// 记录日志并返回
@@ -89,6 +183,7 @@ func (this DiskReaderWriter) Write(p []byte) (n int, err error) {
 
 // Seek 方法用于在虚拟磁盘上设置当前的读写位置（偏移量）。
 // 它接受一个偏移量和相对位置参数（whence），并返回新的偏移量和可能的错误。
+// io.SeekEnd 相对于磁盘容量 Capacity()，允许定位到容量之后，此时 Read 返回 io.EOF。
 func (this DiskReaderWriter) Seek(offset int64, whence int) (int64, error) {
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
@@ -99,8 +194,9 @@ func (this DiskReaderWriter) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekCurrent:
 		desiredOffset += offset
 	case io.SeekEnd:
-		// 后续完善
-		return *this.offset, errors.New("Seek from SeekEnd not implemented")
+		desiredOffset = this.diskHandle.Capacity() + offset
+	default:
+		return *this.offset, errors.Errorf("Invalid whence %d", whence)
 	}
 
 	if desiredOffset < 0 {
@@ -110,30 +206,161 @@ func (this DiskReaderWriter) Seek(offset int64, whence int) (int64, error) {
 	return *this.offset, nil
 }
 
+// streamChunkSize 是 WriteTo 和 ReadFrom 每次传输的字节数（1 MiB），除第一次外每次传输都按扇区对齐。
+const streamChunkSize = contextBatchSectors * disklib.VIXDISKLIB_SECTOR_SIZE
+
+// firstStreamChunk 返回从 offset 开始的第一次传输的长度，使之后的传输从扇区边界开始。
+func firstStreamChunk(offset int64) int {
+	return streamChunkSize - int(offset%disklib.VIXDISKLIB_SECTOR_SIZE)
+}
+
+// WriteTo 实现 io.WriterTo，从当前偏移量开始将磁盘剩余的数据按扇区对齐的块写入 w，直到磁盘末尾。
+// io.Copy(w, diskReaderWriter) 会使用该方法，从而避免 io.Copy 默认的 32 KiB 不对齐读取。
+func (this DiskReaderWriter) WriteTo(w io.Writer) (n int64, err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	buf := make([]byte, streamChunkSize)
+	chunk := firstStreamChunk(*this.offset)
+	for {
+		bytesRead, readErr := this.diskHandle.ReadAt(buf[:chunk], *this.offset)
+		if bytesRead > 0 {
+			bytesWritten, writeErr := w.Write(buf[:bytesRead])
+			*this.offset += int64(bytesWritten)
+			n += int64(bytesWritten)
+			if writeErr == nil && bytesWritten != bytesRead {
+				writeErr = io.ErrShortWrite
+			}
+			if writeErr != nil {
+				return n, writeErr
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return n, readErr
+		}
+		chunk = streamChunkSize
+	}
+	this.logger.Infof("WriteTo returning %d, offset=%d\n", n, *this.offset)
+	return n, nil
+}
+
+// ReadFrom 实现 io.ReaderFrom，从当前偏移量开始将 r 中的数据按扇区对齐的块写入磁盘，直到 r 返回 io.EOF。
+// io.Copy(diskReaderWriter, r) 会使用该方法。r 中的数据超出磁盘容量时，写满磁盘后返回 io.ErrShortWrite。
+func (this DiskReaderWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	buf := make([]byte, streamChunkSize)
+	chunk := firstStreamChunk(*this.offset)
+	for {
+		bytesRead, readErr := io.ReadFull(r, buf[:chunk])
+		if bytesRead > 0 {
+			// 只写入容量以内的部分，其余的数据无法写入
+			toWrite := bytesRead
+			if room := this.diskHandle.Capacity() - *this.offset; int64(toWrite) > room {
+				toWrite = 0
+				if room > 0 {
+					toWrite = int(room)
+				}
+			}
+			bytesWritten, writeErr := this.diskHandle.WriteAt(buf[:toWrite], *this.offset)
+			*this.offset += int64(bytesWritten)
+			n += int64(bytesWritten)
+			if writeErr != nil {
+				return n, writeErr
+			}
+			if toWrite < bytesRead {
+				return n, io.ErrShortWrite
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return n, readErr
+		}
+		chunk = streamChunkSize
+	}
+	this.logger.Infof("ReadFrom returning %d, offset=%d\n", n, *this.offset)
+	return n, nil
+}
+
 // ReadAt 方法用于从虚拟磁盘的指定偏移量处读取数据，并将数据读入切片 p 中。
 // 该方法直接调用底层虚拟磁盘连接句柄的 ReadAt 方法来执行读取操作。
 func (this DiskReaderWriter) ReadAt(p []byte, off int64) (n int, err error) {
 	return this.diskHandle.ReadAt(p, off)
 }
 
+// ReadAtContext 与 ReadAt 相同，但在每批扇区之间检查 ctx。
+func (this DiskReaderWriter) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	return this.diskHandle.ReadAtContext(ctx, p, off)
+}
+
 // WriteAt 方法用于向虚拟磁盘的指定偏移量处写入数据，将数据从切片 p 写入虚拟磁盘。
 // 该方法直接调用底层虚拟磁盘连接句柄的 WriteAt 方法来执行写入操作。
 func (this DiskReaderWriter) WriteAt(p []byte, off int64) (n int, err error) {
 	return this.diskHandle.WriteAt(p, off)
 }
 
+// WriteAtContext 与 WriteAt 相同，但在每批扇区之间检查 ctx。
+func (this DiskReaderWriter) WriteAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	return this.diskHandle.WriteAtContext(ctx, p, off)
+}
+
 // Close 方法用于关闭虚拟磁盘连接。
 // 它直接调用底层虚拟磁盘连接句柄的 Close 方法来执行关闭操作。
 func (this DiskReaderWriter) Close() error {
 	return this.diskHandle.Close()
 }
 
+// Flush 方法将缓存的写入刷新到虚拟磁盘。
+func (this DiskReaderWriter) Flush() error {
+	return this.diskHandle.Flush()
+}
+
 // QueryAllocatedBlocks 方法用于查询虚拟磁盘上已分配的数据块。
 // 它接受起始扇区、扇区数量和块大小作为参数，并返回已分配的数据块信息和可能的错误。
 func (this DiskReaderWriter) QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
 	return this.diskHandle.QueryAllocatedBlocks(startSector, numSectors, chunkSize)
 }
 
+// GetMetadata 方法以键值对的形式返回虚拟磁盘上的全部元数据。
+func (this DiskReaderWriter) GetMetadata() (map[string]string, disklib.VddkError) {
+	return this.diskHandle.GetMetadata()
+}
+
+// ReadMetadata 方法返回元数据键 key 的值。
+func (this DiskReaderWriter) ReadMetadata(key string) (string, disklib.VddkError) {
+	return this.diskHandle.ReadMetadata(key)
+}
+
+// WriteMetadata 方法写入多个元数据键值对，例如为备份的磁盘记录备份任务的 ID。
+func (this DiskReaderWriter) WriteMetadata(values map[string]string) disklib.VddkError {
+	return this.diskHandle.WriteMetadata(values)
+}
+
+// SpaceNeededForClone 方法返回将虚拟磁盘克隆为 diskType 类型所需的字节数。
+func (this DiskReaderWriter) SpaceNeededForClone(diskType disklib.VixDiskLibDiskType) (uint64, disklib.VddkError) {
+	return this.diskHandle.SpaceNeededForClone(diskType)
+}
+
+// Capacity 方法返回虚拟磁盘的总容量（以字节为单位）。
+func (this DiskReaderWriter) Capacity() int64 {
+	return this.diskHandle.Capacity()
+}
+
+// Info 方法返回打开虚拟磁盘时获取的磁盘信息，例如几何信息、适配器类型和扇区大小。
+func (this DiskReaderWriter) Info() disklib.VixDiskLibInfo {
+	return this.diskHandle.info
+}
+
+// WithHandle 方法以当前的磁盘句柄调用 operation，用于执行 disklib 中以句柄为参数的操作，例如 ShrinkContext。
+// 通过 ConnectionPool 打开的磁盘在连接断开时会重新连接并以新的句柄重试 operation。
+func (this DiskReaderWriter) WithHandle(operation func(dli disklib.VixDiskLibHandle) disklib.VddkError) disklib.VddkError {
+	return this.diskHandle.withHandle(operation)
+}
+
 // NewDiskReaderWriter 函数用于创建一个新的虚拟磁盘读写操作对象。
 // 它接受虚拟磁盘连接句柄（DiskConnectHandle）和日志记录器（logger）作为参数，
 // 并返回一个初始化的 DiskReaderWriter 对象，用于执行虚拟磁盘的读写操作。
@@ -152,11 +379,18 @@ func NewDiskReaderWriter(diskHandle DiskConnectHandle, logger logrus.FieldLogger
 
 // DiskConnectHandle 类型表示虚拟磁盘连接句柄，用于管理虚拟磁盘的访问和信息。
 type DiskConnectHandle struct {
-	mutex  *sync.Mutex
+	locks  *sectorRangeLock // 按扇区范围加锁，所有副本共享，见 gvddk_rangelock.go
 	dli    disklib.VixDiskLibHandle
 	conn   disklib.VixDiskLibConnection
 	params disklib.ConnectParams
 	info   disklib.VixDiskLibInfo
+	// 异步读写流水线的深度和每个请求的扇区数，见 WithPipeline
+	pipelineDepth        int
+	pipelineChunkSectors uint64
+	// 读缓存，见 WithCache
+	cache *blockCache
+	// 通过 ConnectionPool 打开时不为空，dli 和 conn 以其中的当前值为准，见 gvddk_pool.go
+	pooled *pooledDisk
 }
 
 // NewDiskHandle 函数用于创建一个新的虚拟磁盘连接句柄。
@@ -164,9 +398,8 @@ type DiskConnectHandle struct {
 // 并返回一个初始化的 DiskConnectHandle 对象，用于管理虚拟磁盘的访问和信息。
 func NewDiskHandle(dli disklib.VixDiskLibHandle, conn disklib.VixDiskLibConnection, params disklib.ConnectParams,
 	info disklib.VixDiskLibInfo) DiskConnectHandle {
-	var mutex sync.Mutex
 	return DiskConnectHandle{
-		mutex:  &mutex,			// 互斥锁，用于保护虚拟磁盘连接句柄的访问
+		locks:  newSectorRangeLock(),	// 扇区范围锁，用于串行化相交的读写操作
 		dli:    dli,			// 虚拟磁盘句柄，用于执行虚拟磁盘操作
 		conn:   conn,			// 虚拟磁盘连接句柄，用于建立和维护虚拟磁盘连接
 		params: params,			// 连接参数，包括连接信息和认证信息
@@ -177,41 +410,85 @@ func NewDiskHandle(dli disklib.VixDiskLibHandle, conn disklib.VixDiskLibConnecti
 // mapError 函数用于将 VddkError 转换为标准错误类型，以便处理特定错误情况。
 // 它根据 VddkError 中的 VixErrorCode 来映射错误。
 func mapError(vddkError disklib.VddkError) error {
-	switch vddkError.VixErrorCode() {
-	case disklib.VIX_E_DISK_OUTOFRANGE:
+	if errors.Is(vddkError, disklib.ErrDiskOutOfRange) {
 		return io.EOF
-	default:
-		return vddkError
 	}
+	return vddkError
 }
 
-// aligned 函数用于检查给定长度和偏移量是否对齐到虚拟磁盘的扇区大小。
-// 它用于确保读写操作的对齐性，以提高性能和避免不必要的内部处理。
-func aligned(len int, off int64) bool {
-	return len%disklib.VIXDISKLIB_SECTOR_SIZE == 0 && off%disklib.VIXDISKLIB_SECTOR_SIZE == 0
+// contextBatchSectors 是带 context 的读写中每批传输的扇区数（1 MiB），批次之间检查 ctx 是否已经结束。
+const contextBatchSectors = 2048
+
+// transferSectors 以 contextBatchSectors 为一批调用 transfer 传输 buf 对应的对齐扇区，并返回已传输的字节数。
+// ctx 永远不会结束时（例如 context.Background()）一次传输全部扇区，与不带 context 的调用行为一致。
+func transferSectors(ctx context.Context, startSector uint64, buf []byte,
+	transfer func(startSector uint64, numSectors uint64, buf []byte) disklib.VddkError) (int, disklib.VddkError) {
+	numSectors := uint64(len(buf) / disklib.VIXDISKLIB_SECTOR_SIZE)
+	if ctx.Done() == nil {
+		if err := transfer(startSector, numSectors, buf); err != nil {
+			return 0, err
+		}
+		return len(buf), nil
+	}
+	var done uint64 = 0
+	for done < numSectors {
+		if ctx.Err() != nil {
+			return int(done * disklib.VIXDISKLIB_SECTOR_SIZE), disklib.WrapContextError(ctx, nil)
+		}
+		batch := numSectors - done
+		if batch > contextBatchSectors {
+			batch = contextBatchSectors
+		}
+		bufOff := done * disklib.VIXDISKLIB_SECTOR_SIZE
+		bufEnd := bufOff + batch*disklib.VIXDISKLIB_SECTOR_SIZE
+		if err := transfer(startSector+done, batch, buf[bufOff:bufEnd]); err != nil {
+			return int(bufOff), err
+		}
+		done = done + batch
+	}
+	return len(buf), nil
 }
 
 // ReadAt 方法用于从虚拟磁盘中指定偏移量处读取数据，并将其写入给定的字节切片 p。
 // 它接受偏移量（off）和目标字节切片（p）作为参数，并返回读取的字节数以及可能的错误。
 func (this DiskConnectHandle) ReadAt(p []byte, off int64) (n int, err error) {
+	return this.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext 与 ReadAt 相同，但在每批扇区之间检查 ctx，ctx 结束后返回已读取的字节数和包含 ctx.Err() 的错误。
+func (this DiskConnectHandle) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if this.cache != nil {
+		return this.cache.readAt(ctx, this.uncached(), p, off)
+	}
+	if this.pooled != nil {
+		return this.pooled.transfer(ctx, this, p, off, DiskConnectHandle.readAtContext)
+	}
+	return this.readAtContext(ctx, p, off)
+}
+
+// readAtContext 使用 this.dli 执行 ReadAtContext。
+func (this DiskConnectHandle) readAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if ctx.Err() != nil {
+		return 0, disklib.WrapContextError(ctx, nil)
+	}
 	capacity := this.Capacity()
 	// 如果偏移量超出容量，则返回EOF（文件末尾）
 	if off >= capacity {
 		return 0, io.EOF
 	}
-	// 如果读取的数据跨越文件末尾，需要将 p 切片截断
+	// 如果读取的数据跨越文件末尾，需要将 p 切片截断，读取成功后按照 io.ReaderAt 的约定返回 io.EOF
+	truncated := false
 	if off+int64(len(p)) > capacity {
 		readLen := int32(capacity - off)
 		p = p[0:readLen]
+		truncated = true
 	}
 	// 计算起始扇区
 	startSector := off / disklib.VIXDISKLIB_SECTOR_SIZE
 	var total int = 0
-	// 如果读取的数据不对齐，需要加锁，以确保读/修改/写操作是原子的
-	if !aligned(len(p), off) {
-		this.mutex.Lock()
-		defer this.mutex.Unlock()
-	}
+	// 以共享方式锁定读取覆盖的扇区，等待相交的写操作（包括非对齐写入的读/修改/写）完成
+	lock := this.locks.lockBytes(off, len(p), false)
+	defer this.locks.unlock(lock)
 	// 处理偏移量不对齐的部分
 	/*
 	这段代码处理了读取偏移量不对齐的情况。它首先从虚拟磁盘中读取一个扇区的数据到临时缓冲区 tmpBuf，
@@ -257,9 +534,9 @@ func (this DiskConnectHandle) ReadAt(p []byte, off int64) (n int, err error) {
 		desOff := total
 		desEnd := total + numAlignedSectors*disklib.VIXDISKLIB_SECTOR_SIZE
 		// 从虚拟磁盘的起始扇区（startSector）读取多个对齐扇区的数据，存储在目标字节切片 p 的指定范围中
-		err := disklib.Read(this.dli, (uint64)(startSector), (uint64)(numAlignedSectors), p[desOff:desEnd])
+		bytesRead, err := this.readAligned(ctx, (uint64)(startSector), p[desOff:desEnd])
 		if err != nil {
-			return total, mapError(err)
+			return total + bytesRead, mapError(err)
 		}
 		// 更新起始扇区，准备处理下一个对齐扇区
 		startSector = startSector + int64(numAlignedSectors)
@@ -283,24 +560,50 @@ func (this DiskConnectHandle) ReadAt(p []byte, off int64) (n int, err error) {
 		// 从 tmpBuf 中提取 tmpBuf 的前 srcEnd 字节数据，然后复制到目标字节切片 p 的剩余部分
 		tmpSlice := tmpBuf[0:srcEnd]
 		copy(p[total:], tmpSlice)
+		// 更新已读取的总字节数 total
+		total = total + count
+	}
+	if truncated {
+		return total, io.EOF
 	}
 	// 返回已读取的总字节数 total
 	return total, nil
 }
 
+// WriteAt 方法用于向虚拟磁盘中指定偏移量处写入字节切片 p 中的数据，并返回写入的字节数以及可能的错误。
 func (this DiskConnectHandle) WriteAt(p []byte, off int64) (n int, err error) {
+	return this.WriteAtContext(context.Background(), p, off)
+}
+
+// WriteAtContext 与 WriteAt 相同，但在每批扇区之间检查 ctx，ctx 结束后返回已写入的字节数和包含 ctx.Err() 的错误。
+func (this DiskConnectHandle) WriteAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if this.cache != nil {
+		// 写穿缓存：先写入磁盘，无论是否成功都使相交的缓存块失效
+		n, err = this.uncached().WriteAtContext(ctx, p, off)
+		this.cache.invalidate(off, len(p))
+		return n, err
+	}
+	if this.pooled != nil {
+		return this.pooled.transfer(ctx, this, p, off, DiskConnectHandle.writeAtContext)
+	}
+	return this.writeAtContext(ctx, p, off)
+}
+
+// writeAtContext 使用 this.dli 执行 WriteAtContext。
+func (this DiskConnectHandle) writeAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if ctx.Err() != nil {
+		return 0, disklib.WrapContextError(ctx, nil)
+	}
 	// 获取虚拟磁盘的容量，即虚拟磁盘的总扇区数
 	capacity := this.Capacity()
 	// 如果写操作的起始偏移量（off）或结束偏移量超出虚拟磁盘的容量，返回一个错误（io.ErrShortWrite）
 	if off > capacity || off+int64(len(p)) > capacity {
 		return 0, io.ErrShortWrite
 	}
-	// 如果写操作的数据不对齐（不是以扇区大小的倍数开始），需要加锁来确保对不对齐数据的读取、修改和写入的一致性。
-	if !aligned(len(p), off) {
-		// 加锁，防止多个携程同时访问不对齐数据，确保原子性的读取、修改和写入
-		this.mutex.Lock()
-		defer this.mutex.Unlock()
-	}
+	// 独占写入覆盖的扇区，对齐的写入也要加锁，否则会与其他携程对边界扇区的读取、修改和写入交错而丢失数据。
+	// 范围不相交的读写不受影响，可以并行执行。
+	lock := this.locks.lockBytes(off, len(p), true)
+	defer this.locks.unlock(lock)
 	var total int64 = 0		// 总共已写入的字节数
 	var srcOff int64 = 0 	// p 中要复制的数据的起始索引
 	var srcEnd int64 = 0	// p 中要复制的数据的结束索引
@@ -345,9 +648,9 @@ func (this DiskConnectHandle) WriteAt(p []byte, off int64) (n int, err error) {
 		// 计算 p 中待写入数据的结束索引
 		srcEnd = srcOff + numSector*disklib.VIXDISKLIB_SECTOR_SIZE
 		// 直接将待写入数据 p 中的完整扇区数据写入虚拟磁盘
-		err := disklib.Write(this.dli, uint64(startSector), uint64(numSector), p[srcOff:srcEnd])
+		bytesWritten, err := this.writeAligned(ctx, uint64(startSector), p[srcOff:srcEnd])
 		if err != nil {
-			return int(total), mapError(err)
+			return int(total) + bytesWritten, mapError(err)
 		}
 		// 更新起始扇区索引、已写入的总字节数以及待写入数据 p 中的数据索引
 		startSector = startSector + numSector
@@ -385,8 +688,11 @@ func (this DiskConnectHandle) WriteAt(p []byte, off int64) (n int, err error) {
 	return len(p), nil
 }
 
-// Close 关闭虚拟磁盘连接及相关资源。
+// Close 关闭虚拟磁盘连接及相关资源。通过 ConnectionPool 打开的句柄只关闭磁盘，连接归还给连接池。
 func (this DiskConnectHandle) Close() error {
+	if this.pooled != nil {
+		return this.pooled.close()
+	}
 	// 尝试关闭虚拟磁盘句柄
 	vErr := disklib.Close(this.dli)
 	if vErr != nil {
@@ -397,8 +703,8 @@ func (this DiskConnectHandle) Close() error {
 	if vErr != nil {
 		return errors.New(fmt.Sprintf(vErr.Error()+" with error code: %d", vErr.VixErrorCode()))
 	}
-	// 结束虚拟磁盘的访问
-	vErr = disklib.EndAccess(this.params)
+	// 结束虚拟磁盘的访问，本地磁盘跳过
+	vErr = endAccess(this.params)
 	if vErr != nil {
 		return errors.New(fmt.Sprintf(vErr.Error()+" with error code: %d", vErr.VixErrorCode()))
 	}
@@ -406,6 +712,18 @@ func (this DiskConnectHandle) Close() error {
 	return nil
 }
 
+// Flush 将虚拟磁盘句柄上缓存的写入刷新到磁盘。
+func (this DiskConnectHandle) Flush() error {
+	if this.pooled != nil {
+		return this.pooled.flush()
+	}
+	vErr := disklib.Flush(this.dli)
+	if vErr != nil {
+		return errors.New(fmt.Sprintf(vErr.Error()+" with error code: %d", vErr.VixErrorCode()))
+	}
+	return nil
+}
+
 // Capacity 返回虚拟磁盘的总容量（以字节为单位）。
 func (this DiskConnectHandle) Capacity() int64 {
 	return int64(this.info.Capacity) * disklib.VIXDISKLIB_SECTOR_SIZE
@@ -413,5 +731,59 @@ func (this DiskConnectHandle) Capacity() int64 {
 
 // QueryAllocatedBlocks 调用 VDDK 中的 QueryAllocatedBlocks 函数以查询虚拟磁盘上的已分配块信息。
 func (this DiskConnectHandle) QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
-	return disklib.QueryAllocatedBlocks(this.dli, startSector, numSectors, chunkSize)
+	var blocks []disklib.VixDiskLibBlock
+	vErr := this.withHandle(func(dli disklib.VixDiskLibHandle) disklib.VddkError {
+		var vErr disklib.VddkError
+		blocks, vErr = disklib.QueryAllocatedBlocks(dli, startSector, numSectors, chunkSize)
+		return vErr
+	})
+	return blocks, vErr
+}
+
+// GetMetadata 以键值对的形式返回虚拟磁盘上的全部元数据。
+func (this DiskConnectHandle) GetMetadata() (map[string]string, disklib.VddkError) {
+	var metadata map[string]string
+	vErr := this.withHandle(func(dli disklib.VixDiskLibHandle) disklib.VddkError {
+		var vErr disklib.VddkError
+		metadata, vErr = disklib.GetMetadata(dli)
+		return vErr
+	})
+	return metadata, vErr
+}
+
+// ReadMetadata 返回元数据键 key 的值。
+func (this DiskConnectHandle) ReadMetadata(key string) (string, disklib.VddkError) {
+	var val string
+	vErr := this.withHandle(func(dli disklib.VixDiskLibHandle) disklib.VddkError {
+		var vErr disklib.VddkError
+		val, vErr = disklib.ReadMetadataKey(dli, key)
+		return vErr
+	})
+	return val, vErr
+}
+
+// WriteMetadata 写入多个元数据键值对。
+func (this DiskConnectHandle) WriteMetadata(values map[string]string) disklib.VddkError {
+	return this.withHandle(func(dli disklib.VixDiskLibHandle) disklib.VddkError {
+		return disklib.WriteMetadataBatch(dli, values)
+	})
+}
+
+// SpaceNeededForClone 返回将虚拟磁盘克隆为 diskType 类型所需的字节数。
+func (this DiskConnectHandle) SpaceNeededForClone(diskType disklib.VixDiskLibDiskType) (uint64, disklib.VddkError) {
+	var space uint64
+	vErr := this.withHandle(func(dli disklib.VixDiskLibHandle) disklib.VddkError {
+		var vErr disklib.VddkError
+		space, vErr = disklib.SpaceNeededForClone(dli, diskType)
+		return vErr
+	})
+	return space, vErr
+}
+
+// withHandle 以当前的磁盘句柄执行 operation，连接池中的磁盘在连接断开时重新连接后重试。
+func (this DiskConnectHandle) withHandle(operation func(dli disklib.VixDiskLibHandle) disklib.VddkError) disklib.VddkError {
+	if this.pooled != nil {
+		return this.pooled.withHandle(operation)
+	}
+	return operation(this.dli)
 }
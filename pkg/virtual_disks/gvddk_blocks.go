@@ -0,0 +1,21 @@
+package virtual_disks
+
+import (
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// AllocatedBlockIterator 按窗口分页遍历磁盘中已分配的区域，参见 disklib.AllocatedBlockIterator。
+type AllocatedBlockIterator = disklib.AllocatedBlockIterator
+
+// AllocatedBlocks 返回遍历整个磁盘已分配区域的迭代器，磁盘容量取自 GetInfo。
+// chunkSize 必须在 VIXDISKLIB_MIN_CHUNK_SIZE 和 VIXDISKLIB_MAX_CHUNK_SIZE 之间。
+func (this DiskReaderWriter) AllocatedBlocks(chunkSize disklib.VixDiskLibSectorType) (*AllocatedBlockIterator, disklib.VddkError) {
+	return this.AllocatedBlocksRange(0, this.diskHandle.info.Capacity, chunkSize)
+}
+
+// AllocatedBlocksRange 返回遍历从 startSector 开始 numSectors 个扇区内已分配区域的迭代器。
+// startSector 必须是 chunkSize 的整数倍，超出磁盘容量的部分会被忽略。
+func (this DiskReaderWriter) AllocatedBlocksRange(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType,
+	chunkSize disklib.VixDiskLibSectorType) (*AllocatedBlockIterator, disklib.VddkError) {
+	return disklib.NewAllocatedBlockIterator(this, startSector, numSectors, chunkSize, this.diskHandle.info.Capacity)
+}
@@ -0,0 +1,171 @@
+package virtual_disks
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// DefaultBufferedWriterSize 是 NewBufferedWriter 的默认缓冲区大小：1 MiB。
+const DefaultBufferedWriterSize = streamChunkSize
+
+// BufferedWriter 将连续的小块写入合并为按扇区对齐的大块写入 DiskReaderWriter，
+// 避免每次不足一个扇区的写入都在 DiskConnectHandle.WriteAt 中读取、修改并写回整个扇区，适合从流格式恢复磁盘。
+// 缓冲区满时只写出到最后一个扇区边界为止的部分，剩余的数据留在缓冲区中，使之后的批次从扇区边界开始。
+// 写入位置不连续、Seek、Flush 和 Close 时写出缓冲区中的全部数据。
+//
+// 写入缓冲区成功不代表数据已经写到磁盘：写出失败的错误由之后的 Write、WriteAt、Flush 或 Close 返回，
+// 并且之后所有的写入都返回该错误，调用者必须检查 Flush 或 Close 的返回值。BufferedWriter 不能被多个携程同时使用。
+type BufferedWriter struct {
+	disk   DiskReaderWriter
+	buf    []byte // 尚未写出的数据，容量为缓冲区大小
+	start  int64  // buf[0] 在磁盘上的偏移量
+	offset int64  // 下一次 Write 的偏移量
+	err    error  // 写出失败或关闭后的错误
+}
+
+// NewBufferedWriter 返回写入 disk 的 BufferedWriter，Write 从 disk 的当前偏移量开始，之后的偏移量与 disk 相互独立。
+// size 是缓冲区的字节数，会被调整为扇区大小的整数倍，小于等于 0 时使用 DefaultBufferedWriterSize。
+func NewBufferedWriter(disk DiskReaderWriter, size int) *BufferedWriter {
+	if size <= 0 {
+		size = DefaultBufferedWriterSize
+	}
+	size = (size + disklib.VIXDISKLIB_SECTOR_SIZE - 1) / disklib.VIXDISKLIB_SECTOR_SIZE * disklib.VIXDISKLIB_SECTOR_SIZE
+	offset, _ := disk.Seek(0, io.SeekCurrent)
+	return &BufferedWriter{
+		disk:   disk,
+		buf:    make([]byte, 0, size),
+		offset: offset,
+	}
+}
+
+// Write 将 p 写入当前偏移量，并将偏移量增加写入的字节数。
+func (this *BufferedWriter) Write(p []byte) (n int, err error) {
+	n, err = this.WriteAt(p, this.offset)
+	this.offset += int64(n)
+	return n, err
+}
+
+// WriteAt 将 p 写入偏移量 off。off 紧接在缓冲区中的数据之后时追加到缓冲区，否则先写出缓冲区。
+// 超出磁盘容量的写入立即返回 io.ErrShortWrite。
+func (this *BufferedWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	if this.err != nil {
+		return 0, this.err
+	}
+	if off < 0 || off+int64(len(p)) > this.disk.Capacity() {
+		return 0, io.ErrShortWrite
+	}
+	if len(this.buf) > 0 && off != this.start+int64(len(this.buf)) {
+		if err := this.flushBuffer(); err != nil {
+			return 0, err
+		}
+	}
+	if len(this.buf) == 0 {
+		this.start = off
+	}
+	for n < len(p) {
+		// 缓冲区为空并且剩余的数据不少于缓冲区大小时直接写出，不经过缓冲区复制
+		if len(this.buf) == 0 && len(p)-n >= cap(this.buf) {
+			length := len(p) - n - int((this.start+int64(len(p)-n))%disklib.VIXDISKLIB_SECTOR_SIZE)
+			written, err := this.disk.WriteAt(p[n:n+length], this.start)
+			n += written
+			this.start += int64(written)
+			if err != nil {
+				this.err = errors.Wrapf(err, "Buffered write of %d bytes at offset %d failed", length-written, this.start)
+				return n, this.err
+			}
+			continue
+		}
+		copied := copy(this.buf[len(this.buf):cap(this.buf)], p[n:])
+		this.buf = this.buf[:len(this.buf)+copied]
+		n += copied
+		if len(this.buf) == cap(this.buf) {
+			if err := this.flushAligned(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Seek 写出缓冲区后设置 Write 的偏移量，io.SeekEnd 相对于磁盘容量。
+func (this *BufferedWriter) Seek(offset int64, whence int) (int64, error) {
+	if err := this.flushBuffer(); err != nil {
+		return this.offset, err
+	}
+	desiredOffset := this.offset
+	switch whence {
+	case io.SeekStart:
+		desiredOffset = offset
+	case io.SeekCurrent:
+		desiredOffset += offset
+	case io.SeekEnd:
+		desiredOffset = this.disk.Capacity() + offset
+	default:
+		return this.offset, errors.Errorf("Invalid whence %d", whence)
+	}
+	if desiredOffset < 0 {
+		return this.offset, errors.Errorf("Seek to negative offset %d", desiredOffset)
+	}
+	this.offset = desiredOffset
+	return this.offset, nil
+}
+
+// Buffered 返回缓冲区中尚未写出的字节数。
+func (this *BufferedWriter) Buffered() int {
+	return len(this.buf)
+}
+
+// Flush 写出缓冲区中的全部数据，并将磁盘句柄上缓存的写入刷新到磁盘。
+func (this *BufferedWriter) Flush() error {
+	if err := this.flushBuffer(); err != nil {
+		return err
+	}
+	return this.disk.Flush()
+}
+
+// Close 写出缓冲区并关闭底层的 DiskReaderWriter。写出失败时仍然关闭磁盘，并返回写出的错误。
+func (this *BufferedWriter) Close() error {
+	if this.err == errBufferedWriterClosed {
+		return this.err
+	}
+	err := this.Flush()
+	if closeErr := this.disk.Close(); err == nil {
+		err = closeErr
+	}
+	this.err = errBufferedWriterClosed
+	return err
+}
+
+// errBufferedWriterClosed 是关闭之后写入返回的错误。
+var errBufferedWriterClosed = errors.New("BufferedWriter is closed")
+
+// flushBuffer 写出缓冲区中的全部数据。
+func (this *BufferedWriter) flushBuffer() error {
+	if this.err != nil {
+		return this.err
+	}
+	return this.write(len(this.buf))
+}
+
+// flushAligned 写出缓冲区中到最后一个扇区边界为止的数据。
+func (this *BufferedWriter) flushAligned() error {
+	end := this.start + int64(len(this.buf))
+	return this.write(len(this.buf) - int(end%disklib.VIXDISKLIB_SECTOR_SIZE))
+}
+
+// write 写出缓冲区中的前 length 个字节，并从缓冲区中移除已写出的部分。写出失败后的错误会一直保留。
+func (this *BufferedWriter) write(length int) error {
+	if length <= 0 {
+		return nil
+	}
+	written, err := this.disk.WriteAt(this.buf[:length], this.start)
+	this.buf = this.buf[:copy(this.buf, this.buf[written:])]
+	this.start += int64(written)
+	if err != nil {
+		this.err = errors.Wrapf(err, "Buffered write of %d bytes at offset %d failed", length-written, this.start)
+		return this.err
+	}
+	return nil
+}
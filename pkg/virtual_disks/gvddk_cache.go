@@ -0,0 +1,312 @@
+package virtual_disks
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// 默认的缓存参数：64 KiB 的块，最多缓存 256 个块（16 MiB），顺序读时最多预读 16 个块。
+const (
+	DefaultCacheBlockSize    = 64 * 1024
+	DefaultCacheCapacity     = 256
+	DefaultCacheMaxReadAhead = 16
+)
+
+// CacheOptions 控制 WithCache 创建的块缓存，零值表示使用默认参数。
+type CacheOptions struct {
+	// BlockSize 是缓存块的字节数，会被调整为扇区大小的整数倍
+	BlockSize int
+	// Capacity 是 LRU 中最多缓存的块数
+	Capacity int
+	// MaxReadAhead 是顺序读时最多预读的块数，小于 0 时关闭预读
+	MaxReadAhead int
+}
+
+// CacheStats 统计块缓存的命中情况，块数按缓存块计算。
+type CacheStats struct {
+	Hits            int64 // 读取时已在缓存中的块数
+	Misses          int64 // 读取时需要从磁盘读取的块数
+	ReadAheadBlocks int64 // 顺序读时预读的块数
+	Evictions       int64 // 因超过容量被淘汰的块数
+	Invalidations   int64 // 因写入而失效的块数
+}
+
+// cacheBlock 是 LRU 链表中的一个缓存块。
+type cacheBlock struct {
+	index int64
+	data  []byte // 磁盘末尾的块可能不足 blockSize
+}
+
+// blockCache 是以 blockSize 为单位的 LRU 读缓存，由同一磁盘句柄的所有副本共享。
+type blockCache struct {
+	mutex        sync.Mutex
+	blockSize    int64
+	capacity     int
+	maxReadAhead int
+	lru          *list.List // 最近使用的块在前面
+	blocks       map[int64]*list.Element
+	generation   uint64 // 每次写入后加一，读取期间发生写入时不缓存读到的数据
+	nextOffset   int64  // 上一次读取的结束位置，用于识别顺序读
+	readAhead    int    // 当前的预读块数，连续的顺序读时倍增
+	stats        CacheStats
+}
+
+// WithCache 返回一个带有 LRU 块缓存的 DiskConnectHandle 副本。
+// 读取按 opts.BlockSize 对齐的块从缓存中获取，未命中的连续块合并为一次读取；识别到顺序读时预读后续的块，
+// 预读的块数随着连续的顺序读倍增，直到 opts.MaxReadAhead。写入直接写到磁盘，并使相交的缓存块失效。
+// 只有通过返回的句柄及其副本写入才会使缓存失效，其他句柄或其他程序对磁盘的修改不会反映到缓存中。
+func (this DiskConnectHandle) WithCache(opts CacheOptions) DiskConnectHandle {
+	this.cache = newBlockCache(opts)
+	return this
+}
+
+// WithCache 返回一个底层句柄带有 LRU 块缓存的 DiskReaderWriter，它与原对象共享读写偏移量。
+// 适合通过 Read 进行大量小块的顺序读，或者反复读取相同区域的场景。
+func (this DiskReaderWriter) WithCache(opts CacheOptions) DiskReaderWriter {
+	this.diskHandle = this.diskHandle.WithCache(opts)
+	return this
+}
+
+// CacheStats 返回块缓存的统计，没有启用缓存时返回零值。
+func (this DiskConnectHandle) CacheStats() CacheStats {
+	if this.cache == nil {
+		return CacheStats{}
+	}
+	this.cache.mutex.Lock()
+	defer this.cache.mutex.Unlock()
+	return this.cache.stats
+}
+
+// CacheStats 返回底层句柄块缓存的统计，没有启用缓存时返回零值。
+func (this DiskReaderWriter) CacheStats() CacheStats {
+	return this.diskHandle.CacheStats()
+}
+
+// uncached 返回不使用缓存的句柄副本，用于读写磁盘。
+func (this DiskConnectHandle) uncached() DiskConnectHandle {
+	this.cache = nil
+	return this
+}
+
+// newBlockCache 按 opts 创建块缓存，未设置的参数使用默认值。
+func newBlockCache(opts CacheOptions) *blockCache {
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = DefaultCacheBlockSize
+	}
+	opts.BlockSize = (opts.BlockSize + disklib.VIXDISKLIB_SECTOR_SIZE - 1) / disklib.VIXDISKLIB_SECTOR_SIZE * disklib.VIXDISKLIB_SECTOR_SIZE
+	if opts.Capacity <= 0 {
+		opts.Capacity = DefaultCacheCapacity
+	}
+	if opts.MaxReadAhead == 0 {
+		opts.MaxReadAhead = DefaultCacheMaxReadAhead
+	}
+	if opts.MaxReadAhead < 0 {
+		opts.MaxReadAhead = 0
+	}
+	return &blockCache{
+		blockSize:    int64(opts.BlockSize),
+		capacity:     opts.Capacity,
+		maxReadAhead: opts.MaxReadAhead,
+		lru:          list.New(),
+		blocks:       make(map[int64]*list.Element),
+		nextOffset:   -1,
+	}
+}
+
+// readAt 从缓存中读取 [off, off+len(p))，未命中的块通过 handle 从磁盘读取后加入缓存。
+// 返回值的约定与 ReadAtContext 相同。
+func (this *blockCache) readAt(ctx context.Context, handle DiskConnectHandle, p []byte, off int64) (int, error) {
+	if ctx.Err() != nil {
+		return 0, disklib.WrapContextError(ctx, nil)
+	}
+	capacity := handle.Capacity()
+	if off >= capacity {
+		return 0, io.EOF
+	}
+	truncated := false
+	if off+int64(len(p)) > capacity {
+		p = p[:capacity-off]
+		truncated = true
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	readAhead := this.access(off, len(p))
+	numBlocks := (capacity + this.blockSize - 1) / this.blockSize
+	last := (off + int64(len(p)) - 1) / this.blockSize
+	total := 0
+	for index := off / this.blockSize; index <= last; {
+		if data := this.get(index); data != nil {
+			total = total + this.copyBlock(p, off, index, data)
+			index++
+			continue
+		}
+		// 合并请求范围内连续未命中的块，读到请求末尾时再预读后面未缓存的块
+		runEnd := index + 1
+		for runEnd <= last && !this.contains(runEnd) {
+			runEnd++
+		}
+		misses := runEnd - index
+		if runEnd > last {
+			for extra := 0; extra < readAhead && runEnd < numBlocks && !this.contains(runEnd); extra++ {
+				runEnd++
+			}
+		}
+		blocks, err := this.fetch(ctx, handle, index, runEnd, capacity)
+		if err != nil {
+			return total, err
+		}
+		this.mutex.Lock()
+		this.stats.Misses = this.stats.Misses + misses
+		this.stats.ReadAheadBlocks = this.stats.ReadAheadBlocks + int64(len(blocks)) - misses
+		this.mutex.Unlock()
+		for i := int64(0); i < misses; i++ {
+			total = total + this.copyBlock(p, off, index+i, blocks[i])
+		}
+		index = index + misses
+	}
+	if truncated {
+		return total, io.EOF
+	}
+	return total, nil
+}
+
+// fetch 通过 handle 读取块 [first, end) 并加入缓存，返回每个块的数据。
+func (this *blockCache) fetch(ctx context.Context, handle DiskConnectHandle, first int64, end int64, capacity int64) ([][]byte, error) {
+	this.mutex.Lock()
+	generation := this.generation
+	this.mutex.Unlock()
+	start := first * this.blockSize
+	length := end*this.blockSize - start
+	if start+length > capacity {
+		length = capacity - start
+	}
+	buf := make([]byte, length)
+	if _, err := handle.ReadAtContext(ctx, buf, start); err != nil {
+		return nil, err
+	}
+	blocks := make([][]byte, 0, end-first)
+	for index := first; index < end; index++ {
+		blockStart := (index - first) * this.blockSize
+		blockEnd := blockStart + this.blockSize
+		if blockEnd > length {
+			blockEnd = length
+		}
+		blocks = append(blocks, buf[blockStart:blockEnd:blockEnd])
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	// 读取期间有写入时，读到的数据可能已经过期，只返回给调用者而不缓存
+	if generation == this.generation {
+		for i, data := range blocks {
+			this.insertLocked(first+int64(i), data)
+		}
+	}
+	return blocks, nil
+}
+
+// copyBlock 将块 index 中与 [off, off+len(p)) 相交的部分复制到 p 中，返回复制的字节数。
+func (this *blockCache) copyBlock(p []byte, off int64, index int64, data []byte) int {
+	blockStart := index * this.blockSize
+	start, end := blockStart, blockStart+int64(len(data))
+	if start < off {
+		start = off
+	}
+	if end > off+int64(len(p)) {
+		end = off + int64(len(p))
+	}
+	return copy(p[start-off:end-off], data[start-blockStart:end-blockStart])
+}
+
+// access 记录一次读取，返回这次读取未命中时预读的块数。从上一次读取的结束位置开始的读取是顺序读，
+// 连续的顺序读使预读块数倍增到 maxReadAhead，随机读取将其清零。
+func (this *blockCache) access(off int64, length int) int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if off == this.nextOffset {
+		if this.readAhead == 0 {
+			this.readAhead = 1
+		} else {
+			this.readAhead = this.readAhead * 2
+		}
+		if this.readAhead > this.maxReadAhead {
+			this.readAhead = this.maxReadAhead
+		}
+	} else {
+		this.readAhead = 0
+	}
+	this.nextOffset = off + int64(length)
+	return this.readAhead
+}
+
+// get 返回缓存中的块 index 并将其移到 LRU 的最前面，未缓存时返回 nil。
+func (this *blockCache) get(index int64) []byte {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	element, ok := this.blocks[index]
+	if !ok {
+		return nil
+	}
+	this.stats.Hits++
+	this.lru.MoveToFront(element)
+	return element.Value.(*cacheBlock).data
+}
+
+// contains 判断块 index 是否已缓存，不影响 LRU 顺序和统计。
+func (this *blockCache) contains(index int64) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	_, ok := this.blocks[index]
+	return ok
+}
+
+// insertLocked 将块加入缓存，超过容量时淘汰最久未使用的块，调用方需持有 this.mutex。
+func (this *blockCache) insertLocked(index int64, data []byte) {
+	if element, ok := this.blocks[index]; ok {
+		element.Value.(*cacheBlock).data = data
+		this.lru.MoveToFront(element)
+		return
+	}
+	this.blocks[index] = this.lru.PushFront(&cacheBlock{index: index, data: data})
+	for this.lru.Len() > this.capacity {
+		oldest := this.lru.Back()
+		this.lru.Remove(oldest)
+		delete(this.blocks, oldest.Value.(*cacheBlock).index)
+		this.stats.Evictions++
+	}
+}
+
+// invalidate 在写入 [off, off+length) 之后使相交的缓存块失效。
+func (this *blockCache) invalidate(off int64, length int) {
+	if length <= 0 {
+		return
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.generation++
+	first := off / this.blockSize
+	last := (off + int64(length) - 1) / this.blockSize
+	remove := func(index int64, element *list.Element) {
+		this.lru.Remove(element)
+		delete(this.blocks, index)
+		this.stats.Invalidations++
+	}
+	// 写入范围远大于缓存时遍历缓存，而不是遍历写入范围内的每个块
+	if last-first+1 > int64(len(this.blocks)) {
+		for index, element := range this.blocks {
+			if index >= first && index <= last {
+				remove(index, element)
+			}
+		}
+		return
+	}
+	for index := first; index <= last; index++ {
+		if element, ok := this.blocks[index]; ok {
+			remove(index, element)
+		}
+	}
+}
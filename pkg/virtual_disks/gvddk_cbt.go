@@ -0,0 +1,340 @@
+package virtual_disks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// ChangedArea 表示一个发生变化的磁盘区域，以字节为单位，对应 vSphere 中的 DiskChangeExtent。
+type ChangedArea struct {
+	Start  int64 `json:"start"`
+	Length int64 `json:"length"`
+}
+
+// DiskChangeInfo 是一次 QueryChangedDiskAreas 查询的结果，对应 vSphere 中的 DiskChangeInfo。
+// 一次查询只覆盖 [StartOffset, StartOffset+Length)，调用方需要从覆盖范围的末尾继续查询直到磁盘末尾。
+type DiskChangeInfo struct {
+	StartOffset int64         `json:"startOffset"`
+	Length      int64         `json:"length"`
+	ChangedArea []ChangedArea `json:"changedArea"`
+}
+
+// ChangedAreasProvider 提供自 changeId 以来发生变化的磁盘区域，例如通过 vSphere 的 QueryChangedDiskAreas 实现。
+// changeId 为 "*" 时返回所有已分配的区域，用于第一次全量备份。
+type ChangedAreasProvider interface {
+	QueryChangedDiskAreas(ctx context.Context, startOffset int64, changeId string) (DiskChangeInfo, error)
+}
+
+// changeFile 是 FileChangedAreasProvider 读取的 JSON 文件格式。
+type changeFile struct {
+	BaseChangeId string `json:"baseChangeId"`
+	ChangeId     string `json:"changeId"`
+	DiskChangeInfo
+}
+
+// FileChangedAreasProvider 从本地 JSON 文件中读取变化区域，用于测试或在没有 vCenter 的环境中回放 CBT 查询结果。
+// 文件格式为 {"baseChangeId": "...", "changeId": "...", "startOffset": 0, "length": N, "changedArea": [{"start": S, "length": L}]}，
+// 其中 baseChangeId 为空时不校验查询的 changeId，changeId 是这些变化之后的新 change ID。
+type FileChangedAreasProvider struct {
+	path string
+}
+
+// NewFileChangedAreasProvider 创建一个从 path 读取变化区域的 FileChangedAreasProvider。
+func NewFileChangedAreasProvider(path string) *FileChangedAreasProvider {
+	return &FileChangedAreasProvider{path: path}
+}
+
+// load 读取并解析 JSON 文件。
+func (this *FileChangedAreasProvider) load() (changeFile, error) {
+	var file changeFile
+	data, err := ioutil.ReadFile(this.path)
+	if err != nil {
+		return file, errors.Wrapf(err, "Read changed areas file %s failed", this.path)
+	}
+	if err = json.Unmarshal(data, &file); err != nil {
+		return file, errors.Wrapf(err, "Parse changed areas file %s failed", this.path)
+	}
+	return file, nil
+}
+
+// QueryChangedDiskAreas 返回文件中起始位置不小于 startOffset 的变化区域，覆盖范围一次到达文件记录的末尾。
+func (this *FileChangedAreasProvider) QueryChangedDiskAreas(ctx context.Context, startOffset int64, changeId string) (DiskChangeInfo, error) {
+	file, err := this.load()
+	if err != nil {
+		return DiskChangeInfo{}, err
+	}
+	if file.BaseChangeId != "" && changeId != "*" && changeId != file.BaseChangeId {
+		return DiskChangeInfo{}, errors.Errorf("Changed areas file %s is based on change ID %s, not %s", this.path, file.BaseChangeId, changeId)
+	}
+	end := file.StartOffset + file.Length
+	result := DiskChangeInfo{StartOffset: startOffset, Length: end - startOffset, ChangedArea: []ChangedArea{}}
+	if result.Length < 0 {
+		result.Length = 0
+	}
+	for _, area := range file.ChangedArea {
+		if area.Start+area.Length > startOffset {
+			result.ChangedArea = append(result.ChangedArea, area)
+		}
+	}
+	return result, nil
+}
+
+// NewChangeId 返回文件中记录的新 change ID。
+func (this *FileChangedAreasProvider) NewChangeId() (string, error) {
+	file, err := this.load()
+	if err != nil {
+		return "", err
+	}
+	return file.ChangeId, nil
+}
+
+// 增量读取时每次返回的最大字节数：1 MiB
+const DefaultIncrementalBlockSize = 1024 * 1024
+
+// IncrementalBlock 是增量读取返回的一段数据，Offset 为其在磁盘上的字节偏移量。
+type IncrementalBlock struct {
+	Offset int64
+	Data   []byte
+}
+
+// IncrementalReader 只读取自上一次备份以来发生变化的磁盘区域。
+// 变化区域会被合并，并对齐到 VIXDISKLIB_MIN_CHUNK_SIZE 个扇区，以避免对 VDDK 发出大量零碎的小请求。
+type IncrementalReader struct {
+	diskReaderWriter DiskReaderWriter
+	extents          []ChangedArea
+	changeId         string
+	blockSize        int
+	index            int   // 当前正在读取的区域
+	offset           int64 // 当前区域中下一次读取的位置
+}
+
+// NewIncrementalReader 通过 provider 查询整个磁盘自 changeId 以来的变化区域，并返回只读取这些区域的 IncrementalReader。
+// newChangeId 是本次备份对应的新 change ID（通常来自快照中磁盘的 backing.changeId），会在数据全部写出后由 EmitTo 记录下来。
+func NewIncrementalReader(ctx context.Context, diskReaderWriter DiskReaderWriter, provider ChangedAreasProvider,
+	changeId string, newChangeId string) (*IncrementalReader, error) {
+	capacity := diskReaderWriter.diskHandle.Capacity()
+	areas := make([]ChangedArea, 0)
+	var startOffset int64 = 0
+	for startOffset < capacity {
+		if ctx.Err() != nil {
+			return nil, disklib.WrapContextError(ctx, nil)
+		}
+		info, err := provider.QueryChangedDiskAreas(ctx, startOffset, changeId)
+		if err != nil {
+			return nil, errors.Wrapf(err, "QueryChangedDiskAreas from offset %d failed", startOffset)
+		}
+		areas = append(areas, info.ChangedArea...)
+		next := info.StartOffset + info.Length
+		// 没有前进的查询结果意味着 provider 已经覆盖了它所知道的全部范围
+		if next <= startOffset {
+			break
+		}
+		startOffset = next
+	}
+	return &IncrementalReader{
+		diskReaderWriter: diskReaderWriter,
+		extents:          mergeChangedAreas(areas, disklib.VIXDISKLIB_MIN_CHUNK_SIZE*disklib.VIXDISKLIB_SECTOR_SIZE, capacity),
+		changeId:         newChangeId,
+		blockSize:        DefaultIncrementalBlockSize,
+	}, nil
+}
+
+// mergeChangedAreas 将变化区域扩展到 alignment 的边界、截断到 capacity，并合并重叠或相邻的区域。
+func mergeChangedAreas(areas []ChangedArea, alignment int64, capacity int64) []ChangedArea {
+	aligned := make([]ChangedArea, 0, len(areas))
+	for _, area := range areas {
+		if area.Length <= 0 || area.Start >= capacity {
+			continue
+		}
+		start := area.Start / alignment * alignment
+		end := (area.Start + area.Length + alignment - 1) / alignment * alignment
+		if end > capacity {
+			end = capacity
+		}
+		aligned = append(aligned, ChangedArea{Start: start, Length: end - start})
+	}
+	sort.Slice(aligned, func(i, j int) bool { return aligned[i].Start < aligned[j].Start })
+	merged := make([]ChangedArea, 0, len(aligned))
+	for _, area := range aligned {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if area.Start <= last.Start+last.Length {
+				if end := area.Start + area.Length; end > last.Start+last.Length {
+					last.Length = end - last.Start
+				}
+				continue
+			}
+		}
+		merged = append(merged, area)
+	}
+	return merged
+}
+
+// SetBlockSize 设置 Next 每次返回的最大字节数，需要是扇区大小的整数倍。
+func (this *IncrementalReader) SetBlockSize(blockSize int) {
+	if blockSize < disklib.VIXDISKLIB_SECTOR_SIZE {
+		blockSize = disklib.VIXDISKLIB_SECTOR_SIZE
+	}
+	this.blockSize = blockSize / disklib.VIXDISKLIB_SECTOR_SIZE * disklib.VIXDISKLIB_SECTOR_SIZE
+}
+
+// Extents 返回合并并对齐后的变化区域。
+func (this *IncrementalReader) Extents() []ChangedArea {
+	return this.extents
+}
+
+// ChangeId 返回本次备份对应的新 change ID。
+func (this *IncrementalReader) ChangeId() string {
+	return this.changeId
+}
+
+// ChangedBytes 返回所有变化区域的总字节数。
+func (this *IncrementalReader) ChangedBytes() int64 {
+	var total int64 = 0
+	for _, extent := range this.extents {
+		total = total + extent.Length
+	}
+	return total
+}
+
+// Next 读取下一段变化的数据，所有区域读完后返回 io.EOF。
+func (this *IncrementalReader) Next(ctx context.Context) (IncrementalBlock, error) {
+	for this.index < len(this.extents) && this.offset >= this.extents[this.index].Length {
+		this.index++
+		this.offset = 0
+	}
+	if this.index >= len(this.extents) {
+		return IncrementalBlock{}, io.EOF
+	}
+	extent := this.extents[this.index]
+	length := extent.Length - this.offset
+	if length > int64(this.blockSize) {
+		length = int64(this.blockSize)
+	}
+	block := IncrementalBlock{Offset: extent.Start + this.offset, Data: make([]byte, length)}
+	n, err := this.diskReaderWriter.ReadAtContext(ctx, block.Data, block.Offset)
+	if err != nil {
+		return IncrementalBlock{}, err
+	}
+	block.Data = block.Data[:n]
+	this.offset = this.offset + int64(n)
+	return block, nil
+}
+
+// IncrementalEmitter 接收增量备份的数据和新的 change ID。
+type IncrementalEmitter interface {
+	EmitBlock(offset int64, data []byte) error
+	// EmitChangeId 在所有数据成功写出后被调用一次
+	EmitChangeId(changeId string) error
+}
+
+// EmitTo 将全部变化的数据写入 emitter，成功后再记录新的 change ID，
+// 这样中途失败的备份不会推进 change ID，下一次备份仍然会包含这些变化。
+func (this *IncrementalReader) EmitTo(ctx context.Context, emitter IncrementalEmitter) error {
+	for {
+		block, err := this.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err = emitter.EmitBlock(block.Offset, block.Data); err != nil {
+			return errors.Wrapf(err, "Emit block at offset %d failed", block.Offset)
+		}
+	}
+	return emitter.EmitChangeId(this.changeId)
+}
+
+// WriterAtEmitter 将增量数据写入目标（例如上一次全量备份的镜像文件）的相同偏移量处，
+// 并把新的 change ID 写入 changeIdPath，供下一次增量备份读取。
+type WriterAtEmitter struct {
+	target       io.WriterAt
+	changeIdPath string
+}
+
+// NewWriterAtEmitter 创建一个 WriterAtEmitter。
+func NewWriterAtEmitter(target io.WriterAt, changeIdPath string) *WriterAtEmitter {
+	return &WriterAtEmitter{target: target, changeIdPath: changeIdPath}
+}
+
+// EmitBlock 将数据写入目标的 offset 处。
+func (this *WriterAtEmitter) EmitBlock(offset int64, data []byte) error {
+	_, err := this.target.WriteAt(data, offset)
+	return err
+}
+
+// EmitChangeId 先将目标中的数据刷新到存储，再写入临时文件并重命名，保证 change ID 文件不会只写入一半，
+// 并且崩溃后不会出现 change ID 已经推进而备份数据还没有落盘的情况。
+// 目标实现了 Flush() error 或 Sync() error 时依次调用，例如 DiskReaderWriter 和 *os.File。
+func (this *WriterAtEmitter) EmitChangeId(changeId string) error {
+	if flusher, ok := this.target.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return errors.Wrap(err, "Flush backup target failed")
+		}
+	}
+	if syncer, ok := this.target.(interface{ Sync() error }); ok {
+		if err := syncer.Sync(); err != nil {
+			return errors.Wrap(err, "Sync backup target failed")
+		}
+	}
+	dir := filepath.Dir(this.changeIdPath)
+	tmpFile, err := ioutil.TempFile(dir, filepath.Base(this.changeIdPath)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "Create change ID file failed")
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = tmpFile.WriteString(changeId + "\n"); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "Write change ID file failed")
+	}
+	if err = tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "Sync change ID file failed")
+	}
+	if err = tmpFile.Close(); err != nil {
+		return errors.Wrap(err, "Write change ID file failed")
+	}
+	if err = os.Rename(tmpFile.Name(), this.changeIdPath); err != nil {
+		return errors.Wrap(err, "Rename change ID file failed")
+	}
+	return syncDir(dir)
+}
+
+// syncDir 将目录 dir 刷新到存储，使其中的重命名在崩溃后仍然有效。Windows 不支持对目录调用 fsync，直接返回。
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	file, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "Open directory %s failed", dir)
+	}
+	defer file.Close()
+	if err = file.Sync(); err != nil {
+		return errors.Wrapf(err, "Sync directory %s failed", dir)
+	}
+	return nil
+}
+
+// ReadChangeId 读取 WriterAtEmitter 记录的 change ID，文件不存在时返回 "*"，表示需要进行全量备份。
+func ReadChangeId(changeIdPath string) (string, error) {
+	data, err := ioutil.ReadFile(changeIdPath)
+	if os.IsNotExist(err) {
+		return "*", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "Read change ID file %s failed", changeIdPath)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,48 @@
+package virtual_disks
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// ClonePlan 是克隆前的空间检查结果。
+type ClonePlan struct {
+	DiskType    disklib.VixDiskLibDiskType // 克隆后的磁盘类型
+	DstDir      string                     // 克隆的目标目录
+	SpaceNeeded uint64                     // VixDiskLib_SpaceNeededForClone 返回的所需字节数
+	FreeSpace   uint64                     // 目标目录所在文件系统上非特权用户可用的字节数
+}
+
+// Fits 判断目标目录是否有足够的空间。
+func (this ClonePlan) Fits() bool {
+	return this.SpaceNeeded <= this.FreeSpace
+}
+
+// PlanClone 计算将 src 克隆为 diskType 类型所需的空间，并与本地目标目录 dstDir 所在文件系统的可用空间（statfs）比较。
+// 空间不足时返回填好的 ClonePlan 以及 VIX_E_DISK_FULL 错误（errors.Is(err, disklib.ErrDiskFull) 成立），
+// 调用者应据此放弃克隆，避免克隆进行到一半时磁盘写满。
+func PlanClone(src DiskReaderWriter, diskType disklib.VixDiskLibDiskType, dstDir string) (ClonePlan, disklib.VddkError) {
+	plan := ClonePlan{DiskType: diskType, DstDir: dstDir}
+	spaceNeeded, vErr := src.SpaceNeededForClone(diskType)
+	if vErr != nil {
+		return plan, vErr
+	}
+	plan.SpaceNeeded = spaceNeeded
+	available, err := freeSpace(dstDir)
+	if err != nil {
+		var code uint64 = disklib.VIX_E_FAIL
+		if os.IsNotExist(err) {
+			code = disklib.VIX_E_FILE_NOT_FOUND
+		}
+		return plan, disklib.NewVddkError(code, fmt.Sprintf("Get free space of %s failed: %v. The error code is %d.", dstDir, err, code))
+	}
+	plan.FreeSpace = available
+	if !plan.Fits() {
+		return plan, disklib.NewVddkError(disklib.VIX_E_DISK_FULL,
+			fmt.Sprintf("Plan clone failed: %d bytes are needed but only %d bytes are free in %s. The error code is %d.",
+				plan.SpaceNeeded, plan.FreeSpace, dstDir, disklib.VIX_E_DISK_FULL))
+	}
+	return plan, nil
+}
@@ -0,0 +1,213 @@
+package virtual_disks
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// CopyDisk 的默认参数
+const (
+	DefaultCopyChunkSize = 2048        // 查询已分配块的粒度：2048 个扇区（1 MiB）
+	DefaultCopyBlockSize = 1024 * 1024 // 每次读写的字节数
+	DefaultCopyWorkers   = 4
+)
+
+// CopyOptions 控制 CopyDisk 的行为，零值表示使用默认参数。
+type CopyOptions struct {
+	// ChunkSize 是调用 QueryAllocatedBlocks 的块大小（扇区），必须在 VIXDISKLIB_MIN_CHUNK_SIZE 和 VIXDISKLIB_MAX_CHUNK_SIZE 之间
+	ChunkSize disklib.VixDiskLibSectorType
+	// BlockSize 是每次读写的字节数，会被调整为扇区大小的整数倍
+	BlockSize int
+	// Workers 是并行读写的 goroutine 数量
+	Workers int
+	// FreshTarget 为 true 表示目标磁盘是新建的（未写入的区域读出为零），源磁盘中未分配的区域不写入目标磁盘。
+	// 为 false 时这些区域在目标磁盘上写入零，覆盖目标磁盘中原有的数据
+	FreshTarget bool
+	// DetectZeroes 为 true 时全零的数据块按未分配的区域处理，只在 FreshTarget 为 true 时减少写入
+	DetectZeroes bool
+	// Progress 在每个数据块处理完后被调用，调用是串行的
+	Progress func(stats CopyStats)
+}
+
+// CopyStats 统计 CopyDisk 复制和跳过的字节数。
+type CopyStats struct {
+	BytesCopied  int64 // 从源磁盘复制到目标磁盘的字节数
+	BytesSkipped int64 // 未分配或全零而没有从源磁盘复制的字节数
+	BytesZeroed  int64 // BytesSkipped 中在目标磁盘上写入零的字节数，FreshTarget 为 true 时为 0
+}
+
+// copyJob 是一个需要复制的数据块。
+type copyJob struct {
+	offset int64
+	length int
+	zero   bool // 在目标磁盘上写入零，不读取源磁盘
+}
+
+// CopyDisk 将 src 的内容复制到 dst，与 CopyDiskContext(context.Background(), ...) 相同。
+// 默认在目标磁盘上将源磁盘中未分配的区域写为零；目标磁盘是新建的磁盘时设置 opts.FreshTarget 可以跳过这些写入。
+func CopyDisk(src DiskReaderWriter, dst DiskReaderWriter, opts CopyOptions) (CopyStats, error) {
+	return CopyDiskContext(context.Background(), src, dst, opts)
+}
+
+// CopyDiskContext 将 src 的内容复制到 dst，只从源磁盘读取已分配的区域。
+// 源磁盘的已分配区域由 AllocatedBlockIterator 按窗口查询，后端不支持查询已分配块时整个磁盘都会被复制。
+// 未分配的区域在目标磁盘上写入零；只有 opts.FreshTarget 为 true 时才跳过，此时目标磁盘必须是新建的，
+// 否则目标磁盘中原有的数据会留在这些区域中。数据块由 opts.Workers 个 goroutine 并行读写，
+// 任意一个数据块失败或 ctx 结束后停止复制，返回已经完成的统计和错误。
+func CopyDiskContext(ctx context.Context, src DiskReaderWriter, dst DiskReaderWriter, opts CopyOptions) (CopyStats, error) {
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = DefaultCopyChunkSize
+	}
+	if opts.ChunkSize < disklib.VIXDISKLIB_MIN_CHUNK_SIZE || opts.ChunkSize > disklib.VIXDISKLIB_MAX_CHUNK_SIZE {
+		return CopyStats{}, errors.Errorf("Chunk size %d is not between %d and %d", opts.ChunkSize,
+			disklib.VIXDISKLIB_MIN_CHUNK_SIZE, disklib.VIXDISKLIB_MAX_CHUNK_SIZE)
+	}
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = DefaultCopyBlockSize
+	}
+	opts.BlockSize = (opts.BlockSize + disklib.VIXDISKLIB_SECTOR_SIZE - 1) / disklib.VIXDISKLIB_SECTOR_SIZE * disklib.VIXDISKLIB_SECTOR_SIZE
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultCopyWorkers
+	}
+	capacity := src.diskHandle.Capacity()
+	if dst.diskHandle.Capacity() < capacity {
+		return CopyStats{}, errors.Errorf("Destination capacity %d is smaller than source capacity %d", dst.diskHandle.Capacity(), capacity)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var stats CopyStats
+	var statsMutex sync.Mutex
+	var firstErr error
+	var errOnce sync.Once
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	report := func(copied int64, skipped int64, zeroed int64) {
+		atomic.AddInt64(&stats.BytesCopied, copied)
+		atomic.AddInt64(&stats.BytesSkipped, skipped)
+		atomic.AddInt64(&stats.BytesZeroed, zeroed)
+		if opts.Progress != nil {
+			statsMutex.Lock()
+			opts.Progress(loadCopyStats(&stats))
+			statsMutex.Unlock()
+		}
+	}
+
+	jobs := make(chan copyJob, opts.Workers)
+	zeroes := make([]byte, opts.BlockSize)
+	var workers sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			buf := make([]byte, opts.BlockSize)
+			for job := range jobs {
+				data := buf[:job.length]
+				if job.zero {
+					data = zeroes[:job.length]
+				} else if _, err := src.ReadAtContext(ctx, data, job.offset); err != nil {
+					fail(errors.Wrapf(err, "Read source disk at offset %d failed", job.offset))
+					continue
+				}
+				zero := job.zero || opts.DetectZeroes && isZeroBlock(data)
+				if zero && opts.FreshTarget {
+					report(0, int64(job.length), 0)
+					continue
+				}
+				if _, err := dst.WriteAtContext(ctx, data, job.offset); err != nil {
+					fail(errors.Wrapf(err, "Write destination disk at offset %d failed", job.offset))
+					continue
+				}
+				if zero {
+					report(0, int64(job.length), int64(job.length))
+				} else {
+					report(int64(job.length), 0, 0)
+				}
+			}
+		}()
+	}
+	// send 将 [offset, end) 拆分为数据块交给 worker，ctx 结束时返回 false
+	send := func(offset int64, end int64, zero bool) bool {
+		for offset < end {
+			length := end - offset
+			if length > int64(opts.BlockSize) {
+				length = int64(opts.BlockSize)
+			}
+			select {
+			case jobs <- copyJob{offset: offset, length: int(length), zero: zero}:
+			case <-ctx.Done():
+				return false
+			}
+			offset = offset + length
+		}
+		return true
+	}
+
+	// 遍历已分配的区域并将其拆分为数据块交给 worker，next 与下一个已分配区域之间是未分配的区域
+	capacitySectors := disklib.VixDiskLibSectorType(capacity / disklib.VIXDISKLIB_SECTOR_SIZE)
+	capacity = int64(capacitySectors) * disklib.VIXDISKLIB_SECTOR_SIZE
+	skip := func(offset int64, end int64) bool {
+		if opts.FreshTarget {
+			if end > offset {
+				report(0, end-offset, 0)
+			}
+			return true
+		}
+		return send(offset, end, true)
+	}
+	it, vErr := disklib.NewAllocatedBlockIterator(disklib.AssumeAllocatedIfUnsupported(src), 0, capacitySectors, opts.ChunkSize, capacitySectors)
+	if vErr != nil {
+		fail(vErr)
+	} else {
+		next := int64(0)
+		for it.Next() {
+			block := it.Block()
+			offset := int64(block.Offset()) * disklib.VIXDISKLIB_SECTOR_SIZE
+			end := int64(block.Offset()+block.Length()) * disklib.VIXDISKLIB_SECTOR_SIZE
+			if !skip(next, offset) || !send(offset, end, false) {
+				break
+			}
+			next = end
+		}
+		if vErr = it.Err(); vErr != nil {
+			fail(errors.Wrap(vErr, "Query allocated blocks of the source disk failed"))
+		} else if ctx.Err() == nil {
+			skip(next, capacity)
+		}
+	}
+	close(jobs)
+	workers.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		// 外部的 ctx 被取消或超时
+		firstErr = disklib.WrapContextError(ctx, nil)
+	}
+	return loadCopyStats(&stats), firstErr
+}
+
+// loadCopyStats 原子地读取 stats 中的每个计数。
+func loadCopyStats(stats *CopyStats) CopyStats {
+	return CopyStats{
+		BytesCopied:  atomic.LoadInt64(&stats.BytesCopied),
+		BytesSkipped: atomic.LoadInt64(&stats.BytesSkipped),
+		BytesZeroed:  atomic.LoadInt64(&stats.BytesZeroed),
+	}
+}
+
+// isZeroBlock 判断数据块是否全为零。
+func isZeroBlock(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package virtual_disks
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// isLocal 判断参数是否表示本地（hosted）磁盘，即没有指定服务器。
+func isLocal(params disklib.ConnectParams) bool {
+	return params.ServerName() == ""
+}
+
+// endAccess 结束远程磁盘的访问，本地磁盘没有执行 PrepareForAccess，直接返回。
+func endAccess(params disklib.ConnectParams) disklib.VddkError {
+	if isLocal(params) {
+		return nil
+	}
+	return disklib.EndAccess(params)
+}
+
+// localParams 返回访问本地磁盘 path 所用的连接参数，flags 含 VIXDISKLIB_FLAG_OPEN_READ_ONLY 时以只读方式连接。
+func localParams(path string, flags uint32) disklib.ConnectParams {
+	params := disklib.BuildConnectParams(disklib.ForPath(path), disklib.WithOpenFlags(flags))
+	if flags&disklib.VIXDISKLIB_FLAG_OPEN_READ_ONLY != 0 {
+		params = params.With(disklib.ReadOnly())
+	}
+	return params
+}
+
+// OpenLocal 以服务器名为空的本地连接打开工作站上的 hosted VMDK 文件，不需要 vCenter，也不执行 PrepareForAccess 和 EndAccess。
+// 适合在实验环境中使用或校验恢复出的磁盘，例如：OpenLocal("/backup/disk.vmdk", disklib.VIXDISKLIB_FLAG_OPEN_READ_ONLY, logger)。
+func OpenLocal(path string, flags uint32, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
+	return Open(localParams(path, flags), logger)
+}
+
+// CreateLocal 在本地路径 path 上按 createParams 创建 hosted VMDK 文件并打开。
+func CreateLocal(path string, createParams disklib.VixDiskLibCreateParams, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
+	return CreateDisk(localParams(path, 0), createParams, logger)
+}
+
+// CloneLocal 将本地磁盘 srcPath 克隆为 dstPath，createParams 指定目标的磁盘类型和适配器，容量与源磁盘相同。
+// overWrite 为 false 时目标已存在会返回错误。progress 可以为 nil。
+func CloneLocal(srcPath string, dstPath string, createParams disklib.VixDiskLibCreateParams, overWrite bool,
+	progress disklib.ProgressFunc) disklib.VddkError {
+	conn, vErr := disklib.Connect(localParams(srcPath, disklib.VIXDISKLIB_FLAG_OPEN_READ_ONLY))
+	if vErr != nil {
+		return vErr
+	}
+	defer disklib.Disconnect(conn)
+	return disklib.Clone(conn, dstPath, conn, srcPath, createParams, progress, overWrite)
+}
@@ -0,0 +1,121 @@
+package virtual_disks
+
+import (
+	"context"
+
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// 默认的流水线参数：每个请求 1 MiB，最多 8 个请求同时在 VDDK 中排队。
+const (
+	DefaultPipelineDepth        = 8
+	DefaultPipelineChunkSectors = 2048
+)
+
+// WithPipeline 返回一个使用异步读写流水线的 DiskConnectHandle 副本。
+// 读写中对齐的部分按 chunkSectors 切分成多个请求，最多同时有 depth 个请求未完成，
+// 使 NBD/NBDSSL 连接上不再只有一个请求在途，大块顺序读写可以接近线速。depth 小于 2 时关闭流水线。
+func (this DiskConnectHandle) WithPipeline(depth int, chunkSectors uint64) DiskConnectHandle {
+	if chunkSectors == 0 {
+		chunkSectors = DefaultPipelineChunkSectors
+	}
+	this.pipelineDepth = depth
+	this.pipelineChunkSectors = chunkSectors
+	return this
+}
+
+// WithPipeline 返回一个底层句柄使用异步读写流水线的 DiskReaderWriter，它与原对象共享读写偏移量。
+func (this DiskReaderWriter) WithPipeline(depth int, chunkSectors uint64) DiskReaderWriter {
+	this.diskHandle = this.diskHandle.WithPipeline(depth, chunkSectors)
+	return this
+}
+
+// pipelined 判断句柄是否启用了流水线。
+func (this DiskConnectHandle) pipelined() bool {
+	return this.pipelineDepth > 1
+}
+
+// readAligned 读取对齐的扇区，启用流水线时使用异步读取。
+func (this DiskConnectHandle) readAligned(ctx context.Context, startSector uint64, buf []byte) (int, disklib.VddkError) {
+	if this.pipelined() {
+		return pipelineSectors(ctx, startSector, buf, this.pipelineDepth, this.pipelineChunkSectors,
+			func(startSector uint64, numSectors uint64, buf []byte) (*disklib.AsyncRequest, disklib.VddkError) {
+				return disklib.ReadAsync(this.dli, startSector, numSectors, buf)
+			})
+	}
+	return transferSectors(ctx, startSector, buf,
+		func(startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+			return disklib.Read(this.dli, startSector, numSectors, buf)
+		})
+}
+
+// writeAligned 写入对齐的扇区，启用流水线时使用异步写入。
+func (this DiskConnectHandle) writeAligned(ctx context.Context, startSector uint64, buf []byte) (int, disklib.VddkError) {
+	if this.pipelined() {
+		return pipelineSectors(ctx, startSector, buf, this.pipelineDepth, this.pipelineChunkSectors,
+			func(startSector uint64, numSectors uint64, buf []byte) (*disklib.AsyncRequest, disklib.VddkError) {
+				return disklib.WriteAsync(this.dli, startSector, numSectors, buf)
+			})
+	}
+	return transferSectors(ctx, startSector, buf,
+		func(startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+			return disklib.Write(this.dli, startSector, numSectors, buf)
+		})
+}
+
+// pipelineRequest 记录一个已提交的请求及其覆盖的扇区数。
+type pipelineRequest struct {
+	request    *disklib.AsyncRequest
+	numSectors uint64
+}
+
+// pipelineSectors 将 buf 对应的对齐扇区切分为 chunkSectors 大小的请求，并保持最多 depth 个请求同时未完成。
+// 请求按提交顺序等待，返回从 startSector 开始连续成功传输的字节数。出错或 ctx 结束后不再提交新请求，
+// 但会等待所有已提交的请求完成后才返回，保证返回时 VDDK 不再使用 buf。
+func pipelineSectors(ctx context.Context, startSector uint64, buf []byte, depth int, chunkSectors uint64,
+	submit func(startSector uint64, numSectors uint64, buf []byte) (*disklib.AsyncRequest, disklib.VddkError)) (int, disklib.VddkError) {
+	numSectors := uint64(len(buf) / disklib.VIXDISKLIB_SECTOR_SIZE)
+	pending := make([]pipelineRequest, 0, depth)
+	var submitted uint64 = 0
+	var completed uint64 = 0
+	var firstErr disklib.VddkError
+	broken := false // 是否已有请求失败，此后完成的请求不再计入连续成功的部分
+	for {
+		// 队列未满时继续提交
+		if firstErr == nil && submitted < numSectors && len(pending) < depth {
+			if ctx.Err() != nil {
+				firstErr = disklib.WrapContextError(ctx, nil)
+				continue
+			}
+			batch := numSectors - submitted
+			if batch > chunkSectors {
+				batch = chunkSectors
+			}
+			bufOff := submitted * disklib.VIXDISKLIB_SECTOR_SIZE
+			bufEnd := bufOff + batch*disklib.VIXDISKLIB_SECTOR_SIZE
+			request, err := submit(startSector+submitted, batch, buf[bufOff:bufEnd])
+			if err != nil {
+				firstErr = err
+				continue
+			}
+			pending = append(pending, pipelineRequest{request: request, numSectors: batch})
+			submitted = submitted + batch
+			continue
+		}
+		if len(pending) == 0 {
+			break
+		}
+		// 等待最早提交的请求
+		err := pending[0].request.Wait()
+		if err != nil {
+			broken = true
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if !broken {
+			completed = completed + pending[0].numSectors
+		}
+		pending = pending[1:]
+	}
+	return int(completed * disklib.VIXDISKLIB_SECTOR_SIZE), firstErr
+}
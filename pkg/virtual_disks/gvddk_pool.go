@@ -0,0 +1,534 @@
+package virtual_disks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// ConnectionPool 的默认参数
+const (
+	DefaultPoolMaxRetries       = 3
+	DefaultPoolRetryBackoff     = time.Second
+	DefaultPoolIdleTimeout      = 5 * time.Minute
+	DefaultPoolReconnectTimeout = 5 * time.Minute
+)
+
+// PoolOptions 控制 ConnectionPool 的行为，零值表示使用默认参数。
+type PoolOptions struct {
+	// MaxSessionsPerHost 是每台服务器同时打开的连接数上限，小于等于 0 表示不限制。
+	// 达到上限时先断开该服务器上的空闲连接，没有空闲连接时等待其他连接被释放。
+	MaxSessionsPerHost int
+	// MaxRetries 是读写遇到连接错误后重新打开磁盘并重试的次数
+	MaxRetries int
+	// RetryBackoff 是第一次重试前的等待时间，之后每次重试的等待时间依次递增
+	RetryBackoff time.Duration
+	// IdleTimeout 是连接在没有打开任何磁盘后保留的时间，超时后断开连接并执行 EndAccess
+	IdleTimeout time.Duration
+	// ReconnectTimeout 是读写遇到连接错误后一次重新连接并打开磁盘的最长时间，包括等待 MaxSessionsPerHost 的空位
+	ReconnectTimeout time.Duration
+	// Logger 记录重新连接和断开连接失败的日志，为空时使用 logrus 的标准记录器
+	Logger logrus.FieldLogger
+}
+
+// PoolStats 是 ConnectionPool 的统计信息。
+type PoolStats struct {
+	Connections int   // 当前打开的连接数，包括空闲连接
+	Idle        int   // 没有打开任何磁盘的连接数
+	Reconnects  int64 // 连接错误后成功重新打开磁盘的次数
+}
+
+// ConnectionPool 复用 VDDK 连接：连接参数中服务器、凭据、传输模式、只读标志和访问目标都相同的磁盘共享
+// 同一个 VixDiskLibConnection，只在第一次打开时执行 PrepareForAccess 和 ConnectEx。
+// VDDK 的 ConnectEx 将连接绑定在 VMX（及其快照）或 FCD 上，连接不能用来打开其他虚拟机或其他 FCD 的磁盘，
+// 因此访问目标也是键的一部分：同一虚拟机的多块磁盘共享连接，同一块磁盘关闭后再次打开时复用空闲连接。
+// 连接池不能减少访问不同目标的开销：打开 500 个不同的 FCD 仍然需要 500 次 PrepareForAccess 和 ConnectEx。
+// 磁盘关闭后连接保持空闲，直到空闲超过 IdleTimeout、被 MaxSessionsPerHost 挤出或连接池关闭，断开时执行 EndAccess。
+//
+// 通过连接池打开的磁盘在读写遇到 VIX_E_HOST_NETWORK_CONN_REFUSED、VIX_E_HOST_TCP_CONN_LOST 等连接错误时，
+// 会丢弃出错的连接、重新连接并打开磁盘，然后从未完成的扇区继续读写。
+type ConnectionPool struct {
+	mutex      sync.Mutex
+	options    PoolOptions
+	conns      map[poolKey]*pooledConnection
+	sessions   map[string]int // 每台服务器上 conns 中的连接数，包括正在建立的连接，不包括出错等待断开的连接
+	changed    chan struct{}  // 连接被释放或断开时关闭并替换，用于唤醒等待的 acquire
+	closed     bool
+	reconnects int64
+}
+
+// poolKey 是连接池中连接的键。
+type poolKey struct {
+	server     string
+	thumbPrint string
+	userName   string
+	credential string
+	mode       string
+	identity   string
+	readOnly   bool
+	target     string
+}
+
+// newPoolKey 根据连接参数生成连接池的键。
+func newPoolKey(params disklib.ConnectParams) poolKey {
+	return poolKey{
+		server:     params.ServerName(),
+		thumbPrint: params.ThumbPrint(),
+		userName:   params.UserName(),
+		credential: params.CredentialDigest(),
+		mode:       params.Mode(),
+		identity:   params.Identity(),
+		readOnly:   params.IsReadOnly(),
+		target: fmt.Sprintf("vmx=%s snapshot=%s fcd=%s ds=%s fcdss=%s", params.VmxSpec(), params.SnapshotRef(),
+			params.FcdId(), params.Datastore(), params.FcdssId()),
+	}
+}
+
+// pooledConnection 是连接池中的一个连接。
+type pooledConnection struct {
+	key    poolKey
+	params disklib.ConnectParams
+	conn   disklib.VixDiskLibConnection
+	ready  chan struct{} // 连接建立完成（成功或失败）后关闭
+	err    disklib.VddkError
+	refs   int  // 正在使用该连接的磁盘数和等待连接建立的调用数
+	broken bool // 连接出错或被挤出，引用全部释放后断开
+	idle   int  // 引用计数降为 0 的次数，用于判断空闲超时的定时器是否过期
+}
+
+// pooledDisk 是通过连接池打开的磁盘，连接错误后 dli 和 conn 会被替换。
+type pooledDisk struct {
+	mutex      sync.RWMutex // 读写持有读锁，重新打开和关闭持有写锁
+	pool       *ConnectionPool
+	params     disklib.ConnectParams
+	conn       *pooledConnection // 为空表示重新打开失败，下一次读写时再次尝试
+	dli        disklib.VixDiskLibHandle
+	generation int // 每次重新打开后加一，避免多个 goroutine 重复重新打开
+	closed     bool
+}
+
+// NewConnectionPool 创建一个空的连接池。
+func NewConnectionPool(options PoolOptions) *ConnectionPool {
+	if options.MaxRetries <= 0 {
+		options.MaxRetries = DefaultPoolMaxRetries
+	}
+	if options.RetryBackoff <= 0 {
+		options.RetryBackoff = DefaultPoolRetryBackoff
+	}
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = DefaultPoolIdleTimeout
+	}
+	if options.ReconnectTimeout <= 0 {
+		options.ReconnectTimeout = DefaultPoolReconnectTimeout
+	}
+	if options.Logger == nil {
+		options.Logger = logrus.StandardLogger()
+	}
+	return &ConnectionPool{
+		options:  options,
+		conns:    make(map[poolKey]*pooledConnection),
+		sessions: make(map[string]int),
+		changed:  make(chan struct{}),
+	}
+}
+
+// Open 通过连接池打开磁盘，与 OpenContext(context.Background(), ...) 相同。
+func (this *ConnectionPool) Open(globalParams disklib.ConnectParams, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
+	return this.OpenContext(context.Background(), globalParams, logger)
+}
+
+// OpenContext 与 Open 函数相同，但连接复用连接池中的连接，返回的 DiskReaderWriter 关闭时连接归还给连接池。
+// 等待 MaxSessionsPerHost 的空位或等待连接建立时 ctx 结束则返回错误。
+func (this *ConnectionPool) OpenContext(ctx context.Context, globalParams disklib.ConnectParams, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
+	if vErr := globalParams.Validate(); vErr != nil {
+		return DiskReaderWriter{}, vErr
+	}
+	disk := &pooledDisk{pool: this, params: globalParams}
+	conn, dli, vErr := this.openDisk(ctx, globalParams)
+	if vErr != nil {
+		return DiskReaderWriter{}, vErr
+	}
+	info, vErr := disklib.GetInfo(dli)
+	if vErr != nil {
+		disklib.Close(dli)
+		this.release(conn)
+		return DiskReaderWriter{}, vErr
+	}
+	disk.conn = conn
+	disk.dli = dli
+	diskHandle := NewDiskHandle(dli, conn.conn, globalParams, info)
+	diskHandle.pooled = disk
+	return NewDiskReaderWriter(diskHandle, logger), nil
+}
+
+// Stats 返回连接池的统计信息。
+func (this *ConnectionPool) Stats() PoolStats {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	stats := PoolStats{Reconnects: this.reconnects}
+	for _, conn := range this.conns {
+		select {
+		case <-conn.ready:
+		default:
+			// 正在建立的连接
+			continue
+		}
+		if conn.err != nil {
+			continue
+		}
+		stats.Connections++
+		if conn.refs == 0 {
+			stats.Idle++
+		}
+	}
+	return stats
+}
+
+// Close 断开所有空闲连接，仍在使用的连接在其磁盘关闭后断开。之后不能再通过连接池打开磁盘。
+func (this *ConnectionPool) Close() error {
+	this.mutex.Lock()
+	this.closed = true
+	idle := make([]*pooledConnection, 0)
+	for _, conn := range this.conns {
+		if conn.refs == 0 {
+			this.removeLocked(conn)
+			idle = append(idle, conn)
+		}
+	}
+	this.signalLocked()
+	this.mutex.Unlock()
+	var firstErr error
+	for _, conn := range idle {
+		if err := this.disconnect(conn); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// openDisk 从连接池取得连接并打开磁盘，失败时释放连接。
+func (this *ConnectionPool) openDisk(ctx context.Context, params disklib.ConnectParams) (*pooledConnection, disklib.VixDiskLibHandle, disklib.VddkError) {
+	conn, vErr := this.acquire(ctx, params)
+	if vErr != nil {
+		return nil, disklib.VixDiskLibHandle{}, vErr
+	}
+	dli, vErr := disklib.Open(conn.conn, params)
+	if vErr != nil {
+		if isReconnectError(vErr) {
+			this.markBroken(conn)
+		}
+		this.release(conn)
+		return nil, disklib.VixDiskLibHandle{}, vErr
+	}
+	return conn, dli, nil
+}
+
+// acquire 返回与 params 匹配的连接并增加引用计数，没有时建立新连接。
+func (this *ConnectionPool) acquire(ctx context.Context, params disklib.ConnectParams) (*pooledConnection, disklib.VddkError) {
+	key := newPoolKey(params)
+	for {
+		if ctx.Err() != nil {
+			return nil, disklib.WrapContextError(ctx, nil)
+		}
+		this.mutex.Lock()
+		if this.closed {
+			this.mutex.Unlock()
+			return nil, disklib.NewVddkError(disklib.VIX_E_FAIL, fmt.Sprintf("Open disk from a closed connection pool failed. The error code is %d.", disklib.VIX_E_FAIL))
+		}
+		if conn, ok := this.conns[key]; ok {
+			conn.refs++
+			this.mutex.Unlock()
+			select {
+			case <-conn.ready:
+			case <-ctx.Done():
+				this.release(conn)
+				return nil, disklib.WrapContextError(ctx, nil)
+			}
+			if conn.err != nil {
+				this.release(conn)
+				return nil, conn.err
+			}
+			return conn, nil
+		}
+		if this.options.MaxSessionsPerHost > 0 && this.sessions[key.server] >= this.options.MaxSessionsPerHost {
+			if idle := this.evictIdleLocked(key.server); idle != nil {
+				this.mutex.Unlock()
+				if err := this.disconnect(idle); err != nil {
+					this.options.Logger.Warnf("Disconnect idle connection to %s failed: %v", key.server, err)
+				}
+				continue
+			}
+			changed := this.changed
+			this.mutex.Unlock()
+			select {
+			case <-changed:
+			case <-ctx.Done():
+			}
+			continue
+		}
+		conn := &pooledConnection{key: key, params: params, ready: make(chan struct{}), refs: 1}
+		this.conns[key] = conn
+		this.sessions[key.server]++
+		this.mutex.Unlock()
+
+		conn.conn, conn.err = connect(params)
+		if conn.err != nil {
+			this.mutex.Lock()
+			this.removeLocked(conn)
+			this.mutex.Unlock()
+		}
+		close(conn.ready)
+		if conn.err != nil {
+			this.release(conn)
+			return nil, conn.err
+		}
+		return conn, nil
+	}
+}
+
+// connect 执行 PrepareForAccess 和 ConnectEx，本地磁盘只执行 Connect。
+func connect(params disklib.ConnectParams) (disklib.VixDiskLibConnection, disklib.VddkError) {
+	if isLocal(params) {
+		return disklib.Connect(params)
+	}
+	if vErr := disklib.PrepareForAccess(params); vErr != nil {
+		return disklib.VixDiskLibConnection{}, vErr
+	}
+	conn, vErr := disklib.ConnectEx(params)
+	if vErr != nil {
+		disklib.EndAccess(params)
+		return disklib.VixDiskLibConnection{}, vErr
+	}
+	return conn, nil
+}
+
+// release 减少连接的引用计数，出错、被挤出或连接池已关闭的连接在没有引用后断开，
+// 其他连接在空闲超过 IdleTimeout 后断开。
+func (this *ConnectionPool) release(conn *pooledConnection) {
+	this.mutex.Lock()
+	conn.refs--
+	dead := conn.refs == 0 && (conn.broken || conn.err != nil || this.closed)
+	if dead {
+		this.removeLocked(conn)
+	} else if conn.refs == 0 {
+		conn.idle++
+		idle := conn.idle
+		time.AfterFunc(this.options.IdleTimeout, func() { this.expire(conn, idle) })
+	}
+	this.signalLocked()
+	this.mutex.Unlock()
+	if dead && conn.err == nil {
+		if err := this.disconnect(conn); err != nil {
+			this.options.Logger.Warnf("Disconnect from %s failed: %v", conn.key.server, err)
+		}
+	}
+}
+
+// expire 断开从第 idle 次释放起一直空闲的连接。
+func (this *ConnectionPool) expire(conn *pooledConnection, idle int) {
+	this.mutex.Lock()
+	if conn.refs != 0 || conn.idle != idle || this.conns[conn.key] != conn {
+		this.mutex.Unlock()
+		return
+	}
+	conn.broken = true
+	this.removeLocked(conn)
+	this.signalLocked()
+	this.mutex.Unlock()
+	if err := this.disconnect(conn); err != nil {
+		this.options.Logger.Warnf("Disconnect idle connection to %s failed: %v", conn.key.server, err)
+	}
+}
+
+// markBroken 将连接从连接池中移除，之后的 acquire 会建立新连接。
+// 出错的连接不再计入 MaxSessionsPerHost，其他磁盘仍在使用时也不会阻塞新连接的建立。
+func (this *ConnectionPool) markBroken(conn *pooledConnection) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	conn.broken = true
+	this.removeLocked(conn)
+	this.signalLocked()
+}
+
+// evictIdleLocked 移除服务器 server 上的一个空闲连接并返回它，调用方需持有 this.mutex。
+func (this *ConnectionPool) evictIdleLocked(server string) *pooledConnection {
+	for key, conn := range this.conns {
+		if key.server == server && conn.refs == 0 && conn.err == nil {
+			conn.broken = true
+			this.removeLocked(conn)
+			return conn
+		}
+	}
+	return nil
+}
+
+// removeLocked 将连接从 conns 中移除并减少其服务器上的连接数，连接已经被移除时不做任何事，调用方需持有 this.mutex。
+func (this *ConnectionPool) removeLocked(conn *pooledConnection) {
+	if this.conns[conn.key] != conn {
+		return
+	}
+	delete(this.conns, conn.key)
+	this.sessions[conn.key.server]--
+}
+
+// signalLocked 唤醒所有等待的 acquire，调用方需持有 this.mutex。
+func (this *ConnectionPool) signalLocked() {
+	close(this.changed)
+	this.changed = make(chan struct{})
+}
+
+// disconnect 断开连接并结束访问。
+func (this *ConnectionPool) disconnect(conn *pooledConnection) error {
+	if vErr := disklib.Disconnect(conn.conn); vErr != nil {
+		endAccess(conn.params)
+		return vErr
+	}
+	if vErr := endAccess(conn.params); vErr != nil {
+		return vErr
+	}
+	return nil
+}
+
+// isReconnectError 判断错误是否表示连接已经断开，需要重新连接。
+func isReconnectError(err error) bool {
+	return disklib.Retryable(err)
+}
+
+// errPooledDiskClosed 是磁盘关闭后继续读写时返回的错误。
+var errPooledDiskClosed = disklib.NewVddkError(disklib.VIX_E_INVALID_ARG,
+	fmt.Sprintf("Access a closed disk failed. The error code is %d.", disklib.VIX_E_INVALID_ARG))
+
+// retry 以当前的磁盘句柄执行 operation，因连接错误失败时重新连接并打开磁盘后再次执行，最多重试 MaxRetries 次。
+func (this *pooledDisk) retry(ctx context.Context, operation func(dli disklib.VixDiskLibHandle, conn disklib.VixDiskLibConnection) error) error {
+	options := this.pool.options
+	for attempt := 0; ; attempt++ {
+		this.mutex.RLock()
+		closed, connected, generation := this.closed, this.conn != nil, this.generation
+		var err error
+		if !closed && connected {
+			err = operation(this.dli, this.conn.conn)
+		}
+		this.mutex.RUnlock()
+		if closed {
+			return errPooledDiskClosed
+		}
+		if connected && (err == nil || !isReconnectError(err) || attempt >= options.MaxRetries) {
+			return err
+		}
+		if connected {
+			name := this.params.FcdId()
+			if name == "" {
+				name = this.params.Path()
+			}
+			options.Logger.Warnf("Disk %s lost its connection, reconnecting (attempt %d of %d): %v",
+				name, attempt+1, options.MaxRetries, err)
+		}
+		select {
+		case <-time.After(options.RetryBackoff * time.Duration(attempt+1)):
+		case <-ctx.Done():
+			return disklib.WrapContextError(ctx, nil)
+		}
+		if err = this.reopen(ctx, generation); err != nil && (!isReconnectError(err) || attempt >= options.MaxRetries) {
+			return err
+		}
+	}
+}
+
+// reopen 关闭出错的句柄、丢弃出错的连接，然后重新连接并打开磁盘。其他 goroutine 已经重新打开时直接返回。
+// 重新连接最多等待 ReconnectTimeout，避免持有写锁无限期地等待 MaxSessionsPerHost 的空位。
+func (this *pooledDisk) reopen(ctx context.Context, generation int) disklib.VddkError {
+	ctx, cancel := context.WithTimeout(ctx, this.pool.options.ReconnectTimeout)
+	defer cancel()
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return errPooledDiskClosed
+	}
+	if this.generation != generation {
+		return nil
+	}
+	if this.conn != nil {
+		disklib.Close(this.dli)
+		this.pool.markBroken(this.conn)
+		this.pool.release(this.conn)
+		this.conn = nil
+	}
+	this.generation++
+	conn, dli, vErr := this.pool.openDisk(ctx, this.params)
+	if vErr != nil {
+		return vErr
+	}
+	this.conn = conn
+	this.dli = dli
+	this.pool.mutex.Lock()
+	this.pool.reconnects++
+	this.pool.mutex.Unlock()
+	return nil
+}
+
+// transfer 以当前的磁盘句柄执行读写，重新连接后从未完成的位置继续。
+func (this *pooledDisk) transfer(ctx context.Context, handle DiskConnectHandle, p []byte, off int64,
+	operation func(handle DiskConnectHandle, ctx context.Context, p []byte, off int64) (int, error)) (int, error) {
+	total := 0
+	err := this.retry(ctx, func(dli disklib.VixDiskLibHandle, conn disklib.VixDiskLibConnection) error {
+		handle.dli = dli
+		handle.conn = conn
+		n, err := operation(handle, ctx, p[total:], off+int64(total))
+		total = total + n
+		return err
+	})
+	return total, err
+}
+
+// flush 以当前的磁盘句柄执行 Flush。
+func (this *pooledDisk) flush() error {
+	err := this.retry(context.Background(), func(dli disklib.VixDiskLibHandle, conn disklib.VixDiskLibConnection) error {
+		if vErr := disklib.Flush(dli); vErr != nil {
+			return vErr
+		}
+		return nil
+	})
+	if vErr, ok := err.(disklib.VddkError); ok {
+		return errors.New(fmt.Sprintf(vErr.Error()+" with error code: %d", vErr.VixErrorCode()))
+	}
+	return err
+}
+
+// withHandle 以当前的磁盘句柄执行 operation，例如 QueryAllocatedBlocks 和元数据的读写。
+func (this *pooledDisk) withHandle(operation func(dli disklib.VixDiskLibHandle) disklib.VddkError) disklib.VddkError {
+	err := this.retry(context.Background(), func(dli disklib.VixDiskLibHandle, conn disklib.VixDiskLibConnection) error {
+		if vErr := operation(dli); vErr != nil {
+			return vErr
+		}
+		return nil
+	})
+	if err != nil {
+		return err.(disklib.VddkError)
+	}
+	return nil
+}
+
+// close 关闭磁盘并将连接归还给连接池。
+func (this *pooledDisk) close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	if this.conn == nil {
+		return nil
+	}
+	vErr := disklib.Close(this.dli)
+	this.pool.release(this.conn)
+	this.conn = nil
+	if vErr != nil {
+		return errors.New(fmt.Sprintf(vErr.Error()+" with error code: %d", vErr.VixErrorCode()))
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package virtual_disks
+
+import (
+	"sync"
+
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// sectorRange 是 sectorRangeLock 中的一个加锁请求，覆盖扇区 [start, end)。
+type sectorRange struct {
+	start     uint64
+	end       uint64
+	exclusive bool // 写操作独占，读操作共享
+}
+
+// overlaps 判断两个扇区范围是否相交。
+func (this *sectorRange) overlaps(other *sectorRange) bool {
+	return this.start < other.end && other.start < this.end
+}
+
+// sectorRangeLock 是以扇区范围为粒度的读写锁，由同一磁盘句柄的所有副本共享。
+// 范围相交的写操作之间、写操作与读操作之间互斥，因此非对齐写入的读/修改/写不会与其他写入交错；
+// 范围不相交的操作以及相交的读操作可以并行执行。
+// 等待中的写操作会阻止之后到达的相交读操作加锁，避免写操作在连续的读操作下饿死。
+type sectorRangeLock struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	held    []*sectorRange // 已经加锁的范围
+	waiting []*sectorRange // 等待中的写操作
+}
+
+// newSectorRangeLock 创建一个没有任何加锁范围的 sectorRangeLock。
+func newSectorRangeLock() *sectorRangeLock {
+	lock := &sectorRangeLock{}
+	lock.cond = sync.NewCond(&lock.mutex)
+	return lock
+}
+
+// lockBytes 锁定覆盖字节范围 [off, off+length) 的所有扇区，返回的范围需要传给 unlock。
+func (this *sectorRangeLock) lockBytes(off int64, length int, exclusive bool) *sectorRange {
+	start := uint64(off) / disklib.VIXDISKLIB_SECTOR_SIZE
+	end := (uint64(off) + uint64(length) + disklib.VIXDISKLIB_SECTOR_SIZE - 1) / disklib.VIXDISKLIB_SECTOR_SIZE
+	return this.lock(start, end, exclusive)
+}
+
+// lock 锁定扇区 [start, end)，直到没有相交的冲突请求为止。
+func (this *sectorRangeLock) lock(start uint64, end uint64, exclusive bool) *sectorRange {
+	request := &sectorRange{start: start, end: end, exclusive: exclusive}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if exclusive {
+		this.waiting = append(this.waiting, request)
+	}
+	for this.conflictsLocked(request) {
+		this.cond.Wait()
+	}
+	if exclusive {
+		this.waiting = removeRange(this.waiting, request)
+	}
+	this.held = append(this.held, request)
+	return request
+}
+
+// unlock 释放 lock 返回的范围，并唤醒所有等待的请求。
+func (this *sectorRangeLock) unlock(request *sectorRange) {
+	this.mutex.Lock()
+	this.held = removeRange(this.held, request)
+	this.mutex.Unlock()
+	this.cond.Broadcast()
+}
+
+// conflictsLocked 判断 request 是否与已加锁的范围冲突；读请求还需要等待相交的写请求，调用方需持有 this.mutex。
+func (this *sectorRangeLock) conflictsLocked(request *sectorRange) bool {
+	for _, held := range this.held {
+		if (request.exclusive || held.exclusive) && held.overlaps(request) {
+			return true
+		}
+	}
+	if !request.exclusive {
+		for _, waiting := range this.waiting {
+			if waiting.overlaps(request) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeRange 从 ranges 中删除 request，不保留顺序。
+func removeRange(ranges []*sectorRange, request *sectorRange) []*sectorRange {
+	for i, r := range ranges {
+		if r == request {
+			last := len(ranges) - 1
+			ranges[i] = ranges[last]
+			ranges[last] = nil
+			return ranges[:last]
+		}
+	}
+	return ranges
+}
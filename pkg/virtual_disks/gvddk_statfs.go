@@ -0,0 +1,15 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package virtual_disks
+
+import "syscall"
+
+// freeSpace 返回 dir 所在文件系统上非特权用户可用的字节数。
+func freeSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package virtual_disks
+
+import (
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// freeSpace 在不支持 statfs 的平台上总是返回错误。
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.Errorf("statfs of %s is not supported on %s", dir, runtime.GOOS)
+}
@@ -0,0 +1,371 @@
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Chunk 是结构化读取回复中的一段数据或空洞。
+type Chunk struct {
+	Offset int64
+	Length int64
+	Hole   bool
+}
+
+// Client 是一个简单的 NBD 客户端，按顺序发送请求，可以用来从 NBD 服务器恢复数据或测试 Server。
+type Client struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	writer     *bufio.Writer
+	mutex      sync.Mutex
+	size       int64
+	flags      uint16
+	structured bool
+	handle     uint64
+}
+
+// Dial 连接 network 上 address 处的 NBD 服务器并打开导出名为 exportName 的磁盘。
+func Dial(network string, address string, exportName string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Dial %s %s failed", network, address)
+	}
+	client, err := NewClient(conn, exportName)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewClient 在已经建立的连接上完成握手。服务器支持时使用结构化回复，服务器不支持 NBD_OPT_GO 时退回 NBD_OPT_EXPORT_NAME。
+func NewClient(conn net.Conn, exportName string) (*Client, error) {
+	client := &Client{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+	if err := client.negotiate(exportName); err != nil {
+		return nil, errors.Wrap(err, "NBD negotiation failed")
+	}
+	return client, nil
+}
+
+// negotiate 完成 fixed newstyle 握手。
+func (this *Client) negotiate(exportName string) error {
+	var greeting struct {
+		Magic       uint64
+		OptionMagic uint64
+		Flags       uint16
+	}
+	if err := readFull(this.reader, &greeting); err != nil {
+		return err
+	}
+	if greeting.Magic != nbdMagic || greeting.OptionMagic != optionMagic {
+		return errors.New("Server does not support newstyle negotiation")
+	}
+	if greeting.Flags&flagFixedNewstyle == 0 {
+		return errors.New("Server does not support fixed newstyle negotiation")
+	}
+	clientFlags := uint32(flagFixedNewstyle)
+	noZeroes := greeting.Flags&flagNoZeroes != 0
+	if noZeroes {
+		clientFlags = clientFlags | flagNoZeroes
+	}
+	if err := writeFull(this.writer, clientFlags); err != nil {
+		return err
+	}
+
+	replyType, _, err := this.option(optStructuredReply, nil)
+	if err != nil {
+		return err
+	}
+	this.structured = replyType == repAck
+
+	data := make([]byte, 4+len(exportName)+2)
+	binary.BigEndian.PutUint32(data, uint32(len(exportName)))
+	copy(data[4:], exportName)
+	replyType, payload, err := this.option(optGo, data)
+	if err != nil {
+		return err
+	}
+	for replyType == repInfo {
+		if len(payload) >= 12 && binary.BigEndian.Uint16(payload) == infoExport {
+			this.size = int64(binary.BigEndian.Uint64(payload[2:]))
+			this.flags = binary.BigEndian.Uint16(payload[10:])
+		}
+		if replyType, payload, err = this.readOptionReply(optGo); err != nil {
+			return err
+		}
+	}
+	switch replyType {
+	case repAck:
+		return nil
+	case repErrUnsup:
+		return this.exportName(exportName, noZeroes)
+	default:
+		return errors.Errorf("Server rejected export %q with reply type 0x%x: %s", exportName, replyType, payload)
+	}
+}
+
+// exportName 使用 NBD_OPT_EXPORT_NAME 打开磁盘，服务器不会再发送选项回复。
+func (this *Client) exportName(exportName string, noZeroes bool) error {
+	if err := writeFull(this.writer, uint64(optionMagic), uint32(optExportName), uint32(len(exportName)), []byte(exportName)); err != nil {
+		return err
+	}
+	if err := this.writer.Flush(); err != nil {
+		return err
+	}
+	var size uint64
+	if err := readFull(this.reader, &size); err != nil {
+		return err
+	}
+	if err := readFull(this.reader, &this.flags); err != nil {
+		return err
+	}
+	this.size = int64(size)
+	if !noZeroes {
+		if _, err := io.ReadFull(this.reader, make([]byte, 124)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// option 发送一个选项并读取第一个回复。
+func (this *Client) option(option uint32, data []byte) (uint32, []byte, error) {
+	if err := writeFull(this.writer, uint64(optionMagic), option, uint32(len(data)), data); err != nil {
+		return 0, nil, err
+	}
+	if err := this.writer.Flush(); err != nil {
+		return 0, nil, err
+	}
+	return this.readOptionReply(option)
+}
+
+// readOptionReply 读取一个选项回复。
+func (this *Client) readOptionReply(option uint32) (uint32, []byte, error) {
+	var reply optionReply
+	if err := readFull(this.reader, &reply); err != nil {
+		return 0, nil, err
+	}
+	if reply.Magic != optionReplyMagic || reply.Option != option {
+		return 0, nil, errors.Errorf("Unexpected option reply magic 0x%x for option %d", reply.Magic, reply.Option)
+	}
+	if reply.Length > maxNameLength*2 {
+		return 0, nil, errors.Errorf("Option reply length %d is too large", reply.Length)
+	}
+	payload := make([]byte, reply.Length)
+	if _, err := io.ReadFull(this.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	return reply.Type, payload, nil
+}
+
+// Size 返回导出磁盘的大小（以字节为单位）。
+func (this *Client) Size() int64 {
+	return this.size
+}
+
+// ReadOnly 判断服务器是否以只读方式导出磁盘。
+func (this *Client) ReadOnly() bool {
+	return this.flags&transmissionReadOnly != 0
+}
+
+// Structured 判断是否协商了结构化回复。
+func (this *Client) Structured() bool {
+	return this.structured
+}
+
+// ReadAt 从导出磁盘的 off 处读取数据，off 超出磁盘大小时返回 io.EOF，跨越磁盘末尾的读取会被截断。
+func (this *Client) ReadAt(p []byte, off int64) (int, error) {
+	_, n, err := this.ReadChunks(p, off)
+	return n, err
+}
+
+// ReadChunks 与 ReadAt 相同，同时返回服务器回复的数据块和空洞。
+func (this *Client) ReadChunks(p []byte, off int64) ([]Chunk, int, error) {
+	if off >= this.size {
+		return nil, 0, io.EOF
+	}
+	if off+int64(len(p)) > this.size {
+		p = p[:this.size-off]
+	}
+	var chunks []Chunk
+	total := 0
+	for total < len(p) {
+		length := len(p) - total
+		if length > MaxRequestSize {
+			length = MaxRequestSize
+		}
+		received, err := this.read(p[total:total+length], off+int64(total))
+		chunks = append(chunks, received...)
+		if err != nil {
+			return chunks, total, err
+		}
+		total = total + length
+	}
+	return chunks, total, nil
+}
+
+// read 发送一个读取请求并接收回复。
+func (this *Client) read(p []byte, off int64) ([]Chunk, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	handle, err := this.send(cmdRead, 0, off, uint32(len(p)), nil)
+	if err != nil {
+		return nil, err
+	}
+	if !this.structured {
+		if err = this.readSimpleReply(handle); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(this.reader, p); err != nil {
+			return nil, err
+		}
+		return []Chunk{{Offset: off, Length: int64(len(p))}}, nil
+	}
+	var chunks []Chunk
+	var replyErr error
+	for {
+		var reply structuredReply
+		if err = readFull(this.reader, &reply); err != nil {
+			return chunks, err
+		}
+		if reply.Magic == simpleReplyMagic {
+			return chunks, errors.New("Server sent a simple reply to a structured read")
+		}
+		if reply.Magic != structuredReplyMagic || reply.Handle != handle {
+			return chunks, errors.Errorf("Unexpected reply magic 0x%x for handle %d", reply.Magic, reply.Handle)
+		}
+		if reply.Length > MaxRequestSize+8 {
+			return chunks, errors.Errorf("Reply chunk length %d is too large", reply.Length)
+		}
+		payload := make([]byte, reply.Length)
+		if _, err = io.ReadFull(this.reader, payload); err != nil {
+			return chunks, err
+		}
+		switch reply.Type {
+		case replyTypeNone:
+		case replyTypeOffsetData, replyTypeOffsetHole:
+			if len(payload) < 8 {
+				return chunks, errors.New("Reply chunk is too short")
+			}
+			chunk := Chunk{Offset: int64(binary.BigEndian.Uint64(payload)), Hole: reply.Type == replyTypeOffsetHole}
+			if chunk.Hole {
+				if len(payload) != 12 {
+					return chunks, errors.New("Invalid hole chunk")
+				}
+				chunk.Length = int64(binary.BigEndian.Uint32(payload[8:]))
+			} else {
+				chunk.Length = int64(len(payload) - 8)
+			}
+			if chunk.Offset < off || chunk.Offset+chunk.Length > off+int64(len(p)) {
+				return chunks, errors.Errorf("Reply chunk at %d, length %d is outside of the request", chunk.Offset, chunk.Length)
+			}
+			dst := p[chunk.Offset-off : chunk.Offset-off+chunk.Length]
+			if chunk.Hole {
+				for i := range dst {
+					dst[i] = 0
+				}
+			} else {
+				copy(dst, payload[8:])
+			}
+			chunks = append(chunks, chunk)
+		default:
+			if reply.Type&(1<<15) == 0 {
+				return chunks, errors.Errorf("Unknown reply type %d", reply.Type)
+			}
+			replyErr = errors.Errorf("NBD read at %d, length %d failed with error %d", off, len(p), errorCode(payload))
+		}
+		if reply.Flags&replyFlagDone != 0 {
+			return chunks, replyErr
+		}
+	}
+}
+
+// errorCode 返回错误回复中的错误码。
+func errorCode(payload []byte) uint32 {
+	if len(payload) < 4 {
+		return errIO
+	}
+	return binary.BigEndian.Uint32(payload)
+}
+
+// WriteAt 将 p 写入导出磁盘的 off 处。
+func (this *Client) WriteAt(p []byte, off int64) (int, error) {
+	total := 0
+	for total < len(p) {
+		length := len(p) - total
+		if length > MaxRequestSize {
+			length = MaxRequestSize
+		}
+		if err := this.command(cmdWrite, 0, off+int64(total), uint32(length), p[total:total+length]); err != nil {
+			return total, err
+		}
+		total = total + length
+	}
+	return total, nil
+}
+
+// Flush 要求服务器将已经完成的写入刷新到磁盘。
+func (this *Client) Flush() error {
+	return this.command(cmdFlush, 0, 0, 0, nil)
+}
+
+// Trim 通知服务器 [off, off+length) 中的数据不再需要。
+func (this *Client) Trim(off int64, length uint32) error {
+	return this.command(cmdTrim, 0, off, length, nil)
+}
+
+// Close 发送 NBD_CMD_DISC 并关闭连接。
+func (this *Client) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	_, err := this.send(cmdDisc, 0, 0, 0, nil)
+	if closeErr := this.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// command 发送一个只有简单回复的请求并等待回复。
+func (this *Client) command(cmd uint16, flags uint16, off int64, length uint32, data []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	handle, err := this.send(cmd, flags, off, length, data)
+	if err != nil {
+		return err
+	}
+	return this.readSimpleReply(handle)
+}
+
+// send 发送一个请求，返回请求的句柄。
+func (this *Client) send(cmd uint16, flags uint16, off int64, length uint32, data []byte) (uint64, error) {
+	this.handle++
+	req := request{Magic: requestMagic, Flags: flags, Type: cmd, Handle: this.handle, Offset: uint64(off), Length: length}
+	if err := writeFull(this.writer, req, data); err != nil {
+		return 0, err
+	}
+	return this.handle, this.writer.Flush()
+}
+
+// readSimpleReply 读取简单回复，回复中的错误码不为 0 时返回错误。
+func (this *Client) readSimpleReply(handle uint64) error {
+	var reply simpleReply
+	if err := readFull(this.reader, &reply); err != nil {
+		return err
+	}
+	if reply.Magic != simpleReplyMagic || reply.Handle != handle {
+		return errors.Errorf("Unexpected reply magic 0x%x for handle %d", reply.Magic, reply.Handle)
+	}
+	if reply.Error != 0 {
+		return errors.Errorf("NBD request failed with error %d", reply.Error)
+	}
+	return nil
+}
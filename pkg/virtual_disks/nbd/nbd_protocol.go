@@ -0,0 +1,184 @@
+// Package nbd 通过 NBD（Network Block Device）协议导出已经打开的虚拟磁盘，
+// qemu-img、nbdkit 的客户端以及 nbd-client 可以直接读写 vSphere 上的 FCD，协议参见
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md。
+package nbd
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// 握手阶段的魔数
+const (
+	nbdMagic         = 0x4e42444d41474943 // "NBDMAGIC"
+	optionMagic      = 0x49484156454f5054 // "IHAVEOPT"
+	optionReplyMagic = 0x3e889045565a9
+)
+
+// 握手标志和客户端标志
+const (
+	flagFixedNewstyle = 1 << 0
+	flagNoZeroes      = 1 << 1
+)
+
+// 客户端在握手阶段发送的选项
+const (
+	optExportName      = 1
+	optAbort           = 2
+	optList            = 3
+	optInfo            = 6
+	optGo              = 7
+	optStructuredReply = 8
+)
+
+// 选项的回复类型，最高位为 1 的是错误
+const (
+	repAck        = 1
+	repServer     = 2
+	repInfo       = 3
+	repErrUnsup   = 1<<31 + 1
+	repErrInvalid = 1<<31 + 3
+	repErrUnknown = 1<<31 + 6
+)
+
+// NBD_REP_INFO 中的信息类型
+const (
+	infoExport    = 0
+	infoBlockSize = 3
+)
+
+// 传输标志，描述导出的磁盘支持哪些命令
+const (
+	transmissionHasFlags  = 1 << 0
+	transmissionReadOnly  = 1 << 1
+	transmissionSendFlush = 1 << 2
+	transmissionSendFUA   = 1 << 3
+	transmissionSendTrim  = 1 << 5
+	transmissionSendDF    = 1 << 7
+)
+
+// 传输阶段的魔数
+const (
+	requestMagic         = 0x25609513
+	simpleReplyMagic     = 0x67446698
+	structuredReplyMagic = 0x668e33ef
+)
+
+// 传输阶段的命令
+const (
+	cmdRead  = 0
+	cmdWrite = 1
+	cmdDisc  = 2
+	cmdFlush = 3
+	cmdTrim  = 4
+)
+
+// 命令标志
+const (
+	cmdFlagFUA = 1 << 0
+	cmdFlagDF  = 1 << 2
+)
+
+// 结构化回复的标志和类型
+const (
+	replyFlagDone       = 1 << 0
+	replyTypeNone       = 0
+	replyTypeOffsetData = 1
+	replyTypeOffsetHole = 2
+	replyTypeError      = 1<<15 + 1
+)
+
+// 回复中的错误码，取值与 Linux 的 errno 相同
+const (
+	errPerm     = 1
+	errIO       = 5
+	errInval    = 22
+	errNoSpc    = 28
+	errOverflow = 75
+)
+
+// 块大小的约束：读写可以不对齐，推荐按颗粒读写，单个请求最大 32 MiB
+const (
+	minBlockSize       = 1
+	preferredBlockSize = 64 * 1024
+	MaxRequestSize     = 32 * 1024 * 1024
+)
+
+// 导出名的最大长度
+const maxNameLength = 4096
+
+// request 是传输阶段客户端发送的请求头。
+type request struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Offset uint64
+	Length uint32
+}
+
+// simpleReply 是简单回复的回复头。
+type simpleReply struct {
+	Magic  uint32
+	Error  uint32
+	Handle uint64
+}
+
+// structuredReply 是结构化回复中每个数据块的块头。
+type structuredReply struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Length uint32
+}
+
+// optionReply 是握手阶段对选项的回复头。
+type optionReply struct {
+	Magic  uint64
+	Option uint32
+	Type   uint32
+	Length uint32
+}
+
+// readFull 按大端序从 r 中读取 data。
+func readFull(r io.Reader, data interface{}) error {
+	return binary.Read(r, binary.BigEndian, data)
+}
+
+// writeFull 按大端序将 data 写入 w。
+func writeFull(w io.Writer, data ...interface{}) error {
+	for _, item := range data {
+		var err error
+		if buf, ok := item.([]byte); ok {
+			_, err = w.Write(buf)
+		} else {
+			err = binary.Write(w, binary.BigEndian, item)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readName 读取以 uint32 长度开头的导出名。
+func readName(r io.Reader, remaining uint32) (string, uint32, error) {
+	var length uint32
+	if remaining < 4 {
+		return "", 0, errors.New("Option data is too short for an export name")
+	}
+	if err := readFull(r, &length); err != nil {
+		return "", 0, err
+	}
+	if length > remaining-4 || length > maxNameLength {
+		return "", 0, errors.Errorf("Export name length %d is invalid", length)
+	}
+	name := make([]byte, length)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return "", 0, err
+	}
+	return string(name), remaining - 4 - length, nil
+}
@@ -0,0 +1,614 @@
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// Export 是可以通过 NBD 导出的磁盘，virtual_disks.DiskReaderWriter 满足该接口。
+type Export interface {
+	io.ReaderAt
+	io.WriterAt
+	Capacity() int64
+	QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError)
+}
+
+// Flusher 是支持 NBD_CMD_FLUSH 的磁盘，没有实现该接口时 FLUSH 直接返回成功。
+type Flusher interface {
+	Flush() error
+}
+
+// Trimmer 是支持 NBD_CMD_TRIM 的磁盘。TRIM 只是建议性的，没有实现该接口时 TRIM 直接返回成功。
+type Trimmer interface {
+	Trim(off int64, length int64) error
+}
+
+// ErrServerClosed 在 Server 被关闭后由 Serve 和 ListenAndServe 返回。
+var ErrServerClosed = errors.New("NBD server closed")
+
+// Options 控制 Server 的行为。
+type Options struct {
+	// ExportName 是导出名，为空时接受客户端请求的任意导出名
+	ExportName string
+	// ReadOnly 为 true 时拒绝写入和 TRIM
+	ReadOnly bool
+	// Logger 为 nil 时使用 logrus 的标准日志记录器
+	Logger logrus.FieldLogger
+}
+
+// Server 通过 NBD 协议导出一块磁盘。每个连接按顺序处理请求，多个连接可以同时读写同一块磁盘。
+type Server struct {
+	export    Export
+	options   Options
+	logger    logrus.FieldLogger
+	mutex     sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer 创建导出 export 的 NBD 服务器，调用者负责在服务器关闭后关闭 export。
+func NewServer(export Export, options Options) *Server {
+	logger := options.Logger
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	return &Server{
+		export:    export,
+		options:   options,
+		logger:    logger,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe 在 network（"unix" 或 "tcp"）上的 address 监听并处理连接，直到服务器被关闭。
+func (this *Server) ListenAndServe(network string, address string) error {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return errors.Wrapf(err, "Listen on %s %s failed", network, address)
+	}
+	return this.Serve(listener)
+}
+
+// Serve 接受 listener 上的连接并为每个连接启动一个 goroutine，直到服务器被关闭。
+// Serve 返回时 listener 已经被关闭。
+func (this *Server) Serve(listener net.Listener) error {
+	if !this.track(listener, nil) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer this.untrack(listener, nil)
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if this.isClosed() {
+				return ErrServerClosed
+			}
+			return errors.Wrap(err, "Accept failed")
+		}
+		if !this.track(nil, conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer this.wg.Done()
+			defer this.untrack(nil, conn)
+			if err := this.ServeConn(conn); err != nil && !this.isClosed() {
+				this.logger.Errorf("NBD connection from %s failed: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn 在一个已经建立的连接上完成握手并处理请求，直到客户端断开。ServeConn 返回时连接已经被关闭。
+func (this *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	c := &connection{
+		server: this,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+	transmit, err := c.negotiate()
+	if err != nil {
+		return errors.Wrap(err, "NBD negotiation failed")
+	}
+	if !transmit {
+		return nil
+	}
+	this.logger.Infof("NBD client %s connected", conn.RemoteAddr())
+	return c.transmit()
+}
+
+// Close 关闭所有监听和连接，并等待连接的 goroutine 退出。
+func (this *Server) Close() error {
+	this.mutex.Lock()
+	this.closed = true
+	var firstErr error
+	for listener := range this.listeners {
+		if err := listener.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for conn := range this.conns {
+		conn.Close()
+	}
+	this.mutex.Unlock()
+	this.wg.Wait()
+	return firstErr
+}
+
+// track 记录监听或连接，服务器已经关闭时返回 false。连接在返回 true 时计入 wg，由处理连接的 goroutine 调用 wg.Done。
+func (this *Server) track(listener net.Listener, conn net.Conn) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return false
+	}
+	if listener != nil {
+		this.listeners[listener] = struct{}{}
+	}
+	if conn != nil {
+		this.conns[conn] = struct{}{}
+		this.wg.Add(1)
+	}
+	return true
+}
+
+// untrack 删除 track 记录的监听或连接。
+func (this *Server) untrack(listener net.Listener, conn net.Conn) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if listener != nil {
+		delete(this.listeners, listener)
+	}
+	if conn != nil {
+		delete(this.conns, conn)
+	}
+}
+
+func (this *Server) isClosed() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.closed
+}
+
+// transmissionFlags 返回导出磁盘的传输标志。
+func (this *Server) transmissionFlags() uint16 {
+	flags := uint16(transmissionHasFlags | transmissionSendFlush | transmissionSendFUA | transmissionSendTrim | transmissionSendDF)
+	if this.options.ReadOnly {
+		flags = flags | transmissionReadOnly
+	}
+	return flags
+}
+
+// acceptName 判断客户端请求的导出名是否存在。
+func (this *Server) acceptName(name string) bool {
+	return this.options.ExportName == "" || name == this.options.ExportName
+}
+
+// connection 是一个客户端连接的状态。
+type connection struct {
+	server     *Server
+	reader     *bufio.Reader
+	writer     *bufio.Writer
+	noZeroes   bool
+	structured bool
+}
+
+// negotiate 完成 fixed newstyle 握手，返回 true 表示进入传输阶段，false 表示客户端放弃了连接。
+func (this *connection) negotiate() (bool, error) {
+	if err := writeFull(this.writer, uint64(nbdMagic), uint64(optionMagic), uint16(flagFixedNewstyle|flagNoZeroes)); err != nil {
+		return false, err
+	}
+	if err := this.writer.Flush(); err != nil {
+		return false, err
+	}
+	var clientFlags uint32
+	if err := readFull(this.reader, &clientFlags); err != nil {
+		return false, err
+	}
+	this.noZeroes = clientFlags&flagNoZeroes != 0
+	for {
+		var header struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := readFull(this.reader, &header); err != nil {
+			return false, err
+		}
+		if header.Magic != optionMagic {
+			return false, errors.Errorf("Invalid option magic 0x%x", header.Magic)
+		}
+		transmit, done, err := this.handleOption(header.Option, header.Length)
+		if err != nil || done {
+			return transmit, err
+		}
+		if err = this.writer.Flush(); err != nil {
+			return false, err
+		}
+	}
+}
+
+// handleOption 处理一个选项，done 为 true 表示握手结束。
+func (this *connection) handleOption(option uint32, length uint32) (transmit bool, done bool, err error) {
+	switch option {
+	case optExportName:
+		if length > maxNameLength {
+			return false, true, errors.Errorf("Export name length %d is invalid", length)
+		}
+		name := make([]byte, length)
+		if _, err = io.ReadFull(this.reader, name); err != nil {
+			return false, true, err
+		}
+		// NBD_OPT_EXPORT_NAME 无法回复错误，只能断开连接
+		if !this.server.acceptName(string(name)) {
+			return false, true, errors.Errorf("Unknown export name %q", name)
+		}
+		err = writeFull(this.writer, uint64(this.server.export.Capacity()), this.server.transmissionFlags())
+		if err == nil && !this.noZeroes {
+			err = writeFull(this.writer, make([]byte, 124))
+		}
+		if err == nil {
+			err = this.writer.Flush()
+		}
+		return err == nil, true, err
+	case optAbort:
+		if err = this.discard(length); err != nil {
+			return false, true, err
+		}
+		err = this.writeOptionReply(option, repAck, nil)
+		if err == nil {
+			err = this.writer.Flush()
+		}
+		return false, true, err
+	case optList:
+		if length != 0 {
+			return false, false, this.rejectOption(option, length, repErrInvalid)
+		}
+		name := []byte(this.server.options.ExportName)
+		data := make([]byte, 4+len(name))
+		binary.BigEndian.PutUint32(data, uint32(len(name)))
+		copy(data[4:], name)
+		if err = this.writeOptionReply(option, repServer, data); err != nil {
+			return false, true, err
+		}
+		return false, false, this.writeOptionReply(option, repAck, nil)
+	case optInfo, optGo:
+		return this.handleInfo(option, length)
+	case optStructuredReply:
+		if length != 0 {
+			return false, false, this.rejectOption(option, length, repErrInvalid)
+		}
+		this.structured = true
+		return false, false, this.writeOptionReply(option, repAck, nil)
+	default:
+		return false, false, this.rejectOption(option, length, repErrUnsup)
+	}
+}
+
+// handleInfo 处理 NBD_OPT_INFO 和 NBD_OPT_GO，后者在回复后进入传输阶段。
+func (this *connection) handleInfo(option uint32, length uint32) (bool, bool, error) {
+	name, remaining, err := readName(this.reader, length)
+	if err != nil {
+		return false, true, err
+	}
+	var count uint16
+	if remaining < 2 {
+		return false, false, this.rejectOption(option, remaining, repErrInvalid)
+	}
+	if err = readFull(this.reader, &count); err != nil {
+		return false, true, err
+	}
+	remaining = remaining - 2
+	if uint32(count)*2 != remaining {
+		return false, false, this.rejectOption(option, remaining, repErrInvalid)
+	}
+	wantBlockSize := false
+	for i := uint16(0); i < count; i++ {
+		var infoType uint16
+		if err = readFull(this.reader, &infoType); err != nil {
+			return false, true, err
+		}
+		if infoType == infoBlockSize {
+			wantBlockSize = true
+		}
+	}
+	if !this.server.acceptName(name) {
+		return false, false, this.writeOptionReply(option, repErrUnknown, []byte("unknown export name"))
+	}
+	info := make([]byte, 12)
+	binary.BigEndian.PutUint16(info[0:], infoExport)
+	binary.BigEndian.PutUint64(info[2:], uint64(this.server.export.Capacity()))
+	binary.BigEndian.PutUint16(info[10:], this.server.transmissionFlags())
+	if err = this.writeOptionReply(option, repInfo, info); err != nil {
+		return false, true, err
+	}
+	if wantBlockSize {
+		blockSize := make([]byte, 14)
+		binary.BigEndian.PutUint16(blockSize[0:], infoBlockSize)
+		binary.BigEndian.PutUint32(blockSize[2:], minBlockSize)
+		binary.BigEndian.PutUint32(blockSize[6:], preferredBlockSize)
+		binary.BigEndian.PutUint32(blockSize[10:], MaxRequestSize)
+		if err = this.writeOptionReply(option, repInfo, blockSize); err != nil {
+			return false, true, err
+		}
+	}
+	if err = this.writeOptionReply(option, repAck, nil); err != nil {
+		return false, true, err
+	}
+	if option != optGo {
+		return false, false, nil
+	}
+	return true, true, this.writer.Flush()
+}
+
+// rejectOption 丢弃选项剩余的数据并回复错误。
+func (this *connection) rejectOption(option uint32, length uint32, replyType uint32) error {
+	if err := this.discard(length); err != nil {
+		return err
+	}
+	return this.writeOptionReply(option, replyType, nil)
+}
+
+// discard 丢弃客户端发送的 length 字节。
+func (this *connection) discard(length uint32) error {
+	_, err := io.CopyN(ioutil.Discard, this.reader, int64(length))
+	return err
+}
+
+// writeOptionReply 写出一个选项回复。
+func (this *connection) writeOptionReply(option uint32, replyType uint32, data []byte) error {
+	return writeFull(this.writer, optionReply{Magic: optionReplyMagic, Option: option, Type: replyType, Length: uint32(len(data))}, data)
+}
+
+// transmit 依次处理传输阶段的请求，直到客户端发送 NBD_CMD_DISC 或断开连接。
+func (this *connection) transmit() error {
+	for {
+		var req request
+		if err := readFull(this.reader, &req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if req.Magic != requestMagic {
+			return errors.Errorf("Invalid request magic 0x%x", req.Magic)
+		}
+		var err error
+		switch req.Type {
+		case cmdRead:
+			err = this.handleRead(req)
+		case cmdWrite:
+			err = this.handleWrite(req)
+		case cmdDisc:
+			return nil
+		case cmdFlush:
+			err = this.writeSimpleReply(req.Handle, this.flush())
+		case cmdTrim:
+			err = this.writeSimpleReply(req.Handle, this.trim(req))
+		default:
+			err = this.writeSimpleReply(req.Handle, errInval)
+		}
+		if err == nil {
+			err = this.writer.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// checkRange 检查请求的范围，返回 0 表示范围有效。
+func (this *connection) checkRange(req request, outOfRange uint32) uint32 {
+	if req.Length > MaxRequestSize {
+		if this.structured {
+			return errOverflow
+		}
+		return errInval
+	}
+	if req.Offset+uint64(req.Length) > uint64(this.server.export.Capacity()) || req.Offset+uint64(req.Length) < req.Offset {
+		return outOfRange
+	}
+	return 0
+}
+
+// handleRead 处理 NBD_CMD_READ。协商了结构化回复时，未分配的区域以 NBD_REPLY_TYPE_OFFSET_HOLE 回复。
+func (this *connection) handleRead(req request) error {
+	if code := this.checkRange(req, errInval); code != 0 {
+		if this.structured {
+			return this.writeStructuredError(req.Handle, code, "read out of range")
+		}
+		return this.writeSimpleReply(req.Handle, code)
+	}
+	if !this.structured {
+		buf := make([]byte, req.Length)
+		if _, err := this.server.export.ReadAt(buf, int64(req.Offset)); err != nil {
+			this.server.logger.Errorf("NBD read at %d, length %d failed: %v", req.Offset, req.Length, err)
+			return this.writeSimpleReply(req.Handle, errIO)
+		}
+		return writeFull(this.writer, simpleReply{Magic: simpleReplyMagic, Handle: req.Handle}, buf)
+	}
+	if req.Length == 0 {
+		return writeFull(this.writer, structuredReply{Magic: structuredReplyMagic, Flags: replyFlagDone, Type: replyTypeNone, Handle: req.Handle})
+	}
+	extents := []readExtent{{offset: int64(req.Offset), length: int64(req.Length), data: true}}
+	if req.Flags&cmdFlagDF == 0 {
+		extents = this.allocatedExtents(int64(req.Offset), int64(req.Length))
+	}
+	for i, extent := range extents {
+		var flags uint16 = 0
+		if i == len(extents)-1 {
+			flags = replyFlagDone
+		}
+		if !extent.data {
+			hole := make([]byte, 12)
+			binary.BigEndian.PutUint64(hole[0:], uint64(extent.offset))
+			binary.BigEndian.PutUint32(hole[8:], uint32(extent.length))
+			if err := writeFull(this.writer, structuredReply{Magic: structuredReplyMagic, Flags: flags, Type: replyTypeOffsetHole, Handle: req.Handle, Length: 12}, hole); err != nil {
+				return err
+			}
+			continue
+		}
+		buf := make([]byte, 8+extent.length)
+		binary.BigEndian.PutUint64(buf[0:], uint64(extent.offset))
+		if _, err := this.server.export.ReadAt(buf[8:], extent.offset); err != nil {
+			this.server.logger.Errorf("NBD read at %d, length %d failed: %v", extent.offset, extent.length, err)
+			return this.writeStructuredError(req.Handle, errIO, err.Error())
+		}
+		if err := writeFull(this.writer, structuredReply{Magic: structuredReplyMagic, Flags: flags, Type: replyTypeOffsetData, Handle: req.Handle, Length: uint32(len(buf))}, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readExtent 是读取请求中的一段数据或空洞。
+type readExtent struct {
+	offset int64
+	length int64
+	data   bool
+}
+
+// allocatedExtents 根据 QueryAllocatedBlocks 将 [off, off+length) 划分为数据和空洞，查询失败时整个范围都作为数据。
+func (this *connection) allocatedExtents(off int64, length int64) []readExtent {
+	all := []readExtent{{offset: off, length: length, data: true}}
+	const chunkSize = disklib.VIXDISKLIB_MIN_CHUNK_SIZE
+	capacitySectors := this.server.export.Capacity() / disklib.VIXDISKLIB_SECTOR_SIZE
+	startSector := off / disklib.VIXDISKLIB_SECTOR_SIZE / chunkSize * chunkSize
+	endSector := (off + length + disklib.VIXDISKLIB_SECTOR_SIZE - 1) / disklib.VIXDISKLIB_SECTOR_SIZE
+	endSector = (endSector + chunkSize - 1) / chunkSize * chunkSize
+	if endSector > capacitySectors {
+		endSector = capacitySectors
+	}
+	if endSector <= startSector {
+		return all
+	}
+	it, vErr := disklib.NewAllocatedBlockIterator(this.server.export, disklib.VixDiskLibSectorType(startSector),
+		disklib.VixDiskLibSectorType(endSector-startSector), chunkSize, disklib.VixDiskLibSectorType(capacitySectors))
+	if vErr != nil {
+		return all
+	}
+	var blocks []disklib.VixDiskLibBlock
+	for it.Next() {
+		blocks = append(blocks, it.Block())
+	}
+	if it.Err() != nil {
+		return all
+	}
+	var extents []readExtent
+	add := func(start int64, end int64, data bool) {
+		if start < off {
+			start = off
+		}
+		if end > off+length {
+			end = off + length
+		}
+		if end <= start {
+			return
+		}
+		if last := len(extents) - 1; last >= 0 && extents[last].data == data {
+			extents[last].length = end - extents[last].offset
+			return
+		}
+		extents = append(extents, readExtent{offset: start, length: end - start, data: data})
+	}
+	pos := off
+	for _, block := range blocks {
+		blockStart := int64(block.Offset()) * disklib.VIXDISKLIB_SECTOR_SIZE
+		blockEnd := blockStart + int64(block.Length())*disklib.VIXDISKLIB_SECTOR_SIZE
+		add(pos, blockStart, false)
+		add(blockStart, blockEnd, true)
+		if blockEnd > pos {
+			pos = blockEnd
+		}
+	}
+	add(pos, off+length, false)
+	return extents
+}
+
+// handleWrite 处理 NBD_CMD_WRITE，设置了 FUA 标志时写入后立即刷新。
+func (this *connection) handleWrite(req request) error {
+	if req.Length > MaxRequestSize {
+		// 无法跳过过大的写入数据，只能断开连接
+		return errors.Errorf("Write request length %d exceeds the maximum %d", req.Length, MaxRequestSize)
+	}
+	buf := make([]byte, req.Length)
+	if _, err := io.ReadFull(this.reader, buf); err != nil {
+		return err
+	}
+	if this.server.options.ReadOnly {
+		return this.writeSimpleReply(req.Handle, errPerm)
+	}
+	if code := this.checkRange(req, errNoSpc); code != 0 {
+		return this.writeSimpleReply(req.Handle, code)
+	}
+	if _, err := this.server.export.WriteAt(buf, int64(req.Offset)); err != nil {
+		this.server.logger.Errorf("NBD write at %d, length %d failed: %v", req.Offset, req.Length, err)
+		return this.writeSimpleReply(req.Handle, errIO)
+	}
+	if req.Flags&cmdFlagFUA != 0 {
+		return this.writeSimpleReply(req.Handle, this.flush())
+	}
+	return this.writeSimpleReply(req.Handle, 0)
+}
+
+// flush 刷新磁盘，返回回复中的错误码。
+func (this *connection) flush() uint32 {
+	flusher, ok := this.server.export.(Flusher)
+	if !ok {
+		return 0
+	}
+	if err := flusher.Flush(); err != nil {
+		this.server.logger.Errorf("NBD flush failed: %v", err)
+		return errIO
+	}
+	return 0
+}
+
+// trim 处理 NBD_CMD_TRIM，返回回复中的错误码。
+func (this *connection) trim(req request) uint32 {
+	if this.server.options.ReadOnly {
+		return errPerm
+	}
+	if req.Offset+uint64(req.Length) > uint64(this.server.export.Capacity()) || req.Offset+uint64(req.Length) < req.Offset {
+		return errInval
+	}
+	trimmer, ok := this.server.export.(Trimmer)
+	if !ok {
+		return 0
+	}
+	if err := trimmer.Trim(int64(req.Offset), int64(req.Length)); err != nil {
+		this.server.logger.Errorf("NBD trim at %d, length %d failed: %v", req.Offset, req.Length, err)
+		return errIO
+	}
+	if req.Flags&cmdFlagFUA != 0 {
+		return this.flush()
+	}
+	return 0
+}
+
+// writeSimpleReply 写出简单回复。
+func (this *connection) writeSimpleReply(handle uint64, code uint32) error {
+	return writeFull(this.writer, simpleReply{Magic: simpleReplyMagic, Error: code, Handle: handle})
+}
+
+// writeStructuredError 写出结束读取请求的 NBD_REPLY_TYPE_ERROR。
+func (this *connection) writeStructuredError(handle uint64, code uint32, message string) error {
+	payload := make([]byte, 6+len(message))
+	binary.BigEndian.PutUint32(payload[0:], code)
+	binary.BigEndian.PutUint16(payload[4:], uint16(len(message)))
+	copy(payload[6:], message)
+	return writeFull(this.writer, structuredReply{Magic: structuredReplyMagic, Flags: replyFlagDone, Type: replyTypeError, Handle: handle, Length: uint32(len(payload))}, payload)
+}
@@ -0,0 +1,140 @@
+package vmdk
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// noParentCID 是没有父磁盘时 parentCID 的取值。
+const noParentCID = 0xffffffff
+
+// ExtentDescriptor 是描述符中的一行扩展描述，例如 RW 4192256 SPARSE "disk-s001.vmdk"。
+type ExtentDescriptor struct {
+	Access   string // RW、RDONLY 或 NOACCESS
+	Sectors  int64  // 扩展的扇区数
+	Type     string // SPARSE、FLAT、ZERO、VMFS 等
+	FileName string // 相对于描述符所在目录的文件名
+	Offset   int64  // FLAT 扩展在文件中的起始扇区
+}
+
+// Descriptor 是 VMDK 的文本描述符。
+type Descriptor struct {
+	Version            int
+	CID                uint32
+	ParentCID          uint32
+	CreateType         string
+	ParentFileNameHint string
+	Extents            []ExtentDescriptor
+	DDB                map[string]string // ddb.* 键值对
+}
+
+// Capacity 返回所有扩展的总扇区数。
+func (this *Descriptor) Capacity() int64 {
+	var sectors int64 = 0
+	for _, extent := range this.Extents {
+		sectors = sectors + extent.Sectors
+	}
+	return sectors
+}
+
+// HasParent 判断描述符是否引用了父磁盘。
+func (this *Descriptor) HasParent() bool {
+	return this.ParentCID != noParentCID && this.ParentFileNameHint != ""
+}
+
+// ParseDescriptor 解析 VMDK 文本描述符。
+func ParseDescriptor(text string) (*Descriptor, error) {
+	descriptor := &Descriptor{ParentCID: noParentCID, DDB: make(map[string]string)}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(strings.TrimRight(scanner.Text(), "\x00"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if extent, ok, err := parseExtentLine(line); ok {
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid extent description on line %d", lineNumber)
+			}
+			descriptor.Extents = append(descriptor.Extents, extent)
+			continue
+		}
+		equal := strings.Index(line, "=")
+		if equal < 0 {
+			return nil, errors.Errorf("Invalid descriptor line %d: %s", lineNumber, line)
+		}
+		key := strings.TrimSpace(line[:equal])
+		value := strings.Trim(strings.TrimSpace(line[equal+1:]), "\"")
+		var err error
+		switch key {
+		case "version":
+			descriptor.Version, err = strconv.Atoi(value)
+		case "CID":
+			descriptor.CID, err = parseCID(value)
+		case "parentCID":
+			descriptor.ParentCID, err = parseCID(value)
+		case "createType":
+			descriptor.CreateType = value
+		case "parentFileNameHint":
+			descriptor.ParentFileNameHint = value
+		default:
+			if strings.HasPrefix(key, "ddb.") {
+				descriptor.DDB[key] = value
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid value for %s on line %d", key, lineNumber)
+		}
+	}
+	if len(descriptor.Extents) == 0 {
+		return nil, errors.New("Descriptor does not contain any extent")
+	}
+	return descriptor, nil
+}
+
+// parseCID 解析十六进制的内容 ID。
+func parseCID(value string) (uint32, error) {
+	cid, err := strconv.ParseUint(value, 16, 32)
+	return uint32(cid), err
+}
+
+// parseExtentLine 解析扩展描述行，第二个返回值表示该行是否为扩展描述。
+func parseExtentLine(line string) (ExtentDescriptor, bool, error) {
+	var extent ExtentDescriptor
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return extent, false, nil
+	}
+	switch fields[0] {
+	case "RW", "RDONLY", "NOACCESS":
+	default:
+		return extent, false, nil
+	}
+	extent.Access = fields[0]
+	sectors, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return extent, true, err
+	}
+	extent.Sectors = sectors
+	extent.Type = fields[2]
+	if extent.Type == "ZERO" {
+		return extent, true, nil
+	}
+	// 文件名可能包含空格，位于一对引号之间
+	first := strings.Index(line, "\"")
+	last := strings.LastIndex(line, "\"")
+	if first < 0 || last <= first {
+		return extent, true, errors.New("Missing extent file name")
+	}
+	extent.FileName = line[first+1 : last]
+	if rest := strings.Fields(line[last+1:]); len(rest) > 0 {
+		if extent.Offset, err = strconv.ParseInt(rest[0], 10, 64); err != nil {
+			return extent, true, err
+		}
+	}
+	return extent, true, nil
+}
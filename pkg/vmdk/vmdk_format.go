@@ -0,0 +1,117 @@
+// Package vmdk 在不依赖 VDDK 的情况下读写 VMDK 文件，格式参见 VMware Virtual Disk Format 5.0。
+package vmdk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// SectorSize 是 VMDK 中扇区的大小。
+const SectorSize = 512
+
+// 稀疏扩展头中的常量
+const (
+	sparseMagic            = 0x564d444b // "KDMV"
+	sparseVersion          = 1
+	streamOptimizedVersion = 3
+	defaultGrainSectors    = 128 // 每个颗粒 64 KiB
+	numGTEsPerGT           = 512
+	gdAtEnd                = 0xffffffffffffffff
+
+	flagValidNewLineTest = 1 << 0
+	flagRedundantGT      = 1 << 1
+	flagCompressed       = 1 << 16
+	flagMarkers          = 1 << 17
+
+	compressionDeflate = 1
+)
+
+// streamOptimized 文件中标记的类型
+const (
+	markerEOS    = 0
+	markerGT     = 1
+	markerGD     = 2
+	markerFooter = 3
+)
+
+// sparseExtentHeader 是稀疏扩展文件开头的 512 字节头部，所有字段均为小端序。
+type sparseExtentHeader struct {
+	MagicNumber        uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RgdOffset          uint64
+	GdOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+	Pad                [433]uint8
+}
+
+// newSparseExtentHeader 返回换行检测字符已经填好的头部。
+func newSparseExtentHeader() sparseExtentHeader {
+	return sparseExtentHeader{
+		MagicNumber:        sparseMagic,
+		NumGTEsPerGT:       numGTEsPerGT,
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+	}
+}
+
+// marshal 将头部编码为一个扇区。
+func (this *sparseExtentHeader) marshal() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, this)
+	return buf.Bytes()
+}
+
+// readSparseExtentHeader 从 r 的 off 处读取并校验头部。
+func readSparseExtentHeader(r io.ReaderAt, off int64) (sparseExtentHeader, error) {
+	var header sparseExtentHeader
+	buf := make([]byte, SectorSize)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return header, errors.Wrap(err, "Read sparse extent header failed")
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &header); err != nil {
+		return header, errors.Wrap(err, "Decode sparse extent header failed")
+	}
+	if header.MagicNumber != sparseMagic {
+		return header, errors.Errorf("Invalid sparse extent magic number 0x%x", header.MagicNumber)
+	}
+	return header, nil
+}
+
+// marshalMarker 将元数据标记编码为一个扇区。streamOptimized 文件中每段数据之前都有一个标记：
+// 颗粒标记为 {lba uint64, size uint32}，size 为压缩数据的长度；元数据标记的 size 为 0，随后的 uint32 给出类型。
+func marshalMarker(val uint64, typ uint32) []byte {
+	buf := make([]byte, SectorSize)
+	binary.LittleEndian.PutUint64(buf[0:8], val)
+	binary.LittleEndian.PutUint32(buf[12:16], typ)
+	return buf
+}
+
+// Source 是可以被导出为 VMDK 的磁盘，virtual_disks.DiskReaderWriter 和 Disk 都满足该接口。
+type Source interface {
+	io.ReaderAt
+	Capacity() int64
+	QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError)
+}
+
+// sectorsFor 返回容纳 size 字节所需的扇区数。
+func sectorsFor(size int64) int64 {
+	return (size + SectorSize - 1) / SectorSize
+}
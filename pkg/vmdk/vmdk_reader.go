@@ -0,0 +1,559 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// 颗粒表项中表示“颗粒全为零”的取值，仅在头部设置了 flagZeroedGTE 时有效
+const (
+	flagZeroedGTE  = 1 << 2
+	zeroedGrainGTE = 1
+)
+
+// 文本描述符文件的最大大小，超过该大小的非稀疏文件不会被当作描述符解析，内嵌的描述符也不能超过该大小
+const maxDescriptorFileSize = 1024 * 1024
+
+// 稀疏扩展头部中字段的上限，超过上限的文件视为损坏，避免按照损坏的字段分配过大的内存
+const (
+	maxGrainSectors = 64 * 1024 // 颗粒最大 32 MiB，VMware 创建的文件均为 128 个扇区
+	maxGTEsPerGT    = 64 * 1024 // 颗粒表最多 64K 项，VMware 创建的文件均为 512 项
+)
+
+// extent 是磁盘中的一个扩展，偏移量均相对于扩展的起始位置，以字节为单位。
+type extent interface {
+	// unitEnd 返回包含 off 的分配单元的结束位置，一次 read 不会跨越分配单元
+	unitEnd(off int64) int64
+	// read 将 off 处的数据读入 p，返回 false 表示该分配单元在本扩展中未分配，需要从父磁盘读取
+	read(p []byte, off int64) (bool, error)
+	// allocated 判断 [off, off+length) 中是否有已分配的数据
+	allocated(off int64, length int64) (bool, error)
+	close() error
+}
+
+// Disk 是一个以只读方式打开的 VMDK 磁盘，支持 monolithicSparse、monolithicFlat、twoGbMaxExtentSparse、
+// twoGbMaxExtentFlat、vmfs 和 streamOptimized 格式，并会沿着 parentFileNameHint 打开父磁盘链。
+// 它提供与 DiskConnectHandle 相同的 ReadAt、Capacity 和 QueryAllocatedBlocks，可以替代 VDDK 打开的磁盘使用。
+type Disk struct {
+	path       string
+	descriptor *Descriptor
+	extents    []extent
+	starts     []int64 // 每个扩展在磁盘中的起始字节偏移量
+	capacity   int64
+	parent     *Disk
+}
+
+// Open 打开 path 指向的 VMDK 文件，path 可以是文本描述符，也可以是内嵌描述符的稀疏文件。
+func Open(path string) (*Disk, error) {
+	return openChain(path, map[string]bool{})
+}
+
+// openChain 打开 path 及其父磁盘链，visited 记录链上已经打开过的文件，父磁盘链中出现环时返回错误。
+func openChain(path string, visited map[string]bool) (*Disk, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Resolve path %s failed", path)
+	}
+	if visited[absPath] {
+		return nil, errors.Errorf("Parent chain of %s contains a cycle", path)
+	}
+	visited[absPath] = true
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Open %s failed", path)
+	}
+	descriptor, embedded, err := readDescriptor(file)
+	file.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Read descriptor of %s failed", path)
+	}
+	disk := &Disk{path: path, descriptor: descriptor}
+	dir := filepath.Dir(path)
+	for _, extentDescriptor := range descriptor.Extents {
+		extentPath := filepath.Join(dir, extentDescriptor.FileName)
+		// 内嵌描述符的单扩展文件中，扩展就是文件本身，即使文件被重命名过
+		if embedded && len(descriptor.Extents) == 1 {
+			extentPath = path
+		}
+		if extentDescriptor.Sectors < 0 || extentDescriptor.Offset < 0 || extentDescriptor.Offset > math.MaxInt64/SectorSize ||
+			extentDescriptor.Sectors > (math.MaxInt64-disk.capacity)/SectorSize {
+			disk.Close()
+			return nil, errors.Errorf("Invalid size %d or offset %d of extent %s of %s", extentDescriptor.Sectors,
+				extentDescriptor.Offset, extentDescriptor.FileName, path)
+		}
+		ext, err := openExtent(extentDescriptor, extentPath)
+		if err != nil {
+			disk.Close()
+			return nil, errors.Wrapf(err, "Open extent %s of %s failed", extentDescriptor.FileName, path)
+		}
+		disk.extents = append(disk.extents, ext)
+		disk.starts = append(disk.starts, disk.capacity)
+		disk.capacity = disk.capacity + extentDescriptor.Sectors*SectorSize
+	}
+	if descriptor.HasParent() {
+		parentPath := descriptor.ParentFileNameHint
+		if !filepath.IsAbs(parentPath) {
+			parentPath = filepath.Join(dir, parentPath)
+		}
+		parent, err := openChain(parentPath, visited)
+		if err != nil {
+			disk.Close()
+			return nil, errors.Wrapf(err, "Open parent of %s failed", path)
+		}
+		if parent.descriptor.CID != descriptor.ParentCID {
+			parent.Close()
+			disk.Close()
+			return nil, errors.Errorf("Content ID of parent %s is %08x, %s expects %08x", parentPath, parent.descriptor.CID, path, descriptor.ParentCID)
+		}
+		disk.parent = parent
+	}
+	return disk, nil
+}
+
+// readDescriptor 读取文件中的描述符，第二个返回值表示描述符是否内嵌在稀疏文件中。
+func readDescriptor(file *os.File) (*Descriptor, bool, error) {
+	magic := make([]byte, 4)
+	if _, err := file.ReadAt(magic, 0); err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if binary.LittleEndian.Uint32(magic) == sparseMagic {
+		header, err := readSparseExtentHeader(file, 0)
+		if err != nil {
+			return nil, false, err
+		}
+		if header.DescriptorOffset == 0 || header.DescriptorSize == 0 {
+			return nil, false, errors.New("Sparse extent does not contain an embedded descriptor")
+		}
+		if header.DescriptorSize > maxDescriptorFileSize/SectorSize || !withinFile(info.Size(), header.DescriptorOffset, header.DescriptorSize*SectorSize) {
+			return nil, false, errors.Errorf("Embedded descriptor of %d sectors at sector %d is out of range", header.DescriptorSize, header.DescriptorOffset)
+		}
+		buf := make([]byte, header.DescriptorSize*SectorSize)
+		if _, err = file.ReadAt(buf, int64(header.DescriptorOffset)*SectorSize); err != nil {
+			return nil, false, err
+		}
+		descriptor, err := ParseDescriptor(string(bytes.TrimRight(buf, "\x00")))
+		return descriptor, true, err
+	}
+	if info.Size() > maxDescriptorFileSize {
+		return nil, false, errors.New("File is neither a sparse extent nor a text descriptor")
+	}
+	buf := make([]byte, info.Size())
+	if _, err = io.ReadFull(file, buf); err != nil {
+		return nil, false, err
+	}
+	descriptor, err := ParseDescriptor(string(buf))
+	return descriptor, false, err
+}
+
+// withinFile 判断从扇区 sector 开始的 length 个字节是否都在大小为 fileSize 的文件中，计算不会溢出。
+func withinFile(fileSize int64, sector uint64, length uint64) bool {
+	fileSectors := uint64(fileSize) / SectorSize
+	return sector <= fileSectors && length <= uint64(fileSize)-sector*SectorSize
+}
+
+// openExtent 根据扩展描述打开扩展文件。
+func openExtent(extentDescriptor ExtentDescriptor, path string) (extent, error) {
+	switch extentDescriptor.Type {
+	case "ZERO":
+		return zeroExtent{}, nil
+	case "FLAT", "VMFS":
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return &flatExtent{file: file, offset: extentDescriptor.Offset * SectorSize, size: extentDescriptor.Sectors * SectorSize}, nil
+	case "SPARSE":
+		return openSparseExtent(path)
+	default:
+		return nil, errors.Errorf("Extent type %s is not supported", extentDescriptor.Type)
+	}
+}
+
+// Descriptor 返回磁盘的描述符。
+func (this *Disk) Descriptor() *Descriptor {
+	return this.descriptor
+}
+
+// Parent 返回父磁盘，没有父磁盘时返回 nil。
+func (this *Disk) Parent() *Disk {
+	return this.parent
+}
+
+// Capacity 返回磁盘的总容量（以字节为单位）。
+func (this *Disk) Capacity() int64 {
+	return this.capacity
+}
+
+// Close 关闭磁盘及其父磁盘链打开的所有文件。
+func (this *Disk) Close() error {
+	var firstErr error
+	for _, ext := range this.extents {
+		if err := ext.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	this.extents = nil
+	if this.parent != nil {
+		if err := this.parent.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		this.parent = nil
+	}
+	return firstErr
+}
+
+// findExtent 返回包含磁盘偏移量 off 的扩展编号。
+func (this *Disk) findExtent(off int64) int {
+	index := 0
+	for i, start := range this.starts {
+		if start <= off {
+			index = i
+		}
+	}
+	return index
+}
+
+// extentEnd 返回第 index 个扩展在磁盘中的结束位置。
+func (this *Disk) extentEnd(index int) int64 {
+	if index+1 < len(this.starts) {
+		return this.starts[index+1]
+	}
+	return this.capacity
+}
+
+// ReadAt 从磁盘的 off 处读取数据。与 DiskConnectHandle.ReadAt 相同，off 超出容量时返回 io.EOF，
+// 跨越磁盘末尾的读取会被截断。在本磁盘中未分配的区域从父磁盘读取，没有父磁盘时读出为零。
+func (this *Disk) ReadAt(p []byte, off int64) (int, error) {
+	if off >= this.capacity {
+		return 0, io.EOF
+	}
+	if off+int64(len(p)) > this.capacity {
+		p = p[:this.capacity-off]
+	}
+	total := 0
+	for total < len(p) {
+		pos := off + int64(total)
+		index := this.findExtent(pos)
+		start := this.starts[index]
+		end := start + this.extents[index].unitEnd(pos-start)
+		if extentEnd := this.extentEnd(index); end > extentEnd {
+			end = extentEnd
+		}
+		if remain := int64(len(p) - total); end-pos > remain {
+			end = pos + remain
+		}
+		buf := p[total : total+int(end-pos)]
+		ok, err := this.extents[index].read(buf, pos-start)
+		if err != nil {
+			return total, errors.Wrapf(err, "Read %s at offset %d failed", this.path, pos)
+		}
+		if !ok {
+			if err = this.readParent(buf, pos); err != nil {
+				return total, err
+			}
+		}
+		total = total + len(buf)
+	}
+	return total, nil
+}
+
+// readParent 从父磁盘读取本磁盘中未分配的区域，父磁盘容量之外的部分读出为零。
+func (this *Disk) readParent(buf []byte, off int64) error {
+	for i := range buf {
+		buf[i] = 0
+	}
+	if this.parent == nil || off >= this.parent.capacity {
+		return nil
+	}
+	_, err := this.parent.ReadAt(buf, off)
+	return err
+}
+
+// allocated 判断 [off, off+length) 在磁盘链中是否有已分配的数据。
+func (this *Disk) allocated(off int64, length int64) (bool, error) {
+	end := off + length
+	for pos := off; pos < end; {
+		index := this.findExtent(pos)
+		start := this.starts[index]
+		extentEnd := this.extentEnd(index)
+		if extentEnd > end {
+			extentEnd = end
+		}
+		ok, err := this.extents[index].allocated(pos-start, extentEnd-pos)
+		if err != nil || ok {
+			return ok, err
+		}
+		pos = extentEnd
+	}
+	if this.parent != nil && off < this.parent.capacity {
+		return this.parent.allocated(off, length)
+	}
+	return false, nil
+}
+
+// QueryAllocatedBlocks 按照 chunkSize 返回磁盘链中已分配的块，参数的校验和相邻块的合并与 VDDK 一致，参见 disklib.QueryChunks。
+func (this *Disk) QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
+	capacitySectors := disklib.VixDiskLibSectorType(this.capacity / SectorSize)
+	return disklib.QueryChunks(startSector, numSectors, chunkSize, capacitySectors, func(chunk disklib.VixDiskLibSectorType, chunkEnd disklib.VixDiskLibSectorType) (bool, error) {
+		return this.allocated(int64(chunk)*SectorSize, int64(chunkEnd-chunk)*SectorSize)
+	})
+}
+
+// zeroExtent 是 ZERO 类型的扩展，读出全为零且没有已分配的数据。
+type zeroExtent struct{}
+
+func (zeroExtent) unitEnd(off int64) int64 {
+	return 1<<63 - 1
+}
+
+func (zeroExtent) read(p []byte, off int64) (bool, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return true, nil
+}
+
+func (zeroExtent) allocated(off int64, length int64) (bool, error) {
+	return false, nil
+}
+
+func (zeroExtent) close() error {
+	return nil
+}
+
+// flatExtent 是预分配的扩展，数据从文件的 offset 处开始连续存放，全部视为已分配。
+type flatExtent struct {
+	file   *os.File
+	offset int64
+	size   int64
+}
+
+func (this *flatExtent) unitEnd(off int64) int64 {
+	return this.size
+}
+
+func (this *flatExtent) read(p []byte, off int64) (bool, error) {
+	n, err := this.file.ReadAt(p, this.offset+off)
+	if err == io.EOF {
+		// 文件比扩展短时，缺少的部分读出为零
+		for i := n; i < len(p); i++ {
+			p[i] = 0
+		}
+		err = nil
+	}
+	return true, err
+}
+
+func (this *flatExtent) allocated(off int64, length int64) (bool, error) {
+	return length > 0, nil
+}
+
+func (this *flatExtent) close() error {
+	return this.file.Close()
+}
+
+// sparseExtent 是带颗粒目录和颗粒表的稀疏扩展，包括 streamOptimized 格式中压缩的颗粒。
+type sparseExtent struct {
+	file       *os.File
+	fileSize   int64
+	header     sparseExtentHeader
+	grainSize  int64
+	gd         []uint32
+	mutex      sync.Mutex
+	gts        map[uint32][]uint32 // 已读取的颗粒表，按其扇区偏移量缓存
+	cacheGrain int64               // 最近一次解压的颗粒编号
+	cacheData  []byte
+}
+
+// openSparseExtent 打开稀疏扩展文件并读取颗粒目录。
+func openSparseExtent(path string) (*sparseExtent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	ext, err := newSparseExtent(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return ext, nil
+}
+
+// newSparseExtent 读取稀疏扩展的头部和颗粒目录。streamOptimized 文件的颗粒目录位置记录在文件末尾的 footer 中。
+// 头部中的字段在使用前都与文件大小和上限比较，损坏或被截断的文件返回错误。
+func newSparseExtent(file *os.File) (*sparseExtent, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header, err := readSparseExtentHeader(file, 0)
+	if err != nil {
+		return nil, err
+	}
+	if header.GdOffset == gdAtEnd {
+		// 文件末尾依次为 footer 标记、footer 和流结束标记，各占一个扇区
+		if info.Size() < 3*SectorSize {
+			return nil, errors.Errorf("Stream optimized file of %d bytes is truncated", info.Size())
+		}
+		if header, err = readSparseExtentHeader(file, info.Size()-2*SectorSize); err != nil {
+			return nil, errors.Wrap(err, "Read stream optimized footer failed")
+		}
+	}
+	if header.GrainSize == 0 || header.GrainSize > maxGrainSectors || header.GrainSize&(header.GrainSize-1) != 0 {
+		return nil, errors.Errorf("Invalid grain size %d in sparse extent header", header.GrainSize)
+	}
+	if header.NumGTEsPerGT == 0 || header.NumGTEsPerGT > maxGTEsPerGT {
+		return nil, errors.Errorf("Invalid number of grain table entries %d in sparse extent header", header.NumGTEsPerGT)
+	}
+	if header.Capacity > math.MaxInt64/SectorSize {
+		return nil, errors.Errorf("Invalid capacity %d in sparse extent header", header.Capacity)
+	}
+	if header.Flags&flagCompressed != 0 && header.CompressAlgorithm != compressionDeflate {
+		return nil, errors.Errorf("Compression algorithm %d is not supported", header.CompressAlgorithm)
+	}
+	grainSize := int64(header.GrainSize) * SectorSize
+	numGrains := (int64(header.Capacity) + int64(header.GrainSize) - 1) / int64(header.GrainSize)
+	numGTs := (numGrains + int64(header.NumGTEsPerGT) - 1) / int64(header.NumGTEsPerGT)
+	// 颗粒目录的每一项占 4 个字节，必须完整地位于文件中
+	if !withinFile(info.Size(), header.GdOffset, uint64(numGTs)*4) {
+		return nil, errors.Errorf("Grain directory of %d entries at sector %d is beyond the end of the file", numGTs, header.GdOffset)
+	}
+	buf := make([]byte, numGTs*4)
+	if _, err = file.ReadAt(buf, int64(header.GdOffset)*SectorSize); err != nil {
+		return nil, errors.Wrap(err, "Read grain directory failed")
+	}
+	gd := make([]uint32, numGTs)
+	for i := range gd {
+		gd[i] = binary.LittleEndian.Uint32(buf[i*4:])
+	}
+	return &sparseExtent{
+		file:       file,
+		fileSize:   info.Size(),
+		header:     header,
+		grainSize:  grainSize,
+		gd:         gd,
+		gts:        make(map[uint32][]uint32),
+		cacheGrain: -1,
+	}, nil
+}
+
+// lookup 返回颗粒的颗粒表项，即颗粒数据所在的扇区，0 表示未分配。
+func (this *sparseExtent) lookup(grain int64) (uint32, error) {
+	gdIndex := grain / int64(this.header.NumGTEsPerGT)
+	if gdIndex >= int64(len(this.gd)) || this.gd[gdIndex] == 0 {
+		return 0, nil
+	}
+	gtOffset := this.gd[gdIndex]
+	gt, ok := this.gts[gtOffset]
+	if !ok {
+		buf := make([]byte, this.header.NumGTEsPerGT*4)
+		if _, err := this.file.ReadAt(buf, int64(gtOffset)*SectorSize); err != nil {
+			return 0, errors.Wrap(err, "Read grain table failed")
+		}
+		gt = make([]uint32, this.header.NumGTEsPerGT)
+		for i := range gt {
+			gt[i] = binary.LittleEndian.Uint32(buf[i*4:])
+		}
+		this.gts[gtOffset] = gt
+	}
+	return gt[grain%int64(this.header.NumGTEsPerGT)], nil
+}
+
+func (this *sparseExtent) unitEnd(off int64) int64 {
+	return (off/this.grainSize + 1) * this.grainSize
+}
+
+func (this *sparseExtent) read(p []byte, off int64) (bool, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	grain := off / this.grainSize
+	entry, err := this.lookup(grain)
+	if err != nil || entry == 0 {
+		return false, err
+	}
+	if entry == zeroedGrainGTE && this.header.Flags&flagZeroedGTE != 0 {
+		for i := range p {
+			p[i] = 0
+		}
+		return true, nil
+	}
+	grainOff := off % this.grainSize
+	if this.header.Flags&flagCompressed == 0 {
+		_, err = this.file.ReadAt(p, int64(entry)*SectorSize+grainOff)
+		return true, err
+	}
+	if this.cacheGrain != grain {
+		if this.cacheData, err = this.readCompressedGrain(entry); err != nil {
+			return true, err
+		}
+		this.cacheGrain = grain
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	if grainOff < int64(len(this.cacheData)) {
+		copy(p, this.cacheData[grainOff:])
+	}
+	return true, nil
+}
+
+// readCompressedGrain 读取并解压位于 sector 处的压缩颗粒，颗粒数据之前是 {lba uint64, size uint32}。
+func (this *sparseExtent) readCompressedGrain(sector uint32) ([]byte, error) {
+	head := make([]byte, 12)
+	if _, err := this.file.ReadAt(head, int64(sector)*SectorSize); err != nil {
+		return nil, errors.Wrap(err, "Read compressed grain header failed")
+	}
+	size := binary.LittleEndian.Uint32(head[8:12])
+	if int64(size) > compressBound(this.grainSize) || !withinFile(this.fileSize, uint64(sector), 12+uint64(size)) {
+		return nil, errors.Errorf("Invalid compressed grain size %d at sector %d", size, sector)
+	}
+	compressed := make([]byte, size)
+	if _, err := this.file.ReadAt(compressed, int64(sector)*SectorSize+12); err != nil {
+		return nil, errors.Wrap(err, "Read compressed grain failed")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.Wrap(err, "Decompress grain failed")
+	}
+	defer zr.Close()
+	data := make([]byte, this.grainSize)
+	n, err := io.ReadFull(zr, data)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.Wrap(err, "Decompress grain failed")
+	}
+	return data[:n], nil
+}
+
+// compressBound 返回 length 字节的数据经过 zlib 压缩后的最大长度，与 zlib 的 compressBound 相同。
+func compressBound(length int64) int64 {
+	return length + length>>12 + length>>14 + length>>25 + 13
+}
+
+func (this *sparseExtent) allocated(off int64, length int64) (bool, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for grain := off / this.grainSize; grain <= (off+length-1)/this.grainSize; grain++ {
+		entry, err := this.lookup(grain)
+		if err != nil || entry != 0 {
+			return entry != 0, err
+		}
+	}
+	return false, nil
+}
+
+func (this *sparseExtent) close() error {
+	return this.file.Close()
+}
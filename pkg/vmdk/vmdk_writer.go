@@ -0,0 +1,350 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// WriterOptions 控制写出的 VMDK 描述符的内容，零值表示使用默认值。
+type WriterOptions struct {
+	FileName         string // 描述符中扩展的文件名，默认为 "disk.vmdk"
+	AdapterType      string // ddb.adapterType，默认为 "lsilogic"
+	HWVersion        int    // ddb.virtualHWVersion，默认为 4，可被所有 OVF 导入工具接受
+	CompressionLevel int    // zlib 压缩级别，0 表示 zlib.DefaultCompression，不压缩时使用 NoCompression
+	NoCompression    bool   // 为 true 时使用 zlib.NoCompression 并忽略 CompressionLevel
+}
+
+// StreamOptimizedWriter 以 streamOptimized 格式顺序写出 VMDK 文件：颗粒经过 deflate 压缩，
+// 颗粒表、颗粒目录和 footer 写在数据之后，因此输出只需要一个 io.Writer，可以直接写入网络或对象存储。
+// 数据必须按偏移量递增的顺序写入，没有写入的区域和全零的颗粒不占用空间。
+type StreamOptimizedWriter struct {
+	w          io.Writer
+	opts       WriterOptions
+	capacity   int64 // 磁盘容量（字节）
+	grainSize  int64 // 颗粒大小（字节）
+	header     sparseExtentHeader
+	position   uint64   // 已经写出的扇区数
+	offset     int64    // 下一次写入的磁盘字节偏移量
+	grain      []byte   // 当前颗粒的数据
+	grainIndex int64    // 当前颗粒的编号，-1 表示没有
+	gt         []uint32 // 当前颗粒表
+	gtIndex    int64    // 当前颗粒表的编号，-1 表示没有
+	gd         []uint32 // 颗粒目录
+	compressed bytes.Buffer
+	zlibWriter *zlib.Writer
+	closed     bool
+}
+
+// NewStreamOptimizedWriter 创建一个容量为 capacity 字节的 streamOptimized 写入器，并立即写出头部和描述符。
+// capacity 必须是扇区大小的整数倍。
+func NewStreamOptimizedWriter(w io.Writer, capacity int64, opts WriterOptions) (*StreamOptimizedWriter, error) {
+	if capacity <= 0 || capacity%SectorSize != 0 {
+		return nil, errors.Errorf("Capacity %d is not a positive multiple of the sector size", capacity)
+	}
+	if opts.FileName == "" {
+		opts.FileName = "disk.vmdk"
+	}
+	if opts.AdapterType == "" {
+		opts.AdapterType = "lsilogic"
+	}
+	if opts.HWVersion == 0 {
+		opts.HWVersion = 4
+	}
+	if opts.NoCompression {
+		opts.CompressionLevel = zlib.NoCompression
+	} else if opts.CompressionLevel == 0 {
+		opts.CompressionLevel = zlib.DefaultCompression
+	}
+	zlibWriter, err := zlib.NewWriterLevel(nil, opts.CompressionLevel)
+	if err != nil {
+		return nil, errors.Wrap(err, "Create zlib writer failed")
+	}
+	grainSize := int64(defaultGrainSectors * SectorSize)
+	numGrains := (capacity + grainSize - 1) / grainSize
+	writer := &StreamOptimizedWriter{
+		w:          w,
+		opts:       opts,
+		capacity:   capacity,
+		grainSize:  grainSize,
+		grain:      make([]byte, grainSize),
+		grainIndex: -1,
+		gt:         make([]uint32, numGTEsPerGT),
+		gtIndex:    -1,
+		gd:         make([]uint32, (numGrains+numGTEsPerGT-1)/numGTEsPerGT),
+		zlibWriter: zlibWriter,
+	}
+
+	descriptor, err := writer.descriptor()
+	if err != nil {
+		return nil, err
+	}
+	descriptorSectors := uint64(sectorsFor(int64(len(descriptor))))
+	overHead := (1 + descriptorSectors + defaultGrainSectors - 1) / defaultGrainSectors * defaultGrainSectors
+	writer.header = newSparseExtentHeader()
+	writer.header.Version = streamOptimizedVersion
+	writer.header.Flags = flagValidNewLineTest | flagCompressed | flagMarkers
+	writer.header.Capacity = uint64(capacity / SectorSize)
+	writer.header.GrainSize = defaultGrainSectors
+	writer.header.DescriptorOffset = 1
+	writer.header.DescriptorSize = descriptorSectors
+	writer.header.GdOffset = gdAtEnd
+	writer.header.OverHead = overHead
+	writer.header.CompressAlgorithm = compressionDeflate
+
+	// 头部、描述符，然后填充到 overHead 个扇区
+	if err = writer.writeSectors(writer.header.marshal()); err != nil {
+		return nil, err
+	}
+	if err = writer.writeSectors(descriptor); err != nil {
+		return nil, err
+	}
+	if err = writer.writeSectors(make([]byte, (overHead-writer.position)*SectorSize)); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// descriptor 生成嵌入在文件中的文本描述符。
+func (this *StreamOptimizedWriter) descriptor() ([]byte, error) {
+	cid := make([]byte, 4)
+	if _, err := rand.Read(cid); err != nil {
+		return nil, errors.Wrap(err, "Generate content ID failed")
+	}
+	capacitySectors := this.capacity / SectorSize
+	cylinders := capacitySectors / (255 * 63)
+	if cylinders > 65535 {
+		cylinders = 65535
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Disk DescriptorFile\n")
+	fmt.Fprintf(&buf, "version=1\n")
+	fmt.Fprintf(&buf, "CID=%08x\n", binary.LittleEndian.Uint32(cid))
+	fmt.Fprintf(&buf, "parentCID=ffffffff\n")
+	fmt.Fprintf(&buf, "createType=\"streamOptimized\"\n\n")
+	fmt.Fprintf(&buf, "# Extent description\n")
+	fmt.Fprintf(&buf, "RW %d SPARSE \"%s\"\n\n", capacitySectors, this.opts.FileName)
+	fmt.Fprintf(&buf, "# The Disk Data Base\n")
+	fmt.Fprintf(&buf, "#DDB\n\n")
+	fmt.Fprintf(&buf, "ddb.virtualHWVersion = \"%d\"\n", this.opts.HWVersion)
+	fmt.Fprintf(&buf, "ddb.geometry.cylinders = \"%d\"\n", cylinders)
+	fmt.Fprintf(&buf, "ddb.geometry.heads = \"255\"\n")
+	fmt.Fprintf(&buf, "ddb.geometry.sectors = \"63\"\n")
+	fmt.Fprintf(&buf, "ddb.adapterType = \"%s\"\n", this.opts.AdapterType)
+	return buf.Bytes(), nil
+}
+
+// writeSectors 写出 data 并填充到扇区边界。
+func (this *StreamOptimizedWriter) writeSectors(data []byte) error {
+	if _, err := this.w.Write(data); err != nil {
+		return errors.Wrap(err, "Write stream optimized VMDK failed")
+	}
+	if pad := len(data) % SectorSize; pad != 0 {
+		if _, err := this.w.Write(make([]byte, SectorSize-pad)); err != nil {
+			return errors.Wrap(err, "Write stream optimized VMDK failed")
+		}
+	}
+	this.position = this.position + uint64(sectorsFor(int64(len(data))))
+	return nil
+}
+
+// Write 在当前偏移量处写入 p，实现 io.Writer。
+func (this *StreamOptimizedWriter) Write(p []byte) (int, error) {
+	return this.WriteAt(p, this.offset)
+}
+
+// WriteAt 在磁盘的 off 处写入 p。off 不能小于之前写入的末尾，跳过的区域在磁盘中读出为零。
+func (this *StreamOptimizedWriter) WriteAt(p []byte, off int64) (int, error) {
+	if this.closed {
+		return 0, errors.New("Write to a closed stream optimized writer")
+	}
+	if off < this.offset {
+		return 0, errors.Errorf("Stream optimized writer only supports sequential writes: offset %d is before %d", off, this.offset)
+	}
+	if off+int64(len(p)) > this.capacity {
+		return 0, io.ErrShortWrite
+	}
+	written := 0
+	for written < len(p) {
+		grainIndex := off / this.grainSize
+		if grainIndex != this.grainIndex {
+			if err := this.flushGrain(); err != nil {
+				return written, err
+			}
+			this.grainIndex = grainIndex
+		}
+		n := copy(this.grain[off%this.grainSize:], p[written:])
+		written = written + n
+		off = off + int64(n)
+	}
+	this.offset = off
+	return written, nil
+}
+
+// flushGrain 压缩并写出当前颗粒，全零的颗粒不写出。
+func (this *StreamOptimizedWriter) flushGrain() error {
+	if this.grainIndex < 0 {
+		return nil
+	}
+	grainIndex := this.grainIndex
+	this.grainIndex = -1
+	length := this.grainSize
+	if remain := this.capacity - grainIndex*this.grainSize; remain < length {
+		length = remain
+	}
+	data := this.grain[:length]
+	if isZero(data) {
+		return nil
+	}
+	defer func() {
+		for i := range this.grain {
+			this.grain[i] = 0
+		}
+	}()
+	if gtIndex := grainIndex / numGTEsPerGT; gtIndex != this.gtIndex {
+		if err := this.flushGT(); err != nil {
+			return err
+		}
+		this.gtIndex = gtIndex
+	}
+	this.compressed.Reset()
+	this.compressed.Write(make([]byte, 12))
+	this.zlibWriter.Reset(&this.compressed)
+	if _, err := this.zlibWriter.Write(data); err != nil {
+		return errors.Wrap(err, "Compress grain failed")
+	}
+	if err := this.zlibWriter.Close(); err != nil {
+		return errors.Wrap(err, "Compress grain failed")
+	}
+	buf := this.compressed.Bytes()
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(grainIndex*defaultGrainSectors))
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(len(buf)-12))
+	this.gt[grainIndex%numGTEsPerGT] = uint32(this.position)
+	return this.writeSectors(buf)
+}
+
+// flushGT 写出当前颗粒表，并在颗粒目录中记录它的位置。
+func (this *StreamOptimizedWriter) flushGT() error {
+	if this.gtIndex < 0 {
+		return nil
+	}
+	gtSectors := uint64(numGTEsPerGT * 4 / SectorSize)
+	if err := this.writeSectors(marshalMarker(gtSectors, markerGT)); err != nil {
+		return err
+	}
+	this.gd[this.gtIndex] = uint32(this.position)
+	buf := make([]byte, numGTEsPerGT*4)
+	for i, entry := range this.gt {
+		binary.LittleEndian.PutUint32(buf[i*4:], entry)
+		this.gt[i] = 0
+	}
+	this.gtIndex = -1
+	return this.writeSectors(buf)
+}
+
+// Close 写出剩余的颗粒、颗粒表、颗粒目录、footer 和流结束标记。Close 不会关闭底层的 io.Writer。
+func (this *StreamOptimizedWriter) Close() error {
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	if err := this.flushGrain(); err != nil {
+		return err
+	}
+	if err := this.flushGT(); err != nil {
+		return err
+	}
+	gdBuf := make([]byte, len(this.gd)*4)
+	for i, entry := range this.gd {
+		binary.LittleEndian.PutUint32(gdBuf[i*4:], entry)
+	}
+	if err := this.writeSectors(marshalMarker(uint64(sectorsFor(int64(len(gdBuf)))), markerGD)); err != nil {
+		return err
+	}
+	footer := this.header
+	footer.GdOffset = this.position
+	if err := this.writeSectors(gdBuf); err != nil {
+		return err
+	}
+	if err := this.writeSectors(marshalMarker(1, markerFooter)); err != nil {
+		return err
+	}
+	if err := this.writeSectors(footer.marshal()); err != nil {
+		return err
+	}
+	return this.writeSectors(marshalMarker(0, markerEOS))
+}
+
+// ExportStreamOptimized 将 src 导出为 streamOptimized VMDK 写入 w，只读取 QueryAllocatedBlocks 报告的已分配区域；
+// src 不支持查询已分配块时读取整个磁盘。生成的文件可以直接作为 OVF 中的磁盘导入。
+func ExportStreamOptimized(ctx context.Context, src Source, w io.Writer, opts WriterOptions) error {
+	writer, err := NewStreamOptimizedWriter(w, src.Capacity(), opts)
+	if err != nil {
+		return err
+	}
+	ranges, err := allocatedRanges(src, defaultGrainSectors)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1024*1024)
+	for _, r := range ranges {
+		for offset := r.offset; offset < r.end; {
+			if ctx.Err() != nil {
+				return disklib.WrapContextError(ctx, nil)
+			}
+			length := r.end - offset
+			if length > int64(len(buf)) {
+				length = int64(len(buf))
+			}
+			if _, err = src.ReadAt(buf[:length], offset); err != nil {
+				return errors.Wrapf(err, "Read source disk at offset %d failed", offset)
+			}
+			if _, err = writer.WriteAt(buf[:length], offset); err != nil {
+				return err
+			}
+			offset = offset + length
+		}
+	}
+	return writer.Close()
+}
+
+// byteRange 是一个以字节为单位的磁盘区域 [offset, end)。
+type byteRange struct {
+	offset int64
+	end    int64
+}
+
+// allocatedRanges 以 chunkSize 扇区为粒度遍历 src 中已分配的区域，src 不支持查询已分配块时返回整个磁盘。
+func allocatedRanges(src Source, chunkSize disklib.VixDiskLibSectorType) ([]byteRange, error) {
+	capacitySectors := disklib.VixDiskLibSectorType(src.Capacity() / SectorSize)
+	it, vErr := disklib.NewAllocatedBlockIterator(disklib.AssumeAllocatedIfUnsupported(src), 0, capacitySectors, chunkSize, capacitySectors)
+	if vErr != nil {
+		return nil, vErr
+	}
+	ranges := make([]byteRange, 0)
+	for it.Next() {
+		block := it.Block()
+		ranges = append(ranges, byteRange{offset: int64(block.Offset()) * SectorSize, end: int64(block.Offset()+block.Length()) * SectorSize})
+	}
+	if vErr = it.Err(); vErr != nil {
+		return nil, errors.Wrap(vErr, "Query allocated blocks failed")
+	}
+	return ranges, nil
+}
+
+// isZero 判断数据是否全为零。
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
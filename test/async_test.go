@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// TestAsyncReadWrite 测试 ReadAsync、WriteAsync、Wait 和 Flush。
+func TestAsyncReadWrite(t *testing.T) {
+	setupFake(t, "fcd-async")
+	params := newFakeParams("fcd-async")
+	conn, err := disklib.ConnectEx(params)
+	if err != nil {
+		t.Fatalf("ConnectEx failed: %s", err.Error())
+	}
+	defer disklib.Disconnect(conn)
+	dli, err := disklib.Open(conn, params)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err.Error())
+	}
+	defer disklib.Close(dli)
+	data := bytes.Repeat([]byte{'A', 'S'}, 8*disklib.VIXDISKLIB_SECTOR_SIZE)
+	requests := make([]*disklib.AsyncRequest, 0)
+	for i := 0; i < 4; i++ {
+		request, err := disklib.WriteAsync(dli, uint64(i*16), 16, data)
+		if err != nil {
+			t.Fatalf("WriteAsync failed: %s", err.Error())
+		}
+		requests = append(requests, request)
+	}
+	if err = disklib.Wait(dli); err != nil {
+		t.Fatalf("Wait failed: %s", err.Error())
+	}
+	for _, request := range requests {
+		select {
+		case <-request.Done():
+		default:
+			t.Fatalf("Request is not done after Wait")
+		}
+		if request.Err() != nil {
+			t.Errorf("WriteAsync request failed: %s", request.Err().Error())
+		}
+	}
+	if err = disklib.Flush(dli); err != nil {
+		t.Errorf("Flush failed: %s", err.Error())
+	}
+	buf := make([]byte, len(data))
+	request, err := disklib.ReadAsync(dli, 48, 16, buf)
+	if err != nil {
+		t.Fatalf("ReadAsync failed: %s", err.Error())
+	}
+	if err = request.Wait(); err != nil || !bytes.Equal(buf, data) {
+		t.Errorf("ReadAsync returned unexpected data, err = %v", err)
+	}
+	// 超出容量的异步读取通过请求返回错误
+	request, err = disklib.ReadAsync(dli, fakeCapacity, 1, buf)
+	if err != nil {
+		t.Fatalf("ReadAsync failed: %s", err.Error())
+	}
+	if err = request.Wait(); err == nil || err.VixErrorCode() != disklib.VIX_E_DISK_OUTOFRANGE {
+		t.Errorf("Expected VIX_E_DISK_OUTOFRANGE from asynchronous read, got %v", err)
+	}
+}
+
+// TestPipelinedReadWrite 测试启用流水线的 DiskReaderWriter 读写大块数据。
+func TestPipelinedReadWrite(t *testing.T) {
+	setupFake(t, "fcd-pipeline")
+	diskReaderWriter, err := virtual_disks.Open(newFakeParams("fcd-pipeline"), logrus.New())
+	if err != nil {
+		t.Fatalf("Open failed: %s", err.Error())
+	}
+	defer diskReaderWriter.Close()
+	pipelined := diskReaderWriter.WithPipeline(4, 256)
+	data := make([]byte, 5*1024*1024+300)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	n, werr := pipelined.WriteAt(data, 100)
+	if werr != nil || n != len(data) {
+		t.Fatalf("Pipelined WriteAt returned n = %d, err = %v", n, werr)
+	}
+	readBack := make([]byte, len(data))
+	n, rerr := pipelined.ReadAt(readBack, 100)
+	if rerr != nil || n != len(data) || !bytes.Equal(readBack, data) {
+		t.Fatalf("Pipelined ReadAt returned n = %d, err = %v", n, rerr)
+	}
+	// 流水线读到的数据与同步读取一致
+	syncRead := make([]byte, len(data))
+	if n, rerr = diskReaderWriter.ReadAt(syncRead, 100); rerr != nil || !bytes.Equal(syncRead, data) {
+		t.Errorf("Synchronous ReadAt returned n = %d, err = %v", n, rerr)
+	}
+	// 与原对象共享读写偏移量
+	if _, serr := pipelined.Seek(100, 0); serr != nil {
+		t.Fatalf("Seek failed: %v", serr)
+	}
+	head := make([]byte, 4096)
+	if _, rerr = diskReaderWriter.Read(head); rerr != nil || !bytes.Equal(head, data[:4096]) {
+		t.Errorf("Pipelined reader does not share the offset, err = %v", rerr)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// collectBlocks 遍历迭代器，返回所有区域的 [offset, length] 对。
+func collectBlocks(t *testing.T, it *virtual_disks.AllocatedBlockIterator) [][2]uint64 {
+	t.Helper()
+	blocks := [][2]uint64{}
+	for it.Next() {
+		block := it.Block()
+		blocks = append(blocks, [2]uint64{uint64(block.Offset()), uint64(block.Length())})
+	}
+	if vErr := it.Err(); vErr != nil {
+		t.Fatalf("Iterate allocated blocks failed: %s", vErr.Error())
+	}
+	return blocks
+}
+
+// TestAllocatedBlocks 测试迭代器跨越多个窗口遍历整个磁盘，合并跨越窗口边界的区域，并处理磁盘末尾不足一个块的部分。
+func TestAllocatedBlocks(t *testing.T) {
+	const chunkSize = disklib.VIXDISKLIB_MIN_CHUNK_SIZE
+	const window = chunkSize * disklib.VIXDISKLIB_MAX_CHUNK_NUMBER
+	// 容量不是块大小的整数倍，最后一个块只有 100 个扇区
+	const capacity = 2*window + 100
+	fake := disklib.NewFakeBackend()
+	fake.AddDisk("fcd-blocks", capacity)
+	fake.AddDisk("fcd-empty", 8192)
+	if vErr := disklib.InitWithBackend(fake, 7, 0, ""); vErr != nil {
+		t.Fatalf("Init failed: %s", vErr.Error())
+	}
+	t.Cleanup(disklib.Exit)
+
+	diskReaderWriter, vErr := virtual_disks.Open(newFakeParams("fcd-blocks"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer diskReaderWriter.Close()
+	sector := make([]byte, disklib.VIXDISKLIB_SECTOR_SIZE)
+	for _, offset := range []uint64{0, window - 1, window, capacity - 1} {
+		if _, err := diskReaderWriter.WriteAt(sector, int64(offset)*disklib.VIXDISKLIB_SECTOR_SIZE); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+	}
+
+	it, vErr := diskReaderWriter.AllocatedBlocks(chunkSize)
+	if vErr != nil {
+		t.Fatalf("AllocatedBlocks failed: %s", vErr.Error())
+	}
+	expected := [][2]uint64{{0, chunkSize}, {window - chunkSize, 2 * chunkSize}, {2 * window, 100}}
+	if blocks := collectBlocks(t, it); !reflect.DeepEqual(blocks, expected) {
+		t.Errorf("Expected blocks %v, got %v", expected, blocks)
+	}
+
+	// 范围查询只返回范围内的部分，超出容量的部分被忽略
+	it, vErr = diskReaderWriter.AllocatedBlocksRange(window, 2*window, chunkSize)
+	if vErr != nil {
+		t.Fatalf("AllocatedBlocksRange failed: %s", vErr.Error())
+	}
+	expected = [][2]uint64{{window, chunkSize}, {2 * window, 100}}
+	if blocks := collectBlocks(t, it); !reflect.DeepEqual(blocks, expected) {
+		t.Errorf("Expected blocks %v, got %v", expected, blocks)
+	}
+	it, vErr = diskReaderWriter.AllocatedBlocksRange(0, chunkSize/2, chunkSize)
+	if vErr != nil {
+		t.Fatalf("AllocatedBlocksRange failed: %s", vErr.Error())
+	}
+	expected = [][2]uint64{{0, chunkSize / 2}}
+	if blocks := collectBlocks(t, it); !reflect.DeepEqual(blocks, expected) {
+		t.Errorf("Expected blocks %v, got %v", expected, blocks)
+	}
+
+	for _, bad := range []struct {
+		start     disklib.VixDiskLibSectorType
+		chunkSize disklib.VixDiskLibSectorType
+	}{
+		{0, disklib.VIXDISKLIB_MIN_CHUNK_SIZE - 1},
+		{0, disklib.VIXDISKLIB_MAX_CHUNK_SIZE + 1},
+		{1, chunkSize},
+	} {
+		if _, vErr := diskReaderWriter.AllocatedBlocksRange(bad.start, capacity, bad.chunkSize); !errors.Is(vErr, disklib.ErrInvalidArg) {
+			t.Errorf("Expected start %d and chunk size %d to fail with VIX_E_INVALID_ARG, got %v", bad.start, bad.chunkSize, vErr)
+		}
+	}
+
+	empty, vErr := virtual_disks.Open(newFakeParams("fcd-empty"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer empty.Close()
+	it, vErr = empty.AllocatedBlocks(2048)
+	if vErr != nil {
+		t.Fatalf("AllocatedBlocks failed: %s", vErr.Error())
+	}
+	if blocks := collectBlocks(t, it); len(blocks) != 0 {
+		t.Errorf("Expected no blocks on an empty disk, got %v", blocks)
+	}
+}
+
+// unsupportedQuerier 的 QueryAllocatedBlocks 总是返回 VIX_E_NOT_SUPPORTED。
+type unsupportedQuerier struct{}
+
+// QueryAllocatedBlocks 返回 VIX_E_NOT_SUPPORTED。
+func (unsupportedQuerier) QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType,
+	chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
+	return nil, disklib.NewVddkError(disklib.VIX_E_NOT_SUPPORTED, "QueryAllocatedBlocks failed. The error code is 6.")
+}
+
+// TestQueryChunks 测试 QueryChunks 的参数校验和相邻块的合并，以及 AssumeAllocatedIfUnsupported 的后备结果。
+func TestQueryChunks(t *testing.T) {
+	const capacity = 1000
+	allocated := func(chunkStart disklib.VixDiskLibSectorType, chunkEnd disklib.VixDiskLibSectorType) (bool, error) {
+		// 第 0、1、3 个块以及最后一个不完整的块已分配
+		return chunkStart != 256 && chunkStart != 512 && chunkStart != 640, nil
+	}
+	blocks, vErr := disklib.QueryChunks(0, capacity, 128, capacity, allocated)
+	if vErr != nil {
+		t.Fatalf("QueryChunks failed: %s", vErr.Error())
+	}
+	got := [][2]uint64{}
+	for _, block := range blocks {
+		got = append(got, [2]uint64{uint64(block.Offset()), uint64(block.Length())})
+	}
+	if expected := [][2]uint64{{0, 256}, {384, 128}, {768, 232}}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	for _, args := range [][3]disklib.VixDiskLibSectorType{{64, 128, 128}, {0, 100, 128}, {0, 1024, 128}, {0, 128, 64}} {
+		if _, vErr = disklib.QueryChunks(args[0], args[1], args[2], capacity, allocated); vErr == nil {
+			t.Errorf("Expected QueryChunks%v to fail", args)
+		}
+	}
+	if _, vErr = disklib.QueryChunks(0, 128, 128, capacity, func(disklib.VixDiskLibSectorType, disklib.VixDiskLibSectorType) (bool, error) {
+		return false, errors.New("read failed")
+	}); vErr == nil || vErr.VixErrorCode() != disklib.VIX_E_FAIL {
+		t.Errorf("Expected VIX_E_FAIL when the allocation check fails, got %v", vErr)
+	}
+
+	it, vErr := disklib.NewAllocatedBlockIterator(unsupportedQuerier{}, 0, capacity, 128, capacity)
+	if vErr != nil {
+		t.Fatalf("NewAllocatedBlockIterator failed: %s", vErr.Error())
+	}
+	if it.Next() || it.Err() == nil || it.Err().VixErrorCode() != disklib.VIX_E_NOT_SUPPORTED {
+		t.Errorf("Expected VIX_E_NOT_SUPPORTED from the iterator, got %v", it.Err())
+	}
+	it, _ = disklib.NewAllocatedBlockIterator(disklib.AssumeAllocatedIfUnsupported(unsupportedQuerier{}), 0, capacity, 128, capacity)
+	if got := collectBlocks(t, it); !reflect.DeepEqual(got, [][2]uint64{{0, capacity}}) {
+		t.Errorf("Expected the whole disk to be allocated, got %v", got)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// openBufferedDisk 打开一块 1024 扇区的磁盘。
+func openBufferedDisk(t *testing.T) (virtual_disks.DiskReaderWriter, *countingBackend) {
+	backend := &countingBackend{}
+	return openFake(t, "fcd-buffered", withFakeCapacity(1024), withWrappedBackend(backend.wrap)), backend
+}
+
+// TestBufferedWriterSmallWrites 测试大量不足一个扇区的顺序写入被合并为少量对齐的写入。
+func TestBufferedWriterSmallWrites(t *testing.T) {
+	diskReaderWriter, backend := openBufferedDisk(t)
+	if _, err := diskReaderWriter.Seek(100, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	writer := virtual_disks.NewBufferedWriter(diskReaderWriter, 64*1024)
+	var expected bytes.Buffer
+	for i := 0; expected.Len() < 300*1024; i++ {
+		record := bytes.Repeat([]byte{byte(i)}, 37)
+		expected.Write(record)
+		if n, err := writer.Write(record); err != nil || n != len(record) {
+			t.Fatalf("Write returned n = %d, err = %v", n, err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if writer.Buffered() != 0 {
+		t.Errorf("Expected an empty buffer after Flush, got %d bytes", writer.Buffered())
+	}
+	// 只有第一批的开头和最后一批的末尾不对齐，需要读取、修改并写回
+	if reads := atomic.LoadInt32(&backend.reads); reads != 2 {
+		t.Errorf("Expected 2 read-modify-write reads, got %d", reads)
+	}
+	if writes := atomic.LoadInt32(&backend.writes); writes > 12 {
+		t.Errorf("Expected the writes to be coalesced, got %d disk writes", writes)
+	}
+	readBack := make([]byte, expected.Len())
+	if _, err := diskReaderWriter.ReadAt(readBack, 100); err != nil || !bytes.Equal(readBack, expected.Bytes()) {
+		t.Errorf("Read back different data, err = %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if _, err := writer.Write([]byte{1}); err == nil {
+		t.Errorf("Expected Write after Close to fail")
+	}
+}
+
+// TestBufferedWriterGapAndSeek 测试写入位置不连续和 Seek 时写出缓冲区，大块写入不经过缓冲区。
+func TestBufferedWriterGapAndSeek(t *testing.T) {
+	diskReaderWriter, _ := openBufferedDisk(t)
+	defer diskReaderWriter.Close()
+	writer := virtual_disks.NewBufferedWriter(diskReaderWriter, 4096)
+	if _, err := writer.Write([]byte("first")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := writer.WriteAt([]byte("second"), 1000); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if writer.Buffered() != len("second") {
+		t.Errorf("Expected the gap to flush the first write, %d bytes buffered", writer.Buffered())
+	}
+	if pos, err := writer.Seek(-10, io.SeekEnd); err != nil || pos != diskReaderWriter.Capacity()-10 {
+		t.Fatalf("Seek returned %d, err = %v", pos, err)
+	}
+	if writer.Buffered() != 0 {
+		t.Errorf("Expected Seek to flush the buffer, %d bytes buffered", writer.Buffered())
+	}
+	if _, err := writer.Write([]byte("0123456789")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := writer.Write([]byte("x")); err != io.ErrShortWrite {
+		t.Errorf("Expected a write beyond the capacity to fail with io.ErrShortWrite, got %v", err)
+	}
+	large := bytes.Repeat([]byte{'L'}, 3*4096+100)
+	if _, err := writer.WriteAt(large, 8192+3); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	for _, check := range []struct {
+		off  int64
+		data []byte
+	}{
+		{0, []byte("first")},
+		{1000, []byte("second")},
+		{diskReaderWriter.Capacity() - 10, []byte("0123456789")},
+		{8192 + 3, large},
+	} {
+		buf := make([]byte, len(check.data))
+		if _, err := diskReaderWriter.ReadAt(buf, check.off); err != nil || !bytes.Equal(buf, check.data) {
+			t.Errorf("Unexpected data at offset %d, err = %v", check.off, err)
+		}
+	}
+}
+
+// TestBufferedWriterDeferredError 测试写出失败的错误由之后的写入和 Flush 返回，并且一直保留。
+func TestBufferedWriterDeferredError(t *testing.T) {
+	diskReaderWriter, backend := openBufferedDisk(t)
+	writer := virtual_disks.NewBufferedWriter(diskReaderWriter, 4096)
+	atomic.StoreInt32(&backend.failWrites, 1)
+	// 写入缓冲区的数据还没有写到磁盘，不会失败
+	if _, err := writer.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("Expected the buffered write to succeed, got %v", err)
+	}
+	err := writer.Flush()
+	if !errors.Is(err, disklib.ErrDiskFull) {
+		t.Fatalf("Expected Flush to fail with VIX_E_DISK_FULL, got %v", err)
+	}
+	atomic.StoreInt32(&backend.failWrites, 0)
+	if _, err := writer.Write([]byte{1}); !errors.Is(err, disklib.ErrDiskFull) {
+		t.Errorf("Expected the error to be sticky, got %v", err)
+	}
+	if writer.Buffered() != 1000 {
+		t.Errorf("Expected the unwritten data to stay buffered, got %d bytes", writer.Buffered())
+	}
+	if err := writer.Close(); !errors.Is(err, disklib.ErrDiskFull) {
+		t.Errorf("Expected Close to return the deferred error, got %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// 缓存测试的块大小：16 个扇区
+const cacheBlockSize = 16 * disklib.VIXDISKLIB_SECTOR_SIZE
+
+// openCacheDisk 打开一块 1024 扇区的磁盘并写入随机数据，返回不带缓存的读写对象、写入的数据和后端。
+func openCacheDisk(t *testing.T) (virtual_disks.DiskReaderWriter, []byte, *countingBackend) {
+	backend := &countingBackend{}
+	diskReaderWriter := openFake(t, "fcd-cache", withFakeCapacity(1024), withWrappedBackend(backend.wrap))
+	data := make([]byte, diskReaderWriter.Capacity())
+	rand.New(rand.NewSource(1)).Read(data)
+	if _, err := diskReaderWriter.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	atomic.StoreInt32(&backend.reads, 0)
+	return diskReaderWriter, data, backend
+}
+
+// TestCacheSequentialRead 测试小块顺序读由缓存和自适应预读合并为少量的磁盘读取。
+func TestCacheSequentialRead(t *testing.T) {
+	diskReaderWriter, data, backend := openCacheDisk(t)
+	cached := diskReaderWriter.WithCache(virtual_disks.CacheOptions{BlockSize: cacheBlockSize, Capacity: 8, MaxReadAhead: 4})
+	// 每次读取 4 KiB，即半个缓存块
+	buf := make([]byte, 4096)
+	for off := 0; off < len(data); off += len(buf) {
+		if _, err := io.ReadFull(cached, buf); err != nil || !bytes.Equal(buf, data[off:off+len(buf)]) {
+			t.Fatalf("Sequential read at %d through the cache returned wrong data, err = %v", off, err)
+		}
+	}
+	numBlocks := int64(len(data) / cacheBlockSize)
+	stats := cached.CacheStats()
+	if stats.Misses+stats.ReadAheadBlocks != numBlocks || stats.ReadAheadBlocks == 0 || stats.Evictions != numBlocks-8 {
+		t.Errorf("Unexpected cache stats %+v", stats)
+	}
+	// 每个未命中最多预读 4 个块
+	if reads := atomic.LoadInt32(&backend.reads); reads < int32(numBlocks/5) || reads >= int32(numBlocks/2) {
+		t.Errorf("Expected read-ahead to batch disk reads, got %d reads for %d blocks", reads, numBlocks)
+	}
+	// 缓存对原对象的统计没有影响
+	if stats := diskReaderWriter.CacheStats(); stats != (virtual_disks.CacheStats{}) {
+		t.Errorf("Expected no stats without a cache, got %+v", stats)
+	}
+}
+
+// TestCacheUnalignedRead 测试反复读取同一个边界扇区只访问一次磁盘，以及随机读取不触发预读。
+func TestCacheUnalignedRead(t *testing.T) {
+	diskReaderWriter, data, backend := openCacheDisk(t)
+	cached := diskReaderWriter.WithCache(virtual_disks.CacheOptions{BlockSize: cacheBlockSize})
+	buf := make([]byte, 10)
+	for i := 0; i < 100; i++ {
+		if _, err := cached.ReadAt(buf, 505); err != nil || !bytes.Equal(buf, data[505:515]) {
+			t.Fatalf("ReadAt returned %v, err = %v", buf, err)
+		}
+	}
+	if reads := atomic.LoadInt32(&backend.reads); reads != 1 {
+		t.Errorf("Expected 1 disk read, got %d", reads)
+	}
+	if stats := cached.CacheStats(); stats.Hits != 99 || stats.Misses != 1 || stats.ReadAheadBlocks != 0 {
+		t.Errorf("Unexpected cache stats %+v", stats)
+	}
+	// 跨越块边界和磁盘末尾的读取
+	tail := make([]byte, cacheBlockSize+100)
+	off := int64(len(data) - cacheBlockSize - 50)
+	n, err := cached.ReadAt(tail, off)
+	if err != io.EOF || n != cacheBlockSize+50 || !bytes.Equal(tail[:n], data[off:]) {
+		t.Errorf("ReadAt at the end of the disk returned n = %d, err = %v", n, err)
+	}
+}
+
+// TestCacheLRU 测试超过容量时淘汰最久未使用的块。
+func TestCacheLRU(t *testing.T) {
+	diskReaderWriter, _, _ := openCacheDisk(t)
+	cached := diskReaderWriter.WithCache(virtual_disks.CacheOptions{BlockSize: cacheBlockSize, Capacity: 2, MaxReadAhead: -1})
+	buf := make([]byte, disklib.VIXDISKLIB_SECTOR_SIZE)
+	for _, block := range []int64{0, 1, 0, 2, 0, 1} {
+		if _, err := cached.ReadAt(buf, block*cacheBlockSize); err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+	}
+	// 读取块 2 时淘汰块 1，块 0 一直在使用
+	if stats := cached.CacheStats(); stats.Hits != 2 || stats.Misses != 4 || stats.Evictions != 2 {
+		t.Errorf("Unexpected cache stats %+v", stats)
+	}
+}
+
+// TestCacheWriteInvalidation 测试写入直接写到磁盘，并使缓存中相交的块失效。
+func TestCacheWriteInvalidation(t *testing.T) {
+	diskReaderWriter, data, _ := openCacheDisk(t)
+	cached := diskReaderWriter.WithCache(virtual_disks.CacheOptions{BlockSize: cacheBlockSize})
+	buf := make([]byte, 2*cacheBlockSize)
+	if _, err := cached.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	update := bytes.Repeat([]byte{'U'}, 100)
+	if _, err := cached.WriteAt(update, cacheBlockSize-50); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(data[cacheBlockSize-50:], update)
+	if _, err := cached.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, data[:2*cacheBlockSize]) {
+		t.Errorf("Read after write through the cache returned stale data, err = %v", err)
+	}
+	if _, err := diskReaderWriter.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, data[:2*cacheBlockSize]) {
+		t.Errorf("The write did not reach the disk, err = %v", err)
+	}
+	if stats := cached.CacheStats(); stats.Invalidations != 2 {
+		t.Errorf("Expected 2 invalidated blocks, got %+v", stats)
+	}
+}
+
+// TestCacheConcurrent 测试并发读写后缓存中的数据与磁盘一致。
+func TestCacheConcurrent(t *testing.T) {
+	diskReaderWriter, _, _ := openCacheDisk(t)
+	cached := diskReaderWriter.WithCache(virtual_disks.CacheOptions{BlockSize: cacheBlockSize, Capacity: 16})
+	capacity := cached.Capacity()
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(worker)))
+			buf := make([]byte, 3000)
+			for i := 0; i < 200; i++ {
+				off := random.Int63n(capacity - int64(len(buf)))
+				var err error
+				if worker%2 == 0 {
+					random.Read(buf)
+					_, err = cached.WriteAt(buf, off)
+				} else {
+					_, err = cached.ReadAt(buf, off)
+				}
+				if err != nil {
+					t.Errorf("I/O at %d failed: %v", off, err)
+					return
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	fromCache := make([]byte, capacity)
+	fromDisk := make([]byte, capacity)
+	if _, err := cached.ReadAt(fromCache, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if _, err := diskReaderWriter.ReadAt(fromDisk, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(fromCache, fromDisk) {
+		t.Errorf("The cache is inconsistent with the disk after concurrent I/O")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// TestIncrementalReader 测试根据变化区域文件进行增量读取，并记录新的 change ID。
+func TestIncrementalReader(t *testing.T) {
+	setupFake(t, "fcd-cbt")
+	diskReaderWriter, vErr := virtual_disks.Open(newFakeParams("fcd-cbt"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer diskReaderWriter.Close()
+	changed := bytes.Repeat([]byte{'I'}, 1000)
+	for _, offset := range []int64{70000, 140000, 5 * 1024 * 1024} {
+		if _, werr := diskReaderWriter.WriteAt(changed, offset); werr != nil {
+			t.Fatalf("WriteAt failed: %v", werr)
+		}
+	}
+	dir := t.TempDir()
+	changesPath := filepath.Join(dir, "changes.json")
+	// 前两个区域对齐到 64 KiB 后相邻，应被合并
+	changes := `{"baseChangeId": "52 1/1", "changeId": "52 1/2", "startOffset": 0, "length": 1073741824,
+		"changedArea": [{"start": 140000, "length": 1000}, {"start": 70000, "length": 1000}, {"start": 5242880, "length": 1000}]}`
+	if err := ioutil.WriteFile(changesPath, []byte(changes), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	provider := virtual_disks.NewFileChangedAreasProvider(changesPath)
+	if _, err := virtual_disks.NewIncrementalReader(context.Background(), diskReaderWriter, provider, "52 1/0", "52 1/2"); err == nil {
+		t.Errorf("Expected an error for a mismatched base change ID")
+	}
+	newChangeId, err := provider.NewChangeId()
+	if err != nil {
+		t.Fatalf("NewChangeId failed: %v", err)
+	}
+	reader, err := virtual_disks.NewIncrementalReader(context.Background(), diskReaderWriter, provider, "52 1/1", newChangeId)
+	if err != nil {
+		t.Fatalf("NewIncrementalReader failed: %v", err)
+	}
+	expected := []virtual_disks.ChangedArea{{Start: 65536, Length: 131072}, {Start: 5242880, Length: 65536}}
+	extents := reader.Extents()
+	if len(extents) != len(expected) || extents[0] != expected[0] || extents[1] != expected[1] {
+		t.Fatalf("Unexpected extents %v, expected %v", extents, expected)
+	}
+	reader.SetBlockSize(100000)
+	image, err := os.Create(filepath.Join(dir, "image.raw"))
+	if err != nil {
+		t.Fatalf("Create image failed: %v", err)
+	}
+	defer image.Close()
+	changeIdPath := filepath.Join(dir, "changeid")
+	if changeId, _ := virtual_disks.ReadChangeId(changeIdPath); changeId != "*" {
+		t.Errorf("Expected * for a missing change ID file, got %s", changeId)
+	}
+	if err = reader.EmitTo(context.Background(), virtual_disks.NewWriterAtEmitter(image, changeIdPath)); err != nil {
+		t.Fatalf("EmitTo failed: %v", err)
+	}
+	info, _ := image.Stat()
+	if info.Size() != 5242880+65536 {
+		t.Errorf("Unexpected image size %d", info.Size())
+	}
+	readBack := make([]byte, len(changed))
+	for _, offset := range []int64{70000, 140000, 5 * 1024 * 1024} {
+		if _, err = image.ReadAt(readBack, offset); err != nil || !bytes.Equal(readBack, changed) {
+			t.Errorf("Image does not contain the changed data at %d, err = %v", offset, err)
+		}
+	}
+	if changeId, _ := virtual_disks.ReadChangeId(changeIdPath); changeId != "52 1/2" {
+		t.Errorf("Expected new change ID 52 1/2, got %s", changeId)
+	}
+	if reader.ChangedBytes() != 131072+65536 {
+		t.Errorf("Unexpected changed bytes %d", reader.ChangedBytes())
+	}
+}
+
+// syncRecorder 记录对目标的 WriteAt、Flush 和 Sync 调用，并在 Sync 时检查 change ID 文件还没有写入。
+type syncRecorder struct {
+	t            *testing.T
+	changeIdPath string
+	calls        []string
+}
+
+// WriteAt 记录调用并丢弃数据。
+func (this *syncRecorder) WriteAt(p []byte, off int64) (int, error) {
+	this.calls = append(this.calls, "WriteAt")
+	return len(p), nil
+}
+
+// Flush 记录调用。
+func (this *syncRecorder) Flush() error {
+	this.calls = append(this.calls, "Flush")
+	return nil
+}
+
+// Sync 记录调用。
+func (this *syncRecorder) Sync() error {
+	this.calls = append(this.calls, "Sync")
+	if _, err := os.Stat(this.changeIdPath); !os.IsNotExist(err) {
+		this.t.Errorf("The change ID was written before the backup target was synced")
+	}
+	return nil
+}
+
+// TestWriterAtEmitterSync 测试 EmitChangeId 在写入 change ID 之前刷新目标，目标刷新失败时不写入 change ID。
+func TestWriterAtEmitterSync(t *testing.T) {
+	changeIdPath := filepath.Join(t.TempDir(), "changeid")
+	target := &syncRecorder{t: t, changeIdPath: changeIdPath}
+	emitter := virtual_disks.NewWriterAtEmitter(target, changeIdPath)
+	if err := emitter.EmitBlock(0, []byte("data")); err != nil {
+		t.Fatalf("EmitBlock failed: %v", err)
+	}
+	if err := emitter.EmitChangeId("52 1/3"); err != nil {
+		t.Fatalf("EmitChangeId failed: %v", err)
+	}
+	if calls := strings.Join(target.calls, " "); calls != "WriteAt Flush Sync" {
+		t.Errorf("Unexpected calls %s", calls)
+	}
+	if changeId, _ := virtual_disks.ReadChangeId(changeIdPath); changeId != "52 1/3" {
+		t.Errorf("Expected new change ID 52 1/3, got %s", changeId)
+	}
+
+	image, err := os.Create(filepath.Join(t.TempDir(), "image.raw"))
+	if err != nil {
+		t.Fatalf("Create image failed: %v", err)
+	}
+	image.Close()
+	// 已经关闭的文件无法刷新，change ID 保持不变
+	if err = virtual_disks.NewWriterAtEmitter(image, changeIdPath).EmitChangeId("52 1/4"); err == nil {
+		t.Errorf("Expected an error when the backup target cannot be synced")
+	}
+	if changeId, _ := virtual_disks.ReadChangeId(changeIdPath); changeId != "52 1/3" {
+		t.Errorf("Expected the change ID to stay at 52 1/3, got %s", changeId)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// TestPlanClone 测试 SpaceNeededForClone 返回所需的字节数，以及 PlanClone 拒绝空间不足的克隆。
+func TestPlanClone(t *testing.T) {
+	fake := disklib.NewFakeBackend()
+	fake.AddDisk("fcd-clone", 8192)
+	// 2 PiB 的稀疏磁盘，预分配类型的克隆不可能放进测试机器的临时目录
+	fake.AddDisk("fcd-huge", 1<<42)
+	if vErr := disklib.InitWithBackend(fake, 7, 0, ""); vErr != nil {
+		t.Fatalf("Init failed: %s", vErr.Error())
+	}
+	t.Cleanup(disklib.Exit)
+	dstDir := t.TempDir()
+
+	src, vErr := virtual_disks.Open(newFakeParams("fcd-clone"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer src.Close()
+	if _, err := src.WriteAt(make([]byte, 4096), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	sparse, vErr := src.SpaceNeededForClone(disklib.VIXDISKLIB_DISK_MONOLITHIC_SPARSE)
+	if vErr != nil || sparse == 0 || sparse >= uint64(src.Capacity()) {
+		t.Errorf("Expected the sparse clone to need only the allocated data, got %d, err = %v", sparse, vErr)
+	}
+	plan, vErr := virtual_disks.PlanClone(src, disklib.VIXDISKLIB_DISK_MONOLITHIC_FLAT, dstDir)
+	if vErr != nil {
+		t.Fatalf("PlanClone failed: %s", vErr.Error())
+	}
+	if !plan.Fits() || plan.SpaceNeeded != uint64(src.Capacity()) || plan.FreeSpace == 0 {
+		t.Errorf("Unexpected clone plan %+v", plan)
+	}
+
+	huge, vErr := virtual_disks.Open(newFakeParams("fcd-huge"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer huge.Close()
+	plan, vErr = virtual_disks.PlanClone(huge, disklib.VIXDISKLIB_DISK_MONOLITHIC_FLAT, dstDir)
+	if !errors.Is(vErr, disklib.ErrDiskFull) {
+		t.Errorf("Expected PlanClone of a 2 PiB flat disk to fail with VIX_E_DISK_FULL, got %v", vErr)
+	}
+	if plan.Fits() || plan.SpaceNeeded != uint64(huge.Capacity()) {
+		t.Errorf("Unexpected clone plan %+v", plan)
+	}
+	if _, vErr = virtual_disks.PlanClone(huge, disklib.VIXDISKLIB_DISK_MONOLITHIC_SPARSE, dstDir); vErr != nil {
+		t.Errorf("Expected the empty sparse clone to fit, got %v", vErr)
+	}
+	_, vErr = virtual_disks.PlanClone(src, disklib.VIXDISKLIB_DISK_MONOLITHIC_SPARSE, filepath.Join(dstDir, "missing"))
+	if !errors.Is(vErr, disklib.ErrFileNotFound) {
+		t.Errorf("Expected PlanClone to a missing directory to fail with VIX_E_FILE_NOT_FOUND, got %v", vErr)
+	}
+}
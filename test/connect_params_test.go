@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// TestConnectParamsBuilder 测试构建器与 NewConnectParams 生成相同的参数，以及访问方法和隐去密钥的 String。
+func TestConnectParamsBuilder(t *testing.T) {
+	params := disklib.BuildConnectParams(
+		disklib.WithServer("vc.example.com"),
+		disklib.WithThumbprint("AA:BB"),
+		disklib.WithCredentials("administrator", "secret-password"),
+		disklib.ForFCD("fcd-1", "datastore-1"),
+		disklib.WithTransport("hotadd:nbdssl"),
+		disklib.ReadOnly())
+	expected := disklib.NewConnectParams("", "vc.example.com", "AA:BB", "administrator", "secret-password", "fcd-1",
+		"datastore-1", "", "", "", "", disklib.VIXDISKLIB_FLAG_OPEN_READ_ONLY, true, "hotadd:nbdssl")
+	if params != expected {
+		t.Errorf("Builder returned %s, expected %s", params, expected)
+	}
+	if vErr := params.Validate(); vErr != nil {
+		t.Errorf("Validate failed: %s", vErr.Error())
+	}
+	if params.ServerName() != "vc.example.com" || params.FcdId() != "fcd-1" || params.Datastore() != "datastore-1" ||
+		!params.IsReadOnly() || !params.HasPassword() || params.HasCookie() || params.Mode() != "hotadd:nbdssl" {
+		t.Errorf("Unexpected accessors for %s", params)
+	}
+	for _, text := range []string{params.String(), fmt.Sprintf("%v", params), fmt.Sprintf("%#v", params)} {
+		if strings.Contains(text, "secret-password") || !strings.Contains(text, "password=***") {
+			t.Errorf("Password is not redacted in %s", text)
+		}
+	}
+
+	// With 返回修改后的副本
+	snapshot := params.With(disklib.WithFCDSnapshot("fcdss-1"))
+	if snapshot.FcdssId() != "fcdss-1" || params.FcdssId() != "" {
+		t.Errorf("With modified the original params")
+	}
+}
+
+// TestConnectParamsValidate 测试 Validate 拒绝矛盾的参数组合，且 PrepareForAccess 和 ConnectEx 在调用后端之前返回错误。
+func TestConnectParamsValidate(t *testing.T) {
+	server := []disklib.ConnectOption{disklib.WithServer("vc.example.com"), disklib.WithCredentials("user", "password")}
+	invalid := map[string]disklib.ConnectParams{
+		"fcd without datastore": disklib.BuildConnectParams(append(server, disklib.ForFCD("fcd-1", ""))...),
+		"snapshot without fcd":  disklib.BuildConnectParams(append(server, disklib.WithFCDSnapshot("fcdss-1"))...),
+		"fcd and vmx": disklib.BuildConnectParams(append(server, disklib.ForFCD("fcd-1", "ds"),
+			disklib.ForVMX("moref=vm-1", "[ds] vm/vm.vmdk"))...),
+		"snapshot ref without vmx": disklib.BuildConnectParams(append(server, disklib.WithSnapshotRef("snapshot-1"))...),
+		"cookie and password": disklib.BuildConnectParams(append(server,
+			disklib.WithSessionCookie("vmware_soap_session=1", "user"))...),
+		"unknown transport":   disklib.BuildConnectParams(append(server, disklib.WithTransport("nbd:ftp"))...),
+		"fcd without server":  disklib.BuildConnectParams(disklib.ForFCD("fcd-1", "ds")),
+		"server without user": disklib.BuildConnectParams(disklib.WithServer("vc.example.com")),
+	}
+	for name, params := range invalid {
+		vErr := params.Validate()
+		if vErr == nil || vErr.VixErrorCode() != disklib.VIX_E_INVALID_ARG {
+			t.Errorf("%s: expected VIX_E_INVALID_ARG, got %v", name, vErr)
+		}
+	}
+	valid := map[string]disklib.ConnectParams{
+		"local disk": disklib.BuildConnectParams(disklib.ForPath("disk.vmdk")),
+		"session cookie": disklib.BuildConnectParams(disklib.WithServer("vc.example.com"),
+			disklib.WithSessionCookie("vmware_soap_session=1", ""), disklib.ForFCD("fcd-1", "ds")),
+		"vmx snapshot": disklib.BuildConnectParams(append(server, disklib.ForVMX("moref=vm-1", "[ds] vm/vm.vmdk"),
+			disklib.WithSnapshotRef("snapshot-1"), disklib.WithTransport(disklib.SAN))...),
+	}
+	for name, params := range valid {
+		if vErr := params.Validate(); vErr != nil {
+			t.Errorf("%s: Validate failed: %s", name, vErr.Error())
+		}
+	}
+
+	// 后端中存在 fcd-1，返回 VIX_E_INVALID_ARG 说明请求没有到达后端
+	setupFake(t, "fcd-1")
+	params := disklib.BuildConnectParams(append(server, disklib.ForFCD("fcd-1", ""))...)
+	if vErr := disklib.PrepareForAccess(params); vErr == nil || vErr.VixErrorCode() != disklib.VIX_E_INVALID_ARG {
+		t.Errorf("PrepareForAccess should reject invalid params, got %v", vErr)
+	}
+	if _, vErr := disklib.ConnectEx(params); vErr == nil || vErr.VixErrorCode() != disklib.VIX_E_INVALID_ARG {
+		t.Errorf("ConnectEx should reject invalid params, got %v", vErr)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// TestContextReadWrite 测试带 context 的打开与读写在取消和超时后的行为。
+func TestContextReadWrite(t *testing.T) {
+	setupFake(t, "fcd-ctx")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := virtual_disks.OpenContext(cancelled, newFakeParams("fcd-ctx"), logrus.New()); err == nil || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled from OpenContext, got %v", err)
+	}
+	diskReaderWriter, err := virtual_disks.OpenContext(context.Background(), newFakeParams("fcd-ctx"), logrus.New())
+	if err != nil {
+		t.Fatalf("OpenContext failed: %s", err.Error())
+	}
+	defer diskReaderWriter.Close()
+	// 未结束的 context 下读写与普通读写一致，跨越多个批次
+	data := bytes.Repeat([]byte{'C'}, 3*1024*1024+100)
+	n, werr := diskReaderWriter.WriteAtContext(context.Background(), data, 7)
+	if werr != nil || n != len(data) {
+		t.Fatalf("WriteAtContext returned n = %d, err = %v", n, werr)
+	}
+	ctx, cancelRead := context.WithCancel(context.Background())
+	defer cancelRead()
+	readBack := make([]byte, len(data))
+	n, rerr := diskReaderWriter.ReadAtContext(ctx, readBack, 7)
+	if rerr != nil || n != len(data) || !bytes.Equal(readBack, data) {
+		t.Fatalf("ReadAtContext returned n = %d, err = %v", n, rerr)
+	}
+	// 已取消的 context 不会读写任何数据
+	n, rerr = diskReaderWriter.ReadAtContext(cancelled, readBack, 0)
+	if n != 0 || !errors.Is(rerr, context.Canceled) {
+		t.Errorf("Expected context.Canceled from ReadAtContext, got n = %d, err = %v", n, rerr)
+	}
+	vErr, ok := rerr.(disklib.VddkError)
+	if !ok || vErr.VixErrorCode() != disklib.VIX_E_CANCELLED {
+		t.Errorf("Expected a VddkError with VIX_E_CANCELLED, got %v", rerr)
+	}
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	n, werr = diskReaderWriter.WriteContext(expired, data)
+	if n != 0 || !errors.Is(werr, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded from WriteContext, got n = %d, err = %v", n, werr)
+	}
+}
+
+// TestContextClone 测试 context 在克隆过程中被取消时通过进度回调中止克隆。
+func TestContextClone(t *testing.T) {
+	setupFake(t, "fcd-ctx-clone")
+	conn, err := disklib.ConnectEx(newFakeParams("fcd-ctx-clone"))
+	if err != nil {
+		t.Fatalf("ConnectEx failed: %s", err.Error())
+	}
+	defer disklib.Disconnect(conn)
+	createParams := disklib.NewCreateParams(disklib.VIXDISKLIB_DISK_MONOLITHIC_SPARSE, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7, 4096)
+	if err = disklib.Create(conn, "src.vmdk", createParams, nil); err != nil {
+		t.Fatalf("Create failed: %s", err.Error())
+	}
+	src, err := disklib.Open(conn, disklib.NewConnectParams("", "", "", "", "", "", "", "", "", "", "src.vmdk", 0, false, ""))
+	if err != nil {
+		t.Fatalf("Open failed: %s", err.Error())
+	}
+	for _, startSector := range []uint64{0, 1024, 2048} {
+		if err = disklib.Write(src, startSector, 1, bytes.Repeat([]byte{'X'}, disklib.VIXDISKLIB_SECTOR_SIZE)); err != nil {
+			t.Fatalf("Write failed: %s", err.Error())
+		}
+	}
+	disklib.Close(src)
+	// 第一次报告进度时取消 context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = disklib.CloneContext(ctx, conn, "dst.vmdk", conn, "src.vmdk", createParams, func(percentCompleted int) bool {
+		cancel()
+		return true
+	}, false)
+	if err == nil || !errors.Is(err, context.Canceled) || err.VixErrorCode() != disklib.VIX_E_CANCELLED {
+		t.Fatalf("Expected cancelled clone, got %v", err)
+	}
+	if err = disklib.GrowContext(ctx, conn, "src.vmdk", 8192, false, nil); err == nil || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled from GrowContext, got %v", err)
+	}
+	if err = disklib.CheckRepairContext(ctx, conn, "src.vmdk", false); err == nil || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled from CheckRepairContext, got %v", err)
+	}
+	if err = disklib.CloneContext(context.Background(), conn, "dst.vmdk", conn, "src.vmdk", createParams, nil, false); err != nil {
+		t.Errorf("CloneContext failed: %s", err.Error())
+	}
+}
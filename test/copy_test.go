@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// TestCopyDisk 测试只复制已分配区域的并行磁盘复制。
+func TestCopyDisk(t *testing.T) {
+	fake := setupFake(t, "fcd-copy-src")
+	fake.AddDisk("fcd-copy-dst", fakeCapacity)
+	src, err := virtual_disks.Open(newFakeParams("fcd-copy-src"), logrus.New())
+	if err != nil {
+		t.Fatalf("Open source failed: %s", err.Error())
+	}
+	defer src.Close()
+	dst, err := virtual_disks.Open(newFakeParams("fcd-copy-dst"), logrus.New())
+	if err != nil {
+		t.Fatalf("Open destination failed: %s", err.Error())
+	}
+	defer dst.Close()
+	data := bytes.Repeat([]byte("copy"), 300*1024)
+	offsets := []int64{0, 10 * 1024 * 1024, fakeCapacity*disklib.VIXDISKLIB_SECTOR_SIZE - int64(len(data))}
+	for _, offset := range offsets {
+		if _, werr := src.WriteAt(data, offset); werr != nil {
+			t.Fatalf("WriteAt failed: %v", werr)
+		}
+	}
+	// 已分配但全为零的 1 MiB
+	if _, werr := src.WriteAt(make([]byte, 1024*1024), 100*1024*1024); werr != nil {
+		t.Fatalf("WriteAt failed: %v", werr)
+	}
+	progressCalls := 0
+	stats, cerr := virtual_disks.CopyDisk(src, dst, virtual_disks.CopyOptions{
+		BlockSize:    256 * 1024,
+		Workers:      3,
+		FreshTarget:  true,
+		DetectZeroes: true,
+		Progress:     func(stats virtual_disks.CopyStats) { progressCalls++ },
+	})
+	if cerr != nil {
+		t.Fatalf("CopyDisk failed: %v", cerr)
+	}
+	capacity := int64(fakeCapacity * disklib.VIXDISKLIB_SECTOR_SIZE)
+	if stats.BytesCopied+stats.BytesSkipped != capacity {
+		t.Errorf("Copied %d + skipped %d bytes does not add up to capacity %d", stats.BytesCopied, stats.BytesSkipped, capacity)
+	}
+	// 每段 1.2 MiB 的数据覆盖 5 个 256 KiB 的数据块，其余已分配但全零的数据块被跳过
+	if stats.BytesCopied != 3*5*256*1024 {
+		t.Errorf("Expected 3.75 MiB copied, got %d", stats.BytesCopied)
+	}
+	if progressCalls == 0 {
+		t.Errorf("Expected progress to be reported")
+	}
+	readBack := make([]byte, len(data))
+	for _, offset := range offsets {
+		if _, rerr := dst.ReadAt(readBack, offset); rerr != nil || !bytes.Equal(readBack, data) {
+			t.Errorf("Destination does not contain the source data at %d, err = %v", offset, rerr)
+		}
+	}
+	// 已取消的 context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, cerr = virtual_disks.CopyDiskContext(ctx, src, dst, virtual_disks.CopyOptions{}); !errors.Is(cerr, context.Canceled) {
+		t.Errorf("Expected context.Canceled from CopyDiskContext, got %v", cerr)
+	}
+}
+
+// TestCopyDiskDirtyTarget 测试目标磁盘中已有数据时，源磁盘中未分配和全零的区域在目标磁盘上被写为零，以及块大小的检查。
+func TestCopyDiskDirtyTarget(t *testing.T) {
+	fake := disklib.NewFakeBackend()
+	fake.AddDisk("fcd-dirty-src", 8192)
+	fake.AddDisk("fcd-dirty-dst", 8192)
+	if vErr := disklib.InitWithBackend(fake, 7, 0, ""); vErr != nil {
+		t.Fatalf("Init failed: %s", vErr.Error())
+	}
+	t.Cleanup(disklib.Exit)
+	src, vErr := virtual_disks.Open(newFakeParams("fcd-dirty-src"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open source failed: %s", vErr.Error())
+	}
+	defer src.Close()
+	dst, vErr := virtual_disks.Open(newFakeParams("fcd-dirty-dst"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open destination failed: %s", vErr.Error())
+	}
+	defer dst.Close()
+	capacity := src.Capacity()
+	if _, err := dst.WriteAt(bytes.Repeat([]byte{'D'}, int(capacity)), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	data := bytes.Repeat([]byte("copy"), 50000)
+	if _, err := src.WriteAt(data, 1024*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := src.WriteAt(make([]byte, 128*1024), 3*1024*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := virtual_disks.CopyDisk(src, dst, virtual_disks.CopyOptions{ChunkSize: disklib.VIXDISKLIB_MAX_CHUNK_SIZE + 1}); err == nil {
+		t.Errorf("Expected an error for a chunk size larger than VIXDISKLIB_MAX_CHUNK_SIZE")
+	}
+	stats, err := virtual_disks.CopyDisk(src, dst, virtual_disks.CopyOptions{ChunkSize: 128, BlockSize: 64 * 1024, DetectZeroes: true})
+	if err != nil {
+		t.Fatalf("CopyDisk failed: %v", err)
+	}
+	if stats.BytesCopied+stats.BytesSkipped != capacity || stats.BytesZeroed != stats.BytesSkipped {
+		t.Errorf("Expected every skipped byte to be zeroed, got %+v", stats)
+	}
+	expected := make([]byte, capacity)
+	copy(expected[1024*1024:], data)
+	readBack := make([]byte, capacity)
+	if _, err = dst.ReadAt(readBack, 0); err != nil || !bytes.Equal(readBack, expected) {
+		t.Errorf("Destination still contains data that is not in the source, err = %v", err)
+	}
+}
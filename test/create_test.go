@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// TestCreateParams 测试创建参数的访问方法以及扇区大小的默认值。
+func TestCreateParams(t *testing.T) {
+	createParams := disklib.NewCreateParams(disklib.VIXDISKLIB_DISK_VMFS_THIN, disklib.VIXDISKLIB_ADAPTER_NVME, 19, 8192)
+	if createParams.DiskType() != disklib.VIXDISKLIB_DISK_VMFS_THIN || createParams.AdapterType() != disklib.VIXDISKLIB_ADAPTER_NVME ||
+		createParams.HwVersion() != 19 || createParams.Capacity() != 8192 {
+		t.Errorf("Unexpected create params %+v", createParams)
+	}
+	if createParams.LogicalSectorSize() != 512 || createParams.PhysicalSectorSize() != 512 {
+		t.Errorf("Expected 512 byte sectors by default, got %d/%d", createParams.LogicalSectorSize(), createParams.PhysicalSectorSize())
+	}
+	native4k := createParams.WithSectorSize(4096, 4096)
+	if native4k.LogicalSectorSize() != 4096 || native4k.PhysicalSectorSize() != 4096 || createParams.LogicalSectorSize() != 512 {
+		t.Errorf("WithSectorSize should return a modified copy")
+	}
+	if (disklib.VixDiskLibCreateParams{}).LogicalSectorSize() != 512 {
+		t.Errorf("Expected 512 byte logical sectors for zero create params")
+	}
+}
+
+// TestCreateDisk 测试 CreateDisk 创建并打开一块 4Kn 磁盘，以及不合法的扇区大小和已存在的路径。
+func TestCreateDisk(t *testing.T) {
+	setupFake(t, "fcd-create")
+	params := newFakeParams("").With(disklib.ForFCD("", ""), disklib.ForPath("[datastore-1] backup/disk-4kn.vmdk"))
+	createParams := disklib.NewCreateParams(disklib.VIXDISKLIB_DISK_VMFS_THIN, disklib.VIXDISKLIB_ADAPTER_SCSI_PVSCSI, 14, 8192).
+		WithSectorSize(4096, 4096)
+	diskReaderWriter, vErr := virtual_disks.CreateDisk(params, createParams, logrus.New())
+	if vErr != nil {
+		t.Fatalf("CreateDisk failed: %s", vErr.Error())
+	}
+	if diskReaderWriter.Capacity() != 8192*disklib.VIXDISKLIB_SECTOR_SIZE {
+		t.Errorf("Unexpected capacity %d", diskReaderWriter.Capacity())
+	}
+	data := bytes.Repeat([]byte("4kn!"), 1024)
+	if _, err := diskReaderWriter.WriteAt(data, 4096); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	diskReaderWriter.Close()
+
+	reopened, vErr := virtual_disks.Open(params, logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer reopened.Close()
+	buf := make([]byte, len(data))
+	if _, err := reopened.ReadAt(buf, 4096); err != nil || !bytes.Equal(buf, data) {
+		t.Errorf("ReadAt returned unexpected data, err = %v", err)
+	}
+	conn, vErr := disklib.ConnectEx(params)
+	if vErr != nil {
+		t.Fatalf("ConnectEx failed: %s", vErr.Error())
+	}
+	defer disklib.Disconnect(conn)
+	dli, vErr := disklib.Open(conn, params)
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	info, vErr := disklib.GetInfo(dli)
+	disklib.Close(dli)
+	if vErr != nil || info.LogicalSectorSize != 4096 || info.PhysicalSectorSize != 4096 || info.AdapterType != disklib.VIXDISKLIB_ADAPTER_SCSI_PVSCSI {
+		t.Errorf("Unexpected disk info %+v, err = %v", info, vErr)
+	}
+
+	if _, vErr = virtual_disks.CreateDisk(params, createParams, logrus.New()); !errors.Is(vErr, disklib.ErrFileAlreadyExists) {
+		t.Errorf("Expected VIX_E_FILE_ALREADY_EXISTS when creating an existing disk, got %v", vErr)
+	}
+	invalid := params.With(disklib.ForPath("[datastore-1] backup/invalid.vmdk"))
+	if _, vErr = virtual_disks.CreateDisk(invalid, createParams.WithSectorSize(4096, 512), logrus.New()); !errors.Is(vErr, disklib.ErrInvalidArg) {
+		t.Errorf("Expected VIX_E_INVALID_ARG for a physical sector smaller than the logical sector, got %v", vErr)
+	}
+	if _, vErr = virtual_disks.CreateDisk(params.With(disklib.ForPath("")), createParams, logrus.New()); !errors.Is(vErr, disklib.ErrInvalidArg) {
+		t.Errorf("Expected VIX_E_INVALID_ARG without a path, got %v", vErr)
+	}
+}
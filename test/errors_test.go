@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// TestErrorsIs 测试 VddkError 以及包装后的错误可以用 errors.Is 与哨兵错误比较。
+func TestErrorsIs(t *testing.T) {
+	notFound := disklib.NewVddkError(disklib.VIX_E_FILE_NOT_FOUND, "Open failed. The error code is 4.")
+	if !errors.Is(notFound, disklib.ErrFileNotFound) {
+		t.Errorf("Expected VIX_E_FILE_NOT_FOUND to match ErrFileNotFound")
+	}
+	if errors.Is(notFound, disklib.ErrAccessDenied) {
+		t.Errorf("VIX_E_FILE_NOT_FOUND should not match ErrAccessDenied")
+	}
+	wrapped := fmt.Errorf("open disk: %w", pkgerrors.Wrap(notFound, "vdisk"))
+	if !errors.Is(wrapped, disklib.ErrFileNotFound) {
+		t.Errorf("Expected wrapped error to match ErrFileNotFound")
+	}
+	if !errors.Is(wrapped, disklib.NewVddkError(disklib.VIX_E_FILE_NOT_FOUND, "")) {
+		t.Errorf("Expected wrapped error to match a VddkError with the same code")
+	}
+	for _, code := range []uint64{disklib.VIX_E_HOST_TCP_CONN_LOST, disklib.VIX_E_HOST_SERVER_SHUTDOWN,
+		disklib.VIX_E_CANNOT_CONNECT_TO_HOST} {
+		if !errors.Is(disklib.NewVddkError(code, ""), disklib.ErrHostConnectionLost) {
+			t.Errorf("Expected error code %d to match ErrHostConnectionLost", code)
+		}
+	}
+	if errors.Unwrap(disklib.NewVddkError(disklib.VIX_E_DISK_OUTOFRANGE, "")) != disklib.ErrDiskOutOfRange {
+		t.Errorf("Expected VIX_E_DISK_OUTOFRANGE to unwrap to ErrDiskOutOfRange")
+	}
+}
+
+// TestRetryable 测试只有主机连接类错误可以重试，context 结束导致的错误不可重试。
+func TestRetryable(t *testing.T) {
+	if !disklib.Retryable(pkgerrors.Wrap(disklib.NewVddkError(disklib.VIX_E_HOST_TCP_CONN_LOST, ""), "read")) {
+		t.Errorf("Expected VIX_E_HOST_TCP_CONN_LOST to be retryable")
+	}
+	if disklib.Retryable(disklib.NewVddkError(disklib.VIX_E_FILE_NOT_FOUND, "")) {
+		t.Errorf("VIX_E_FILE_NOT_FOUND should not be retryable")
+	}
+	if disklib.Retryable(io.EOF) || disklib.Retryable(nil) {
+		t.Errorf("Non VDDK errors should not be retryable")
+	}
+
+	setupFake(t, "fcd-errors")
+	diskReaderWriter, vErr := virtual_disks.Open(newFakeParams("fcd-errors"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer diskReaderWriter.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := diskReaderWriter.ReadAtContext(ctx, make([]byte, disklib.VIXDISKLIB_SECTOR_SIZE), 0)
+	if err == nil {
+		t.Fatalf("Expected ReadAtContext with a cancelled context to fail")
+	}
+	if !errors.Is(err, context.Canceled) || disklib.Retryable(err) {
+		t.Errorf("Expected a non retryable context.Canceled error, got %v", err)
+	}
+}
+
+// textBackend 返回自定义的错误说明，并统计 GetErrorText 的调用次数。
+type textBackend struct {
+	*disklib.FakeBackend
+	calls *int32
+}
+
+// GetErrorText 在 FakeBackend 的说明前加上前缀。
+func (this textBackend) GetErrorText(errCode uint64, locale string) string {
+	atomic.AddInt32(this.calls, 1)
+	return "vddk: " + this.FakeBackend.GetErrorText(errCode, locale)
+}
+
+// TestGetErrorText 测试获取错误码的说明，以及 VddkError 的错误信息中包含该说明。
+func TestGetErrorText(t *testing.T) {
+	// 初始化之前使用内置的英文说明
+	if msg := disklib.NewVddkError(disklib.VIX_E_DISK_FULL, "Write failed. The error code is 8.").Error(); msg != "Write failed. The error code is 8. Disk full." {
+		t.Errorf("Unexpected error message %q before Init", msg)
+	}
+	var calls int32
+	setupFake(t, "fcd-errors", withWrappedBackend(func(fake *disklib.FakeBackend) disklib.Backend {
+		return textBackend{fake, &calls}
+	}))
+	if text := disklib.GetErrorText(disklib.VIX_E_FILE_NOT_FOUND, ""); text != "vddk: A file was not found" {
+		t.Errorf("Unexpected error text %q", text)
+	}
+	// 内置说明中有的错误码在初始化之后也不调用后端
+	atomic.StoreInt32(&calls, 0)
+	_, vErr := virtual_disks.Open(newFakeParams("fcd-missing"), logrus.New())
+	if vErr == nil {
+		t.Fatalf("Expected Open of a missing disk to fail")
+	}
+	if !strings.HasSuffix(vErr.Error(), "The error code is 4. A file was not found.") {
+		t.Errorf("Unexpected error message %q", vErr.Error())
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("Expected no GetErrorText calls for a known error code, got %d", n)
+	}
+	// 已经包含说明的信息不会重复追加
+	if msg := disklib.NewVddkError(vErr.VixErrorCode(), vErr.Error()).Error(); msg != vErr.Error() {
+		t.Errorf("Expected the error text once, got %q", msg)
+	}
+	// 其它错误码使用后端返回的说明，并且每个错误码只查询一次
+	for i := 0; i < 3; i++ {
+		if msg := disklib.NewVddkError(99999, "Read failed. The error code is 99999.").Error(); msg != "Read failed. The error code is 99999. vddk: Unknown error 99999." {
+			t.Errorf("Unexpected error message %q after Init", msg)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Expected one GetErrorText call for an unknown error code, got %d", n)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// 测试用 FCD 的容量：1 GiB
+const fakeCapacity = 2048 * 1024
+
+// newFakeParams 返回打开 FakeBackend 中 FCD 磁盘所用的连接参数。
+func newFakeParams(fcdId string) disklib.ConnectParams {
+	return disklib.BuildConnectParams(
+		disklib.WithServer("10.0.0.1"),
+		disklib.WithCredentials("user", "password"),
+		disklib.ForFCD(fcdId, "datastore-1"),
+		disklib.WithIdentity("fake-test"),
+		disklib.WithOpenFlags(disklib.VIXDISKLIB_FLAG_OPEN_COMPRESSION_SKIPZ),
+		disklib.WithTransport(disklib.NBD))
+}
+
+// fakeSetup 是 setupFake 的可选参数。
+type fakeSetup struct {
+	capacity disklib.VixDiskLibSectorType
+	wrap     func(fake *disklib.FakeBackend) disklib.Backend
+}
+
+// fakeOption 修改 setupFake 的可选参数。
+type fakeOption func(setup *fakeSetup)
+
+// withFakeCapacity 指定登记的 FCD 磁盘的容量（扇区），默认为 fakeCapacity。
+func withFakeCapacity(capacity disklib.VixDiskLibSectorType) fakeOption {
+	return func(setup *fakeSetup) {
+		setup.capacity = capacity
+	}
+}
+
+// withWrappedBackend 使用 wrap 返回的后端初始化 disklib，用于统计或拦截对 FakeBackend 的调用。
+func withWrappedBackend(wrap func(fake *disklib.FakeBackend) disklib.Backend) fakeOption {
+	return func(setup *fakeSetup) {
+		setup.wrap = wrap
+	}
+}
+
+// setupFake 使用 FakeBackend 初始化 disklib，并登记一块 FCD 磁盘。
+func setupFake(t *testing.T, fcdId string, opts ...fakeOption) *disklib.FakeBackend {
+	setup := fakeSetup{capacity: fakeCapacity}
+	for _, opt := range opts {
+		opt(&setup)
+	}
+	fake := disklib.NewFakeBackend()
+	fake.AddDisk(fcdId, setup.capacity)
+	var backend disklib.Backend = fake
+	if setup.wrap != nil {
+		backend = setup.wrap(fake)
+	}
+	if err := disklib.InitWithBackend(backend, 7, 0, ""); err != nil {
+		t.Fatalf("Init failed, got error code: %d, error message: %s.", err.VixErrorCode(), err.Error())
+	}
+	t.Cleanup(disklib.Exit)
+	return fake
+}
+
+// openFake 调用 setupFake 并打开登记的 FCD 磁盘，测试结束时关闭磁盘。
+func openFake(t *testing.T, fcdId string, opts ...fakeOption) virtual_disks.DiskReaderWriter {
+	setupFake(t, fcdId, opts...)
+	diskReaderWriter, vErr := virtual_disks.Open(newFakeParams(fcdId), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed, got error code: %d, error message: %s.", vErr.VixErrorCode(), vErr.Error())
+	}
+	t.Cleanup(func() { diskReaderWriter.Close() })
+	return diskReaderWriter
+}
+
+// countingBackend 统计对 FakeBackend 的读写调用次数，failWrites 不为 0 时写入返回 VIX_E_DISK_FULL。
+type countingBackend struct {
+	*disklib.FakeBackend
+	reads      int32
+	writes     int32
+	failWrites int32
+}
+
+// wrap 包装 fake 并返回 this，用作 withWrappedBackend 的参数。
+func (this *countingBackend) wrap(fake *disklib.FakeBackend) disklib.Backend {
+	this.FakeBackend = fake
+	return this
+}
+
+// Read 统计调用次数后读取 FakeBackend。
+func (this *countingBackend) Read(diskHandle disklib.VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	atomic.AddInt32(&this.reads, 1)
+	return this.FakeBackend.Read(diskHandle, startSector, numSectors, buf)
+}
+
+// Write 统计调用次数后写入 FakeBackend。
+func (this *countingBackend) Write(diskHandle disklib.VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	atomic.AddInt32(&this.writes, 1)
+	if atomic.LoadInt32(&this.failWrites) != 0 {
+		return disklib.NewVddkError(disklib.VIX_E_DISK_FULL, "Write failed. The error code is 8.")
+	}
+	return this.FakeBackend.Write(diskHandle, startSector, numSectors, buf)
+}
+
+// TestFakeOpenReadWrite 在 FakeBackend 上测试打开、读写、查询已分配块和关闭的完整流程。
+func TestFakeOpenReadWrite(t *testing.T) {
+	setupFake(t, "fcd-1")
+	diskReaderWriter, err := virtual_disks.Open(newFakeParams("fcd-1"), logrus.New())
+	if err != nil {
+		t.Fatalf("Open failed, got error code: %d, error message: %s.", err.VixErrorCode(), err.Error())
+	}
+	// 新磁盘上没有已分配的块
+	blocks, err := diskReaderWriter.QueryAllocatedBlocks(0, fakeCapacity, 2048)
+	if err != nil {
+		t.Fatalf("QueryAllocatedBlocks failed: %d, error message: %s", err.VixErrorCode(), err.Error())
+	}
+	if len(blocks) != 0 {
+		t.Errorf("Expected no allocated blocks, got %d", len(blocks))
+	}
+	// 不对齐的写入和读取
+	data := bytes.Repeat([]byte{'E'}, disklib.VIXDISKLIB_SECTOR_SIZE+14)
+	n, werr := diskReaderWriter.WriteAt(data, 500)
+	if werr != nil || n != len(data) {
+		t.Fatalf("WriteAt returned n = %d, err = %v", n, werr)
+	}
+	readBack := make([]byte, len(data)+20)
+	n, rerr := diskReaderWriter.ReadAt(readBack, 490)
+	if rerr != nil || n != len(readBack) {
+		t.Fatalf("ReadAt returned n = %d, err = %v", n, rerr)
+	}
+	if !bytes.Equal(readBack[10:10+len(data)], data) || !bytes.Equal(readBack[:10], make([]byte, 10)) {
+		t.Errorf("ReadAt returned unexpected data")
+	}
+	// 写入之后第一个 1 MiB 块应被报告为已分配
+	blocks, err = diskReaderWriter.QueryAllocatedBlocks(0, fakeCapacity, 2048)
+	if err != nil {
+		t.Fatalf("QueryAllocatedBlocks failed: %d, error message: %s", err.VixErrorCode(), err.Error())
+	}
+	if len(blocks) != 1 || blocks[0].Offset() != 0 || blocks[0].Length() != 2048 {
+		t.Errorf("Unexpected allocated blocks %v", blocks)
+	}
+	// 读取到容量末尾之后返回 EOF
+	if _, rerr = diskReaderWriter.ReadAt(make([]byte, 1), fakeCapacity*disklib.VIXDISKLIB_SECTOR_SIZE); rerr != io.EOF {
+		t.Errorf("Expected EOF when reading beyond capacity, got %v", rerr)
+	}
+	if cerr := diskReaderWriter.Close(); cerr != nil {
+		t.Errorf("Close failed: %v", cerr)
+	}
+}
+
+// TestFakeLowLevel 在 FakeBackend 上测试低级 API 的创建、克隆和子磁盘操作。
+func TestFakeLowLevel(t *testing.T) {
+	setupFake(t, "fcd-2")
+	params := newFakeParams("fcd-2")
+	conn, err := disklib.ConnectEx(params)
+	if err != nil {
+		t.Fatalf("ConnectEx failed: %s", err.Error())
+	}
+	defer disklib.Disconnect(conn)
+	createParams := disklib.NewCreateParams(disklib.VIXDISKLIB_DISK_MONOLITHIC_SPARSE, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7, 4096)
+	if err = disklib.Create(conn, "base.vmdk", createParams, nil); err != nil {
+		t.Fatalf("Create failed: %s", err.Error())
+	}
+	if err = disklib.Create(conn, "base.vmdk", createParams, nil); err == nil || err.VixErrorCode() != disklib.VIX_E_FILE_ALREADY_EXISTS {
+		t.Errorf("Expected VIX_E_FILE_ALREADY_EXISTS when creating an existing disk, got %v", err)
+	}
+	base, err := disklib.Open(conn, disklib.NewConnectParams("", "", "", "", "", "", "", "", "", "", "base.vmdk", 0, false, ""))
+	if err != nil {
+		t.Fatalf("Open failed: %s", err.Error())
+	}
+	sector := bytes.Repeat([]byte{'P'}, disklib.VIXDISKLIB_SECTOR_SIZE)
+	if err = disklib.Write(base, 10, 1, sector); err != nil {
+		t.Fatalf("Write failed: %s", err.Error())
+	}
+	if err = disklib.Write(base, 4096, 1, sector); err == nil || err.VixErrorCode() != disklib.VIX_E_DISK_OUTOFRANGE {
+		t.Errorf("Expected VIX_E_DISK_OUTOFRANGE when writing beyond capacity, got %v", err)
+	}
+	// 子磁盘读取父磁盘中的数据，写入不影响父磁盘
+	if err = disklib.CreateChild(base, "child.vmdk", disklib.VIXDISKLIB_DISK_MONOLITHIC_SPARSE, nil); err != nil {
+		t.Fatalf("CreateChild failed: %s", err.Error())
+	}
+	child, err := disklib.Open(conn, disklib.NewConnectParams("", "", "", "", "", "", "", "", "", "", "child.vmdk", 0, false, ""))
+	if err != nil {
+		t.Fatalf("Open child failed: %s", err.Error())
+	}
+	buf := make([]byte, disklib.VIXDISKLIB_SECTOR_SIZE)
+	if err = disklib.Read(child, 10, 1, buf); err != nil || !bytes.Equal(buf, sector) {
+		t.Errorf("Child disk did not read through to parent, err = %v", err)
+	}
+	if err = disklib.Write(child, 10, 1, make([]byte, disklib.VIXDISKLIB_SECTOR_SIZE)); err != nil {
+		t.Fatalf("Write to child failed: %s", err.Error())
+	}
+	if err = disklib.Read(base, 10, 1, buf); err != nil || !bytes.Equal(buf, sector) {
+		t.Errorf("Write to child disk modified the parent, err = %v", err)
+	}
+	info, err := disklib.GetInfo(child)
+	if err != nil || info.NumLinks != 2 || info.ParentFileNameHint != "base.vmdk" {
+		t.Errorf("Unexpected child info %+v, err = %v", info, err)
+	}
+	disklib.Close(child)
+	disklib.Close(base)
+	// 克隆后的磁盘包含源磁盘的数据
+	if err = disklib.Clone(conn, "clone.vmdk", conn, "base.vmdk", createParams, nil, false); err != nil {
+		t.Fatalf("Clone failed: %s", err.Error())
+	}
+	clone, err := disklib.Open(conn, disklib.NewConnectParams("", "", "", "", "", "", "", "", "", "", "clone.vmdk", disklib.VIXDISKLIB_FLAG_OPEN_READ_ONLY, false, ""))
+	if err != nil {
+		t.Fatalf("Open clone failed: %s", err.Error())
+	}
+	if err = disklib.Read(clone, 10, 1, buf); err != nil || !bytes.Equal(buf, sector) {
+		t.Errorf("Clone does not contain source data, err = %v", err)
+	}
+	if err = disklib.Write(clone, 10, 1, buf); err == nil || err.VixErrorCode() != disklib.VIX_E_FILE_READ_ONLY {
+		t.Errorf("Expected VIX_E_FILE_READ_ONLY when writing a read only handle, got %v", err)
+	}
+	disklib.Close(clone)
+}
+
+// TestFakeProgress 测试长时间操作的进度回调与取消。
+func TestFakeProgress(t *testing.T) {
+	setupFake(t, "fcd-3")
+	conn, err := disklib.ConnectEx(newFakeParams("fcd-3"))
+	if err != nil {
+		t.Fatalf("ConnectEx failed: %s", err.Error())
+	}
+	defer disklib.Disconnect(conn)
+	createParams := disklib.NewCreateParams(disklib.VIXDISKLIB_DISK_MONOLITHIC_SPARSE, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7, 4096)
+	progressCh := make(chan int, 10)
+	if err = disklib.Create(conn, "src.vmdk", createParams, disklib.ProgressToChannel(progressCh)); err != nil {
+		t.Fatalf("Create failed: %s", err.Error())
+	}
+	if len(progressCh) == 0 {
+		t.Errorf("Expected progress to be reported to the channel")
+	}
+	src, err := disklib.Open(conn, disklib.NewConnectParams("", "", "", "", "", "", "", "", "", "", "src.vmdk", 0, false, ""))
+	if err != nil {
+		t.Fatalf("Open failed: %s", err.Error())
+	}
+	sector := bytes.Repeat([]byte{'G'}, disklib.VIXDISKLIB_SECTOR_SIZE)
+	for _, startSector := range []uint64{0, 1024, 2048} {
+		if err = disklib.Write(src, startSector, 1, sector); err != nil {
+			t.Fatalf("Write failed: %s", err.Error())
+		}
+	}
+	disklib.Close(src)
+	// 回调返回 false 时克隆被取消，目标磁盘不会被创建
+	calls := 0
+	cancel := func(percentCompleted int) bool {
+		calls++
+		return percentCompleted == 0
+	}
+	if err = disklib.Clone(conn, "dst.vmdk", conn, "src.vmdk", createParams, cancel, false); err == nil || err.VixErrorCode() != disklib.VIX_E_CANCELLED {
+		t.Fatalf("Expected VIX_E_CANCELLED when progress callback returns false, got %v", err)
+	}
+	if calls < 2 {
+		t.Errorf("Expected the progress callback to be invoked before cancellation, got %d calls", calls)
+	}
+	if _, err = disklib.Open(conn, disklib.NewConnectParams("", "", "", "", "", "", "", "", "", "", "dst.vmdk", 0, false, "")); err == nil {
+		t.Errorf("Cancelled clone should not create the destination disk")
+	}
+	// 完整的克隆最后报告 100%
+	last := -1
+	if err = disklib.Clone(conn, "dst.vmdk", conn, "src.vmdk", createParams, func(percentCompleted int) bool {
+		if percentCompleted < last {
+			t.Errorf("Progress went backwards from %d to %d", last, percentCompleted)
+		}
+		last = percentCompleted
+		return true
+	}, false); err != nil {
+		t.Fatalf("Clone failed: %s", err.Error())
+	}
+	if last != 100 {
+		t.Errorf("Expected final progress of 100, got %d", last)
+	}
+}
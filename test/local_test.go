@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// TestLocalDisks 测试不连接 vCenter 时创建、打开和克隆本地 hosted 磁盘。
+func TestLocalDisks(t *testing.T) {
+	fake := disklib.NewFakeBackend()
+	if vErr := disklib.InitWithBackend(fake, 7, 0, ""); vErr != nil {
+		t.Fatalf("Init failed: %s", vErr.Error())
+	}
+	t.Cleanup(disklib.Exit)
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.vmdk")
+	dstPath := filepath.Join(dir, "dst.vmdk")
+	createParams := disklib.NewCreateParams(disklib.VIXDISKLIB_DISK_MONOLITHIC_SPARSE, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7, 8192)
+
+	src, vErr := virtual_disks.CreateLocal(srcPath, createParams, logrus.New())
+	if vErr != nil {
+		t.Fatalf("CreateLocal failed: %s", vErr.Error())
+	}
+	data := bytes.Repeat([]byte("local"), 1000)
+	if _, err := src.WriteAt(data, 1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := src.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if vErr = virtual_disks.CloneLocal(srcPath, dstPath, createParams, false, nil); vErr != nil {
+		t.Fatalf("CloneLocal failed: %s", vErr.Error())
+	}
+	if vErr = virtual_disks.CloneLocal(srcPath, dstPath, createParams, false, nil); !errors.Is(vErr, disklib.ErrFileAlreadyExists) {
+		t.Errorf("Expected VIX_E_FILE_ALREADY_EXISTS when cloning onto an existing disk, got %v", vErr)
+	}
+	dst, vErr := virtual_disks.OpenLocal(dstPath, disklib.VIXDISKLIB_FLAG_OPEN_READ_ONLY, logrus.New())
+	if vErr != nil {
+		t.Fatalf("OpenLocal failed: %s", vErr.Error())
+	}
+	buf := make([]byte, len(data))
+	if _, err := dst.ReadAt(buf, 1024); err != nil || !bytes.Equal(buf, data) {
+		t.Errorf("Cloned disk returned unexpected data, err = %v", err)
+	}
+	if _, err := dst.WriteAt(data, 0); err == nil {
+		t.Errorf("Expected a write to a read-only local disk to fail")
+	}
+	if err := dst.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if _, vErr = virtual_disks.OpenLocal(filepath.Join(dir, "missing.vmdk"), 0, logrus.New()); !errors.Is(vErr, disklib.ErrFileNotFound) {
+		t.Errorf("Expected VIX_E_FILE_NOT_FOUND for a missing local disk, got %v", vErr)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// TestVddkLogRouting 测试 VDDK 的日志和警告以相应级别送到 logrus，并带有 connection 和 disk 字段。
+func TestVddkLogRouting(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	fake := disklib.NewFakeBackend()
+	fake.AddDisk("fcd-log", 8192)
+	if err := fake.AddSnapshot("snapshot-1", "fcd-log"); err != nil {
+		t.Fatalf("AddSnapshot failed: %v", err)
+	}
+	disklib.SetLogger(logger)
+	if vErr := disklib.InitWithBackend(fake, 7, 0, ""); vErr != nil {
+		t.Fatalf("Init failed: %s", vErr.Error())
+	}
+	t.Cleanup(disklib.Exit)
+
+	diskReaderWriter, vErr := virtual_disks.Open(newFakeParams("fcd-log"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	diskReaderWriter.Close()
+	entries := hook.AllEntries()
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 VDDK log entries, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Level != logrus.InfoLevel || entry.Data["component"] != "vddk" ||
+			entry.Data["connection"] != "10.0.0.1" || entry.Data["disk"] != "fcd-log" {
+			t.Errorf("Unexpected log entry %q with level %s and fields %v", entry.Message, entry.Level, entry.Data)
+		}
+	}
+	if entries[0].Message != "VixDiskLib: Opening disk fcd-log." {
+		t.Errorf("Unexpected log message %q", entries[0].Message)
+	}
+
+	hook.Reset()
+	vmParams := disklib.BuildConnectParams(
+		disklib.WithServer("10.0.0.1"),
+		disklib.WithCredentials("user", "password"),
+		disklib.ForVMX("moref=vm-1", "fcd-log"),
+		disklib.WithSnapshotRef("snapshot-1"))
+	diskReaderWriter, vErr = virtual_disks.Open(vmParams, logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open snapshot disk failed: %s", vErr.Error())
+	}
+	diskReaderWriter.Close()
+	warned := false
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.WarnLevel && entry.Data["disk"] == "fcd-log" {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Errorf("Expected a warning for the read-only snapshot disk")
+	}
+
+	hook.Reset()
+	disklib.SetLogger(nil)
+	diskReaderWriter, vErr = virtual_disks.Open(newFakeParams("fcd-log"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	diskReaderWriter.Close()
+	if len(hook.AllEntries()) != 0 {
+		t.Errorf("Expected no entries after the logger was reset, got %d", len(hook.AllEntries()))
+	}
+}
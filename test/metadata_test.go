@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// TestMetadata 测试通过 DiskReaderWriter 批量写入元数据，并以键值对和单个键的形式读回。
+func TestMetadata(t *testing.T) {
+	fake := disklib.NewFakeBackend()
+	fake.AddDisk("fcd-metadata", 8192)
+	if vErr := disklib.InitWithBackend(fake, 7, 0, ""); vErr != nil {
+		t.Fatalf("Init failed: %s", vErr.Error())
+	}
+	t.Cleanup(disklib.Exit)
+	diskReaderWriter, vErr := virtual_disks.Open(newFakeParams("fcd-metadata"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer diskReaderWriter.Close()
+
+	metadata, vErr := diskReaderWriter.GetMetadata()
+	if vErr != nil || len(metadata) != 0 {
+		t.Fatalf("Expected no metadata on a new disk, got %v, err = %v", metadata, vErr)
+	}
+	values := map[string]string{
+		"backup.jobId": "job-42",
+		"backup.time":  "2026-10-17T00:00:00Z",
+		"large":        strings.Repeat("x", 100*1024),
+		"empty":        "",
+	}
+	if vErr := diskReaderWriter.WriteMetadata(values); vErr != nil {
+		t.Fatalf("WriteMetadata failed: %s", vErr.Error())
+	}
+	metadata, vErr = diskReaderWriter.GetMetadata()
+	if vErr != nil {
+		t.Fatalf("GetMetadata failed: %s", vErr.Error())
+	}
+	if !reflect.DeepEqual(metadata, values) {
+		t.Errorf("GetMetadata returned %d keys, expected %d", len(metadata), len(values))
+	}
+	if val, vErr := diskReaderWriter.ReadMetadata("backup.jobId"); vErr != nil || val != "job-42" {
+		t.Errorf("ReadMetadata returned %q, err = %v", val, vErr)
+	}
+	if _, vErr := diskReaderWriter.ReadMetadata("missing"); vErr == nil {
+		t.Errorf("Expected ReadMetadata of a missing key to fail")
+	}
+}
+
+// TestMetadataLowLevel 测试 disklib 的两阶段查询，以及旧接口在空缓冲区时返回错误而不是 panic。
+func TestMetadataLowLevel(t *testing.T) {
+	setupFake(t, "fcd-metadata")
+	params := newFakeParams("fcd-metadata")
+	conn, vErr := disklib.ConnectEx(params)
+	if vErr != nil {
+		t.Fatalf("ConnectEx failed: %s", vErr.Error())
+	}
+	defer disklib.Disconnect(conn)
+	dli, vErr := disklib.Open(conn, params)
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer disklib.Close(dli)
+
+	if vErr := disklib.WriteMetadataBatch(dli, map[string]string{"b": "2", "a": "1"}); vErr != nil {
+		t.Fatalf("WriteMetadataBatch failed: %s", vErr.Error())
+	}
+	keys, vErr := disklib.ListMetadataKeys(dli)
+	if vErr != nil || !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("ListMetadataKeys returned %v, err = %v", keys, vErr)
+	}
+	if val, vErr := disklib.ReadMetadataKey(dli, "b"); vErr != nil || val != "2" {
+		t.Errorf("ReadMetadataKey returned %q, err = %v", val, vErr)
+	}
+	vErr = disklib.GetMetadataKeys(dli, []byte{}, 0, 0)
+	if !errors.Is(vErr, disklib.ErrBufferTooSmall) {
+		t.Errorf("Expected GetMetadataKeys with an empty buffer to fail with VIX_E_BUFFER_TOOSMALL, got %v", vErr)
+	}
+	vErr = disklib.ReadMetadata(dli, "a", nil, 0, 0)
+	if !errors.Is(vErr, disklib.ErrBufferTooSmall) {
+		t.Errorf("Expected ReadMetadata with an empty buffer to fail with VIX_E_BUFFER_TOOSMALL, got %v", vErr)
+	}
+	// bufLen 超过缓冲区长度时只使用缓冲区本身
+	vErr = disklib.GetMetadataKeys(dli, nil, 10, 0)
+	if !errors.Is(vErr, disklib.ErrBufferTooSmall) {
+		t.Errorf("Expected GetMetadataKeys with bufLen beyond the buffer to fail with VIX_E_BUFFER_TOOSMALL, got %v", vErr)
+	}
+	buf := make([]byte, 8)
+	if vErr = disklib.ReadMetadata(dli, "a", buf, 100, 0); vErr != nil || buf[0] != '1' {
+		t.Errorf("ReadMetadata with bufLen beyond the buffer returned %q, err = %v", buf, vErr)
+	}
+}
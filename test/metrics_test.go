@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/metrics"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// metricValue 返回 registry 中名为 name、标签与 labels 相同的计数器或仪表的值，没有找到时返回 0。
+func metricValue(t *testing.T, registry *prometheus.Registry, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if len(metric.GetLabel()) != len(labels) {
+				continue
+			}
+			matched := true
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					matched = false
+				}
+			}
+			if !matched {
+				continue
+			}
+			if metric.GetCounter() != nil {
+				return metric.GetCounter().GetValue()
+			}
+			return metric.GetGauge().GetValue()
+		}
+	}
+	return 0
+}
+
+// TestMetricsCollector 测试 Collector 记录调用次数、错误码、按传输模式统计的读写字节数以及打开的连接和句柄数。
+func TestMetricsCollector(t *testing.T) {
+	fake := disklib.NewFakeBackend()
+	fake.AddDisk("fcd-metrics", 8192)
+	collector := metrics.NewCollector(fake)
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+	if vErr := disklib.InitWithBackend(collector, 7, 0, ""); vErr != nil {
+		t.Fatalf("Init failed: %s", vErr.Error())
+	}
+	t.Cleanup(disklib.Exit)
+
+	diskReaderWriter, vErr := virtual_disks.Open(newFakeParams("fcd-metrics"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	if n := metricValue(t, registry, "vddk_open_handles", map[string]string{"transport": disklib.NBD}); n != 1 {
+		t.Errorf("Expected 1 open nbd handle, got %v", n)
+	}
+	buf := make([]byte, 64*1024)
+	if _, err := diskReaderWriter.WriteAt(buf[:4096], 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := diskReaderWriter.ReadAt(buf[:4096], 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	// 流水线使用 ReadAsync，同样按传输模式统计
+	if _, err := diskReaderWriter.WithPipeline(4, 16).ReadAt(buf, 0); err != nil {
+		t.Fatalf("Pipelined ReadAt failed: %v", err)
+	}
+	if _, vErr := diskReaderWriter.QueryAllocatedBlocks(0, 8192, 1); vErr == nil {
+		t.Fatalf("Expected QueryAllocatedBlocks with a chunk size of 1 to fail")
+	}
+
+	expected := `
+# HELP vddk_read_bytes_total Bytes read from virtual disks by transport mode.
+# TYPE vddk_read_bytes_total counter
+vddk_read_bytes_total{transport="nbd"} 69632
+# HELP vddk_written_bytes_total Bytes written to virtual disks by transport mode.
+# TYPE vddk_written_bytes_total counter
+vddk_written_bytes_total{transport="nbd"} 4096
+# HELP vddk_open_connections Number of open VixDiskLib connections.
+# TYPE vddk_open_connections gauge
+vddk_open_connections 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"vddk_read_bytes_total", "vddk_written_bytes_total", "vddk_open_connections"); err != nil {
+		t.Errorf("Unexpected metrics: %v", err)
+	}
+	code := strconv.FormatUint(disklib.VIX_E_INVALID_ARG, 10)
+	if n := metricValue(t, registry, "vddk_errors_total", map[string]string{"operation": "QueryAllocatedBlocks", "code": code}); n != 1 {
+		t.Errorf("Expected 1 QueryAllocatedBlocks error with code %s, got %v", code, n)
+	}
+	for operation, calls := range map[string]float64{"PrepareForAccess": 1, "ConnectEx": 1, "Open": 1, "Write": 1, "Read": 1, "ReadAsync": 8} {
+		if n := metricValue(t, registry, "vddk_calls_total", map[string]string{"operation": operation}); n != calls {
+			t.Errorf("Expected %v %s calls, got %v", calls, operation, n)
+		}
+	}
+
+	if err := diskReaderWriter.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if n := metricValue(t, registry, "vddk_open_handles", map[string]string{"transport": disklib.NBD}); n != 0 {
+		t.Errorf("Expected no open handles after Close, got %v", n)
+	}
+	if problems, err := testutil.GatherAndLint(registry); err != nil || len(problems) != 0 {
+		t.Errorf("Lint found problems %v, err = %v", problems, err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks/nbd"
+)
+
+// startNBDServer 在 listener 上启动导出 export 的 NBD 服务器，测试结束时关闭服务器。
+func startNBDServer(t *testing.T, export nbd.Export, options nbd.Options, listener net.Listener) {
+	server := nbd.NewServer(export, options)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		server.Close()
+		if err := <-done; err != nbd.ErrServerClosed {
+			t.Errorf("Serve returned %v", err)
+		}
+	})
+}
+
+// TestNBDServer 通过 Unix socket 导出以本地文件为内容的磁盘，并用 Go 客户端读写。
+func TestNBDServer(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "disk.img")
+	content := make([]byte, 4*1024*1024)
+	copy(content[100:], bytes.Repeat([]byte("nbd"), 1000))
+	copy(content[2*1024*1024:], bytes.Repeat([]byte{0x5A}, 65536))
+	if err := ioutil.WriteFile(fileName, content, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	fake := disklib.NewFakeBackend()
+	if err := fake.AddFileDisk("fcd-nbd", fileName); err != nil {
+		t.Fatalf("AddFileDisk failed: %v", err)
+	}
+	if vErr := disklib.InitWithBackend(fake, 7, 0, ""); vErr != nil {
+		t.Fatalf("Init failed: %s", vErr.Error())
+	}
+	t.Cleanup(disklib.Exit)
+	diskReaderWriter, vErr := virtual_disks.Open(newFakeParams("fcd-nbd"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer diskReaderWriter.Close()
+
+	socket := filepath.Join(dir, "nbd.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	startNBDServer(t, diskReaderWriter, nbd.Options{ExportName: "fcd-nbd", Logger: logrus.New()}, listener)
+
+	if _, err = nbd.Dial("unix", socket, "unknown"); err == nil {
+		t.Errorf("Expected an error for an unknown export name")
+	}
+	client, err := nbd.Dial("unix", socket, "fcd-nbd")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	if client.Size() != int64(len(content)) || client.ReadOnly() || !client.Structured() {
+		t.Fatalf("Unexpected size %d, read only %v or structured %v", client.Size(), client.ReadOnly(), client.Structured())
+	}
+
+	// 未分配的颗粒以空洞回复
+	buf := make([]byte, len(content))
+	chunks, n, err := client.ReadChunks(buf, 0)
+	if err != nil || n != len(buf) {
+		t.Fatalf("ReadChunks returned %d, %v", n, err)
+	}
+	if !bytes.Equal(buf, content) {
+		t.Errorf("Data read over NBD does not match the file")
+	}
+	var dataBytes int64
+	for _, chunk := range chunks {
+		if !chunk.Hole {
+			dataBytes = dataBytes + chunk.Length
+		}
+	}
+	if dataBytes != 2*65536 {
+		t.Errorf("Expected 2 allocated grains to be sent as data, got %d bytes in %v", dataBytes, chunks)
+	}
+
+	// 不对齐的写入、刷新和 TRIM
+	data := bytes.Repeat([]byte("write"), 300)
+	if _, err = client.WriteAt(data, 3*1024*1024+7); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err = client.Flush(); err != nil {
+		t.Errorf("Flush failed: %v", err)
+	}
+	if err = client.Trim(0, 65536); err != nil {
+		t.Errorf("Trim failed: %v", err)
+	}
+	readBack := make([]byte, len(data))
+	if _, err = client.ReadAt(readBack, 3*1024*1024+7); err != nil || !bytes.Equal(readBack, data) {
+		t.Errorf("Read back over NBD returned unexpected data, err = %v", err)
+	}
+	if _, err = diskReaderWriter.ReadAt(readBack, 3*1024*1024+7); err != nil || !bytes.Equal(readBack, data) {
+		t.Errorf("Data written over NBD was not written to the disk, err = %v", err)
+	}
+	if _, err = client.WriteAt(data, client.Size()-10); err == nil {
+		t.Errorf("Expected an error for a write beyond the end of the disk")
+	}
+	if _, err = client.ReadAt(readBack, client.Size()); err == nil {
+		t.Errorf("Expected an error for a read beyond the end of the disk")
+	}
+}
+
+// TestNBDServerReadOnly 测试通过 TCP 只读导出磁盘时拒绝写入。
+func TestNBDServerReadOnly(t *testing.T) {
+	setupFake(t, "fcd-nbd-ro")
+	diskReaderWriter, vErr := virtual_disks.Open(newFakeParams("fcd-nbd-ro"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer diskReaderWriter.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	startNBDServer(t, diskReaderWriter, nbd.Options{ReadOnly: true, Logger: logrus.New()}, listener)
+
+	client, err := nbd.Dial("tcp", listener.Addr().String(), "any")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	if !client.ReadOnly() || client.Size() != fakeCapacity*512 {
+		t.Fatalf("Unexpected read only %v or size %d", client.ReadOnly(), client.Size())
+	}
+	if _, err = client.WriteAt(make([]byte, 512), 0); err == nil {
+		t.Errorf("Expected an error for a write to a read only export")
+	}
+	if err = client.Trim(0, 512); err == nil {
+		t.Errorf("Expected an error for a trim on a read only export")
+	}
+	// 全新磁盘的读取只包含空洞
+	chunks, _, err := client.ReadChunks(make([]byte, 1024*1024), 0)
+	if err != nil {
+		t.Fatalf("ReadChunks failed: %v", err)
+	}
+	if len(chunks) != 1 || !chunks[0].Hole || chunks[0].Length != 1024*1024 {
+		t.Errorf("Expected a single hole, got %v", chunks)
+	}
+}
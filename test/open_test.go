@@ -43,8 +43,8 @@ func TestOpen(t *testing.T) {
 		disklib.EndAccess(params)
 		t.Errorf("Open failed, got error code: %d, error message: %s.", err.VixErrorCode(), err.Error())
 	}
-	// 查询虚拟磁盘的已分配块。（假设至少有 1GiB 卷和 1MiB 块大小）
-	abInitial, err := diskReaderWriter.QueryAllocatedBlocks(0, 2048*1024, 2048)
+	// 查询整个虚拟磁盘的已分配块（1MiB 块大小）
+	abInitial, err := allocatedBlocks(diskReaderWriter, 2048)
 	if err != nil {
 		t.Errorf("QueryAllocatedBlocks failed: %d, error message: %s", err.VixErrorCode(), err.Error())
 	} else {
@@ -81,7 +81,7 @@ func TestOpen(t *testing.T) {
 	fmt.Println(err5)
 
 	// 再次查询虚拟磁盘的已分配块
-	abFinal, err := diskReaderWriter.QueryAllocatedBlocks(0, 2048*1024, 2048)
+	abFinal, err := allocatedBlocks(diskReaderWriter, 2048)
 	if err != nil {
 		t.Errorf("QueryAllocatedBlocks failed: %d, error message: %s", err.VixErrorCode(), err.Error())
 	} else {
@@ -95,3 +95,16 @@ func TestOpen(t *testing.T) {
 	// 关闭虚拟磁盘连接
 	diskReaderWriter.Close()
 }
+
+// allocatedBlocks 通过迭代器收集整个磁盘的已分配块。
+func allocatedBlocks(diskReaderWriter virtual_disks.DiskReaderWriter, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
+	it, err := diskReaderWriter.AllocatedBlocks(chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []disklib.VixDiskLibBlock
+	for it.Next() {
+		blocks = append(blocks, it.Block())
+	}
+	return blocks, it.Err()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// setupPool 使用 FakeBackend 初始化 disklib，登记 4 MiB 的磁盘 fcdIds，并创建测试结束时关闭的连接池。
+func setupPool(t *testing.T, options virtual_disks.PoolOptions, fcdIds ...string) (*disklib.FakeBackend, *virtual_disks.ConnectionPool) {
+	fake := disklib.NewFakeBackend()
+	for _, fcdId := range fcdIds {
+		fake.AddDisk(fcdId, 8192)
+	}
+	if vErr := disklib.InitWithBackend(fake, 7, 0, ""); vErr != nil {
+		t.Fatalf("Init failed: %s", vErr.Error())
+	}
+	t.Cleanup(disklib.Exit)
+	if options.RetryBackoff == 0 {
+		options.RetryBackoff = time.Millisecond
+	}
+	pool := virtual_disks.NewConnectionPool(options)
+	t.Cleanup(func() { pool.Close() })
+	return fake, pool
+}
+
+// TestConnectionPoolReuse 测试同一磁盘的多次打开共享一个连接，关闭后连接保持空闲并被复用。
+func TestConnectionPoolReuse(t *testing.T) {
+	fake, pool := setupPool(t, virtual_disks.PoolOptions{}, "fcd-pool")
+	first, vErr := pool.Open(newFakeParams("fcd-pool"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	second, vErr := pool.Open(newFakeParams("fcd-pool"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	if fake.ConnectCount() != 1 {
+		t.Errorf("Expected 1 connection for 2 opens, got %d", fake.ConnectCount())
+	}
+	data := bytes.Repeat([]byte("pool"), 256)
+	if _, err := first.WriteAt(data, 512); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	buf := make([]byte, len(data))
+	if _, err := second.ReadAt(buf, 512); err != nil || !bytes.Equal(buf, data) {
+		t.Errorf("ReadAt through the shared connection returned unexpected data, err = %v", err)
+	}
+	first.Close()
+	second.Close()
+	if stats := pool.Stats(); stats.Connections != 1 || stats.Idle != 1 {
+		t.Errorf("Expected 1 idle connection, got %+v", stats)
+	}
+	if _, err := second.ReadAt(buf, 0); err == nil {
+		t.Errorf("Expected an error for a read after Close")
+	}
+
+	third, vErr := pool.Open(newFakeParams("fcd-pool"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer third.Close()
+	if fake.ConnectCount() != 1 {
+		t.Errorf("Expected the idle connection to be reused, got %d connections", fake.ConnectCount())
+	}
+}
+
+// TestConnectionPoolReconnect 测试连接断开后自动重新连接，并从未完成的位置继续并发读写。
+func TestConnectionPoolReconnect(t *testing.T) {
+	fake, pool := setupPool(t, virtual_disks.PoolOptions{}, "fcd-reconnect")
+	diskReaderWriter, vErr := pool.Open(newFakeParams("fcd-reconnect"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer diskReaderWriter.Close()
+	data := bytes.Repeat([]byte("reconnect"), 100000)
+	if _, err := diskReaderWriter.WriteAt(data, 7); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	// 不经过连接池打开的磁盘在连接断开后读取失败
+	direct, vErr := virtual_disks.Open(newFakeParams("fcd-reconnect"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer direct.Close()
+	fake.DropConnections()
+	if _, err := direct.ReadAt(make([]byte, 512), 0); err == nil {
+		t.Errorf("Expected an error for a read on a dropped connection")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, len(data))
+			if _, err := diskReaderWriter.ReadAt(buf, 7); err != nil || !bytes.Equal(buf, data) {
+				t.Errorf("ReadAt after reconnect returned unexpected data, err = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if stats := pool.Stats(); stats.Reconnects != 1 || stats.Connections != 1 {
+		t.Errorf("Expected exactly 1 reconnect, got %+v", stats)
+	}
+	fake.DropConnections()
+	if _, err := diskReaderWriter.WriteAt(data, 4096); err != nil {
+		t.Errorf("WriteAt after reconnect failed: %v", err)
+	}
+	// 连接池的初始连接、两次重新连接以及直接打开的连接
+	if fake.ConnectCount() != 4 {
+		t.Errorf("Expected 4 connections, got %d", fake.ConnectCount())
+	}
+}
+
+// TestConnectionPoolMaxSessions 测试每台服务器的连接数上限：没有空闲连接时等待，有空闲连接时将其挤出。
+func TestConnectionPoolMaxSessions(t *testing.T) {
+	fake, pool := setupPool(t, virtual_disks.PoolOptions{MaxSessionsPerHost: 1}, "fcd-a", "fcd-b")
+	diskA, vErr := pool.Open(newFakeParams("fcd-a"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, vErr = pool.OpenContext(ctx, newFakeParams("fcd-b"), logrus.New()); vErr == nil {
+		t.Fatalf("Expected an error while the only session is in use")
+	}
+
+	opened := make(chan disklib.VddkError, 1)
+	go func() {
+		diskB, vErr := pool.Open(newFakeParams("fcd-b"), logrus.New())
+		if vErr == nil {
+			diskB.Close()
+		}
+		opened <- vErr
+	}()
+	time.Sleep(20 * time.Millisecond)
+	diskA.Close()
+	if vErr = <-opened; vErr != nil {
+		t.Fatalf("Open after the session was released failed: %s", vErr.Error())
+	}
+	if stats := pool.Stats(); stats.Connections != 1 || fake.ConnectCount() != 2 {
+		t.Errorf("Expected the idle connection to be evicted, got %+v and %d connections", stats, fake.ConnectCount())
+	}
+	if err := pool.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if _, vErr = pool.Open(newFakeParams("fcd-a"), logrus.New()); vErr == nil {
+		t.Errorf("Expected an error for an open on a closed pool")
+	}
+}
+
+// TestConnectionPoolReconnectAtMaxSessions 测试连接数达到上限时，共享同一连接的两块磁盘在连接断开后都能重新连接，
+// 出错的连接在另一块磁盘释放之前不占用 MaxSessionsPerHost 的名额。
+func TestConnectionPoolReconnectAtMaxSessions(t *testing.T) {
+	fake, pool := setupPool(t, virtual_disks.PoolOptions{MaxSessionsPerHost: 1, ReconnectTimeout: 5 * time.Second}, "fcd-shared")
+	diskA, vErr := pool.Open(newFakeParams("fcd-shared"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	diskB, vErr := pool.Open(newFakeParams("fcd-shared"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	fake.DropConnections()
+	done := make(chan error, 1)
+	go func() {
+		_, err := diskA.ReadAt(make([]byte, 512), 0)
+		if err == nil {
+			err = diskA.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ReadAt after the connection was dropped failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("ReadAt deadlocked while the broken connection was still used by another disk")
+	}
+	if _, err := diskB.ReadAt(make([]byte, 512), 0); err != nil {
+		t.Fatalf("ReadAt on the second disk failed: %v", err)
+	}
+	if err := diskB.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	// 第二块磁盘复用第一块磁盘重新建立的连接
+	if stats := pool.Stats(); stats.Connections != 1 || stats.Reconnects != 2 || fake.ConnectCount() != 2 {
+		t.Errorf("Unexpected pool stats %+v with %d connections", stats, fake.ConnectCount())
+	}
+}
+
+// endAccessBackend 统计 FakeBackend 的 EndAccess 调用次数。
+type endAccessBackend struct {
+	*disklib.FakeBackend
+	mutex     sync.Mutex
+	endAccess int
+}
+
+// EndAccess 统计调用次数后调用 FakeBackend。
+func (this *endAccessBackend) EndAccess(appGlobal disklib.ConnectParams) disklib.VddkError {
+	this.mutex.Lock()
+	this.endAccess++
+	this.mutex.Unlock()
+	return this.FakeBackend.EndAccess(appGlobal)
+}
+
+// TestConnectionPoolIdleTimeout 测试空闲超过 IdleTimeout 的连接被断开并结束访问，再次使用前重新使用的连接不会被断开。
+func TestConnectionPoolIdleTimeout(t *testing.T) {
+	fake := disklib.NewFakeBackend()
+	fake.AddDisk("fcd-idle", 8192)
+	backend := &endAccessBackend{FakeBackend: fake}
+	if vErr := disklib.InitWithBackend(backend, 7, 0, ""); vErr != nil {
+		t.Fatalf("Init failed: %s", vErr.Error())
+	}
+	t.Cleanup(disklib.Exit)
+	pool := virtual_disks.NewConnectionPool(virtual_disks.PoolOptions{IdleTimeout: 50 * time.Millisecond})
+	defer pool.Close()
+
+	diskReaderWriter, vErr := pool.Open(newFakeParams("fcd-idle"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	diskReaderWriter.Close()
+	// 在超时之前重新打开，连接被复用并且不会被旧的定时器断开
+	diskReaderWriter, vErr = pool.Open(newFakeParams("fcd-idle"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if stats := pool.Stats(); stats.Connections != 1 || fake.ConnectCount() != 1 {
+		t.Errorf("Expected the connection in use to stay open, got %+v", stats)
+	}
+	diskReaderWriter.Close()
+	endAccess := func() int {
+		backend.mutex.Lock()
+		defer backend.mutex.Unlock()
+		return backend.endAccess
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for endAccess() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := pool.Stats(); stats.Connections != 0 || endAccess() != 1 {
+		t.Errorf("Expected the idle connection to be disconnected with 1 EndAccess call, got %+v and %d calls", stats, endAccess())
+	}
+}
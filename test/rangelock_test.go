@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// openRangeLockDisk 打开一块 8192 扇区的磁盘，opts 可以指定包装 FakeBackend 的后端。
+func openRangeLockDisk(t *testing.T, opts ...fakeOption) virtual_disks.DiskReaderWriter {
+	return openFake(t, "fcd-rangelock", append([]fakeOption{withFakeCapacity(8192)}, opts...)...)
+}
+
+// TestAlignedWriteVsUnalignedWrite 测试对齐写入与另一个携程对同一扇区的读/修改/写互斥（原 multithread_test.go 中的 II vs I II III 场景）。
+// 没有加锁时，非对齐写入可能读到旧的扇区内容，在对齐写入之后写回，导致对齐写入的数据丢失。
+func TestAlignedWriteVsUnalignedWrite(t *testing.T) {
+	diskReaderWriter := openRangeLockDisk(t)
+	sector := disklib.VIXDISKLIB_SECTOR_SIZE
+	zeroes := make([]byte, 2*sector)
+	aligned := bytes.Repeat([]byte{'A'}, sector)
+	unaligned := bytes.Repeat([]byte{'B'}, sector)
+	for i := 0; i < 200; i++ {
+		if _, err := diskReaderWriter.WriteAt(zeroes, 0); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := diskReaderWriter.WriteAt(aligned, int64(sector)); err != nil {
+				t.Errorf("Aligned WriteAt failed: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			// 覆盖扇区 0 的后半部分和扇区 1 的前半部分
+			if _, err := diskReaderWriter.WriteAt(unaligned, int64(sector/2)); err != nil {
+				t.Errorf("Unaligned WriteAt failed: %v", err)
+			}
+		}()
+		wg.Wait()
+		buf := make([]byte, 2*sector)
+		if _, err := diskReaderWriter.ReadAt(buf, 0); err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		// 扇区 1 的后半部分只有对齐写入会修改，前半部分取决于两个写入的先后顺序
+		if !bytes.Equal(buf[sector+sector/2:], aligned[sector/2:]) {
+			t.Fatalf("Iteration %d: the aligned write was lost", i)
+		}
+		if !bytes.Equal(buf[sector/2:sector], unaligned[:sector/2]) {
+			t.Fatalf("Iteration %d: the unaligned write was lost", i)
+		}
+		head := buf[sector : sector+sector/2]
+		if !bytes.Equal(head, aligned[:sector/2]) && !bytes.Equal(head, unaligned[sector/2:]) {
+			t.Fatalf("Iteration %d: sector 1 was torn", i)
+		}
+	}
+}
+
+// TestUnalignedWritesSameSector 测试多个携程并发修改同一扇区的不同字节时不会互相覆盖。
+func TestUnalignedWritesSameSector(t *testing.T) {
+	diskReaderWriter := openRangeLockDisk(t)
+	const writers = 16
+	const width = 30
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// 从扇区 0 的末尾开始，部分写入跨越扇区边界
+			off := int64(disklib.VIXDISKLIB_SECTOR_SIZE - writers*width/2 + i*width)
+			if _, err := diskReaderWriter.WriteAt(bytes.Repeat([]byte{byte('a' + i)}, width), off); err != nil {
+				t.Errorf("WriteAt failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	buf := make([]byte, writers*width)
+	if _, err := diskReaderWriter.ReadAt(buf, int64(disklib.VIXDISKLIB_SECTOR_SIZE-writers*width/2)); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	for i := 0; i < writers; i++ {
+		if expected := bytes.Repeat([]byte{byte('a' + i)}, width); !bytes.Equal(buf[i*width:(i+1)*width], expected) {
+			t.Errorf("Write %d was lost: %q", i, buf[i*width:(i+1)*width])
+		}
+	}
+}
+
+// blockingBackend 在写入 blockSector 时阻塞，直到 release 被关闭，并统计其他携程在此期间对该扇区的访问。
+type blockingBackend struct {
+	*disklib.FakeBackend
+	blockSector uint64
+	blocked     chan struct{}
+	release     chan struct{}
+	once        sync.Once
+	accesses    int32 // 除阻塞的写入之外对 blockSector 的读写次数
+}
+
+// Write 在第一次写入 blockSector 时阻塞。
+func (this *blockingBackend) Write(diskHandle disklib.VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	if this.covers(startSector, numSectors) {
+		first := false
+		this.once.Do(func() { first = true })
+		if first {
+			close(this.blocked)
+			<-this.release
+		} else {
+			atomic.AddInt32(&this.accesses, 1)
+		}
+	}
+	return this.FakeBackend.Write(diskHandle, startSector, numSectors, buf)
+}
+
+// Read 统计对 blockSector 的读取。
+func (this *blockingBackend) Read(diskHandle disklib.VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	if this.covers(startSector, numSectors) {
+		atomic.AddInt32(&this.accesses, 1)
+	}
+	return this.FakeBackend.Read(diskHandle, startSector, numSectors, buf)
+}
+
+// covers 判断 [startSector, startSector+numSectors) 是否包含 blockSector。
+func (this *blockingBackend) covers(startSector uint64, numSectors uint64) bool {
+	return startSector <= this.blockSector && this.blockSector < startSector+numSectors
+}
+
+// TestRangeLockParallelism 测试写入进行中时，不相交的读写可以并行完成，而相交的读写要等待写入完成。
+func TestRangeLockParallelism(t *testing.T) {
+	backend := &blockingBackend{blockSector: 16, blocked: make(chan struct{}), release: make(chan struct{})}
+	diskReaderWriter := openRangeLockDisk(t, withWrappedBackend(func(fake *disklib.FakeBackend) disklib.Backend {
+		backend.FakeBackend = fake
+		return backend
+	}))
+	sector := int64(disklib.VIXDISKLIB_SECTOR_SIZE)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := diskReaderWriter.WriteAt(bytes.Repeat([]byte{'W'}, int(4*sector)), 14*sector)
+		done <- err
+	}()
+	<-backend.blocked
+
+	// 不相交的对齐和非对齐读写不受阻塞的写入影响
+	if _, err := diskReaderWriter.WriteAt(bytes.Repeat([]byte{'X'}, int(sector)), 12*sector+10); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := diskReaderWriter.ReadAt(make([]byte, sector), 18*sector); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+
+	// 相交的操作在写入完成前不能访问磁盘
+	var wg sync.WaitGroup
+	results := make([][]byte, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := diskReaderWriter.WriteAt([]byte("overlap"), 16*sector+100); err != nil {
+			t.Errorf("WriteAt failed: %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		results[0] = make([]byte, sector)
+		if _, err := diskReaderWriter.ReadAt(results[0], 16*sector); err != nil {
+			t.Errorf("ReadAt failed: %v", err)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&backend.accesses); n != 0 {
+		t.Errorf("Expected overlapping I/O to wait for the blocked write, got %d accesses", n)
+	}
+	close(backend.release)
+	if err := <-done; err != nil {
+		t.Fatalf("Blocked WriteAt failed: %v", err)
+	}
+	wg.Wait()
+
+	// 读取要么在非对齐写入之前要么在之后，但一定看到阻塞的写入
+	if !bytes.Equal(results[0][:100], bytes.Repeat([]byte{'W'}, 100)) {
+		t.Errorf("Overlapping read did not observe the blocked write: %q", results[0][:100])
+	}
+	results[1] = make([]byte, sector)
+	if _, err := diskReaderWriter.ReadAt(results[1], 16*sector); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	expected := append(bytes.Repeat([]byte{'W'}, 100), "overlap"...)
+	if got := results[1][:len(expected)]; !bytes.Equal(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	if got := results[1][len(expected):]; !bytes.Equal(got, bytes.Repeat([]byte{'W'}, len(got))) {
+		t.Errorf("Unexpected tail of sector 16: %q", got)
+	}
+}
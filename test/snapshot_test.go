@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/disklib"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// TestOpenVMDiskSnapshot 测试通过快照 MoRef 读取虚拟机磁盘在创建快照时的内容，不受之后写入的影响。
+func TestOpenVMDiskSnapshot(t *testing.T) {
+	diskPath := "[datastore-1] vm-42/vm-42.vmdk"
+	fake := setupFake(t, diskPath)
+	open := func(snapshotMoRef string, readOnly bool) (virtual_disks.DiskReaderWriter, disklib.VddkError) {
+		return virtual_disks.OpenVMDisk("10.0.0.1", "", "user", "password", "vm-42", snapshotMoRef, diskPath,
+			0, readOnly, disklib.NBD, "fake-test", logrus.New())
+	}
+
+	live, vErr := open("", false)
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer live.Close()
+	before := bytes.Repeat([]byte("before"), 1000)
+	after := bytes.Repeat([]byte("after!"), 1000)
+	if _, err := live.WriteAt(before, 4096); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := fake.AddSnapshot("snapshot-7", diskPath); err != nil {
+		t.Fatalf("AddSnapshot failed: %v", err)
+	}
+	if _, err := live.WriteAt(after, 4096); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	snapshot, vErr := open("snapshot-7", true)
+	if vErr != nil {
+		t.Fatalf("Open snapshot failed: %s", vErr.Error())
+	}
+	defer snapshot.Close()
+	buf := make([]byte, len(before))
+	if _, err := snapshot.ReadAt(buf, 4096); err != nil || !bytes.Equal(buf, before) {
+		t.Errorf("Snapshot did not return the data at the time of the snapshot, err = %v", err)
+	}
+	if _, err := live.ReadAt(buf, 4096); err != nil || !bytes.Equal(buf, after) {
+		t.Errorf("Live disk did not return the latest data, err = %v", err)
+	}
+	if _, err := snapshot.WriteAt(buf, 0); err == nil {
+		t.Errorf("Expected an error for a write to a snapshot disk")
+	}
+
+	if _, vErr = open("snapshot-unknown", true); vErr == nil {
+		t.Errorf("Expected an error for an unknown snapshot")
+	}
+	if _, vErr = virtual_disks.OpenVMDisk("10.0.0.1", "", "user", "password", "vm-42", "snapshot-7",
+		"[datastore-1] vm-42/other.vmdk", 0, true, disklib.NBD, "fake-test", logrus.New()); vErr == nil ||
+		vErr.VixErrorCode() != disklib.VIX_E_FILE_NOT_FOUND {
+		t.Errorf("Expected VIX_E_FILE_NOT_FOUND for a disk missing from the snapshot, got %v", vErr)
+	}
+	if err := fake.AddSnapshot("snapshot-8", "[datastore-1] missing.vmdk"); err == nil {
+		t.Errorf("Expected an error for a snapshot of a missing disk")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+)
+
+// 流式读写测试使用的磁盘容量：4 MiB
+const streamCapacity = 8192
+
+// openStreamDisk 打开一块 4 MiB 的磁盘。
+func openStreamDisk(t *testing.T) virtual_disks.DiskReaderWriter {
+	return openFake(t, "fcd-stream", withFakeCapacity(streamCapacity))
+}
+
+// TestDiskReaderWriterSeek 测试 SeekEnd、非法 whence 以及在磁盘末尾读取时返回 io.EOF。
+func TestDiskReaderWriterSeek(t *testing.T) {
+	diskReaderWriter := openStreamDisk(t)
+	capacity := diskReaderWriter.Capacity()
+	if offset, err := diskReaderWriter.Seek(0, io.SeekEnd); err != nil || offset != capacity {
+		t.Errorf("Seek to the end returned %d, %v", offset, err)
+	}
+	if _, err := diskReaderWriter.Seek(0, 3); err == nil {
+		t.Errorf("Expected an error for an invalid whence")
+	}
+	if _, err := diskReaderWriter.Seek(-capacity-1, io.SeekEnd); err == nil {
+		t.Errorf("Expected an error for a negative offset")
+	}
+	if offset, err := diskReaderWriter.Seek(-100, io.SeekEnd); err != nil || offset != capacity-100 {
+		t.Fatalf("Seek returned %d, %v", offset, err)
+	}
+	buf := make([]byte, 1000)
+	if n, err := diskReaderWriter.Read(buf); n != 100 || err != io.EOF {
+		t.Errorf("Read across the end returned %d, %v", n, err)
+	}
+	if n, err := diskReaderWriter.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("Read at the end returned %d, %v", n, err)
+	}
+	if n, err := diskReaderWriter.ReadAt(buf, capacity-513); n != 513 || err != io.EOF {
+		t.Errorf("ReadAt across the end returned %d, %v", n, err)
+	}
+}
+
+// TestDiskReaderWriterStream 测试 io.ReaderFrom、io.WriterTo、io.SectionReader 和 http.ServeContent。
+func TestDiskReaderWriterStream(t *testing.T) {
+	diskReaderWriter := openStreamDisk(t)
+	capacity := diskReaderWriter.Capacity()
+	data := make([]byte, 3*1024*1024+1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	// 从不对齐的偏移量开始写入，io.Copy 通过 ReadFrom 写入
+	if _, err := diskReaderWriter.Seek(7, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	n, err := io.Copy(diskReaderWriter, struct{ io.Reader }{bytes.NewReader(data)})
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("io.Copy to the disk returned %d, %v", n, err)
+	}
+	if offset, _ := diskReaderWriter.Seek(0, io.SeekCurrent); offset != 7+int64(len(data)) {
+		t.Errorf("Unexpected offset %d after ReadFrom", offset)
+	}
+	readBack := make([]byte, len(data))
+	if _, err = diskReaderWriter.ReadAt(readBack, 7); err != nil || !bytes.Equal(readBack, data) {
+		t.Errorf("Data written by ReadFrom does not match, err = %v", err)
+	}
+
+	// io.Copy 通过 WriteTo 读到磁盘末尾
+	if _, err = diskReaderWriter.Seek(7, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	var out bytes.Buffer
+	n, err = io.Copy(&out, diskReaderWriter)
+	if err != nil || n != capacity-7 {
+		t.Fatalf("io.Copy from the disk returned %d, %v", n, err)
+	}
+	if !bytes.Equal(out.Bytes()[:len(data)], data) {
+		t.Errorf("Data read by WriteTo does not match")
+	}
+
+	// SectionReader 只读取指定的区间
+	section, err := ioutil.ReadAll(io.NewSectionReader(diskReaderWriter, 1000, 5000))
+	if err != nil || !bytes.Equal(section, data[993:5993]) {
+		t.Errorf("SectionReader returned %d bytes, %v", len(section), err)
+	}
+
+	// http.ServeContent 需要 io.ReadSeeker
+	if _, err = diskReaderWriter.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	request := httptest.NewRequest(http.MethodGet, "/disk", nil)
+	request.Header.Set("Range", "bytes=107-206")
+	recorder := httptest.NewRecorder()
+	http.ServeContent(recorder, request, "disk.img", time.Time{}, diskReaderWriter)
+	if recorder.Code != http.StatusPartialContent || !bytes.Equal(recorder.Body.Bytes(), data[100:200]) {
+		t.Errorf("ServeContent returned status %d with %d bytes", recorder.Code, recorder.Body.Len())
+	}
+
+	// 超出容量的数据返回 io.ErrShortWrite
+	if _, err = diskReaderWriter.Seek(-1000, io.SeekEnd); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	if _, err = diskReaderWriter.ReadFrom(bytes.NewReader(make([]byte, 2000))); err != io.ErrShortWrite {
+		t.Errorf("Expected io.ErrShortWrite for data beyond the capacity, got %v", err)
+	}
+	// 比磁盘剩余空间多几个字节的数据：容量以内的部分仍然被写入
+	if _, err = diskReaderWriter.Seek(-1000, io.SeekEnd); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	tail := bytes.Repeat([]byte{'T'}, 1003)
+	if n, err := diskReaderWriter.ReadFrom(bytes.NewReader(tail)); n != 1000 || err != io.ErrShortWrite {
+		t.Errorf("ReadFrom beyond the capacity returned n = %d, err = %v", n, err)
+	}
+	tailBack := make([]byte, 1000)
+	if _, err = diskReaderWriter.ReadAt(tailBack, capacity-1000); err != nil || !bytes.Equal(tailBack, tail[:1000]) {
+		t.Errorf("Data before the end of the disk was not written, err = %v", err)
+	}
+	if pos, _ := diskReaderWriter.Seek(0, io.SeekCurrent); pos != capacity {
+		t.Errorf("Expected the offset at the end of the disk, got %d", pos)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/vmware/virtual-disks/pkg/disklib"
+)
+
+// buildVdisk 使用 novddk 构建标签编译 cmd/vdisk，返回可执行文件的路径。
+func buildVdisk(t *testing.T) string {
+	binary := filepath.Join(t.TempDir(), "vdisk")
+	build := exec.Command("go", "build", "-tags", "novddk", "-o", binary, "../cmd/vdisk")
+	if output, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("Build vdisk failed: %v\n%s", err, output)
+	}
+	return binary
+}
+
+// runVdisk 运行 vdisk，返回标准输出和退出码。env 会追加到当前进程的环境变量之后。
+func runVdisk(t *testing.T, binary string, env []string, args ...string) ([]byte, int) {
+	cmd := exec.Command(binary, args...)
+	cmd.Env = append(os.Environ(), env...)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return stdout.Bytes(), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatalf("Run vdisk failed: %v", err)
+	}
+	return stdout.Bytes(), 0
+}
+
+// TestVdiskCLI 测试命令行工具的 JSON 输出、退出码以及配置文件、环境变量和命令行参数的优先级。
+func TestVdiskCLI(t *testing.T) {
+	binary := buildVdisk(t)
+
+	output, code := runVdisk(t, binary, nil, "transport-modes", "--json")
+	var modes []string
+	if code != 0 || json.Unmarshal(output, &modes) != nil || len(modes) != 3 || modes[2] != disklib.NBD {
+		t.Errorf("transport-modes returned %d: %s", code, output)
+	}
+
+	// 打开不存在的磁盘时以 JSON 输出错误码
+	output, code = runVdisk(t, binary, nil, "info", "--server", "10.0.0.1", "--user", "user", "--password", "password",
+		"--fcd-id", "missing", "--datastore", "datastore-1", "--json")
+	var failure struct {
+		Error        string `json:"error"`
+		VixErrorCode uint64 `json:"vixErrorCode"`
+	}
+	if code != 1 || json.Unmarshal(output, &failure) != nil || failure.VixErrorCode != disklib.VIX_E_FILE_NOT_FOUND {
+		t.Errorf("info returned %d: %s", code, output)
+	}
+	// 矛盾的连接参数在调用 VDDK 之前被拒绝
+	output, code = runVdisk(t, binary, nil, "info", "--fcd-id", "missing", "--json")
+	if code != 1 || json.Unmarshal(output, &failure) != nil || failure.VixErrorCode != disklib.VIX_E_INVALID_ARG {
+		t.Errorf("info without a datastore returned %d: %s", code, output)
+	}
+
+	if _, code = runVdisk(t, binary, nil, "create", "disk.vmdk"); code != 2 {
+		t.Errorf("Expected exit code 2 for a missing capacity, got %d", code)
+	}
+	// 乘以后缀后溢出的大小是参数错误
+	if _, code = runVdisk(t, binary, nil, "read", "--path", "disk.vmdk", "--offset", "9007199254740992K"); code != 2 {
+		t.Errorf("Expected exit code 2 for an overflowing offset, got %d", code)
+	}
+	if _, code = runVdisk(t, binary, nil, "no-such-command"); code != 2 {
+		t.Errorf("Expected exit code 2 for an unknown command, got %d", code)
+	}
+
+	// 环境变量覆盖配置文件，命令行参数覆盖环境变量
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	expected, err := disklib.GetThumbPrintForServer(host, port)
+	if err != nil {
+		t.Fatalf("GetThumbPrintForServer failed: %v", err)
+	}
+	configFile := filepath.Join(t.TempDir(), "vdisk.json")
+	if err = ioutil.WriteFile(configFile, []byte(`{"server": "unreachable.invalid"}`), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	var result struct {
+		Server     string `json:"server"`
+		Thumbprint string `json:"thumbprint"`
+	}
+	output, code = runVdisk(t, binary, []string{"VDISK_CONFIG=" + configFile, "VDISK_SERVER=" + host}, "thumbprint", "--port", port, "--json")
+	if code != 0 || json.Unmarshal(output, &result) != nil || result.Thumbprint != expected {
+		t.Errorf("thumbprint with server from the environment returned %d: %s", code, output)
+	}
+	output, code = runVdisk(t, binary, []string{"VDISK_SERVER=unreachable.invalid"}, "thumbprint", "--config", configFile, "--server", host, "--port", port)
+	if code != 0 || string(bytes.TrimSpace(output)) != expected {
+		t.Errorf("thumbprint with server from the command line returned %d: %s", code, output)
+	}
+	if _, code = runVdisk(t, binary, nil, "thumbprint", "--config", configFile, "--port", port); code != 1 {
+		t.Errorf("Expected exit code 1 for the server from the config file, got %d", code)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+	"github.com/vmware/virtual-disks/pkg/vmdk"
+)
+
+// writeSparseVMDK 生成一个带内嵌描述符的 monolithicSparse 文件，grains 的键为颗粒编号，每个颗粒 64 KiB。
+func writeSparseVMDK(t *testing.T, path string, descriptor string, capacity uint64, grains map[uint32][]byte) {
+	const grainSectors = 128
+	numGrains := (capacity + grainSectors - 1) / grainSectors
+	numGTs := (numGrains + 511) / 512
+	descriptorSectors := uint64(len(descriptor)+511) / 512
+	gdOffset := 1 + descriptorSectors
+	gtOffset := gdOffset + (numGTs*4+511)/512
+	overHead := gtOffset + numGTs*4
+	file := make([]byte, overHead*512)
+	binary.LittleEndian.PutUint32(file[0:], 0x564d444b)
+	binary.LittleEndian.PutUint32(file[4:], 1)
+	binary.LittleEndian.PutUint32(file[8:], 1)
+	binary.LittleEndian.PutUint64(file[12:], capacity)
+	binary.LittleEndian.PutUint64(file[20:], grainSectors)
+	binary.LittleEndian.PutUint64(file[28:], 1)
+	binary.LittleEndian.PutUint64(file[36:], descriptorSectors)
+	binary.LittleEndian.PutUint32(file[44:], 512)
+	binary.LittleEndian.PutUint64(file[56:], gdOffset)
+	binary.LittleEndian.PutUint64(file[64:], overHead)
+	copy(file[77:], "\n \r\n")
+	copy(file[512:], descriptor)
+	for i := uint64(0); i < numGTs; i++ {
+		binary.LittleEndian.PutUint32(file[gdOffset*512+i*4:], uint32(gtOffset+i*4))
+	}
+	for grain, data := range grains {
+		binary.LittleEndian.PutUint32(file[gtOffset*512+uint64(grain)*4:], uint32(len(file)/512))
+		padded := make([]byte, grainSectors*512)
+		copy(padded, data)
+		file = append(file, padded...)
+	}
+	if err := ioutil.WriteFile(path, file, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+}
+
+// readAll 通过 ReadAt 读出整个磁盘。
+func readAll(t *testing.T, disk *vmdk.Disk) []byte {
+	data := make([]byte, disk.Capacity())
+	if n, err := disk.ReadAt(data, 0); err != nil || n != len(data) {
+		t.Fatalf("ReadAt returned %d, %v", n, err)
+	}
+	return data
+}
+
+// TestVMDKReaderStreamOptimized 测试读取由 ExportStreamOptimized 导出的文件。
+func TestVMDKReaderStreamOptimized(t *testing.T) {
+	setupFake(t, "fcd-vmdk-read-stream")
+	diskReaderWriter, vErr := virtual_disks.Open(newFakeParams("fcd-vmdk-read-stream"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer diskReaderWriter.Close()
+	if _, err := diskReaderWriter.WriteAt(bytes.Repeat([]byte("reader"), 20000), 65536*10+100); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "stream.vmdk")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err = vmdk.ExportStreamOptimized(context.Background(), diskReaderWriter, out, vmdk.WriterOptions{FileName: "stream.vmdk"}); err != nil {
+		t.Fatalf("ExportStreamOptimized failed: %v", err)
+	}
+	out.Close()
+
+	disk, err := vmdk.Open(path)
+	if err != nil {
+		t.Fatalf("vmdk.Open failed: %v", err)
+	}
+	defer disk.Close()
+	if disk.Capacity() != fakeCapacity*512 || disk.Descriptor().CreateType != "streamOptimized" {
+		t.Fatalf("Unexpected capacity %d or create type %s", disk.Capacity(), disk.Descriptor().CreateType)
+	}
+	// 比较包含写入数据的第一个 MiB 以及磁盘末尾
+	for _, offset := range []int64{0, disk.Capacity() - 1024*1024} {
+		expected := make([]byte, 1024*1024)
+		if _, err = diskReaderWriter.ReadAt(expected, offset); err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		actual := make([]byte, 1024*1024)
+		if _, err = disk.ReadAt(actual, offset); err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("Data read from the stream optimized file at %d does not match the source disk", offset)
+		}
+	}
+	blocks, vErr := disk.QueryAllocatedBlocks(0, fakeCapacity, 128)
+	if vErr != nil {
+		t.Fatalf("QueryAllocatedBlocks failed: %s", vErr.Error())
+	}
+	if len(blocks) != 1 || blocks[0].Offset() != 1280 || blocks[0].Length() != 256 {
+		t.Errorf("Unexpected allocated blocks %v", blocks)
+	}
+	if _, err = disk.ReadAt(make([]byte, 1), disk.Capacity()); err != io.EOF {
+		t.Errorf("Expected io.EOF when reading past the end, got %v", err)
+	}
+}
+
+// TestVMDKReaderFlatExtents 测试 monolithicFlat 以及拆分为多个 FLAT 扩展的 twoGbMaxExtentFlat 磁盘。
+func TestVMDKReaderFlatExtents(t *testing.T) {
+	dir := t.TempDir()
+	first := bytes.Repeat([]byte{0x11}, 1024*512)
+	second := bytes.Repeat([]byte{0x22}, 1024*512)
+	// 第二个扩展从文件的第 1 个扇区开始
+	if err := ioutil.WriteFile(filepath.Join(dir, "split-f001.vmdk"), first, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "split-f002.vmdk"), append(make([]byte, 512), second...), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	descriptor := "# Disk DescriptorFile\nversion=1\nCID=fffffffe\nparentCID=ffffffff\ncreateType=\"twoGbMaxExtentFlat\"\n\n" +
+		"RW 1024 FLAT \"split-f001.vmdk\" 0\nRW 1024 FLAT \"split-f002.vmdk\" 1\nRW 2048 ZERO\n\nddb.adapterType = \"lsilogic\"\n"
+	path := filepath.Join(dir, "split.vmdk")
+	if err := ioutil.WriteFile(path, []byte(descriptor), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	disk, err := vmdk.Open(path)
+	if err != nil {
+		t.Fatalf("vmdk.Open failed: %v", err)
+	}
+	defer disk.Close()
+	if disk.Capacity() != 4096*512 || disk.Descriptor().DDB["ddb.adapterType"] != "lsilogic" {
+		t.Fatalf("Unexpected capacity %d or ddb %v", disk.Capacity(), disk.Descriptor().DDB)
+	}
+	// 跨越扩展边界的读取
+	buf := make([]byte, 1024)
+	if _, err = disk.ReadAt(buf, 1024*512-512); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf[:512], first[:512]) || !bytes.Equal(buf[512:], second[:512]) {
+		t.Errorf("Read across the extent boundary returned unexpected data")
+	}
+	// 读取跨越磁盘末尾时被截断
+	n, err := disk.ReadAt(buf, disk.Capacity()-512)
+	if err != nil || n != 512 || !bytes.Equal(buf[:512], make([]byte, 512)) {
+		t.Errorf("Expected a truncated read of zeroes, got %d, %v", n, err)
+	}
+	blocks, vErr := disk.QueryAllocatedBlocks(0, 4096, 128)
+	if vErr != nil {
+		t.Fatalf("QueryAllocatedBlocks failed: %s", vErr.Error())
+	}
+	if len(blocks) != 1 || blocks[0].Offset() != 0 || blocks[0].Length() != 2048 {
+		t.Errorf("Unexpected allocated blocks %v", blocks)
+	}
+	if _, vErr = disk.QueryAllocatedBlocks(64, 128, 128); vErr == nil {
+		t.Errorf("Expected an error for an unaligned start sector")
+	}
+	if _, vErr = disk.QueryAllocatedBlocks(0, 8192, 128); vErr == nil {
+		t.Errorf("Expected an error for a range beyond the capacity")
+	}
+}
+
+// TestVMDKReaderSparseChain 测试 monolithicSparse 子磁盘沿 parentFileNameHint 读取父磁盘中的数据。
+func TestVMDKReaderSparseChain(t *testing.T) {
+	dir := t.TempDir()
+	parentData := make([]byte, 2048*512)
+	for i := range parentData {
+		parentData[i] = byte(i / 512)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "parent-flat.vmdk"), parentData, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	parentDescriptor := "version=1\nCID=1234abcd\nparentCID=ffffffff\ncreateType=\"monolithicFlat\"\nRW 2048 FLAT \"parent-flat.vmdk\" 0\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "parent.vmdk"), []byte(parentDescriptor), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	grains := map[uint32][]byte{
+		2: bytes.Repeat([]byte("child"), 1000),
+		5: bytes.Repeat([]byte{0xEE}, 65536),
+	}
+	childDescriptor := "version=1\nCID=5678ef01\nparentCID=1234abcd\ncreateType=\"monolithicSparse\"\nparentFileNameHint=\"parent.vmdk\"\nRW 2048 SPARSE \"child.vmdk\"\n"
+	childPath := filepath.Join(dir, "child.vmdk")
+	writeSparseVMDK(t, childPath, childDescriptor, 2048, grains)
+
+	disk, err := vmdk.Open(childPath)
+	if err != nil {
+		t.Fatalf("vmdk.Open failed: %v", err)
+	}
+	defer disk.Close()
+	if disk.Parent() == nil || disk.Parent().Descriptor().CID != 0x1234abcd {
+		t.Fatalf("Parent disk was not opened")
+	}
+	expected := append([]byte{}, parentData...)
+	for grain, data := range grains {
+		start := int(grain) * 65536
+		copy(expected[start:start+65536], make([]byte, 65536))
+		copy(expected[start:], data)
+	}
+	if !bytes.Equal(readAll(t, disk), expected) {
+		t.Errorf("Data read from the child does not match")
+	}
+
+	// 没有父磁盘时只有写入的颗粒是已分配的
+	standalonePath := filepath.Join(dir, "standalone.vmdk")
+	writeSparseVMDK(t, standalonePath, "version=1\nCID=1\nparentCID=ffffffff\ncreateType=\"monolithicSparse\"\nRW 2048 SPARSE \"standalone.vmdk\"\n", 2048, grains)
+	standalone, err := vmdk.Open(standalonePath)
+	if err != nil {
+		t.Fatalf("vmdk.Open failed: %v", err)
+	}
+	defer standalone.Close()
+	blocks, vErr := standalone.QueryAllocatedBlocks(0, 2048, 128)
+	if vErr != nil {
+		t.Fatalf("QueryAllocatedBlocks failed: %s", vErr.Error())
+	}
+	if len(blocks) != 2 || blocks[0].Offset() != 256 || blocks[1].Offset() != 640 || blocks[1].Length() != 128 {
+		t.Errorf("Unexpected allocated blocks %v", blocks)
+	}
+
+	// 父磁盘的内容 ID 与 parentCID 不一致时打开失败
+	mismatchPath := filepath.Join(dir, "mismatch.vmdk")
+	writeSparseVMDK(t, mismatchPath, "version=1\nCID=2\nparentCID=deadbeef\ncreateType=\"monolithicSparse\"\nparentFileNameHint=\"parent.vmdk\"\nRW 2048 SPARSE \"mismatch.vmdk\"\n", 2048, nil)
+	if _, err = vmdk.Open(mismatchPath); err == nil {
+		t.Errorf("Expected an error for a mismatched parent content ID")
+	}
+
+	// parentFileNameHint 指向自身或者两个磁盘互为父磁盘时打开失败
+	if err = ioutil.WriteFile(filepath.Join(dir, "loop-flat.vmdk"), make([]byte, 2048*512), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	for name, hint := range map[string]string{"self.vmdk": "self.vmdk", "loop-a.vmdk": "loop-b.vmdk", "loop-b.vmdk": "./loop-a.vmdk"} {
+		loopDescriptor := "version=1\nCID=3\nparentCID=3\ncreateType=\"monolithicFlat\"\nparentFileNameHint=\"" + hint +
+			"\"\nRW 2048 FLAT \"loop-flat.vmdk\" 0\n"
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(loopDescriptor), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	for _, name := range []string{"self.vmdk", "loop-a.vmdk"} {
+		if _, err = vmdk.Open(filepath.Join(dir, name)); err == nil || !strings.Contains(err.Error(), "cycle") {
+			t.Errorf("Expected a cycle error when opening %s, got %v", name, err)
+		}
+	}
+}
+
+// TestVMDKReaderCorrupt 测试头部、描述符和压缩颗粒中损坏或超出文件范围的字段返回错误，而不是分配过大的内存或 panic。
+func TestVMDKReaderCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	sparsePath := filepath.Join(dir, "valid.vmdk")
+	descriptor := "version=1\nCID=5678ef01\nparentCID=ffffffff\ncreateType=\"monolithicSparse\"\nRW 2048 SPARSE \"valid.vmdk\"\n"
+	writeSparseVMDK(t, sparsePath, descriptor, 2048, map[uint32][]byte{1: bytes.Repeat([]byte{1}, 100)})
+	sparse, err := ioutil.ReadFile(sparsePath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	var stream bytes.Buffer
+	writer, err := vmdk.NewStreamOptimizedWriter(&stream, 2048*512, vmdk.WriterOptions{FileName: "stream.vmdk"})
+	if err != nil {
+		t.Fatalf("NewStreamOptimizedWriter failed: %v", err)
+	}
+	if _, err = writer.Write(bytes.Repeat([]byte("stream"), 1000)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// 每个用例修改文件中的一个字段
+	for _, corrupt := range []struct {
+		name   string
+		file   []byte
+		offset int
+		value  uint64
+		width  int
+	}{
+		{"descriptor size", sparse, 36, 1 << 40, 8},
+		{"descriptor offset", sparse, 28, 1 << 62, 8},
+		{"grain size", sparse, 20, 1 << 40, 8},
+		{"grain size not a power of two", sparse, 20, 100, 8},
+		{"capacity", sparse, 12, 1 << 60, 8},
+		{"grain table entries", sparse, 44, 1<<32 - 1, 4},
+		{"grain directory offset", sparse, 56, 1 << 50, 8},
+		{"compressed grain size", stream.Bytes(), -1, 1<<32 - 16, 4},
+	} {
+		data := append([]byte(nil), corrupt.file...)
+		offset := corrupt.offset
+		if offset < 0 {
+			// 第一个压缩颗粒位于 OverHead 个扇区之后，颗粒标记的第 8 个字节是压缩数据的长度
+			offset = int(binary.LittleEndian.Uint64(data[64:]))*512 + 8
+		}
+		if corrupt.width == 8 {
+			binary.LittleEndian.PutUint64(data[offset:], corrupt.value)
+		} else {
+			binary.LittleEndian.PutUint32(data[offset:], uint32(corrupt.value))
+		}
+		path := filepath.Join(dir, "corrupt.vmdk")
+		if err = ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		disk, err := vmdk.Open(path)
+		if err == nil {
+			_, err = disk.ReadAt(make([]byte, 128*1024), 0)
+			disk.Close()
+		}
+		if err == nil {
+			t.Errorf("Expected an error for a corrupt %s", corrupt.name)
+		}
+	}
+
+	// 被截断的文件
+	for _, length := range []int{512, 1024, len(sparse) - 512} {
+		path := filepath.Join(dir, "truncated.vmdk")
+		if err = ioutil.WriteFile(path, sparse[:length], 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		disk, err := vmdk.Open(path)
+		if err == nil {
+			_, err = disk.ReadAt(make([]byte, 128*1024), 0)
+			disk.Close()
+		}
+		if err == nil {
+			t.Errorf("Expected an error for a file truncated to %d bytes", length)
+		}
+	}
+}
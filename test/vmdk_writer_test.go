@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/virtual-disks/pkg/virtual_disks"
+	"github.com/vmware/virtual-disks/pkg/vmdk"
+)
+
+// TestStreamOptimizedWriter 测试导出 streamOptimized VMDK，并逐个解析输出中的标记。
+func TestStreamOptimizedWriter(t *testing.T) {
+	setupFake(t, "fcd-vmdk-export")
+	diskReaderWriter, vErr := virtual_disks.Open(newFakeParams("fcd-vmdk-export"), logrus.New())
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer diskReaderWriter.Close()
+	written := map[int64][]byte{
+		0:                        bytes.Repeat([]byte("stream"), 1000),
+		65536 * 600:              bytes.Repeat([]byte{0xAB}, 65536),
+		fakeCapacity*512 - 65536: bytes.Repeat([]byte("end"), 100),
+	}
+	for offset, data := range written {
+		if _, err := diskReaderWriter.WriteAt(data, offset); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+	}
+	var out bytes.Buffer
+	if err := vmdk.ExportStreamOptimized(context.Background(), diskReaderWriter, &out, vmdk.WriterOptions{FileName: "export.vmdk"}); err != nil {
+		t.Fatalf("ExportStreamOptimized failed: %v", err)
+	}
+	file := out.Bytes()
+	if len(file)%512 != 0 {
+		t.Fatalf("Output size %d is not a multiple of the sector size", len(file))
+	}
+	// 头部
+	if string(file[0:4]) != "KDMV" || binary.LittleEndian.Uint32(file[4:8]) != 3 || binary.LittleEndian.Uint32(file[8:12]) != 0x30001 {
+		t.Fatalf("Unexpected header % x", file[0:12])
+	}
+	if binary.LittleEndian.Uint64(file[12:20]) != fakeCapacity || binary.LittleEndian.Uint64(file[56:64]) != 0xffffffffffffffff {
+		t.Errorf("Unexpected capacity or gdOffset in header")
+	}
+	descriptorSize := binary.LittleEndian.Uint64(file[36:44])
+	descriptor := string(file[512 : 512+descriptorSize*512])
+	if !strings.Contains(descriptor, `createType="streamOptimized"`) || !strings.Contains(descriptor, `RW 2097152 SPARSE "export.vmdk"`) {
+		t.Errorf("Unexpected descriptor %s", descriptor)
+	}
+	// 依次解析标记直到流结束
+	overHead := binary.LittleEndian.Uint64(file[64:72])
+	grains := make(map[int64][]byte)
+	var footerGdOffset uint64
+	pos := overHead * 512
+	for {
+		val := binary.LittleEndian.Uint64(file[pos : pos+8])
+		size := binary.LittleEndian.Uint32(file[pos+8 : pos+12])
+		if size > 0 {
+			zr, err := zlib.NewReader(bytes.NewReader(file[pos+12 : pos+12+uint64(size)]))
+			if err != nil {
+				t.Fatalf("Grain at sector %d is not zlib compressed: %v", pos/512, err)
+			}
+			data, _ := ioutil.ReadAll(zr)
+			grains[int64(val)*512] = data
+			pos = pos + (12+uint64(size)+511)/512*512
+			continue
+		}
+		markerType := binary.LittleEndian.Uint32(file[pos+12 : pos+16])
+		if markerType == 0 {
+			break
+		}
+		if markerType == 3 {
+			footerGdOffset = binary.LittleEndian.Uint64(file[pos+512+56 : pos+512+64])
+		}
+		pos = pos + 512 + val*512
+	}
+	if pos+512 != uint64(len(file)) {
+		t.Errorf("End of stream marker is not the last sector")
+	}
+	if footerGdOffset == 0 || footerGdOffset == 0xffffffffffffffff {
+		t.Errorf("Footer does not contain the grain directory offset")
+	}
+	if len(grains) != 3 {
+		t.Errorf("Expected 3 non-zero grains, got %d", len(grains))
+	}
+	for offset, data := range written {
+		grainOffset := offset / 65536 * 65536
+		grain := grains[grainOffset]
+		if len(grain) != 65536 || !bytes.Equal(grain[offset-grainOffset:offset-grainOffset+int64(len(data))], data) {
+			t.Errorf("Grain at %d does not contain the written data", grainOffset)
+		}
+	}
+	// 只能按偏移量递增的顺序写入
+	writer, err := vmdk.NewStreamOptimizedWriter(ioutil.Discard, 1024*1024, vmdk.WriterOptions{})
+	if err != nil {
+		t.Fatalf("NewStreamOptimizedWriter failed: %v", err)
+	}
+	if _, err = writer.WriteAt(make([]byte, 512), 4096); err != nil {
+		t.Errorf("WriteAt failed: %v", err)
+	}
+	if _, err = writer.WriteAt(make([]byte, 512), 0); err == nil {
+		t.Errorf("Expected an error for a non sequential write")
+	}
+}
+
+// TestStreamOptimizedWriterCompression 测试 NoCompression 写出未压缩的颗粒，CompressionLevel 为 0 时使用默认压缩级别。
+func TestStreamOptimizedWriterCompression(t *testing.T) {
+	data := bytes.Repeat([]byte("compression"), 6000)
+	sizes := map[bool]int{}
+	for _, noCompression := range []bool{false, true} {
+		var out bytes.Buffer
+		writer, err := vmdk.NewStreamOptimizedWriter(&out, 1024*1024, vmdk.WriterOptions{FileName: "level.vmdk", NoCompression: noCompression})
+		if err != nil {
+			t.Fatalf("NewStreamOptimizedWriter failed: %v", err)
+		}
+		if _, err = writer.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err = writer.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		sizes[noCompression] = out.Len()
+		path := filepath.Join(t.TempDir(), "level.vmdk")
+		if err = ioutil.WriteFile(path, out.Bytes(), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		disk, err := vmdk.Open(path)
+		if err != nil {
+			t.Fatalf("vmdk.Open failed: %v", err)
+		}
+		actual := make([]byte, len(data))
+		_, err = disk.ReadAt(actual, 0)
+		disk.Close()
+		if err != nil || !bytes.Equal(actual, data) {
+			t.Errorf("Data read back with NoCompression = %v does not match, err = %v", noCompression, err)
+		}
+	}
+	// 未压缩的颗粒至少比压缩后的输出多出数据本身的大小
+	if sizes[true]-sizes[false] < len(data) {
+		t.Errorf("Unexpected output sizes %d without compression and %d with the default level", sizes[true], sizes[false])
+	}
+}